@@ -1,13 +1,34 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
 
 	"github.com/izalutski/catty/internal/api"
+	"github.com/izalutski/catty/internal/db"
+	"github.com/spf13/cobra"
 )
 
 func main() {
+	rootCmd := &cobra.Command{
+		Use:   "catty-api",
+		Short: "Run the Catty API server",
+		Args:  cobra.NoArgs,
+		Run:   runServer,
+	}
+
+	migrateCmd.AddCommand(migrateUpCmd)
+	migrateCmd.AddCommand(migrateDownCmd)
+	migrateCmd.AddCommand(migrateStatusCmd)
+	rootCmd.AddCommand(migrateCmd)
+
+	if err := rootCmd.Execute(); err != nil {
+		os.Exit(1)
+	}
+}
+
+func runServer(cmd *cobra.Command, args []string) {
 	addr := os.Getenv("CATTY_API_ADDR")
 	if addr == "" {
 		addr = "127.0.0.1:4815"
@@ -22,3 +43,88 @@ func main() {
 		log.Fatalf("Server error: %v", err)
 	}
 }
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Manage the database schema",
+}
+
+var migrateUpCmd = &cobra.Command{
+	Use:   "up",
+	Short: "Apply all pending migrations",
+	Long: `Apply all pending migrations.
+
+Run this against a database created before catty had migrations too: the
+first migration only creates tables that don't exist yet, so it adopts the
+existing schema as version 1 and applies the rest on top.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client, err := db.NewClient()
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		applied, err := client.MigrateUp()
+		for _, m := range applied {
+			fmt.Printf("applied %04d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Println("schema is up to date")
+		}
+		return nil
+	},
+}
+
+var migrateDownCmd = &cobra.Command{
+	Use:   "down",
+	Short: "Revert the most recent migration",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client, err := db.NewClient()
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		m, err := client.MigrateDown()
+		if err != nil {
+			return err
+		}
+		if m == nil {
+			fmt.Println("no migrations to revert")
+			return nil
+		}
+		fmt.Printf("reverted %04d_%s\n", m.Version, m.Name)
+		return nil
+	},
+}
+
+var migrateStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show which migrations have been applied",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client, err := db.NewClient()
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		status, err := client.MigrationStatus()
+		if err != nil {
+			return err
+		}
+		for _, s := range status {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.Local().Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d_%-30s %s\n", s.Version, s.Name, applied)
+		}
+		return nil
+	},
+}
@@ -0,0 +1,209 @@
+// Command catty-dev runs the whole Catty stack on localhost for development:
+// the API, the metering proxy and executors, with an in-memory store, a
+// local machine provider and stub auth.
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/izalutski/catty/internal/api"
+	"github.com/izalutski/catty/internal/db"
+	"github.com/izalutski/catty/internal/executor"
+	"github.com/izalutski/catty/internal/local"
+	"github.com/izalutski/catty/internal/proxy"
+	"github.com/spf13/cobra"
+)
+
+func main() {
+	rootCmd := &cobra.Command{
+		Use:   "catty-dev",
+		Short: "Run the Catty stack locally for development",
+	}
+
+	rootCmd.AddCommand(upCmd)
+	rootCmd.AddCommand(execCmd)
+
+	if err := rootCmd.Execute(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+var upCmd = &cobra.Command{
+	Use:   "up",
+	Short: "Start the API, proxy and executors on localhost",
+	Long: `Start the API, proxy and executors on localhost.
+
+No Postgres, Fly, WorkOS or Stripe credentials are needed. Data is kept in
+memory and executors run as local processes. If ANTHROPIC_API_KEY or
+OPENAI_API_KEY is set, agents are routed through the in-process metering
+proxy.
+
+Point the CLI at it with:
+  catty --api http://127.0.0.1:4815 login
+  catty --api http://127.0.0.1:4815 new`,
+	RunE: runUp,
+}
+
+// execCmd runs a single executor. The local provider spawns it for each session.
+var execCmd = &cobra.Command{
+	Use:    "exec",
+	Short:  "Run an executor (spawned by 'up')",
+	Hidden: true,
+	RunE:   runExec,
+}
+
+func init() {
+	upCmd.Flags().String("addr", "127.0.0.1:4815", "Address to listen on")
+	upCmd.Flags().String("email", "dev@localhost", "Email of the stub user")
+	upCmd.Flags().String("dir", "", "Directory for executor workspaces (default: temp dir)")
+}
+
+func runUp(cmd *cobra.Command, args []string) error {
+	addr, _ := cmd.Flags().GetString("addr")
+	email, _ := cmd.Flags().GetString("email")
+	dir, _ := cmd.Flags().GetString("dir")
+
+	logLevel := slog.LevelInfo
+	if os.Getenv("CATTY_DEBUG") == "1" {
+		logLevel = slog.LevelDebug
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: logLevel}))
+	slog.SetDefault(logger)
+
+	// Executors are this same binary running the exec subcommand
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("find own executable: %w", err)
+	}
+	machines, err := local.NewProviderWithConfig(local.Config{
+		Binary: self,
+		Args:   []string{"exec"},
+		Dir:    dir,
+	})
+	if err != nil {
+		return fmt.Errorf("create local provider: %w", err)
+	}
+	defer machines.Shutdown()
+
+	store := db.NewMemoryStore()
+
+	r := chi.NewRouter()
+
+	// Metering proxy (only if there is a key to forward with)
+	proxyURL := ""
+	keys, err := proxy.KeysFromEnv()
+	if err != nil {
+		return fmt.Errorf("parse ANTHROPIC_API_KEYS: %w", err)
+	}
+	openAIKeys, err := proxy.OpenAIKeysFromEnv()
+	if err != nil {
+		return fmt.Errorf("parse OPENAI_API_KEYS: %w", err)
+	}
+	policies, err := proxy.PolicyConfigFromEnv()
+	if err != nil {
+		return fmt.Errorf("read CATTY_PROXY_POLICY: %w", err)
+	}
+	if len(keys) > 0 || len(openAIKeys) > 0 {
+		// Usage lives in memory like the rest of the store, so there's no
+		// point in a log
+		usage, err := proxy.NewUsageQueue(store, "", logger)
+		if err != nil {
+			return fmt.Errorf("create usage queue: %w", err)
+		}
+		defer usage.Close()
+
+		p, err := proxy.NewProxy(store, usage, keys, openAIKeys, policies, logger)
+		if err != nil {
+			return fmt.Errorf("create proxy: %w", err)
+		}
+		r.Handle("/s/*", p)
+		r.Get("/metrics", p.Metrics)
+		proxyURL = "http://" + addr
+	} else {
+		logger.Warn("ANTHROPIC_API_KEY and OPENAI_API_KEY not set, agents will have no API access")
+	}
+
+	// Secrets only live as long as the in-memory store, so a fresh key will do
+	secretsKey := make([]byte, 32)
+	if _, err := rand.Read(secretsKey); err != nil {
+		return fmt.Errorf("generate secrets key: %w", err)
+	}
+	secrets, err := api.NewSecretBox(secretsKey)
+	if err != nil {
+		return fmt.Errorf("create secrets box: %w", err)
+	}
+
+	server := api.NewServerWithConfig(addr, &api.Config{
+		Machines: machines,
+		Store:    store,
+		Auth:     api.NewStubAuth(email),
+		ProxyURL: proxyURL,
+		Secrets:  secrets,
+	})
+	r.Mount("/", server.Handler())
+
+	httpServer := &http.Server{
+		Addr:         addr,
+		Handler:      r,
+		ReadTimeout:  5 * time.Minute,
+		WriteTimeout: 0, // Proxy streams and provisioning events are long-lived
+		IdleTimeout:  120 * time.Second,
+	}
+
+	// Channel for shutdown signals
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
+
+	// Channel for server errors
+	serverErr := make(chan error, 1)
+
+	go func() {
+		logger.Info("Starting dev stack", "addr", addr)
+		fmt.Printf("\nDev stack ready. Use it with:\n  catty --api http://%s login\n  catty --api http://%s new\n\n", addr, addr)
+		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			serverErr <- err
+		}
+	}()
+
+	// Wait for shutdown or error
+	select {
+	case err := <-serverErr:
+		return fmt.Errorf("server error: %w", err)
+	case <-shutdown:
+		logger.Info("Shutting down dev stack...")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := httpServer.Shutdown(ctx); err != nil {
+		return fmt.Errorf("shutdown error: %w", err)
+	}
+	return nil
+}
+
+func runExec(cmd *cobra.Command, args []string) error {
+	addr := os.Getenv("CATTY_EXEC_ADDR")
+	if addr == "" {
+		return fmt.Errorf("CATTY_EXEC_ADDR is required")
+	}
+
+	// The default logger writes through the log package; mask the session's secrets there
+	log.SetOutput(executor.NewLogWriter(os.Stderr))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	return executor.ListenAndServe(ctx, addr)
+}
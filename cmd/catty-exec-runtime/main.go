@@ -3,22 +3,20 @@ package main
 import (
 	"context"
 	"log/slog"
-	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
-	"time"
 
 	"github.com/izalutski/catty/internal/executor"
 )
 
 func main() {
-	// Configure structured logging
+	// Configure structured logging, masking the session's secrets
 	level := slog.LevelInfo
 	if os.Getenv("CATTY_DEBUG") != "" {
 		level = slog.LevelDebug
 	}
-	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+	slog.SetDefault(slog.New(slog.NewTextHandler(executor.NewLogWriter(os.Stderr), &slog.HandlerOptions{Level: level})))
 
 	addr := os.Getenv("CATTY_EXEC_ADDR")
 	if addr == "" {
@@ -31,54 +29,18 @@ func main() {
 	}
 	if apiKey := os.Getenv("ANTHROPIC_API_KEY"); apiKey != "" {
 		preview := apiKey
-		if len(apiKey) > 20 {
-			preview = apiKey[:20] + "..."
+		if len(apiKey) > 12 {
+			preview = apiKey[:12] + "..."
 		}
 		slog.Info("anthropic config", "api_key_preview", preview, "api_key_length", len(apiKey))
 	}
 
-	server := executor.NewServer()
+	// Stop on shutdown signals
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	httpServer := &http.Server{
-		Addr:         addr,
-		Handler:      server.Handler(),
-		ReadTimeout:  5 * time.Minute, // Allow large uploads (up to 100MB)
-		WriteTimeout: 0,               // No timeout for WebSocket
-		IdleTimeout:  120 * time.Second,
-	}
-
-	// Channel for shutdown signals
-	shutdown := make(chan os.Signal, 1)
-	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
-
-	// Channel for server errors
-	serverErr := make(chan error, 1)
-
-	// Start server
-	go func() {
-		slog.Info("starting executor server", "addr", addr)
-		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			serverErr <- err
-		}
-	}()
-
-	// Wait for shutdown or error
-	select {
-	case err := <-serverErr:
+	if err := executor.ListenAndServe(ctx, addr); err != nil {
 		slog.Error("server error", "error", err)
 		os.Exit(1)
-	case <-shutdown:
-		slog.Info("shutting down server")
 	}
-
-	// Graceful shutdown
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	if err := httpServer.Shutdown(ctx); err != nil {
-		slog.Error("shutdown error", "error", err)
-		os.Exit(1)
-	}
-
-	slog.Info("server stopped")
 }
@@ -25,20 +25,42 @@ func main() {
 	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: logLevel}))
 
 	// Get required env vars
-	anthropicKey := os.Getenv("ANTHROPIC_API_KEY")
-	if anthropicKey == "" {
-		log.Fatal("ANTHROPIC_API_KEY is required")
+	keys, err := proxy.KeysFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid ANTHROPIC_API_KEYS: %v", err)
+	}
+	openAIKeys, err := proxy.OpenAIKeysFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid OPENAI_API_KEYS: %v", err)
+	}
+	if len(keys) == 0 && len(openAIKeys) == 0 {
+		log.Fatal("ANTHROPIC_API_KEYS, ANTHROPIC_API_KEY, OPENAI_API_KEYS or OPENAI_API_KEY is required")
+	}
+	policies, err := proxy.PolicyConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid CATTY_PROXY_POLICY: %v", err)
 	}
 
 	// Initialize database
-	dbClient, err := db.NewClient()
+	store, err := db.Open()
 	if err != nil {
 		log.Fatalf("Failed to connect to database: %v", err)
 	}
-	defer dbClient.Close()
+	defer store.Close()
+
+	// Usage is written to a local log first and stored in the background,
+	// so it survives database outages and restarts
+	walPath := os.Getenv("CATTY_USAGE_WAL")
+	if walPath == "" {
+		walPath = "usage.wal"
+	}
+	usage, err := proxy.NewUsageQueue(store, walPath, logger)
+	if err != nil {
+		log.Fatalf("Failed to open usage log: %v", err)
+	}
 
 	// Create proxy
-	p, err := proxy.NewProxy(dbClient, anthropicKey, logger)
+	p, err := proxy.NewProxy(store, usage, keys, openAIKeys, policies, logger)
 	if err != nil {
 		log.Fatalf("Failed to create proxy: %v", err)
 	}
@@ -47,7 +69,6 @@ func main() {
 	r := chi.NewRouter()
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
-	r.Use(middleware.Timeout(120 * time.Second)) // Long timeout for streaming
 
 	// Health check
 	r.Get("/healthz", func(w http.ResponseWriter, r *http.Request) {
@@ -55,8 +76,8 @@ func main() {
 		w.Write([]byte("ok"))
 	})
 
-	// Proxy all Anthropic API paths via session-prefixed routes
-	// Format: /s/{label}/v1/messages
+	// Proxy all Anthropic and OpenAI API paths via session-prefixed routes
+	// Format: /s/{label}/v1/messages or /s/{label}/openai/v1/responses
 	r.Handle("/s/*", p)
 
 	// Get listen address
@@ -70,10 +91,25 @@ func main() {
 		Addr:         addr,
 		Handler:      r,
 		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 120 * time.Second,
+		WriteTimeout: 0, // Streams set idle-based write deadlines per write
 		IdleTimeout:  120 * time.Second,
 	}
 
+	// Upstream key and usage queue state in the Prometheus format, on its
+	// own listener so it isn't reachable through the public port
+	metricsAddr := os.Getenv("CATTY_PROXY_METRICS_ADDR")
+	if metricsAddr == "" {
+		metricsAddr = "0.0.0.0:9091"
+	}
+	metricsRouter := chi.NewRouter()
+	metricsRouter.Get("/metrics", p.Metrics)
+	metricsServer := &http.Server{
+		Addr:         metricsAddr,
+		Handler:      metricsRouter,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+
 	// Channel for shutdown signals
 	shutdown := make(chan os.Signal, 1)
 	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
@@ -89,6 +125,13 @@ func main() {
 		}
 	}()
 
+	go func() {
+		logger.Info("Starting metrics server", "addr", metricsAddr)
+		if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			serverErr <- err
+		}
+	}()
+
 	// Wait for shutdown or error
 	select {
 	case err := <-serverErr:
@@ -104,6 +147,8 @@ func main() {
 	if err := server.Shutdown(ctx); err != nil {
 		log.Fatalf("Shutdown error: %v", err)
 	}
+	metricsServer.Close()
+	usage.Close()
 
 	logger.Info("Server stopped")
 }
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/izalutski/catty/internal/cli"
+	"github.com/spf13/cobra"
+)
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "View and edit session defaults",
+	Long: `View and edit session defaults for 'catty new'.
+
+Settings are read from ~/.catty/config.toml and from the nearest
+.catty/config.toml in the current directory or its parents, which takes
+precedence. Use --project to edit the project file.
+
+Keys: agent, region, cpus, memory_mb, ttl_sec, ignore (comma-separated
+patterns) and env.<NAME>.`,
+}
+
+var configGetCmd = &cobra.Command{
+	Use:   "get [key]",
+	Short: "Show effective settings, or a single key",
+	Args:  cobra.MaximumNArgs(1),
+	RunE:  runConfigGet,
+}
+
+var configSetCmd = &cobra.Command{
+	Use:   "set <key> <value>",
+	Short: "Set a key",
+	Example: `  catty config set region ams
+  catty config set --project env.NODE_ENV development
+  catty config set --project ignore "dist,*.tmp"`,
+	Args: cobra.ExactArgs(2),
+	RunE: runConfigSet,
+}
+
+var configUnsetCmd = &cobra.Command{
+	Use:   "unset <key>",
+	Short: "Remove a key",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runConfigUnset,
+}
+
+func init() {
+	configSetCmd.Flags().Bool("project", false, "Edit the project config instead of the global one")
+	configUnsetCmd.Flags().Bool("project", false, "Edit the project config instead of the global one")
+
+	configCmd.AddCommand(configGetCmd)
+	configCmd.AddCommand(configSetCmd)
+	configCmd.AddCommand(configUnsetCmd)
+}
+
+func runConfigGet(cmd *cobra.Command, args []string) error {
+	cfg, err := cli.LoadConfig()
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 1 {
+		value, set, err := cli.GetConfigValue(cfg, args[0])
+		if err != nil {
+			return err
+		}
+		if !set {
+			return fmt.Errorf("%s is not set", args[0])
+		}
+		fmt.Println(value)
+		return nil
+	}
+
+	for _, key := range cli.ConfigKeys {
+		if value, set, _ := cli.GetConfigValue(cfg, key); set {
+			fmt.Printf("%s = %s\n", key, value)
+		}
+	}
+	if env, set, _ := cli.GetConfigValue(cfg, "env"); set {
+		fmt.Println("env:")
+		for _, line := range strings.Split(env, "\n") {
+			fmt.Printf("  %s\n", line)
+		}
+	}
+	return nil
+}
+
+func runConfigSet(cmd *cobra.Command, args []string) error {
+	return editConfig(cmd, args[0], args[1])
+}
+
+func runConfigUnset(cmd *cobra.Command, args []string) error {
+	return editConfig(cmd, args[0], "")
+}
+
+// editConfig sets key to value in the global or project config file.
+func editConfig(cmd *cobra.Command, key, value string) error {
+	path, err := configPath(cmd)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := cli.LoadConfigFile(path)
+	if err != nil {
+		return err
+	}
+	if err := cli.SetConfigValue(cfg, key, value); err != nil {
+		return err
+	}
+	if err := cli.SaveConfigFile(path, cfg); err != nil {
+		return err
+	}
+
+	fmt.Printf("Updated %s\n", path)
+	return nil
+}
+
+// configPath returns the file to edit: the global config, or with
+// --project the nearest project config, creating one in the current
+// directory if there is none.
+func configPath(cmd *cobra.Command) (string, error) {
+	project, _ := cmd.Flags().GetBool("project")
+	if !project {
+		return cli.GlobalConfigPath()
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return "", fmt.Errorf("get current directory: %w", err)
+	}
+	if path := cli.FindProjectConfig(cwd); path != "" {
+		return path, nil
+	}
+	return filepath.Join(cwd, ".catty", "config.toml"), nil
+}
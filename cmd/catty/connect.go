@@ -18,7 +18,7 @@ var connectCmd = &cobra.Command{
 
 func runConnect(cmd *cobra.Command, args []string) error {
 	// Check if logged in
-	if !cli.IsLoggedIn() {
+	if !cli.HasAccessToken() {
 		fmt.Fprintln(os.Stderr, "Not logged in. Please run 'catty login' first.")
 		return fmt.Errorf("authentication required")
 	}
@@ -33,12 +33,7 @@ type DeviceAuthResponse struct {
 
 // DeviceTokenResponse from API
 type DeviceTokenResponse struct {
-	AccessToken string `json:"access_token"`
-	TokenType   string `json:"token_type"`
-	User        *struct {
-		ID    string `json:"id"`
-		Email string `json:"email"`
-	} `json:"user,omitempty"`
+	cli.TokenResponse
 	Pending bool   `json:"pending,omitempty"`
 	Error   string `json:"error,omitempty"`
 }
@@ -47,13 +42,22 @@ func runLogin(cmd *cobra.Command, args []string) error {
 	// Check if already logged in
 	if cli.IsLoggedIn() {
 		creds, _ := cli.LoadCredentials()
-		fmt.Printf("Already logged in as %s\n", creds.Email)
+		fmt.Printf("Already logged in as %s%s\n", creds.Email, profileSuffix())
 		fmt.Println("Run 'catty logout' to log out first")
 		return nil
 	}
 
 	apiAddr := getAPIAddr()
 
+	// Remember an explicitly given API address for this profile
+	if cmd.Flags().Changed("api") {
+		if err := cli.UpdateProfile(cli.ActiveProfile(), func(p *cli.Profile) {
+			p.APIAddr = apiAddr
+		}); err != nil {
+			return fmt.Errorf("failed to save profile: %w", err)
+		}
+	}
+
 	// Step 1: Start device auth flow
 	fmt.Println("Starting login...")
 
@@ -115,20 +119,15 @@ func runLogin(cmd *cobra.Command, args []string) error {
 
 		if tokenResp.AccessToken != "" {
 			// Save credentials
-			creds := &cli.Credentials{
-				AccessToken: tokenResp.AccessToken,
-			}
-			if tokenResp.User != nil {
-				creds.UserID = tokenResp.User.ID
-				creds.Email = tokenResp.User.Email
-			}
+			creds := &cli.Credentials{}
+			creds.Apply(&tokenResp.TokenResponse)
 
 			if err := cli.SaveCredentials(creds); err != nil {
 				return fmt.Errorf("failed to save credentials: %w", err)
 			}
 
 			fmt.Println()
-			fmt.Printf("Logged in as %s\n", creds.Email)
+			fmt.Printf("Logged in as %s%s\n", creds.Email, profileSuffix())
 			fmt.Println("You can now run 'catty new' to start a session")
 			return nil
 		}
@@ -137,6 +136,14 @@ func runLogin(cmd *cobra.Command, args []string) error {
 	return fmt.Errorf("authentication timed out")
 }
 
+// profileSuffix names the active profile in messages, unless it is the default.
+func profileSuffix() string {
+	if profile := cli.ActiveProfile(); profile != cli.DefaultProfile {
+		return fmt.Sprintf(" (profile %s)", profile)
+	}
+	return ""
+}
+
 func pollToken(apiAddr, deviceCode string) (*DeviceTokenResponse, error) {
 	reqBody, _ := json.Marshal(map[string]string{"device_code": deviceCode})
 
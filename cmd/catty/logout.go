@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"os"
 
 	"github.com/izalutski/catty/internal/cli"
 	"github.com/spf13/cobra"
@@ -25,6 +26,11 @@ func runLogout(cmd *cobra.Command, args []string) error {
 	email := ""
 	if creds != nil {
 		email = creds.Email
+
+		// Revoke server-side so copies of the tokens stop working too
+		if err := cli.RevokeSession(getAPIAddr(), creds); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to revoke session: %v\n", err)
+		}
 	}
 
 	if err := cli.DeleteCredentials(); err != nil {
@@ -32,7 +38,7 @@ func runLogout(cmd *cobra.Command, args []string) error {
 	}
 
 	if email != "" {
-		fmt.Printf("Logged out from %s\n", email)
+		fmt.Printf("Logged out from %s%s\n", email, profileSuffix())
 	} else {
 		fmt.Println("Logged out")
 	}
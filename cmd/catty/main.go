@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/izalutski/catty/internal/cli"
 	"github.com/spf13/cobra"
 )
 
@@ -15,16 +16,23 @@ const (
 // Version is set at build time via -ldflags
 var Version = "dev"
 
-var apiAddr string
+var (
+	apiAddr     string
+	profileName string
+)
 
 func main() {
 	rootCmd := &cobra.Command{
 		Use:   "catty",
 		Short: "Catty - Remote AI agent sessions",
 		Long:  "Run Claude Code sessions remotely",
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return cli.SetProfile(profileName)
+		},
 	}
 
 	rootCmd.PersistentFlags().StringVar(&apiAddr, "api", "", fmt.Sprintf("API server address (default: %s)", DefaultAPIAddr))
+	rootCmd.PersistentFlags().StringVar(&profileName, "profile", "", "Profile to use (default: $CATTY_PROFILE or the current profile)")
 
 	rootCmd.AddCommand(newCmd)
 	rootCmd.AddCommand(connectCmd)
@@ -33,6 +41,11 @@ func main() {
 	rootCmd.AddCommand(stopAllCmd)
 	rootCmd.AddCommand(loginCmd)
 	rootCmd.AddCommand(logoutCmd)
+	rootCmd.AddCommand(tokenCmd)
+	rootCmd.AddCommand(secretsCmd)
+	rootCmd.AddCommand(usageCmd)
+	rootCmd.AddCommand(profileCmd)
+	rootCmd.AddCommand(configCmd)
 	rootCmd.AddCommand(versionCmd)
 
 	if err := rootCmd.Execute(); err != nil {
@@ -41,7 +54,8 @@ func main() {
 	}
 }
 
-// getAPIAddr returns the API address to use.
+// getAPIAddr returns the API address to use: the --api flag, then
+// CATTY_API_ADDR, then the active profile's address.
 func getAPIAddr() string {
 	if apiAddr != "" {
 		return apiAddr
@@ -49,5 +63,8 @@ func getAPIAddr() string {
 	if env := os.Getenv("CATTY_API_ADDR"); env != "" {
 		return env
 	}
+	if addr := cli.CurrentProfile().APIAddr; addr != "" {
+		return addr
+	}
 	return DefaultAPIAddr
 }
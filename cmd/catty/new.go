@@ -11,24 +11,101 @@ import (
 var newCmd = &cobra.Command{
 	Use:   "new",
 	Short: "Start a new remote agent session",
-	Long:  "Create a new Fly machine and connect to a remote AI agent interactively",
-	RunE:  runNew,
+	Long: `Create a new Fly machine and connect to a remote AI agent interactively.
+
+Defaults for the session come from ~/.catty/config.toml, the active profile
+and the nearest .catty/config.toml in the current directory or its parents,
+in increasing order of precedence. Flags override all of them.
+
+Environment variables for the agent come from the same config files, then
+--env-file, then --env. Secrets stored with 'catty secrets set' are added
+as well, unless a variable of the same name is given.`,
+	Example: `  catty new --env NODE_ENV=test --env-file .env.catty
+  catty new --budget 500k
+  catty new --budget '$5'`,
+	RunE: runNew,
 }
 
 func init() {
 	newCmd.Flags().String("agent", "claude", "Agent to use: claude or codex")
+	newCmd.Flags().String("region", "iad", "Region to run the machine in")
+	newCmd.Flags().Int("cpus", 1, "Number of CPUs")
+	newCmd.Flags().Int("memory", 1024, "Memory in MB")
+	newCmd.Flags().Int("ttl", 7200, "Session TTL in seconds")
+	newCmd.Flags().StringArray("env", nil, "Set an environment variable for the agent (KEY=VALUE, repeatable)")
+	newCmd.Flags().String("env-file", "", "Read environment variables for the agent from a file of KEY=VALUE lines")
+	newCmd.Flags().String("budget", "", "Cap the session's API usage, in tokens (500k, 2m) or dollars ($5, 5usd)")
 	newCmd.Flags().Bool("no-upload", false, "Don't upload current directory to the remote session")
 }
 
 func runNew(cmd *cobra.Command, args []string) error {
 	// Check if logged in
-	if !cli.IsLoggedIn() {
+	if !cli.HasAccessToken() {
 		fmt.Fprintln(os.Stderr, "Not logged in. Please run 'catty login' first.")
 		return fmt.Errorf("authentication required")
 	}
 
-	agent, _ := cmd.Flags().GetString("agent")
-	noUpload, _ := cmd.Flags().GetBool("no-upload")
+	flags := cmd.Flags()
+	agent, _ := flags.GetString("agent")
+	region, _ := flags.GetString("region")
+	cpus, _ := flags.GetInt("cpus")
+	memoryMB, _ := flags.GetInt("memory")
+	ttlSec, _ := flags.GetInt("ttl")
+	envVars, _ := flags.GetStringArray("env")
+	envFile, _ := flags.GetString("env-file")
+	budget, _ := flags.GetString("budget")
+	noUpload, _ := flags.GetBool("no-upload")
+
+	var budgetTokens, budgetMicroUSD int64
+	if budget != "" {
+		var err error
+		budgetTokens, budgetMicroUSD, err = cli.ParseBudget(budget)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Fill in defaults from config files and the active profile
+	cfg, err := cli.LoadConfig()
+	if err != nil {
+		return err
+	}
+	if !flags.Changed("agent") && cfg.Agent != "" {
+		agent = cfg.Agent
+	}
+	if !flags.Changed("region") && cfg.Region != "" {
+		region = cfg.Region
+	}
+	if !flags.Changed("cpus") && cfg.CPUs > 0 {
+		cpus = cfg.CPUs
+	}
+	if !flags.Changed("memory") && cfg.MemoryMB > 0 {
+		memoryMB = cfg.MemoryMB
+	}
+	if !flags.Changed("ttl") && cfg.TTLSec > 0 {
+		ttlSec = cfg.TTLSec
+	}
+
+	env := cfg.Env
+	if env == nil {
+		env = make(map[string]string)
+	}
+	if envFile != "" {
+		fileEnv, err := cli.ParseEnvFile(envFile)
+		if err != nil {
+			return err
+		}
+		for k, v := range fileEnv {
+			env[k] = v
+		}
+	}
+	for _, kv := range envVars {
+		k, v, err := cli.ParseEnvAssignment(kv)
+		if err != nil {
+			return err
+		}
+		env[k] = v
+	}
 
 	var cmdArgs []string
 
@@ -46,12 +123,16 @@ func runNew(cmd *cobra.Command, args []string) error {
 	opts := &cli.RunOptions{
 		Agent:           agent,
 		Cmd:             cmdArgs,
-		Region:          "iad",
-		CPUs:            1,
-		MemoryMB:        1024,
-		TTLSec:          7200,
+		Region:          region,
+		CPUs:            cpus,
+		MemoryMB:        memoryMB,
+		TTLSec:          ttlSec,
 		APIAddr:         getAPIAddr(),
 		UploadWorkspace: !noUpload,
+		Env:             env,
+		Ignore:          cfg.Ignore,
+		BudgetTokens:    budgetTokens,
+		BudgetMicroUSD:  budgetMicroUSD,
 	}
 
 	return cli.Run(opts)
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/izalutski/catty/internal/cli"
+	"github.com/spf13/cobra"
+)
+
+var profileCmd = &cobra.Command{
+	Use:   "profile",
+	Short: "Manage profiles",
+	Long: `Manage profiles for switching between API servers.
+
+Each profile has its own API address, login and default session options.
+Select one per command with --profile, or for every command with
+'catty profile use'.`,
+}
+
+var profileListCmd = &cobra.Command{
+	Use:     "list",
+	Aliases: []string{"ls"},
+	Short:   "List profiles",
+	Args:    cobra.NoArgs,
+	RunE:    runProfileList,
+}
+
+var profileUseCmd = &cobra.Command{
+	Use:   "use <name>",
+	Short: "Switch the current profile",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runProfileUse,
+}
+
+var profileSetCmd = &cobra.Command{
+	Use:   "set <name>",
+	Short: "Create or update a profile",
+	Example: `  catty profile set staging --api https://api.staging.catty.dev
+  catty profile set default --region ams --memory 2048`,
+	Args: cobra.ExactArgs(1),
+	RunE: runProfileSet,
+}
+
+var profileDeleteCmd = &cobra.Command{
+	Use:   "delete <name>",
+	Short: "Delete a profile and its credentials",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runProfileDelete,
+}
+
+func init() {
+	profileSetCmd.Flags().String("api", "", "API server address")
+	profileSetCmd.Flags().String("agent", "", "Default agent: claude or codex")
+	profileSetCmd.Flags().String("region", "", "Default region")
+	profileSetCmd.Flags().Int("cpus", 0, "Default CPUs")
+	profileSetCmd.Flags().Int("memory", 0, "Default memory in MB")
+	profileSetCmd.Flags().Int("ttl", 0, "Default session TTL in seconds")
+
+	profileCmd.AddCommand(profileListCmd)
+	profileCmd.AddCommand(profileUseCmd)
+	profileCmd.AddCommand(profileSetCmd)
+	profileCmd.AddCommand(profileDeleteCmd)
+}
+
+func runProfileList(cmd *cobra.Command, args []string) error {
+	profiles, err := cli.LoadProfiles()
+	if err != nil {
+		return err
+	}
+	names, err := cli.ProfileNames()
+	if err != nil {
+		return err
+	}
+	active := cli.ActiveProfile()
+
+	if len(names) == 0 {
+		fmt.Printf("No profiles found; using %q\n", active)
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "\tNAME\tAPI\tLOGGED IN AS")
+	for _, name := range names {
+		marker := ""
+		if name == active {
+			marker = "*"
+		}
+		api := DefaultAPIAddr
+		if p, ok := profiles.Profiles[name]; ok && p.APIAddr != "" {
+			api = p.APIAddr
+		}
+		email := "-"
+		if creds := cli.ProfileCredentials(name); creds != nil {
+			email = creds.Email
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", marker, name, api, email)
+	}
+	w.Flush()
+
+	return nil
+}
+
+func runProfileUse(cmd *cobra.Command, args []string) error {
+	name := args[0]
+	if err := cli.ValidateProfileName(name); err != nil {
+		return err
+	}
+
+	profiles, err := cli.LoadProfiles()
+	if err != nil {
+		return err
+	}
+	if _, ok := profiles.Profiles[name]; !ok && name != cli.DefaultProfile && cli.ProfileCredentials(name) == nil {
+		return fmt.Errorf("profile %q not found; create it with 'catty profile set %s --api <addr>'", name, name)
+	}
+
+	profiles.Current = name
+	if err := cli.SaveProfiles(profiles); err != nil {
+		return err
+	}
+
+	fmt.Printf("Switched to profile %s\n", name)
+	return nil
+}
+
+func runProfileSet(cmd *cobra.Command, args []string) error {
+	name := args[0]
+	flags := cmd.Flags()
+
+	err := cli.UpdateProfile(name, func(p *cli.Profile) {
+		if flags.Changed("api") {
+			p.APIAddr, _ = flags.GetString("api")
+		}
+		if flags.Changed("agent") {
+			p.Agent, _ = flags.GetString("agent")
+		}
+		if flags.Changed("region") {
+			p.Region, _ = flags.GetString("region")
+		}
+		if flags.Changed("cpus") {
+			p.CPUs, _ = flags.GetInt("cpus")
+		}
+		if flags.Changed("memory") {
+			p.MemoryMB, _ = flags.GetInt("memory")
+		}
+		if flags.Changed("ttl") {
+			p.TTLSec, _ = flags.GetInt("ttl")
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Saved profile %s\n", name)
+	return nil
+}
+
+func runProfileDelete(cmd *cobra.Command, args []string) error {
+	name := args[0]
+	if err := cli.ValidateProfileName(name); err != nil {
+		return err
+	}
+
+	if err := cli.DeleteProfile(name); err != nil {
+		return err
+	}
+
+	fmt.Printf("Deleted profile %s\n", name)
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/izalutski/catty/internal/cli"
+	"github.com/spf13/cobra"
+)
+
+var secretsCmd = &cobra.Command{
+	Use:   "secrets",
+	Short: "Manage secrets injected into sessions",
+	Long: `Manage secrets injected into sessions.
+
+Secrets are stored encrypted on the server and set as environment variables
+in every new session. Values can't be read back, and the executor masks
+them in its logs. Variables passed with 'catty new --env' take precedence.`,
+}
+
+var secretsSetCmd = &cobra.Command{
+	Use:   "set <name> [value]",
+	Short: "Create or replace a secret",
+	Long: `Create or replace a secret. If the value is omitted it is read from
+stdin, which keeps it out of your shell history.`,
+	Example: `  catty secrets set GITHUB_TOKEN < ~/.github-token
+  gh auth token | catty secrets set GITHUB_TOKEN`,
+	Args: cobra.RangeArgs(1, 2),
+	RunE: runSecretsSet,
+}
+
+var secretsListCmd = &cobra.Command{
+	Use:     "list",
+	Aliases: []string{"ls"},
+	Short:   "List secrets",
+	Args:    cobra.NoArgs,
+	RunE:    runSecretsList,
+}
+
+var secretsDeleteCmd = &cobra.Command{
+	Use:     "delete <name>",
+	Aliases: []string{"rm"},
+	Short:   "Delete a secret",
+	Args:    cobra.ExactArgs(1),
+	RunE:    runSecretsDelete,
+}
+
+func init() {
+	secretsCmd.AddCommand(secretsSetCmd)
+	secretsCmd.AddCommand(secretsListCmd)
+	secretsCmd.AddCommand(secretsDeleteCmd)
+}
+
+func runSecretsSet(cmd *cobra.Command, args []string) error {
+	var value string
+	if len(args) == 2 {
+		value = args[1]
+	} else {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return fmt.Errorf("read value from stdin: %w", err)
+		}
+		value = strings.TrimRight(string(data), "\r\n")
+	}
+	if value == "" {
+		return fmt.Errorf("secret value is empty")
+	}
+
+	opts := &cli.SecretSetOptions{
+		Name:    args[0],
+		Value:   value,
+		APIAddr: getAPIAddr(),
+	}
+	return cli.SecretSet(opts)
+}
+
+func runSecretsList(cmd *cobra.Command, args []string) error {
+	opts := &cli.SecretListOptions{
+		APIAddr: getAPIAddr(),
+	}
+	return cli.SecretList(opts)
+}
+
+func runSecretsDelete(cmd *cobra.Command, args []string) error {
+	opts := &cli.SecretDeleteOptions{
+		Name:    args[0],
+		APIAddr: getAPIAddr(),
+	}
+	return cli.SecretDelete(opts)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"github.com/izalutski/catty/internal/cli"
+	"github.com/spf13/cobra"
+)
+
+var tokenCmd = &cobra.Command{
+	Use:   "token",
+	Short: "Manage personal access tokens",
+	Long: `Manage personal access tokens for CI and automation.
+
+Set CATTY_TOKEN to a token to use it instead of your login.`,
+}
+
+var tokenCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Create a personal access token",
+	Args:  cobra.NoArgs,
+	RunE:  runTokenCreate,
+}
+
+var tokenListCmd = &cobra.Command{
+	Use:     "list",
+	Aliases: []string{"ls"},
+	Short:   "List personal access tokens",
+	Args:    cobra.NoArgs,
+	RunE:    runTokenList,
+}
+
+var tokenRevokeCmd = &cobra.Command{
+	Use:   "revoke <token-id>",
+	Short: "Revoke a personal access token",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runTokenRevoke,
+}
+
+func init() {
+	tokenCreateCmd.Flags().String("name", "", "Name of the token (required)")
+	tokenCreateCmd.Flags().StringSlice("scopes", nil, "Scopes: sessions:read, sessions:write, tokens:write, billing, secrets (default: sessions:read,sessions:write)")
+	tokenCreateCmd.Flags().String("expires", "", "Lifetime, e.g. 30d or 12h (default: never)")
+	tokenCreateCmd.MarkFlagRequired("name")
+
+	tokenCmd.AddCommand(tokenCreateCmd)
+	tokenCmd.AddCommand(tokenListCmd)
+	tokenCmd.AddCommand(tokenRevokeCmd)
+}
+
+func runTokenCreate(cmd *cobra.Command, args []string) error {
+	name, _ := cmd.Flags().GetString("name")
+	scopes, _ := cmd.Flags().GetStringSlice("scopes")
+	expires, _ := cmd.Flags().GetString("expires")
+
+	opts := &cli.TokenCreateOptions{
+		Name:    name,
+		Scopes:  scopes,
+		Expires: expires,
+		APIAddr: getAPIAddr(),
+	}
+	return cli.TokenCreate(opts)
+}
+
+func runTokenList(cmd *cobra.Command, args []string) error {
+	opts := &cli.TokenListOptions{
+		APIAddr: getAPIAddr(),
+	}
+	return cli.TokenList(opts)
+}
+
+func runTokenRevoke(cmd *cobra.Command, args []string) error {
+	opts := &cli.TokenRevokeOptions{
+		TokenID: args[0],
+		APIAddr: getAPIAddr(),
+	}
+	return cli.TokenRevoke(opts)
+}
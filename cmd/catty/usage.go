@@ -0,0 +1,19 @@
+package main
+
+import (
+	"github.com/izalutski/catty/internal/cli"
+	"github.com/spf13/cobra"
+)
+
+var usageCmd = &cobra.Command{
+	Use:   "usage",
+	Short: "Show token usage for the current billing period",
+	RunE:  runUsage,
+}
+
+func runUsage(cmd *cobra.Command, args []string) error {
+	opts := &cli.UsageOptions{
+		APIAddr: getAPIAddr(),
+	}
+	return cli.Usage(opts)
+}
@@ -3,6 +3,7 @@ module github.com/izalutski/catty
 go 1.25
 
 require (
+	github.com/BurntSushi/toml v1.6.0
 	github.com/coder/websocket v1.8.14
 	github.com/creack/pty v1.1.24
 	github.com/go-chi/chi/v5 v5.2.3
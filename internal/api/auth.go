@@ -8,8 +8,9 @@ import (
 	"io"
 	"net/http"
 	"os"
-	"sync"
 	"time"
+
+	"github.com/izalutski/catty/internal/db"
 )
 
 // WorkOS API endpoints
@@ -18,6 +19,8 @@ const (
 	workosDeviceAuthPath = "/user_management/authorize/device"
 	workosTokenPath      = "/user_management/authenticate"
 	workosUserPath       = "/user_management/users"
+	workosJWKSPath       = "/sso/jwks/"
+	workosRevokePath     = "/user_management/sessions/revoke"
 )
 
 // DeviceAuthRequest is the request to start device auth flow.
@@ -41,16 +44,23 @@ type DeviceTokenRequest struct {
 }
 
 // DeviceTokenResponse is the response with access token.
+// It is also returned when refreshing a token.
 type DeviceTokenResponse struct {
-	AccessToken string `json:"access_token"`
-	TokenType   string `json:"token_type"`
-	ExpiresIn   int    `json:"expires_in"`
-	User        *User  `json:"user,omitempty"`
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"` // access token lifetime in seconds
+	User         *User  `json:"user,omitempty"`
 	// Pending state
 	Pending bool   `json:"pending,omitempty"`
 	Error   string `json:"error,omitempty"`
 }
 
+// RefreshTokenRequest is the request to exchange a refresh token for new tokens.
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
 // User represents an authenticated user.
 type User struct {
 	ID        string `json:"id"`
@@ -59,22 +69,46 @@ type User struct {
 	LastName  string `json:"last_name,omitempty"`
 }
 
+// AuthProvider authenticates API requests and implements the device login flow.
+type AuthProvider interface {
+	StartDeviceAuth(w http.ResponseWriter, r *http.Request)
+	PollDeviceToken(w http.ResponseWriter, r *http.Request)
+	RefreshToken(w http.ResponseWriter, r *http.Request)
+	Logout(w http.ResponseWriter, r *http.Request)
+	AuthMiddleware(next http.Handler) http.Handler
+}
+
+var _ AuthProvider = (*AuthHandlers)(nil)
+
+// Token validation cache limits
+const (
+	// tokenCacheSize bounds the number of validated access tokens kept.
+	tokenCacheSize = 10_000
+
+	// userCacheSize and userCacheTTL bound the WorkOS user profiles kept,
+	// so a user's email is fetched once rather than for every new token.
+	userCacheSize = 10_000
+	userCacheTTL  = time.Hour
+)
+
 // AuthHandlers contains authentication HTTP handlers.
 type AuthHandlers struct {
 	clientID string
 	apiKey   string
+	verifier *jwtVerifier
 
-	// In-memory token validation cache
-	tokenCache   map[string]*tokenCacheEntry
-	tokenCacheMu sync.RWMutex
-}
-
-type tokenCacheEntry struct {
-	user      *User
-	expiresAt time.Time
+	// Validated tokens by token hash, kept until the token expires
+	tokenCache *lruCache[*User]
+	// WorkOS user profiles by user ID
+	userCache *lruCache[*User]
 }
 
 // NewAuthHandlers creates new authentication handlers.
+// Access tokens are verified locally against the WorkOS JWKS. The defaults
+// can be overridden with environment variables:
+//   - WORKOS_JWKS_URL: JWKS endpoint (defaults to the client's WorkOS JWKS)
+//   - WORKOS_JWT_ISSUER: expected iss claim (defaults to https://api.workos.com)
+//   - WORKOS_JWT_AUDIENCE: expected aud claim (defaults to the client ID)
 func NewAuthHandlers() (*AuthHandlers, error) {
 	clientID := os.Getenv("WORKOS_CLIENT_ID")
 	apiKey := os.Getenv("WORKOS_API_KEY")
@@ -83,10 +117,25 @@ func NewAuthHandlers() (*AuthHandlers, error) {
 		return nil, fmt.Errorf("WORKOS_CLIENT_ID and WORKOS_API_KEY environment variables are required")
 	}
 
+	jwksURL := os.Getenv("WORKOS_JWKS_URL")
+	if jwksURL == "" {
+		jwksURL = workosBaseURL + workosJWKSPath + clientID
+	}
+	issuer := os.Getenv("WORKOS_JWT_ISSUER")
+	if issuer == "" {
+		issuer = workosBaseURL
+	}
+	audience := os.Getenv("WORKOS_JWT_AUDIENCE")
+	if audience == "" {
+		audience = clientID
+	}
+
 	return &AuthHandlers{
 		clientID:   clientID,
 		apiKey:     apiKey,
-		tokenCache: make(map[string]*tokenCacheEntry),
+		verifier:   newJWTVerifier(jwksURL, issuer, audience),
+		tokenCache: newLRUCache[*User](tokenCacheSize),
+		userCache:  newLRUCache[*User](userCacheSize),
 	}, nil
 }
 
@@ -186,46 +235,178 @@ func (h *AuthHandlers) PollDeviceToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	h.writeTokenResponse(w, respBody)
+}
+
+// RefreshToken handles POST /v1/auth/refresh - exchanges a refresh token
+// for a new access token and refresh token.
+func (h *AuthHandlers) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	var req RefreshTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+
+	if req.RefreshToken == "" {
+		writeError(w, http.StatusBadRequest, "refresh_token is required")
+		return
+	}
+
+	reqBody := map[string]string{
+		"client_id":     h.clientID,
+		"client_secret": h.apiKey,
+		"refresh_token": req.RefreshToken,
+		"grant_type":    "refresh_token",
+	}
+	body, _ := json.Marshal(reqBody)
+
+	httpReq, err := http.NewRequestWithContext(r.Context(), "POST", workosBaseURL+workosTokenPath, bytes.NewReader(body))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to create request: "+err.Error())
+		return
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to call WorkOS: "+err.Error())
+		return
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := io.ReadAll(resp.Body)
+
+	// Refresh token expired, revoked or already used
+	if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnauthorized {
+		writeError(w, http.StatusUnauthorized, "refresh token is invalid or expired; run 'catty login'")
+		return
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("WorkOS error (%d): %s", resp.StatusCode, string(respBody)))
+		return
+	}
+
+	h.writeTokenResponse(w, respBody)
+}
+
+// writeTokenResponse relays a WorkOS authenticate response to the client,
+// caching the new access token for validation.
+func (h *AuthHandlers) writeTokenResponse(w http.ResponseWriter, respBody []byte) {
 	var workosResp struct {
-		AccessToken string `json:"access_token"`
-		User        *User  `json:"user"`
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		User         *User  `json:"user"`
 	}
 	if err := json.Unmarshal(respBody, &workosResp); err != nil {
 		writeError(w, http.StatusInternalServerError, "failed to parse WorkOS response: "+err.Error())
 		return
 	}
 
-	// Cache the token for validation
-	h.tokenCacheMu.Lock()
-	h.tokenCache[workosResp.AccessToken] = &tokenCacheEntry{
-		user:      workosResp.User,
-		expiresAt: time.Now().Add(24 * time.Hour), // Cache for 24 hours
+	// Cache the token for validation; if it doesn't verify, the first
+	// authenticated request will report why
+	expiresIn := 0
+	if claims, err := h.verifier.Verify(workosResp.AccessToken); err == nil {
+		expiresIn = int(time.Until(claims.Expiry()).Seconds())
+		if workosResp.User != nil {
+			h.userCache.Set(claims.Subject, workosResp.User, time.Now().Add(userCacheTTL))
+			h.tokenCache.Set(db.HashToken(workosResp.AccessToken), workosResp.User, claims.Expiry())
+		}
 	}
-	h.tokenCacheMu.Unlock()
 
 	writeJSON(w, http.StatusOK, &DeviceTokenResponse{
-		AccessToken: workosResp.AccessToken,
-		TokenType:   "Bearer",
-		User:        workosResp.User,
+		AccessToken:  workosResp.AccessToken,
+		RefreshToken: workosResp.RefreshToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    expiresIn,
+		User:         workosResp.User,
 	})
 }
 
+// Logout handles POST /v1/auth/logout - revokes the WorkOS session behind
+// the bearer token, which also invalidates its refresh token. Expired access
+// tokens are accepted so that a stale login can still be revoked.
+func (h *AuthHandlers) Logout(w http.ResponseWriter, r *http.Request) {
+	token := extractBearerToken(r)
+	if token == "" {
+		writeError(w, http.StatusUnauthorized, "missing authorization header")
+		return
+	}
+
+	claims, err := h.verifier.VerifyAllowExpired(token)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, "invalid token: "+err.Error())
+		return
+	}
+	h.tokenCache.Delete(db.HashToken(token))
+
+	if claims.SessionID == "" {
+		writeError(w, http.StatusBadRequest, "token has no session")
+		return
+	}
+
+	body, _ := json.Marshal(map[string]string{"session_id": claims.SessionID})
+
+	req, err := http.NewRequestWithContext(r.Context(), "POST", workosBaseURL+workosRevokePath, bytes.NewReader(body))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to create request: "+err.Error())
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+h.apiKey)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to call WorkOS: "+err.Error())
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		respBody, _ := io.ReadAll(resp.Body)
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("WorkOS error (%d): %s", resp.StatusCode, string(respBody)))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "logged_out"})
+}
+
 // ValidateToken validates an access token and returns the user.
+// The token's signature and claims are checked locally; WorkOS is only
+// called to look up users not seen recently.
 func (h *AuthHandlers) ValidateToken(token string) (*User, error) {
-	// Check cache first
-	h.tokenCacheMu.RLock()
-	if entry, ok := h.tokenCache[token]; ok && time.Now().Before(entry.expiresAt) {
-		h.tokenCacheMu.RUnlock()
-		return entry.user, nil
+	key := db.HashToken(token)
+	if user, ok := h.tokenCache.Get(key); ok {
+		return user, nil
 	}
-	h.tokenCacheMu.RUnlock()
 
-	// Validate with WorkOS by fetching user info
-	req, err := http.NewRequest("GET", workosBaseURL+"/user_management/users/me", nil)
+	claims, err := h.verifier.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := h.lookupUser(claims.Subject)
+	if err != nil {
+		return nil, err
+	}
+
+	// Cache until the token expires, so expired tokens are never accepted
+	h.tokenCache.Set(key, user, claims.Expiry())
+
+	return user, nil
+}
+
+// lookupUser fetches a WorkOS user profile by ID, with caching.
+func (h *AuthHandlers) lookupUser(userID string) (*User, error) {
+	if user, ok := h.userCache.Get(userID); ok {
+		return user, nil
+	}
+
+	req, err := http.NewRequest("GET", workosBaseURL+workosUserPath+"/"+userID, nil)
 	if err != nil {
 		return nil, fmt.Errorf("create request: %w", err)
 	}
-	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Authorization", "Bearer "+h.apiKey)
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
@@ -233,8 +414,8 @@ func (h *AuthHandlers) ValidateToken(token string) (*User, error) {
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode == http.StatusUnauthorized {
-		return nil, fmt.Errorf("invalid token")
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("user not found")
 	}
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
@@ -246,13 +427,7 @@ func (h *AuthHandlers) ValidateToken(token string) (*User, error) {
 		return nil, fmt.Errorf("parse response: %w", err)
 	}
 
-	// Cache the result
-	h.tokenCacheMu.Lock()
-	h.tokenCache[token] = &tokenCacheEntry{
-		user:      &user,
-		expiresAt: time.Now().Add(24 * time.Hour),
-	}
-	h.tokenCacheMu.Unlock()
+	h.userCache.Set(userID, &user, time.Now().Add(userCacheTTL))
 
 	return &user, nil
 }
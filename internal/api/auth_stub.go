@@ -0,0 +1,97 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// StubAuth is an AuthProvider for local development. The device flow
+// completes immediately and every request is authenticated as a single
+// fixed user, so no WorkOS credentials are needed.
+type StubAuth struct {
+	user  *User
+	token string
+}
+
+var _ AuthProvider = (*StubAuth)(nil)
+
+// NewStubAuth creates a stub auth provider that logs everyone in as email.
+func NewStubAuth(email string) *StubAuth {
+	return &StubAuth{
+		user: &User{
+			ID:    "dev-user",
+			Email: email,
+		},
+		token: "dev-token",
+	}
+}
+
+// StartDeviceAuth handles POST /v1/auth/device.
+// The returned verification page just confirms the login.
+func (a *StubAuth) StartDeviceAuth(w http.ResponseWriter, r *http.Request) {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	verifyURL := scheme + "://" + r.Host + "/v1/auth/device/verify"
+
+	writeJSON(w, http.StatusOK, &DeviceAuthResponse{
+		DeviceCode:              "dev-device-code",
+		UserCode:                "DEV-MODE",
+		VerificationURI:         verifyURL,
+		VerificationURIComplete: verifyURL,
+		ExpiresIn:               300,
+		Interval:                1,
+	})
+}
+
+// PollDeviceToken handles POST /v1/auth/device/token.
+// Always succeeds with the stub token.
+func (a *StubAuth) PollDeviceToken(w http.ResponseWriter, r *http.Request) {
+	var req DeviceTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &DeviceTokenResponse{
+		AccessToken:  a.token,
+		RefreshToken: a.token,
+		TokenType:    "Bearer",
+		User:         a.user,
+	})
+}
+
+// RefreshToken handles POST /v1/auth/refresh.
+// The stub token never expires, so it is returned unchanged.
+func (a *StubAuth) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, &DeviceTokenResponse{
+		AccessToken:  a.token,
+		RefreshToken: a.token,
+		TokenType:    "Bearer",
+		User:         a.user,
+	})
+}
+
+// Logout handles POST /v1/auth/logout. There is no session to revoke.
+func (a *StubAuth) Logout(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "logged_out"})
+}
+
+// VerifyPage handles GET /v1/auth/device/verify.
+func (a *StubAuth) VerifyPage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Local development stack: logged in as " + a.user.Email + ". Return to your terminal.\n"))
+}
+
+// AuthMiddleware accepts the stub token and authenticates as the stub user.
+func (a *StubAuth) AuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if extractBearerToken(r) != a.token {
+			writeError(w, http.StatusUnauthorized, "invalid token: run 'catty login' against the dev stack")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(WithUser(r.Context(), a.user)))
+	})
+}
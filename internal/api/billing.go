@@ -17,16 +17,16 @@ import (
 
 // BillingHandlers handles billing-related requests.
 type BillingHandlers struct {
-	db              *db.Client
-	stripeKey       string
-	webhookSecret   string
-	priceID         string
-	successURL      string
-	cancelURL       string
+	db            db.Store
+	stripeKey     string
+	webhookSecret string
+	priceID       string
+	successURL    string
+	cancelURL     string
 }
 
 // NewBillingHandlers creates new billing handlers.
-func NewBillingHandlers(dbClient *db.Client) (*BillingHandlers, error) {
+func NewBillingHandlers(store db.Store) (*BillingHandlers, error) {
 	stripeKey := os.Getenv("STRIPE_SECRET_KEY")
 	if stripeKey == "" {
 		return nil, fmt.Errorf("STRIPE_SECRET_KEY is required")
@@ -52,7 +52,7 @@ func NewBillingHandlers(dbClient *db.Client) (*BillingHandlers, error) {
 	stripe.Key = stripeKey
 
 	return &BillingHandlers{
-		db:            dbClient,
+		db:            store,
 		stripeKey:     stripeKey,
 		webhookSecret: webhookSecret,
 		priceID:       priceID,
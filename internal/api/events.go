@@ -0,0 +1,282 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/izalutski/catty/internal/db"
+)
+
+// Provisioning event types, in the order they are normally emitted.
+const (
+	EventImageResolved  = "image_resolved"
+	EventMachineCreated = "machine_created"
+	EventMachineStarted = "machine_started"
+	EventWorkspaceReady = "workspace_ready"
+	EventFailed         = "failed"
+)
+
+// statusPollInterval is how often a subscriber without an in-memory stream
+// checks the stored status of a session being provisioned, and
+// keepAliveInterval how often such a stream sends a comment while waiting.
+const (
+	statusPollInterval = time.Second
+	keepAliveInterval  = 15 * time.Second
+)
+
+// eventRetention is how long a finished provisioning stream is kept around
+// so that late subscribers can still replay it.
+const eventRetention = 5 * time.Minute
+
+// SessionEvent is a single provisioning progress event.
+type SessionEvent struct {
+	Type      string    `json:"type"`
+	Message   string    `json:"message"`
+	MachineID string    `json:"machine_id,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// isTerminal returns true if no further events follow this one.
+func (e *SessionEvent) isTerminal() bool {
+	return e.Type == EventWorkspaceReady || e.Type == EventFailed
+}
+
+// eventStream holds the event history and live subscribers for one session.
+type eventStream struct {
+	history     []SessionEvent
+	subscribers map[chan SessionEvent]struct{}
+	done        bool
+}
+
+// EventHub fans out provisioning events to SSE subscribers.
+// Events are kept in memory, so a subscriber that connects after some steps
+// have completed still sees the full history.
+type EventHub struct {
+	mu      sync.Mutex
+	streams map[string]*eventStream
+}
+
+// NewEventHub creates a new event hub.
+func NewEventHub() *EventHub {
+	return &EventHub{
+		streams: make(map[string]*eventStream),
+	}
+}
+
+// Open registers a new event stream for a session.
+func (h *EventHub) Open(sessionID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.streams[sessionID] = &eventStream{
+		subscribers: make(map[chan SessionEvent]struct{}),
+	}
+}
+
+// Publish records an event and delivers it to all subscribers.
+// Publishing a terminal event closes the stream.
+func (h *EventHub) Publish(sessionID string, ev SessionEvent) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	stream, ok := h.streams[sessionID]
+	if !ok || stream.done {
+		return
+	}
+
+	stream.history = append(stream.history, ev)
+	for ch := range stream.subscribers {
+		ch <- ev
+	}
+
+	if ev.isTerminal() {
+		stream.done = true
+		for ch := range stream.subscribers {
+			close(ch)
+		}
+		stream.subscribers = nil
+		time.AfterFunc(eventRetention, func() {
+			h.mu.Lock()
+			delete(h.streams, sessionID)
+			h.mu.Unlock()
+		})
+	}
+}
+
+// Subscribe returns the events published so far and a channel for the rest.
+// The channel is nil if the stream has already finished. Returns false if
+// there is no stream for the session.
+func (h *EventHub) Subscribe(sessionID string) ([]SessionEvent, chan SessionEvent, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	stream, ok := h.streams[sessionID]
+	if !ok {
+		return nil, nil, false
+	}
+
+	history := append([]SessionEvent(nil), stream.history...)
+	if stream.done {
+		return history, nil, true
+	}
+
+	// Buffer enough for every remaining step so Publish never blocks.
+	ch := make(chan SessionEvent, 8)
+	stream.subscribers[ch] = struct{}{}
+	return history, ch, true
+}
+
+// Unsubscribe removes a subscriber channel.
+func (h *EventHub) Unsubscribe(sessionID string, ch chan SessionEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	stream, ok := h.streams[sessionID]
+	if !ok || stream.subscribers == nil {
+		return
+	}
+	if _, ok := stream.subscribers[ch]; ok {
+		delete(stream.subscribers, ch)
+		close(ch)
+	}
+}
+
+// SessionEvents handles GET /v1/sessions/{session_id}/events.
+// Streams provisioning progress as server-sent events until the session is
+// ready or provisioning fails.
+func (h *Handlers) SessionEvents(w http.ResponseWriter, r *http.Request) {
+	sessionID := chi.URLParam(r, "session_id")
+
+	// Get authenticated user from context
+	authUser := UserFromContext(r.Context())
+	if authUser == nil {
+		writeError(w, http.StatusUnauthorized, "user not found in context")
+		return
+	}
+
+	// Get user from database
+	dbUser, err := h.db.GetUserByWorkosID(authUser.ID)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "user not found")
+		return
+	}
+
+	// Try to get session by ID first, then by label
+	session, err := h.db.GetSessionByID(sessionID)
+	if err != nil {
+		session, err = h.db.GetSessionByLabel(dbUser.ID, sessionID)
+		if err != nil {
+			writeError(w, http.StatusNotFound, "session not found")
+			return
+		}
+	}
+
+	// Verify session belongs to user
+	if session.UserID != dbUser.ID {
+		writeError(w, http.StatusNotFound, "session not found")
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+
+	// Provisioning can outlast the server's default write timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	history, ch, ok := h.events.Subscribe(session.ID)
+	if !ok {
+		// No stream in memory: another instance is provisioning the session,
+		// the API restarted, or the stream expired. Follow the stored status.
+		h.followSessionStatus(w, r, session)
+		return
+	}
+
+	for _, ev := range history {
+		writeSSE(w, ev)
+	}
+	flusher.Flush()
+
+	if ch == nil {
+		return
+	}
+	defer h.events.Unsubscribe(session.ID, ch)
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-ch:
+			if !ok {
+				return
+			}
+			writeSSE(w, ev)
+			flusher.Flush()
+		}
+	}
+}
+
+// followSessionStatus reports a session's provisioning outcome from its
+// stored status, polling while it is still provisioning elsewhere.
+func (h *Handlers) followSessionStatus(w http.ResponseWriter, r *http.Request, session *db.Session) {
+	flusher := w.(http.Flusher)
+
+	ticker := time.NewTicker(statusPollInterval)
+	defer ticker.Stop()
+	lastWrite := time.Now()
+	for session.Status == "provisioning" {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+
+		current, err := h.db.GetSessionByID(session.ID)
+		if err != nil {
+			// Deleted while provisioning
+			writeSSE(w, SessionEvent{Type: EventFailed, Message: "Session stopped", Error: "session was deleted while provisioning", Time: time.Now()})
+			flusher.Flush()
+			return
+		}
+		session = current
+
+		// Keep intermediaries from closing a quiet stream
+		if time.Since(lastWrite) >= keepAliveInterval {
+			io.WriteString(w, ": waiting\n\n")
+			flusher.Flush()
+			lastWrite = time.Now()
+		}
+	}
+
+	switch session.Status {
+	case "running":
+		writeSSE(w, SessionEvent{Type: EventWorkspaceReady, Message: "Session ready", MachineID: session.MachineID, Time: time.Now()})
+	case "failed":
+		writeSSE(w, SessionEvent{Type: EventFailed, Message: "Provisioning failed", Error: "session failed to start", Time: time.Now()})
+	default:
+		writeSSE(w, SessionEvent{Type: EventFailed, Message: "Session " + session.Status, Error: "session is " + session.Status, Time: time.Now()})
+	}
+	flusher.Flush()
+}
+
+// writeSSE writes a single server-sent event.
+func writeSSE(w http.ResponseWriter, ev SessionEvent) {
+	data, _ := json.Marshal(ev)
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+}
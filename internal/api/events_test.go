@@ -0,0 +1,83 @@
+package api
+
+import (
+	"testing"
+)
+
+// eventTypes returns the types of events, in order.
+func eventTypes(events []SessionEvent) []string {
+	var types []string
+	for _, ev := range events {
+		types = append(types, ev.Type)
+	}
+	return types
+}
+
+func TestEventHubReplaysHistory(t *testing.T) {
+	hub := NewEventHub()
+	hub.Open("sess_1")
+	hub.Publish("sess_1", SessionEvent{Type: EventImageResolved})
+	hub.Publish("sess_1", SessionEvent{Type: EventMachineCreated, MachineID: "m_1"})
+
+	// A late subscriber sees what was published before it, then the rest
+	history, ch, ok := hub.Subscribe("sess_1")
+	if !ok || ch == nil {
+		t.Fatalf("Subscribe = %v, %v; want a live stream", ch, ok)
+	}
+	if got := eventTypes(history); len(got) != 2 || got[0] != EventImageResolved || got[1] != EventMachineCreated {
+		t.Errorf("history %v, want image_resolved then machine_created", got)
+	}
+	if history[0].Time.IsZero() {
+		t.Error("published event has no time")
+	}
+
+	hub.Publish("sess_1", SessionEvent{Type: EventMachineStarted})
+	if ev := <-ch; ev.Type != EventMachineStarted {
+		t.Errorf("got %s, want machine_started", ev.Type)
+	}
+}
+
+func TestEventHubClosesOnTerminalEvent(t *testing.T) {
+	hub := NewEventHub()
+	hub.Open("sess_1")
+	_, ch, _ := hub.Subscribe("sess_1")
+
+	hub.Publish("sess_1", SessionEvent{Type: EventFailed, Error: "boom"})
+	if ev, ok := <-ch; !ok || ev.Type != EventFailed {
+		t.Fatalf("got %v, %v; want the failed event", ev, ok)
+	}
+	if _, ok := <-ch; ok {
+		t.Error("channel still open after a terminal event")
+	}
+
+	// Events after the end are dropped, and unsubscribing a closed
+	// channel is safe
+	hub.Publish("sess_1", SessionEvent{Type: EventMachineStarted})
+	hub.Unsubscribe("sess_1", ch)
+
+	// Subscribers of a finished stream get its whole history and no channel
+	history, ch, ok := hub.Subscribe("sess_1")
+	if !ok || ch != nil {
+		t.Fatalf("Subscribe = %v, %v; want a finished stream", ch, ok)
+	}
+	if got := eventTypes(history); len(got) != 1 || got[0] != EventFailed {
+		t.Errorf("history %v, want only failed", got)
+	}
+}
+
+func TestEventHubUnsubscribe(t *testing.T) {
+	hub := NewEventHub()
+	hub.Open("sess_1")
+	_, ch, _ := hub.Subscribe("sess_1")
+
+	hub.Unsubscribe("sess_1", ch)
+	if _, ok := <-ch; ok {
+		t.Error("channel still open after unsubscribing")
+	}
+	// Publishing to a stream without subscribers doesn't block
+	hub.Publish("sess_1", SessionEvent{Type: EventWorkspaceReady})
+
+	if _, _, ok := hub.Subscribe("sess_unknown"); ok {
+		t.Error("Subscribe to a session without a stream succeeded")
+	}
+}
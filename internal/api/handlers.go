@@ -1,17 +1,25 @@
 package api
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/izalutski/catty/internal/db"
-	"github.com/izalutski/catty/internal/fly"
+	"github.com/izalutski/catty/internal/protocol"
+	"github.com/izalutski/catty/internal/provider"
 )
 
 // CreateSessionRequest is the request body for creating a session.
@@ -22,8 +30,38 @@ type CreateSessionRequest struct {
 	CPUs     int      `json:"cpus"`
 	MemoryMB int      `json:"memory_mb"`
 	TTLSec   int      `json:"ttl_sec"`
+	// Env holds extra environment variables for the agent.
+	Env map[string]string `json:"env,omitempty"`
+	// BudgetTokens and BudgetMicroUSD cap the session's API usage; zero
+	// means no cap. Enforced by the metering proxy.
+	BudgetTokens   int64 `json:"budget_tokens,omitempty"`
+	BudgetMicroUSD int64 `json:"budget_cost_microusd,omitempty"`
 }
 
+// Limits on user-supplied session environment variables.
+const (
+	maxSessionEnvVars  = 100
+	maxSessionEnvBytes = 64 * 1024
+)
+
+var envNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// reservedEnvNames are set by catty itself and can't be overridden.
+var reservedEnvNames = map[string]bool{
+	"CONNECT_TOKEN":      true,
+	"ANTHROPIC_API_KEY":  true,
+	"ANTHROPIC_BASE_URL": true,
+	"OPENAI_API_KEY":     true,
+	"OPENAI_BASE_URL":    true,
+}
+
+// maxLabelAttempts is how many labels CreateSession tries before giving up.
+const maxLabelAttempts = 5
+
+// proxyTokenPrefix marks the per-session credentials agents present to the
+// metering proxy in place of an Anthropic API key.
+const proxyTokenPrefix = "catty_proxy_"
+
 // CreateSessionResponse is the response for creating a session.
 type CreateSessionResponse struct {
 	SessionID    string            `json:"session_id"`
@@ -31,6 +69,7 @@ type CreateSessionResponse struct {
 	MachineID    string            `json:"machine_id"`
 	ConnectURL   string            `json:"connect_url"`
 	ConnectToken string            `json:"connect_token"`
+	Status       string            `json:"status"`
 	Headers      map[string]string `json:"headers"`
 }
 
@@ -45,6 +84,9 @@ type SessionResponse struct {
 	Status       string    `json:"status"`
 	CreatedAt    time.Time `json:"created_at"`
 	MachineState string    `json:"machine_state,omitempty"`
+	// Budgets are omitted when the session has none
+	BudgetTokens   int64 `json:"budget_tokens,omitempty"`
+	BudgetMicroUSD int64 `json:"budget_cost_microusd,omitempty"`
 }
 
 // ErrorResponse is the response for errors.
@@ -54,31 +96,61 @@ type ErrorResponse struct {
 
 // Handlers contains HTTP handlers for the API.
 type Handlers struct {
-	flyClient *fly.Client
-	db        *db.Client
+	machines provider.Provider
+	db       db.Store
+	events   *EventHub
+	pool     *WarmPool
+	proxyURL string
+	secrets  *SecretBox
+
+	// provisions cancels the provisioning of sessions being stopped, by
+	// session ID
+	provisionsMu sync.Mutex
+	provisions   map[string]context.CancelFunc
 }
 
 // NewHandlers creates new API handlers.
-func NewHandlers(flyClient *fly.Client, dbClient *db.Client) *Handlers {
+// pool may be nil if the warm pool is disabled, proxyURL empty if agents
+// should talk to Anthropic directly, and secrets nil if secrets are disabled.
+func NewHandlers(machines provider.Provider, store db.Store, pool *WarmPool, proxyURL string, secrets *SecretBox) *Handlers {
 	return &Handlers{
-		flyClient: flyClient,
-		db:        dbClient,
+		machines:   machines,
+		db:         store,
+		events:     NewEventHub(),
+		pool:       pool,
+		proxyURL:   proxyURL,
+		secrets:    secrets,
+		provisions: make(map[string]context.CancelFunc),
 	}
 }
 
 // getImage returns the executor image to use for new machines.
 // Fetches fresh each time to pick up new deployments.
 func (h *Handlers) getImage() (string, error) {
-	return h.flyClient.GetCurrentImage()
+	return h.machines.CurrentImage()
 }
 
 // CreateSession handles POST /v1/sessions.
+// Returns 202 with the session in "provisioning" state; the machine is
+// created in the background.
 func (h *Handlers) CreateSession(w http.ResponseWriter, r *http.Request) {
 	var req CreateSessionRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		writeError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
 		return
 	}
+	if err := validateSessionEnv(req.Env); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.BudgetTokens < 0 || req.BudgetMicroUSD < 0 {
+		writeError(w, http.StatusBadRequest, "budgets must not be negative")
+		return
+	}
+	if (req.BudgetTokens > 0 || req.BudgetMicroUSD > 0) && h.proxyURL == "" {
+		writeError(w, http.StatusBadRequest, "session budgets need the metering proxy, which this server does not use")
+		return
+	}
 
 	// Get authenticated user from context
 	authUser := UserFromContext(r.Context())
@@ -94,6 +166,24 @@ func (h *Handlers) CreateSession(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Stored secrets are injected alongside the request's variables,
+	// which take precedence
+	secretEnv, err := h.userSecrets(dbUser.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load secrets: "+err.Error())
+		return
+	}
+	if len(secretEnv) > 0 {
+		for k, v := range req.Env {
+			secretEnv[k] = v
+		}
+		req.Env = secretEnv
+		if err := validateSessionEnv(req.Env); err != nil {
+			writeError(w, http.StatusBadRequest, "env vars and secrets: "+err.Error())
+			return
+		}
+	}
+
 	// Check quota before creating session
 	allowed, _, err := h.db.CheckQuota(dbUser.ID)
 	if err != nil {
@@ -106,21 +196,38 @@ func (h *Handlers) CreateSession(w http.ResponseWriter, r *http.Request) {
 		if apiHost == "" {
 			apiHost = "api.catty.dev"
 		}
-		writeJSON(w, http.StatusPaymentRequired, map[string]string{
-			"error":       "quota_exceeded",
-			"message":     "Free tier quota exceeded (1M tokens/month). Upgrade to Pro for unlimited usage.",
-			"upgrade_url": fmt.Sprintf("https://%s/v1/billing/checkout", apiHost),
+		// Clients render the limits from the response, not their own copy
+		message := fmt.Sprintf("Free tier quota exceeded (%d tokens or $%.2f per month). Upgrade to Pro for unlimited usage.",
+			db.FreeTierMonthlyTokens, float64(db.FreeTierMonthlyCostMicroUSD)/1_000_000)
+		writeJSON(w, http.StatusPaymentRequired, map[string]any{
+			"error":               "quota_exceeded",
+			"message":             message,
+			"limit_tokens":        db.FreeTierMonthlyTokens,
+			"limit_cost_microusd": db.FreeTierMonthlyCostMicroUSD,
+			"upgrade_url":         fmt.Sprintf("https://%s/v1/billing/checkout", apiHost),
 		})
 		return
 	}
 
-	// Generate connect token and label
+	// Generate connect token
 	connectToken, err := generateToken(32)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "failed to generate token: "+err.Error())
 		return
 	}
-	label := db.GenerateLabel()
+
+	// In proxy mode the agent authenticates to the proxy with a per-session
+	// credential; the real Anthropic key never leaves the API and proxy
+	var proxyToken, proxyTokenHash string
+	if h.proxyURL != "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to generate token: "+err.Error())
+			return
+		}
+		proxyToken = proxyTokenPrefix + hex.EncodeToString(secret)
+		proxyTokenHash = db.HashToken(proxyToken)
+	}
 
 	// Set defaults
 	if req.Region == "" || req.Region == "auto" {
@@ -136,119 +243,366 @@ func (h *Handlers) CreateSession(w http.ResponseWriter, r *http.Request) {
 		req.Cmd = []string{"/bin/sh"}
 	}
 
-	// Get the current executor image
-	image, err := h.getImage()
+	// Save session to database before provisioning so progress can be tracked.
+	// Labels are unique across all users, so pick another on collision.
+	var savedSession *db.Session
+	for attempt := 0; ; attempt++ {
+		savedSession, err = h.db.CreateSession(&db.Session{
+			UserID:         dbUser.ID,
+			Label:          db.GenerateLabel(),
+			ConnectToken:   connectToken,
+			Region:         req.Region,
+			Status:         "provisioning",
+			ProxyTokenHash: proxyTokenHash,
+			BudgetTokens:   req.BudgetTokens,
+			BudgetMicroUSD: req.BudgetMicroUSD,
+		})
+		if !errors.Is(err, db.ErrLabelTaken) || attempt == maxLabelAttempts-1 {
+			break
+		}
+	}
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, "failed to get executor image: "+err.Error())
+		writeError(w, http.StatusInternalServerError, "failed to save session: "+err.Error())
 		return
 	}
 
-	// Build environment for the machine
-	machineEnv := map[string]string{
-		"CONNECT_TOKEN": connectToken,
-		"CATTY_CMD":     joinCmd(req.Cmd),
+	// Provision the machine in the background; progress is reported via
+	// GET /v1/sessions/{id}/events
+	h.events.Open(savedSession.ID)
+	ctx, cancel := context.WithCancel(context.Background())
+	h.provisionsMu.Lock()
+	h.provisions[savedSession.ID] = cancel
+	h.provisionsMu.Unlock()
+	go func() {
+		defer func() {
+			h.provisionsMu.Lock()
+			delete(h.provisions, savedSession.ID)
+			h.provisionsMu.Unlock()
+			cancel()
+		}()
+		h.provision(ctx, savedSession, &req, proxyToken, authUser.Email)
+	}()
+
+	// Return response
+	resp := &CreateSessionResponse{
+		SessionID:    savedSession.ID,
+		Label:        savedSession.Label,
+		ConnectToken: connectToken,
+		Status:       savedSession.Status,
+		Headers:      map[string]string{},
 	}
 
-	// Configure Anthropic API access
-	// If proxy is configured, route API calls through it for metering
-	// Otherwise fall back to direct API key
-	if proxyHost := os.Getenv("CATTY_PROXY_HOST"); proxyHost != "" {
-		// Use proxy: encode session ID in path for tracking
-		// Proxy will extract session ID, look up user, check quota, then forward to Anthropic
-		// Note: session.ID will be set after CreateSession, so we use label as identifier
-		// The proxy will look up the session by label
-		machineEnv["ANTHROPIC_BASE_URL"] = fmt.Sprintf("https://%s/s/%s", proxyHost, label)
-		// Pass through real API key - proxy forwards it to Anthropic
-		if apiKey := os.Getenv("ANTHROPIC_API_KEY"); apiKey != "" {
-			machineEnv["ANTHROPIC_API_KEY"] = apiKey
+	writeJSON(w, http.StatusAccepted, resp)
+}
+
+// provision creates and starts the machine for a session, publishing a
+// progress event after each step. proxyToken is the session's credential
+// for the metering proxy, empty if agents talk to Anthropic directly.
+//
+// The session may be stopped or deleted while it is provisioned, by this
+// instance (which cancels ctx) or another one. Provisioning checks before
+// each step and only marks the session running if it is still
+// provisioning; otherwise it deletes the machine it made.
+func (h *Handlers) provision(ctx context.Context, session *db.Session, req *CreateSessionRequest, proxyToken, owner string) {
+	fail := func(msg string, err error) {
+		fmt.Printf("warning: provisioning session %s failed: %s: %v\n", session.ID, msg, err)
+		if _, err := h.db.TransitionSessionStatus(session.ID, "provisioning", "failed"); err != nil {
+			fmt.Printf("warning: failed to update session status: %v\n", err)
+		}
+		h.events.Publish(session.ID, SessionEvent{Type: EventFailed, Message: msg, Error: err.Error()})
+	}
+	abort := func(machineID string) {
+		fmt.Printf("session %s was stopped while provisioning\n", session.ID)
+		if machineID != "" {
+			h.machines.DeleteMachine(machineID, true)
+		}
+		h.events.Publish(session.ID, SessionEvent{Type: EventFailed, Message: "Session stopped", Error: "session was stopped while provisioning"})
+	}
+
+	metadata := map[string]string{
+		"project": "catty",
+		"label":   session.Label,
+		"owner":   owner,
+		"agent":   req.Agent,
+	}
+
+	if h.provisionStopped(ctx, session.ID) {
+		abort("")
+		return
+	}
+
+	// Prefer a pre-started machine from the warm pool
+	if pm := h.pool.Claim(req.Region, req.CPUs, req.MemoryMB); pm != nil {
+		err := h.claimPooled(session, req, proxyToken, metadata, pm)
+		if err == nil {
+			return
+		}
+		if errors.Is(err, errSessionStopped) {
+			abort(pm.machineID)
+			return
 		}
-	} else if apiKey := os.Getenv("ANTHROPIC_API_KEY"); apiKey != "" {
-		// Direct mode: pass through API key (no metering)
-		machineEnv["ANTHROPIC_API_KEY"] = apiKey
-	}
-
-	// Build machine config
-	machineReq := &fly.CreateMachineRequest{
-		Region: req.Region,
-		Config: &fly.MachineConfig{
-			Image: image,
-			Env:   machineEnv,
-			Services: []fly.MachineService{
-				{
-					Protocol:     "tcp",
-					InternalPort: 8080,
-					Ports: []fly.ServicePort{
-						{Port: 443, Handlers: []string{"tls", "http"}},
-						{Port: 80, Handlers: []string{"http"}},
-					},
-				},
-			},
-			Guest: &fly.GuestConfig{
-				CPUs:     req.CPUs,
-				MemoryMB: req.MemoryMB,
-				CPUKind:  "shared",
-			},
-			Metadata: map[string]string{
-				"project": "catty",
-				"label":   label,
-				"owner":   authUser.Email,
-				"agent":   req.Agent,
-			},
-		},
+		fmt.Printf("warning: failed to configure pooled machine %s, falling back to cold start: %v\n", pm.machineID, err)
+		h.machines.DeleteMachine(pm.machineID, true)
+	}
+
+	// Get the current executor image
+	image, err := h.getImage()
+	if err != nil {
+		fail("Failed to get executor image", err)
+		return
+	}
+	h.events.Publish(session.ID, SessionEvent{Type: EventImageResolved, Message: "Resolved executor image"})
+	if h.provisionStopped(ctx, session.ID) {
+		abort("")
+		return
 	}
 
+	// Build environment for the machine
+	machineEnv := h.sessionEnv(session, proxyToken, req.Env)
+	machineEnv["CONNECT_TOKEN"] = session.ConnectToken
+	machineEnv["CATTY_CMD"] = joinCmd(req.Cmd)
+
 	// Create the machine
-	machine, err := h.flyClient.CreateMachine(machineReq)
+	machine, err := h.machines.CreateMachine(&provider.CreateRequest{
+		Region:   req.Region,
+		Image:    image,
+		Env:      machineEnv,
+		CPUs:     req.CPUs,
+		MemoryMB: req.MemoryMB,
+		Metadata: metadata,
+	})
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, "failed to create machine: "+err.Error())
+		fail("Failed to create machine", err)
+		return
+	}
+	if err := h.db.UpdateSessionMachine(session.ID, machine.ID, machine.Region, h.connectURL(machine.ID)); err != nil {
+		fmt.Printf("warning: failed to save machine for session: %v\n", err)
+	}
+	h.events.Publish(session.ID, SessionEvent{Type: EventMachineCreated, Message: "Created machine " + machine.ID, MachineID: machine.ID})
+	if h.provisionStopped(ctx, session.ID) {
+		abort(machine.ID)
 		return
 	}
 
 	// Wait for machine to start
-	if err := h.flyClient.WaitMachine(machine.ID, "started", 60*time.Second); err != nil {
+	if err := h.machines.WaitMachine(ctx, machine.ID, provider.StateStarted, 60*time.Second); err != nil {
+		if ctx.Err() != nil {
+			abort(machine.ID)
+			return
+		}
 		// Try to clean up
-		h.flyClient.DeleteMachine(machine.ID, true)
-		writeError(w, http.StatusInternalServerError, "machine failed to start: "+err.Error())
+		h.machines.DeleteMachine(machine.ID, true)
+		fail("Machine failed to start", err)
+		return
+	}
+	h.events.Publish(session.ID, SessionEvent{Type: EventMachineStarted, Message: "Machine started", MachineID: machine.ID})
+	if h.provisionStopped(ctx, session.ID) {
+		abort(machine.ID)
 		return
 	}
 
-	// Build connect URL
-	// Use custom domain if set, otherwise fall back to fly.dev
-	execHost := os.Getenv("CATTY_EXEC_HOST")
-	if execHost == "" {
-		execHost = fmt.Sprintf("%s.fly.dev", h.flyClient.AppName())
+	// Wait for the executor to accept connections
+	if err := waitExecutorReady(ctx, h.machines.Endpoint(machine.ID), 30*time.Second); err != nil {
+		if ctx.Err() != nil {
+			abort(machine.ID)
+			return
+		}
+		h.machines.DeleteMachine(machine.ID, true)
+		fail("Executor did not become ready", err)
+		return
 	}
-	connectURL := fmt.Sprintf("wss://%s/connect", execHost)
 
-	// Save session to database
-	session := &db.Session{
-		UserID:       dbUser.ID,
-		MachineID:    machine.ID,
-		Label:        label,
-		ConnectToken: connectToken,
-		ConnectURL:   connectURL,
-		Region:       machine.Region,
-		Status:       "running",
+	// The session is running unless it was stopped in the meantime
+	running, err := h.db.TransitionSessionStatus(session.ID, "provisioning", "running")
+	if err != nil {
+		fmt.Printf("warning: failed to update session status: %v\n", err)
+	} else if !running {
+		abort(machine.ID)
+		return
+	}
+	h.events.Publish(session.ID, SessionEvent{Type: EventWorkspaceReady, Message: "Workspace ready", MachineID: machine.ID})
+}
+
+// errSessionStopped means a session was stopped before its machine was
+// ready.
+var errSessionStopped = errors.New("session stopped while provisioning")
+
+// provisionStopped reports whether provisioning a session should stop:
+// ctx was canceled, or the session was stopped by another instance. A
+// session that can't be read is left to the final status check.
+func (h *Handlers) provisionStopped(ctx context.Context, sessionID string) bool {
+	if ctx.Err() != nil {
+		return true
+	}
+	session, err := h.db.GetSessionByID(sessionID)
+	return err == nil && session.Status != "provisioning"
+}
+
+// cancelProvision stops this instance provisioning a session, if it is.
+func (h *Handlers) cancelProvision(sessionID string) {
+	h.provisionsMu.Lock()
+	defer h.provisionsMu.Unlock()
+	if cancel, ok := h.provisions[sessionID]; ok {
+		cancel()
+	}
+}
+
+// claimPooled assigns a warm pool machine to a session by configuring it
+// with the per-session token, command and environment.
+func (h *Handlers) claimPooled(session *db.Session, req *CreateSessionRequest, proxyToken string, metadata map[string]string, pm *pooledMachine) error {
+	if err := configureExecutor(h.machines.Endpoint(pm.machineID), pm.configureToken, &protocol.ConfigureRequest{
+		ConnectToken: session.ConnectToken,
+		Cmd:          req.Cmd,
+		Env:          h.sessionEnv(session, proxyToken, req.Env),
+	}); err != nil {
+		return err
 	}
-	savedSession, err := h.db.CreateSession(session)
+
+	// Replace the pool markers with the session's metadata
+	metadata[poolMetadataKey] = "claimed"
+	for k, v := range metadata {
+		if err := h.machines.SetMetadata(pm.machineID, k, v); err != nil {
+			fmt.Printf("warning: failed to set machine metadata %s: %v\n", k, err)
+		}
+	}
+
+	if err := h.db.UpdateSessionMachine(session.ID, pm.machineID, pm.region, h.connectURL(pm.machineID)); err != nil {
+		fmt.Printf("warning: failed to save machine for session: %v\n", err)
+	}
+	running, err := h.db.TransitionSessionStatus(session.ID, "provisioning", "running")
 	if err != nil {
-		// Log but don't fail - machine is already running
-		fmt.Printf("warning: failed to save session: %v\n", err)
+		fmt.Printf("warning: failed to update session status: %v\n", err)
+	} else if !running {
+		return errSessionStopped
 	}
 
-	// Return response
-	resp := &CreateSessionResponse{
-		SessionID:    savedSession.ID,
-		Label:        label,
-		MachineID:    machine.ID,
-		ConnectURL:   connectURL,
-		ConnectToken: connectToken,
-		Headers: map[string]string{
-			"fly-force-instance-id": machine.ID,
-		},
+	h.events.Publish(session.ID, SessionEvent{Type: EventImageResolved, Message: "Using pre-started executor"})
+	h.events.Publish(session.ID, SessionEvent{Type: EventMachineCreated, Message: "Claimed machine " + pm.machineID, MachineID: pm.machineID})
+	h.events.Publish(session.ID, SessionEvent{Type: EventMachineStarted, Message: "Machine already running", MachineID: pm.machineID})
+	h.events.Publish(session.ID, SessionEvent{Type: EventWorkspaceReady, Message: "Workspace ready", MachineID: pm.machineID})
+	return nil
+}
+
+// sessionEnv returns the agent environment for a session: the user's
+// variables, with catty's own settings taking precedence. The executor
+// masks the values of the variables listed in CATTY_MASK_ENV in its logs.
+func (h *Handlers) sessionEnv(session *db.Session, proxyToken string, userEnv map[string]string) map[string]string {
+	env := make(map[string]string, len(userEnv))
+	names := make([]string, 0, len(userEnv)+1)
+	for k, v := range userEnv {
+		env[k] = v
+		names = append(names, k)
 	}
 
-	writeJSON(w, http.StatusOK, resp)
+	// Configure Anthropic and OpenAI API access
+	// If proxy is configured, route API calls through it for metering
+	// Otherwise fall back to direct API keys
+	if h.proxyURL != "" {
+		// Use proxy: encode session label in path for tracking
+		// The proxy will look up the session by label, check the session's
+		// credential and quota, then forward to the provider with the real key
+		baseURL := fmt.Sprintf("%s/s/%s", h.proxyURL, session.Label)
+		env["ANTHROPIC_BASE_URL"] = baseURL
+		env["ANTHROPIC_API_KEY"] = proxyToken
+		env["OPENAI_BASE_URL"] = baseURL + "/openai/v1"
+		env["OPENAI_API_KEY"] = proxyToken
+		if session.HasBudget() {
+			// Lets the executor tell the user when the budget runs out
+			env[protocol.BudgetURLEnvVar] = baseURL + protocol.BudgetPath
+		}
+	} else {
+		// Direct mode: pass through API keys (no metering)
+		if apiKey := os.Getenv("ANTHROPIC_API_KEY"); apiKey != "" {
+			env["ANTHROPIC_API_KEY"] = apiKey
+		}
+		if apiKey := os.Getenv("OPENAI_API_KEY"); apiKey != "" {
+			env["OPENAI_API_KEY"] = apiKey
+		}
+	}
+	for _, name := range []string{"ANTHROPIC_API_KEY", "OPENAI_API_KEY"} {
+		if _, ok := userEnv[name]; !ok && env[name] != "" {
+			names = append(names, name)
+		}
+	}
+
+	if len(names) > 0 {
+		sort.Strings(names)
+		env[protocol.MaskEnvVar] = strings.Join(names, ",")
+	}
+
+	return env
+}
+
+// validateSessionEnv checks user-supplied environment variables.
+func validateSessionEnv(env map[string]string) error {
+	if len(env) > maxSessionEnvVars {
+		return fmt.Errorf("too many env vars (max %d)", maxSessionEnvVars)
+	}
+	size := 0
+	for name, value := range env {
+		if err := validateEnvName(name); err != nil {
+			return err
+		}
+		size += len(name) + len(value)
+	}
+	if size > maxSessionEnvBytes {
+		return fmt.Errorf("env vars too large (max %d bytes)", maxSessionEnvBytes)
+	}
+	return nil
+}
+
+// validateEnvName checks that name is a valid variable the user may set.
+func validateEnvName(name string) error {
+	if !envNameRe.MatchString(name) {
+		return fmt.Errorf("invalid env var name: %q", name)
+	}
+	if reservedEnvNames[name] || strings.HasPrefix(name, "CATTY_") {
+		return fmt.Errorf("env var is reserved: %s", name)
+	}
+	return nil
+}
+
+// connectURL returns the WebSocket URL clients use to reach a machine's executor.
+func (h *Handlers) connectURL(machineID string) string {
+	base := h.machines.Endpoint(machineID).BaseURL
+	base = strings.Replace(base, "https://", "wss://", 1)
+	base = strings.Replace(base, "http://", "ws://", 1)
+	return base + "/connect"
+}
+
+// waitExecutorReady polls the executor health endpoint until it responds,
+// the timeout passes or ctx is done.
+func waitExecutorReady(ctx context.Context, endpoint *provider.Endpoint, timeout time.Duration) error {
+	client := &http.Client{Timeout: 5 * time.Second}
+	url := endpoint.BaseURL + "/healthz"
+
+	deadline := time.Now().Add(timeout)
+	var lastErr error
+	for time.Now().Before(deadline) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		for k, v := range endpoint.Headers {
+			req.Header.Set(k, v)
+		}
+
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+			err = fmt.Errorf("health check returned %d", resp.StatusCode)
+		}
+		lastErr = err
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+	return fmt.Errorf("timed out: %w", lastErr)
 }
 
 // ListSessions handles GET /v1/sessions.
@@ -277,13 +631,15 @@ func (h *Handlers) ListSessions(w http.ResponseWriter, r *http.Request) {
 	responses := make([]*SessionResponse, 0, len(sessions))
 	for _, s := range sessions {
 		responses = append(responses, &SessionResponse{
-			SessionID:  s.ID,
-			Label:      s.Label,
-			MachineID:  s.MachineID,
-			ConnectURL: s.ConnectURL,
-			Region:     s.Region,
-			Status:     s.Status,
-			CreatedAt:  s.CreatedAt,
+			SessionID:      s.ID,
+			Label:          s.Label,
+			MachineID:      s.MachineID,
+			ConnectURL:     s.ConnectURL,
+			Region:         s.Region,
+			Status:         s.Status,
+			CreatedAt:      s.CreatedAt,
+			BudgetTokens:   s.BudgetTokens,
+			BudgetMicroUSD: s.BudgetMicroUSD,
 		})
 	}
 	writeJSON(w, http.StatusOK, responses)
@@ -325,19 +681,21 @@ func (h *Handlers) GetSession(w http.ResponseWriter, r *http.Request) {
 	}
 
 	resp := &SessionResponse{
-		SessionID:    session.ID,
-		Label:        session.Label,
-		MachineID:    session.MachineID,
-		ConnectURL:   session.ConnectURL,
-		ConnectToken: session.ConnectToken,
-		Region:       session.Region,
-		Status:       session.Status,
-		CreatedAt:    session.CreatedAt,
+		SessionID:      session.ID,
+		Label:          session.Label,
+		MachineID:      session.MachineID,
+		ConnectURL:     session.ConnectURL,
+		ConnectToken:   session.ConnectToken,
+		Region:         session.Region,
+		Status:         session.Status,
+		CreatedAt:      session.CreatedAt,
+		BudgetTokens:   session.BudgetTokens,
+		BudgetMicroUSD: session.BudgetMicroUSD,
 	}
 
 	// Optionally fetch live machine state
-	if r.URL.Query().Get("live") == "true" {
-		machine, err := h.flyClient.GetMachine(session.MachineID)
+	if r.URL.Query().Get("live") == "true" && session.MachineID != "" {
+		machine, err := h.machines.GetMachine(session.MachineID)
 		if err == nil {
 			resp.MachineState = machine.State
 		}
@@ -384,17 +742,25 @@ func (h *Handlers) StopSession(w http.ResponseWriter, r *http.Request) {
 	// Check if delete is requested
 	deleteAfter := r.URL.Query().Get("delete") == "true"
 
-	// Stop the machine
-	if err := h.flyClient.StopMachine(session.MachineID); err != nil {
-		writeError(w, http.StatusInternalServerError, "failed to stop machine: "+err.Error())
-		return
+	// A session still being provisioned has no machine yet; provisioning
+	// sees the new status and deletes the machine it is making
+	h.cancelProvision(session.ID)
+
+	// Stop the machine (sessions that failed to provision may not have one)
+	if session.MachineID != "" {
+		if err := h.machines.StopMachine(session.MachineID); err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to stop machine: "+err.Error())
+			return
+		}
 	}
 
 	// Delete if requested
 	if deleteAfter {
-		if err := h.flyClient.DeleteMachine(session.MachineID, false); err != nil {
-			writeError(w, http.StatusInternalServerError, "failed to delete machine: "+err.Error())
-			return
+		if session.MachineID != "" {
+			if err := h.machines.DeleteMachine(session.MachineID, false); err != nil {
+				writeError(w, http.StatusInternalServerError, "failed to delete machine: "+err.Error())
+				return
+			}
 		}
 		if err := h.db.DeleteSession(session.ID); err != nil {
 			fmt.Printf("warning: failed to delete session record: %v\n", err)
@@ -0,0 +1,264 @@
+package api
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// jwksRefreshInterval is how long fetched signing keys are trusted
+	// before the JWKS is fetched again.
+	jwksRefreshInterval = time.Hour
+
+	// jwksMinRefetchInterval limits refetches triggered by unknown key IDs,
+	// so garbage tokens can't be used to hammer the JWKS endpoint.
+	jwksMinRefetchInterval = time.Minute
+
+	// jwtClockSkew is the leeway allowed when checking exp and nbf.
+	jwtClockSkew = 30 * time.Second
+)
+
+// jwtClaims are the registered claims checked on access tokens.
+type jwtClaims struct {
+	Subject   string      `json:"sub"`
+	SessionID string      `json:"sid"`
+	Issuer    string      `json:"iss"`
+	Audience  jwtAudience `json:"aud"`
+	ExpiresAt int64       `json:"exp"`
+	NotBefore int64       `json:"nbf"`
+}
+
+// jwtAudience accepts both forms of the aud claim: a string or a list.
+type jwtAudience []string
+
+func (a *jwtAudience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = jwtAudience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("invalid aud claim")
+	}
+	*a = list
+	return nil
+}
+
+// Expiry returns the token's expiry time.
+func (c *jwtClaims) Expiry() time.Time {
+	return time.Unix(c.ExpiresAt, 0)
+}
+
+// jwtVerifier verifies RS256 access tokens against signing keys from a
+// JWKS endpoint, which it caches.
+type jwtVerifier struct {
+	jwksURL  string
+	issuer   string
+	audience string
+	client   *http.Client
+	// now is the clock tokens and cached keys are checked against
+	now func() time.Time
+
+	mu          sync.Mutex
+	keys        map[string]*rsa.PublicKey // by key ID
+	fetchedAt   time.Time
+	lastAttempt time.Time
+}
+
+// newJWTVerifier creates a verifier. Empty issuer or audience skips that check.
+func newJWTVerifier(jwksURL, issuer, audience string) *jwtVerifier {
+	return &jwtVerifier{
+		jwksURL:  jwksURL,
+		issuer:   issuer,
+		audience: audience,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		now:      time.Now,
+	}
+}
+
+// Verify checks the token's signature and claims and returns the claims.
+func (v *jwtVerifier) Verify(token string) (*jwtClaims, error) {
+	return v.verify(token, false)
+}
+
+// VerifyAllowExpired is Verify without the expiry check, for operations
+// such as logout that must work after the token has expired.
+func (v *jwtVerifier) VerifyAllowExpired(token string) (*jwtClaims, error) {
+	return v.verify(token, true)
+}
+
+// verify checks the token's signature and claims, optionally skipping exp.
+func (v *jwtVerifier) verify(token string, allowExpired bool) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed token header: %w", err)
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("unsupported signing algorithm: %s", header.Alg)
+	}
+
+	key, err := v.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return nil, fmt.Errorf("invalid token signature")
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed token claims: %w", err)
+	}
+
+	now := v.now()
+	if claims.ExpiresAt == 0 {
+		return nil, fmt.Errorf("token has no expiry")
+	}
+	if !allowExpired && now.After(claims.Expiry().Add(jwtClockSkew)) {
+		return nil, fmt.Errorf("token expired")
+	}
+	if claims.NotBefore != 0 && now.Add(jwtClockSkew).Before(time.Unix(claims.NotBefore, 0)) {
+		return nil, fmt.Errorf("token not yet valid")
+	}
+	if v.issuer != "" && claims.Issuer != v.issuer {
+		return nil, fmt.Errorf("unexpected token issuer: %s", claims.Issuer)
+	}
+	if v.audience != "" && !containsString(claims.Audience, v.audience) {
+		return nil, fmt.Errorf("token not issued for this audience")
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("token has no subject")
+	}
+
+	return &claims, nil
+}
+
+// key returns the signing key with the given ID, refreshing the JWKS when
+// it is stale or doesn't contain the key.
+func (v *jwtVerifier) key(kid string) (*rsa.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	now := v.now()
+	key, ok := v.keys[kid]
+	stale := now.Sub(v.fetchedAt) > jwksRefreshInterval
+	if ok && !stale {
+		return key, nil
+	}
+
+	// Refetches are rate limited even when the keys are stale, so a JWKS
+	// outage doesn't turn every request into a fetch
+	if now.Sub(v.lastAttempt) > jwksMinRefetchInterval {
+		v.lastAttempt = now
+		keys, err := v.fetchKeys()
+		if err != nil {
+			// Keep using the old keys if the endpoint is briefly unavailable
+			if ok {
+				return key, nil
+			}
+			return nil, fmt.Errorf("fetch signing keys: %w", err)
+		}
+		v.keys = keys
+		v.fetchedAt = now
+		key, ok = keys[kid]
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key: %s", kid)
+	}
+	return key, nil
+}
+
+// fetchKeys downloads the JWKS and returns its RSA signing keys.
+func (v *jwtVerifier) fetchKeys() (map[string]*rsa.PublicKey, error) {
+	resp, err := v.client.Get(v.jwksURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("JWKS error (%d): %s", resp.StatusCode, string(body))
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return nil, fmt.Errorf("parse JWKS: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) > 4 {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("JWKS has no RSA signing keys")
+	}
+
+	return keys, nil
+}
+
+// decodeJWTPart decodes a base64url-encoded JSON token segment.
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,349 @@
+package api
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testIssuer   = "https://auth.example.com"
+	testAudience = "client_test"
+)
+
+// testJWKS stands in for WorkOS's JWKS endpoint.
+type testJWKS struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	keys    map[string]*rsa.PrivateKey // served keys, by key ID
+	down    bool
+	fetches int
+}
+
+func newTestJWKS(t *testing.T) *testJWKS {
+	j := &testJWKS{keys: make(map[string]*rsa.PrivateKey)}
+	j.Server = httptest.NewServer(http.HandlerFunc(j.serve))
+	t.Cleanup(j.Close)
+	return j
+}
+
+func (j *testJWKS) serve(w http.ResponseWriter, r *http.Request) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.fetches++
+	if j.down {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	type jwk struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Use string `json:"use"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	}
+	var keys []jwk
+	for kid, key := range j.keys {
+		keys = append(keys, jwk{
+			Kty: "RSA",
+			Kid: kid,
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+	json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+}
+
+// addKey generates a signing key and serves it under kid.
+func (j *testJWKS) addKey(t *testing.T, kid string) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.mu.Lock()
+	j.keys[kid] = key
+	j.mu.Unlock()
+	return key
+}
+
+func (j *testJWKS) setDown(down bool) {
+	j.mu.Lock()
+	j.down = down
+	j.mu.Unlock()
+}
+
+func (j *testJWKS) fetchCount() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.fetches
+}
+
+// fakeClock is a settable clock for the verifier.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time          { return c.now }
+func (c *fakeClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+// newTestVerifier creates a verifier for jwks on a fake clock.
+func newTestVerifier(jwks *testJWKS) (*jwtVerifier, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(1_800_000_000, 0)}
+	v := newJWTVerifier(jwks.URL, testIssuer, testAudience)
+	v.now = clock.Now
+	return v, clock
+}
+
+// signToken signs claims as an RS256 token, or with the given alg header.
+func signToken(t *testing.T, key *rsa.PrivateKey, kid, alg string, claims map[string]any) string {
+	t.Helper()
+	encode := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+
+	signed := encode(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// validClaims returns claims that pass every check at now.
+func validClaims(now time.Time) map[string]any {
+	return map[string]any{
+		"sub": "user_123",
+		"sid": "session_123",
+		"iss": testIssuer,
+		"aud": testAudience,
+		"exp": now.Add(5 * time.Minute).Unix(),
+		"nbf": now.Add(-time.Minute).Unix(),
+	}
+}
+
+// with returns a copy of claims with one claim changed, or removed if
+// value is nil.
+func with(claims map[string]any, name string, value any) map[string]any {
+	out := make(map[string]any, len(claims))
+	for k, v := range claims {
+		out[k] = v
+	}
+	if value == nil {
+		delete(out, name)
+	} else {
+		out[name] = value
+	}
+	return out
+}
+
+func TestJWTVerifierClaims(t *testing.T) {
+	jwks := newTestJWKS(t)
+	key := jwks.addKey(t, "key-1")
+	v, clock := newTestVerifier(jwks)
+	now := clock.Now()
+	claims := validClaims(now)
+
+	tests := []struct {
+		name         string
+		claims       map[string]any
+		allowExpired bool
+		wantErr      string
+	}{
+		{name: "valid", claims: claims},
+		{name: "audience list", claims: with(claims, "aud", []string{"other", testAudience})},
+		{name: "wrong audience", claims: with(claims, "aud", "client_other"), wantErr: "audience"},
+		{name: "wrong issuer", claims: with(claims, "iss", "https://evil.example.com"), wantErr: "issuer"},
+		{name: "no subject", claims: with(claims, "sub", nil), wantErr: "no subject"},
+		{name: "no expiry", claims: with(claims, "exp", nil), wantErr: "no expiry"},
+		{name: "expired within skew", claims: with(claims, "exp", now.Add(-jwtClockSkew+time.Second).Unix())},
+		{name: "expired at skew", claims: with(claims, "exp", now.Add(-jwtClockSkew).Unix())},
+		{name: "expired past skew", claims: with(claims, "exp", now.Add(-jwtClockSkew-time.Second).Unix()), wantErr: "expired"},
+		{name: "expired allowed", claims: with(claims, "exp", now.Add(-time.Hour).Unix()), allowExpired: true},
+		{name: "not yet valid within skew", claims: with(claims, "nbf", now.Add(jwtClockSkew).Unix())},
+		{name: "not yet valid past skew", claims: with(claims, "nbf", now.Add(jwtClockSkew+time.Second).Unix()), wantErr: "not yet valid"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := signToken(t, key, "key-1", "RS256", tt.claims)
+			verify := v.Verify
+			if tt.allowExpired {
+				verify = v.VerifyAllowExpired
+			}
+			got, err := verify(token)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if got.Subject != "user_123" || got.SessionID != "session_123" {
+					t.Errorf("got claims %+v", got)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want one mentioning %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestJWTVerifierRejectsBadTokens(t *testing.T) {
+	jwks := newTestJWKS(t)
+	key := jwks.addKey(t, "key-1")
+	v, clock := newTestVerifier(jwks)
+	claims := validClaims(clock.Now())
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := signToken(t, key, "key-1", "RS256", claims)
+	parts := strings.Split(valid, ".")
+
+	tests := map[string]string{
+		"HS256":            signToken(t, key, "key-1", "HS256", claims),
+		"none":             base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"key-1"}`)) + "." + parts[1] + ".",
+		"wrong key":        signToken(t, other, "key-1", "RS256", claims),
+		"tampered claims":  parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"user_admin"}`)) + "." + parts[2],
+		"malformed":        "not-a-token",
+		"unknown key":      signToken(t, key, "key-unknown", "RS256", claims),
+		"empty signature":  parts[0] + "." + parts[1] + ".",
+		"extra segment":    valid + ".x",
+		"undecodable body": parts[0] + ".!!!." + parts[2],
+	}
+	for name, token := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := v.Verify(token); err == nil {
+				t.Error("token was accepted")
+			}
+		})
+	}
+
+	// Only RS256 tokens are worth fetching keys for
+	fetches := jwks.fetchCount()
+	clock.Advance(2 * jwksRefreshInterval)
+	if _, err := v.Verify(signToken(t, key, "key-1", "HS256", claims)); err == nil {
+		t.Error("HS256 token was accepted")
+	}
+	if jwks.fetchCount() != fetches {
+		t.Error("a token with an unsupported alg fetched the JWKS")
+	}
+}
+
+func TestJWTVerifierRefetchesForUnknownKeys(t *testing.T) {
+	jwks := newTestJWKS(t)
+	key := jwks.addKey(t, "key-1")
+	v, clock := newTestVerifier(jwks)
+
+	if _, err := v.Verify(signToken(t, key, "key-1", "RS256", validClaims(clock.Now()))); err != nil {
+		t.Fatal(err)
+	}
+	if got := jwks.fetchCount(); got != 1 {
+		t.Fatalf("fetched the JWKS %d times, want 1", got)
+	}
+
+	// Keys are cached
+	clock.Advance(time.Minute)
+	if _, err := v.Verify(signToken(t, key, "key-1", "RS256", validClaims(clock.Now()))); err != nil {
+		t.Fatal(err)
+	}
+	if got := jwks.fetchCount(); got != 1 {
+		t.Errorf("fetched the JWKS %d times for a cached key, want 1", got)
+	}
+
+	// A rotated-in key is found by refetching
+	rotated := jwks.addKey(t, "key-2")
+	clock.Advance(time.Second)
+	if _, err := v.Verify(signToken(t, rotated, "key-2", "RS256", validClaims(clock.Now()))); err != nil {
+		t.Fatalf("rotated key: %v", err)
+	}
+	if got := jwks.fetchCount(); got != 2 {
+		t.Errorf("fetched the JWKS %d times, want 2", got)
+	}
+
+	// Unknown key IDs refetch at most once per jwksMinRefetchInterval
+	for i := range 10 {
+		clock.Advance(time.Second)
+		token := signToken(t, key, "garbage-"+string(rune('a'+i)), "RS256", validClaims(clock.Now()))
+		if _, err := v.Verify(token); err == nil || !strings.Contains(err.Error(), "unknown signing key") {
+			t.Fatalf("got %v, want unknown signing key", err)
+		}
+	}
+	if got := jwks.fetchCount(); got != 2 {
+		t.Errorf("unknown keys fetched the JWKS %d times within the refetch interval, want 2 in all", got)
+	}
+
+	clock.Advance(jwksMinRefetchInterval)
+	v.Verify(signToken(t, key, "garbage-z", "RS256", validClaims(clock.Now())))
+	if got := jwks.fetchCount(); got != 3 {
+		t.Errorf("fetched the JWKS %d times after the refetch interval, want 3", got)
+	}
+}
+
+func TestJWTVerifierKeepsStaleKeysWhenJWKSIsDown(t *testing.T) {
+	jwks := newTestJWKS(t)
+	key := jwks.addKey(t, "key-1")
+	v, clock := newTestVerifier(jwks)
+
+	if _, err := v.Verify(signToken(t, key, "key-1", "RS256", validClaims(clock.Now()))); err != nil {
+		t.Fatal(err)
+	}
+
+	// The cached keys are stale, so the verifier tries the endpoint and
+	// falls back to them
+	jwks.setDown(true)
+	clock.Advance(jwksRefreshInterval + time.Minute)
+	if _, err := v.Verify(signToken(t, key, "key-1", "RS256", validClaims(clock.Now()))); err != nil {
+		t.Fatalf("stale key was not used while the JWKS was down: %v", err)
+	}
+	if got := jwks.fetchCount(); got != 2 {
+		t.Errorf("fetched the JWKS %d times, want 2", got)
+	}
+
+	// Further requests use the stale keys without refetching
+	for range 10 {
+		clock.Advance(time.Second)
+		if _, err := v.Verify(signToken(t, key, "key-1", "RS256", validClaims(clock.Now()))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := jwks.fetchCount(); got != 2 {
+		t.Errorf("fetched the JWKS %d times while it was down, want 2", got)
+	}
+
+	// Keys it never had can't be verified
+	clock.Advance(jwksMinRefetchInterval)
+	_, err := v.Verify(signToken(t, key, "key-2", "RS256", validClaims(clock.Now())))
+	if err == nil || !strings.Contains(err.Error(), "fetch signing keys") {
+		t.Errorf("got %v, want a fetch error", err)
+	}
+
+	// Once the endpoint is back, the keys are refreshed
+	jwks.setDown(false)
+	clock.Advance(jwksMinRefetchInterval + time.Second)
+	if _, err := v.Verify(signToken(t, key, "key-1", "RS256", validClaims(clock.Now()))); err != nil {
+		t.Fatal(err)
+	}
+	if got := jwks.fetchCount(); got != 4 {
+		t.Errorf("fetched the JWKS %d times, want 4", got)
+	}
+}
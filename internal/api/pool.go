@@ -0,0 +1,342 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/izalutski/catty/internal/protocol"
+	"github.com/izalutski/catty/internal/provider"
+)
+
+const (
+	// poolRefillInterval is how often the pool is topped up and checked for stale images.
+	poolRefillInterval = 30 * time.Second
+
+	// poolMetadataKey marks machines created by the warm pool.
+	poolMetadataKey = "pool"
+
+	// poolOwnerMetadataKey names the API instance whose pool a machine is
+	// in. Several instances share the machine provider, and each only
+	// removes its own leftovers.
+	poolOwnerMetadataKey = "pool_owner"
+
+	// poolCreatedMetadataKey records when a pool machine was created, in
+	// RFC 3339.
+	poolCreatedMetadataKey = "pool_created"
+
+	// poolMaxIdleAge is how long an instance keeps an idle machine before
+	// replacing it.
+	poolMaxIdleAge = 12 * time.Hour
+
+	// poolOrphanAge is how old another instance's idle machine must be to
+	// be removed as left behind. Live instances replace theirs well before.
+	poolOrphanAge = 2 * poolMaxIdleAge
+
+	// poolReapInterval is how often idle machines of other instances are
+	// checked for orphans.
+	poolReapInterval = time.Hour
+)
+
+// pooledMachine is an idle, started executor waiting to be claimed.
+type pooledMachine struct {
+	machineID      string
+	region         string
+	image          string
+	configureToken string
+	createdAt      time.Time
+}
+
+// WarmPool keeps a number of started, unconfigured executor machines per
+// region so that new sessions skip the cold start. Pool machines have the
+// default session size, 1 CPU and 1024 MB; sessions of other sizes always
+// start a new machine.
+type WarmPool struct {
+	machines provider.Provider
+	size     int
+	regions  []string
+	cpus     int
+	memoryMB int
+	owner    string
+
+	mu     sync.Mutex
+	idle   map[string][]*pooledMachine
+	refill chan struct{}
+}
+
+// NewWarmPool creates a warm pool from environment variables:
+//   - CATTY_POOL_SIZE: idle machines to keep per region (0 disables the pool)
+//   - CATTY_POOL_REGIONS: comma-separated regions (defaults to iad)
+//   - CATTY_POOL_OWNER: ID of this instance's pool, which must stay the
+//     same across restarts (defaults to FLY_MACHINE_ID, then the hostname)
+//
+// Returns nil if the pool is disabled.
+func NewWarmPool(machines provider.Provider) (*WarmPool, error) {
+	sizeStr := os.Getenv("CATTY_POOL_SIZE")
+	if sizeStr == "" {
+		return nil, nil
+	}
+	size, err := strconv.Atoi(sizeStr)
+	if err != nil || size < 0 {
+		return nil, fmt.Errorf("invalid CATTY_POOL_SIZE: %q", sizeStr)
+	}
+	if size == 0 {
+		return nil, nil
+	}
+
+	regions := []string{"iad"}
+	if r := os.Getenv("CATTY_POOL_REGIONS"); r != "" {
+		regions = nil
+		for _, region := range strings.Split(r, ",") {
+			if region = strings.TrimSpace(region); region != "" {
+				regions = append(regions, region)
+			}
+		}
+	}
+
+	owner := os.Getenv("CATTY_POOL_OWNER")
+	if owner == "" {
+		owner = os.Getenv("FLY_MACHINE_ID")
+	}
+	if owner == "" {
+		if owner, err = os.Hostname(); err != nil {
+			return nil, fmt.Errorf("pool owner: %w", err)
+		}
+	}
+
+	return &WarmPool{
+		machines: machines,
+		size:     size,
+		regions:  regions,
+		cpus:     1,
+		memoryMB: 1024,
+		owner:    owner,
+		idle:     make(map[string][]*pooledMachine),
+		refill:   make(chan struct{}, 1),
+	}, nil
+}
+
+// Start removes pool machines left over from this instance's previous run
+// and starts the background refill loop. Other instances' pools are left
+// alone until their machines are old enough to be orphans.
+func (p *WarmPool) Start() {
+	// Configure tokens of leftover machines are lost on restart, so they can't be claimed
+	leftovers, err := p.machines.ListMachines(map[string]string{
+		poolMetadataKey:      "idle",
+		poolOwnerMetadataKey: p.owner,
+	})
+	if err != nil {
+		fmt.Printf("warning: pool: failed to list leftover machines: %v\n", err)
+	}
+	for _, m := range leftovers {
+		if err := p.machines.DeleteMachine(m.ID, true); err != nil {
+			fmt.Printf("warning: pool: failed to delete leftover machine %s: %v\n", m.ID, err)
+		}
+	}
+
+	go p.loop()
+}
+
+// loop refills the pool periodically and whenever a machine is claimed,
+// and removes orphaned machines now and then.
+func (p *WarmPool) loop() {
+	ticker := time.NewTicker(poolRefillInterval)
+	defer ticker.Stop()
+	reap := time.NewTicker(poolReapInterval)
+	defer reap.Stop()
+
+	p.reapOrphans()
+	p.fill()
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.refill:
+		case <-reap.C:
+			p.reapOrphans()
+		}
+		p.fill()
+	}
+}
+
+// reapOrphans removes idle machines of other instances that are older than
+// poolOrphanAge, such as those of a destroyed API machine. Machines without
+// a creation time predate it and are treated as orphans too.
+func (p *WarmPool) reapOrphans() {
+	idle, err := p.machines.ListMachines(map[string]string{poolMetadataKey: "idle"})
+	if err != nil {
+		fmt.Printf("warning: pool: failed to list idle machines: %v\n", err)
+		return
+	}
+	for _, m := range idle {
+		if m.Metadata[poolOwnerMetadataKey] == p.owner {
+			continue
+		}
+		created, err := time.Parse(time.RFC3339, m.Metadata[poolCreatedMetadataKey])
+		if err == nil && time.Since(created) < poolOrphanAge {
+			continue
+		}
+		if err := p.machines.DeleteMachine(m.ID, true); err != nil {
+			fmt.Printf("warning: pool: failed to delete orphaned machine %s: %v\n", m.ID, err)
+		}
+	}
+}
+
+// fill evicts machines running an outdated image or idle for longer than
+// poolMaxIdleAge, and tops up every region.
+func (p *WarmPool) fill() {
+	image, err := p.machines.CurrentImage()
+	if err != nil {
+		fmt.Printf("warning: pool: failed to get executor image: %v\n", err)
+		return
+	}
+
+	for _, region := range p.regions {
+		// Evict machines from a previous deploy, and old ones so that other
+		// instances never mistake them for orphans
+		p.mu.Lock()
+		var stale []*pooledMachine
+		fresh := p.idle[region][:0]
+		for _, m := range p.idle[region] {
+			if m.image == image && time.Since(m.createdAt) < poolMaxIdleAge {
+				fresh = append(fresh, m)
+			} else {
+				stale = append(stale, m)
+			}
+		}
+		p.idle[region] = fresh
+		missing := p.size - len(fresh)
+		p.mu.Unlock()
+
+		for _, m := range stale {
+			if err := p.machines.DeleteMachine(m.machineID, true); err != nil {
+				fmt.Printf("warning: pool: failed to delete stale machine %s: %v\n", m.machineID, err)
+			}
+		}
+
+		for i := 0; i < missing; i++ {
+			m, err := p.startMachine(region, image)
+			if err != nil {
+				fmt.Printf("warning: pool: failed to start machine in %s: %v\n", region, err)
+				break
+			}
+			p.mu.Lock()
+			p.idle[region] = append(p.idle[region], m)
+			p.mu.Unlock()
+		}
+	}
+}
+
+// startMachine creates an unconfigured executor and waits until it is ready.
+func (p *WarmPool) startMachine(region, image string) (*pooledMachine, error) {
+	configureToken, err := generateToken(32)
+	if err != nil {
+		return nil, fmt.Errorf("generate token: %w", err)
+	}
+
+	env := map[string]string{
+		"CATTY_CONFIGURE_TOKEN": configureToken,
+	}
+	createdAt := time.Now()
+	metadata := map[string]string{
+		"project":              "catty",
+		poolMetadataKey:        "idle",
+		poolOwnerMetadataKey:   p.owner,
+		poolCreatedMetadataKey: createdAt.UTC().Format(time.RFC3339),
+	}
+
+	machine, err := p.machines.CreateMachine(&provider.CreateRequest{
+		Region:   region,
+		Image:    image,
+		Env:      env,
+		CPUs:     p.cpus,
+		MemoryMB: p.memoryMB,
+		Metadata: metadata,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create machine: %w", err)
+	}
+
+	if err := p.machines.WaitMachine(context.Background(), machine.ID, provider.StateStarted, 60*time.Second); err != nil {
+		p.machines.DeleteMachine(machine.ID, true)
+		return nil, fmt.Errorf("wait for machine: %w", err)
+	}
+
+	if err := waitExecutorReady(context.Background(), p.machines.Endpoint(machine.ID), 30*time.Second); err != nil {
+		p.machines.DeleteMachine(machine.ID, true)
+		return nil, fmt.Errorf("wait for executor: %w", err)
+	}
+
+	return &pooledMachine{
+		machineID:      machine.ID,
+		region:         machine.Region,
+		image:          image,
+		configureToken: configureToken,
+		createdAt:      createdAt,
+	}, nil
+}
+
+// Claim takes an idle machine for the given region and size, or returns nil
+// if none is available. Only the pool's own size is ever available. Safe to
+// call on a nil pool.
+func (p *WarmPool) Claim(region string, cpus, memoryMB int) *pooledMachine {
+	if p == nil || cpus != p.cpus || memoryMB != p.memoryMB {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	idle := p.idle[region]
+	if len(idle) == 0 {
+		return nil
+	}
+	m := idle[0]
+	p.idle[region] = idle[1:]
+
+	// Top up in the background
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+
+	return m
+}
+
+// configureExecutor assigns a pooled executor to a session.
+func configureExecutor(endpoint *provider.Endpoint, configureToken string, req *protocol.ConfigureRequest) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPost, endpoint.BaseURL+"/configure", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Authorization", "Bearer "+configureToken)
+	for k, v := range endpoint.Headers {
+		httpReq.Header.Set(k, v)
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("configure failed (%d): %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"maps"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/izalutski/catty/internal/provider"
+)
+
+// poolMachines is a provider that only lists and deletes machines.
+type poolMachines struct {
+	provider.Provider
+
+	mu       sync.Mutex
+	machines map[string]*provider.Machine
+}
+
+func (f *poolMachines) ListMachines(metadata map[string]string) ([]*provider.Machine, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var list []*provider.Machine
+	for _, m := range f.machines {
+		match := true
+		for k, v := range metadata {
+			match = match && m.Metadata[k] == v
+		}
+		if match {
+			list = append(list, m)
+		}
+	}
+	return list, nil
+}
+
+func (f *poolMachines) DeleteMachine(machineID string, force bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.machines, machineID)
+	return nil
+}
+
+func TestWarmPoolReapsOrphans(t *testing.T) {
+	created := func(age time.Duration) string {
+		return time.Now().Add(-age).UTC().Format(time.RFC3339)
+	}
+	machine := func(pool, owner, createdAt string) *provider.Machine {
+		md := map[string]string{poolMetadataKey: pool, poolOwnerMetadataKey: owner}
+		if createdAt != "" {
+			md[poolCreatedMetadataKey] = createdAt
+		}
+		return &provider.Machine{Metadata: md}
+	}
+	machines := map[string]*provider.Machine{
+		"own_old":       machine("idle", "api_1", created(48*time.Hour)),
+		"other_new":     machine("idle", "api_2", created(time.Hour)),
+		"other_old":     machine("idle", "api_2", created(48*time.Hour)),
+		"other_untimed": machine("idle", "api_2", ""),
+		"claimed_old":   machine("claimed", "api_2", created(48*time.Hour)),
+	}
+	for id, m := range machines {
+		m.ID = id
+	}
+	fake := &poolMachines{machines: machines}
+	pool := &WarmPool{machines: fake, owner: "api_1"}
+
+	pool.reapOrphans()
+
+	got := slices.Sorted(maps.Keys(fake.machines))
+	want := []string{"claimed_old", "other_new", "own_old"}
+	if !slices.Equal(got, want) {
+		t.Errorf("machines left %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,247 @@
+package api
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/izalutski/catty/internal/db"
+)
+
+// maxSecretValueBytes limits the size of a single secret.
+const maxSecretValueBytes = 16 * 1024
+
+// SetSecretRequest is the request body for setting a secret.
+type SetSecretRequest struct {
+	Value string `json:"value"`
+}
+
+// SecretResponse describes a secret without its value. Values can't be
+// read back through the API; they are only injected into sessions.
+type SecretResponse struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// SecretBox encrypts secrets at rest with AES-256-GCM. Each ciphertext is
+// bound to its owner and name, so it can't be moved to another user or
+// variable in the database.
+type SecretBox struct {
+	aead cipher.AEAD
+}
+
+// NewSecretBox creates a SecretBox from a 32-byte key.
+func NewSecretBox(key []byte) (*SecretBox, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("secrets key must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &SecretBox{aead: aead}, nil
+}
+
+// NewSecretBoxFromEnv creates a SecretBox from the base64-encoded key in
+// CATTY_SECRETS_KEY. Returns nil if the variable is not set, which
+// disables secrets.
+func NewSecretBoxFromEnv() (*SecretBox, error) {
+	encoded := os.Getenv("CATTY_SECRETS_KEY")
+	if encoded == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("CATTY_SECRETS_KEY is not valid base64: %w", err)
+	}
+	return NewSecretBox(key)
+}
+
+// Seal encrypts a secret value. The nonce is prepended to the ciphertext.
+func (b *SecretBox) Seal(userID, name, value string) ([]byte, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return b.aead.Seal(nonce, nonce, []byte(value), secretAD(userID, name)), nil
+}
+
+// Open decrypts a value sealed by Seal.
+func (b *SecretBox) Open(userID, name string, ciphertext []byte) (string, error) {
+	n := b.aead.NonceSize()
+	if len(ciphertext) < n {
+		return "", fmt.Errorf("ciphertext too short")
+	}
+	plaintext, err := b.aead.Open(nil, ciphertext[:n], ciphertext[n:], secretAD(userID, name))
+	if err != nil {
+		return "", fmt.Errorf("decrypt secret %s: %w", name, err)
+	}
+	return string(plaintext), nil
+}
+
+// secretAD is the additional data that binds a ciphertext to its owner and name.
+func secretAD(userID, name string) []byte {
+	return []byte(userID + "\x00" + name)
+}
+
+// userSecrets decrypts all of a user's secrets into an env map.
+func (h *Handlers) userSecrets(userID string) (map[string]string, error) {
+	if h.secrets == nil {
+		return nil, nil
+	}
+	secrets, err := h.db.ListUserSecrets(userID)
+	if err != nil {
+		return nil, err
+	}
+	env := make(map[string]string, len(secrets))
+	for _, s := range secrets {
+		value, err := h.secrets.Open(userID, s.Name, s.Ciphertext)
+		if err != nil {
+			return nil, err
+		}
+		env[s.Name] = value
+	}
+	return env, nil
+}
+
+// SetSecret handles PUT /v1/secrets/{name}.
+func (h *Handlers) SetSecret(w http.ResponseWriter, r *http.Request) {
+	if h.secrets == nil {
+		writeError(w, http.StatusServiceUnavailable, "secrets are not configured on this server")
+		return
+	}
+
+	name := chi.URLParam(r, "name")
+	if err := validateEnvName(name); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var req SetSecretRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+	if req.Value == "" {
+		writeError(w, http.StatusBadRequest, "value is required")
+		return
+	}
+	if len(req.Value) > maxSecretValueBytes {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("value too large (max %d bytes)", maxSecretValueBytes))
+		return
+	}
+
+	// Get authenticated user from context
+	authUser := UserFromContext(r.Context())
+	if authUser == nil {
+		writeError(w, http.StatusUnauthorized, "user not found in context")
+		return
+	}
+
+	// Get or create user in database
+	dbUser, err := h.db.GetOrCreateUser(authUser.ID, authUser.Email)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to get/create user: "+err.Error())
+		return
+	}
+
+	existing, err := h.db.ListUserSecrets(dbUser.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to list secrets: "+err.Error())
+		return
+	}
+	if len(existing) >= maxSessionEnvVars && !hasSecret(existing, name) {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("too many secrets (max %d)", maxSessionEnvVars))
+		return
+	}
+
+	ciphertext, err := h.secrets.Seal(dbUser.ID, name, req.Value)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to encrypt secret")
+		return
+	}
+	if err := h.db.SetSecret(dbUser.ID, name, ciphertext); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to save secret: "+err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "saved"})
+}
+
+// ListSecrets handles GET /v1/secrets.
+func (h *Handlers) ListSecrets(w http.ResponseWriter, r *http.Request) {
+	// Get authenticated user from context
+	authUser := UserFromContext(r.Context())
+	if authUser == nil {
+		writeError(w, http.StatusUnauthorized, "user not found in context")
+		return
+	}
+
+	// Get user from database
+	dbUser, err := h.db.GetUserByWorkosID(authUser.ID)
+	if err != nil {
+		// User doesn't exist yet, return empty list
+		writeJSON(w, http.StatusOK, []SecretResponse{})
+		return
+	}
+
+	secrets, err := h.db.ListUserSecrets(dbUser.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to list secrets: "+err.Error())
+		return
+	}
+
+	resp := make([]SecretResponse, 0, len(secrets))
+	for _, s := range secrets {
+		resp = append(resp, SecretResponse{Name: s.Name, CreatedAt: s.CreatedAt, UpdatedAt: s.UpdatedAt})
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// DeleteSecret handles DELETE /v1/secrets/{name}.
+func (h *Handlers) DeleteSecret(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	// Get authenticated user from context
+	authUser := UserFromContext(r.Context())
+	if authUser == nil {
+		writeError(w, http.StatusUnauthorized, "user not found in context")
+		return
+	}
+
+	// Get user from database
+	dbUser, err := h.db.GetUserByWorkosID(authUser.ID)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "user not found")
+		return
+	}
+
+	if err := h.db.DeleteSecret(dbUser.ID, name); err != nil {
+		writeError(w, http.StatusNotFound, "secret not found")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+}
+
+func hasSecret(secrets []db.Secret, name string) bool {
+	for _, s := range secrets {
+		if s.Name == name {
+			return true
+		}
+	}
+	return false
+}
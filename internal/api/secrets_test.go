@@ -0,0 +1,48 @@
+package api
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/izalutski/catty/internal/db"
+)
+
+func TestSecretsRoundTrip(t *testing.T) {
+	box, err := NewSecretBox(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := db.NewMemoryStore()
+	user, err := store.GetOrCreateUser("user_test", "test@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandlers(nil, store, nil, "", box)
+
+	sealed, err := box.Seal(user.ID, "GITHUB_TOKEN", "ghp_secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, []byte("ghp_secret")) {
+		t.Fatal("sealed secret contains its value")
+	}
+	if err := store.SetSecret(user.ID, "GITHUB_TOKEN", sealed); err != nil {
+		t.Fatal(err)
+	}
+
+	env, err := h.userSecrets(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(env) != 1 || env["GITHUB_TOKEN"] != "ghp_secret" {
+		t.Errorf("userSecrets = %v, want GITHUB_TOKEN=ghp_secret", env)
+	}
+
+	// A ciphertext only opens for the user and name it was sealed for
+	if _, err := box.Open("user_other", "GITHUB_TOKEN", sealed); err == nil {
+		t.Error("opened a secret as another user")
+	}
+	if _, err := box.Open(user.ID, "OTHER_NAME", sealed); err == nil {
+		t.Error("opened a secret under another name")
+	}
+}
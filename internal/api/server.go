@@ -14,6 +14,8 @@ import (
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/izalutski/catty/internal/db"
 	"github.com/izalutski/catty/internal/fly"
+	"github.com/izalutski/catty/internal/local"
+	"github.com/izalutski/catty/internal/provider"
 )
 
 // Server is the API server.
@@ -23,16 +25,36 @@ type Server struct {
 	httpServer *http.Server
 }
 
-// NewServer creates a new API server.
+// Config holds the dependencies of the API server.
+type Config struct {
+	// Machines runs executor machines.
+	Machines provider.Provider
+	// Store persists users, sessions and usage.
+	Store db.Store
+	// Auth authenticates requests.
+	Auth AuthProvider
+	// Billing is optional; billing routes are only mounted if set.
+	Billing *BillingHandlers
+	// Pool is optional; sessions cold start if nil.
+	Pool *WarmPool
+	// ProxyURL is the base URL of the metering proxy. If empty, agents talk
+	// to Anthropic directly.
+	ProxyURL string
+	// Secrets encrypts users' stored secrets. Optional; the secrets
+	// endpoints are unavailable if nil.
+	Secrets *SecretBox
+}
+
+// NewServer creates a new API server configured from environment variables.
 func NewServer(addr string) (*Server, error) {
-	// Initialize Fly client
-	flyClient, err := fly.NewClient()
+	// Initialize machine provider
+	machines, err := newProvider()
 	if err != nil {
-		return nil, fmt.Errorf("create fly client: %w", err)
+		return nil, fmt.Errorf("create machine provider: %w", err)
 	}
 
-	// Initialize database client
-	dbClient, err := db.NewClient()
+	// Initialize store
+	store, err := db.Open()
 	if err != nil {
 		return nil, fmt.Errorf("create database client: %w", err)
 	}
@@ -46,14 +68,52 @@ func NewServer(addr string) (*Server, error) {
 	// Initialize billing handlers (optional - only if Stripe is configured)
 	var billingHandlers *BillingHandlers
 	if os.Getenv("STRIPE_SECRET_KEY") != "" {
-		billingHandlers, err = NewBillingHandlers(dbClient)
+		billingHandlers, err = NewBillingHandlers(store)
 		if err != nil {
 			return nil, fmt.Errorf("create billing handlers: %w", err)
 		}
 	}
 
+	// Initialize warm pool (optional - only if CATTY_POOL_SIZE is set)
+	pool, err := NewWarmPool(machines)
+	if err != nil {
+		return nil, fmt.Errorf("create warm pool: %w", err)
+	}
+	if pool != nil {
+		pool.Start()
+	}
+
+	// Initialize secrets encryption (optional - only if CATTY_SECRETS_KEY is set)
+	secrets, err := NewSecretBoxFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("create secrets box: %w", err)
+	}
+
+	// Route agents through the metering proxy if configured
+	proxyURL := ""
+	if proxyHost := os.Getenv("CATTY_PROXY_HOST"); proxyHost != "" {
+		proxyURL = "https://" + proxyHost
+	}
+
+	return NewServerWithConfig(addr, &Config{
+		Machines: machines,
+		Store:    store,
+		Auth:     authHandlers,
+		Billing:  billingHandlers,
+		Pool:     pool,
+		ProxyURL: proxyURL,
+		Secrets:  secrets,
+	}), nil
+}
+
+// NewServerWithConfig creates an API server from explicit dependencies.
+func NewServerWithConfig(addr string, cfg *Config) *Server {
+	// Personal access tokens are accepted alongside the provider's tokens
+	authHandlers := NewTokenAuth(cfg.Auth, cfg.Store)
+	billingHandlers := cfg.Billing
+
 	// Create handlers
-	handlers := NewHandlers(flyClient, dbClient)
+	handlers := NewHandlers(cfg.Machines, cfg.Store, cfg.Pool, cfg.ProxyURL, cfg.Secrets)
 
 	// Setup router
 	r := chi.NewRouter()
@@ -61,34 +121,65 @@ func NewServer(addr string) (*Server, error) {
 	// Middleware
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
-	r.Use(middleware.Timeout(60 * time.Second))
 
 	// Routes
 	r.Route("/v1", func(r chi.Router) {
-		// Auth endpoints (public)
-		r.Post("/auth/device", authHandlers.StartDeviceAuth)
-		r.Post("/auth/device/token", authHandlers.PollDeviceToken)
+		// Provisioning event stream is long-lived, so it sits outside the request timeout
+		r.Group(func(r chi.Router) {
+			r.Use(authHandlers.AuthMiddleware)
+			r.With(RequireScope(ScopeSessionsRead)).Get("/sessions/{session_id}/events", handlers.SessionEvents)
+		})
+
+		r.Group(func(r chi.Router) {
+			r.Use(middleware.Timeout(60 * time.Second))
+
+			// Auth endpoints (public)
+			r.Post("/auth/device", authHandlers.StartDeviceAuth)
+			r.Post("/auth/device/token", authHandlers.PollDeviceToken)
+			r.Post("/auth/refresh", authHandlers.RefreshToken)
+			r.Post("/auth/logout", authHandlers.Logout)
+
+			// Billing endpoints (if configured)
+			if billingHandlers != nil {
+				// Webhook is public (verified by signature)
+				r.Post("/billing/webhook", billingHandlers.HandleStripeWebhook)
 
-		// Billing endpoints (if configured)
-		if billingHandlers != nil {
-			// Webhook is public (verified by signature)
-			r.Post("/billing/webhook", billingHandlers.HandleStripeWebhook)
+				// Checkout requires auth - supports both GET (redirect) and POST (JSON)
+				r.Group(func(r chi.Router) {
+					r.Use(authHandlers.AuthMiddleware)
+					r.Use(RequireScope(ScopeBilling))
+					r.Get("/billing/checkout", billingHandlers.CreateCheckoutSession)
+					r.Post("/billing/checkout", billingHandlers.CreateCheckoutSession)
+				})
+			}
 
-			// Checkout requires auth - supports both GET (redirect) and POST (JSON)
+			// Protected session endpoints
 			r.Group(func(r chi.Router) {
 				r.Use(authHandlers.AuthMiddleware)
-				r.Get("/billing/checkout", billingHandlers.CreateCheckoutSession)
-				r.Post("/billing/checkout", billingHandlers.CreateCheckoutSession)
+				r.With(RequireScope(ScopeSessionsWrite)).Post("/sessions", handlers.CreateSession)
+				r.With(RequireScope(ScopeSessionsRead)).Get("/sessions", handlers.ListSessions)
+				r.With(RequireScope(ScopeSessionsRead)).Get("/sessions/{session_id}", handlers.GetSession)
+				r.With(RequireScope(ScopeSessionsWrite)).Post("/sessions/{session_id}/stop", handlers.StopSession)
+				r.With(RequireScope(ScopeSessionsRead)).Get("/usage", handlers.GetUsage)
 			})
-		}
 
-		// Protected session endpoints
-		r.Group(func(r chi.Router) {
-			r.Use(authHandlers.AuthMiddleware)
-			r.Post("/sessions", handlers.CreateSession)
-			r.Get("/sessions", handlers.ListSessions)
-			r.Get("/sessions/{session_id}", handlers.GetSession)
-			r.Post("/sessions/{session_id}/stop", handlers.StopSession)
+			// Personal access tokens
+			r.Group(func(r chi.Router) {
+				r.Use(authHandlers.AuthMiddleware)
+				r.Use(RequireScope(ScopeTokensWrite))
+				r.Post("/tokens", handlers.CreateToken)
+				r.Get("/tokens", handlers.ListTokens)
+				r.Delete("/tokens/{token_id}", handlers.RevokeToken)
+			})
+
+			// Secrets injected into sessions
+			r.Group(func(r chi.Router) {
+				r.Use(authHandlers.AuthMiddleware)
+				r.Use(RequireScope(ScopeSecrets))
+				r.Get("/secrets", handlers.ListSecrets)
+				r.Put("/secrets/{name}", handlers.SetSecret)
+				r.Delete("/secrets/{name}", handlers.DeleteSecret)
+			})
 		})
 	})
 
@@ -104,10 +195,38 @@ func NewServer(addr string) (*Server, error) {
 		w.Write([]byte("ok"))
 	})
 
+	// Stub auth serves its own verification page
+	if stub, ok := cfg.Auth.(*StubAuth); ok {
+		r.Get("/v1/auth/device/verify", stub.VerifyPage)
+	}
+
 	return &Server{
 		addr:   addr,
 		router: r,
-	}, nil
+	}
+}
+
+// Handler returns the HTTP handler for the server.
+func (s *Server) Handler() http.Handler {
+	return s.router
+}
+
+// newProvider creates the machine provider selected by CATTY_PROVIDER:
+// "fly" (default) runs executors as Fly Machines, "local" runs them as
+// processes on this host.
+func newProvider() (provider.Provider, error) {
+	switch name := os.Getenv("CATTY_PROVIDER"); name {
+	case "", "fly":
+		flyClient, err := fly.NewClient()
+		if err != nil {
+			return nil, fmt.Errorf("create fly client: %w", err)
+		}
+		return fly.NewProvider(flyClient), nil
+	case "local":
+		return local.NewProvider()
+	default:
+		return nil, fmt.Errorf("unknown CATTY_PROVIDER: %s (must be 'fly' or 'local')", name)
+	}
 }
 
 // Run starts the server and blocks until shutdown.
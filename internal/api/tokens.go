@@ -0,0 +1,304 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/izalutski/catty/internal/db"
+)
+
+// apiTokenPrefix marks personal access tokens so the middleware can tell
+// them apart from WorkOS access tokens without a database lookup.
+const apiTokenPrefix = "catty_pat_"
+
+// Scopes a personal access token can be granted.
+const (
+	ScopeSessionsRead  = "sessions:read"
+	ScopeSessionsWrite = "sessions:write"
+	ScopeTokensWrite   = "tokens:write"
+	ScopeBilling       = "billing"
+	ScopeSecrets       = "secrets"
+)
+
+var validScopes = map[string]bool{
+	ScopeSessionsRead:  true,
+	ScopeSessionsWrite: true,
+	ScopeTokensWrite:   true,
+	ScopeBilling:       true,
+	ScopeSecrets:       true,
+}
+
+// defaultTokenScopes are granted when a token is created without scopes.
+var defaultTokenScopes = []string{ScopeSessionsRead, ScopeSessionsWrite}
+
+// CreateTokenRequest is the request body for creating a personal access token.
+type CreateTokenRequest struct {
+	Name         string   `json:"name"`
+	Scopes       []string `json:"scopes"`
+	ExpiresInSec int      `json:"expires_in_sec"` // 0 means the token never expires
+}
+
+// TokenResponse describes a personal access token without its secret.
+type TokenResponse struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Prefix    string     `json:"prefix"`
+	Scopes    []string   `json:"scopes"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// CreateTokenResponse is returned once, when a token is created.
+// The secret cannot be retrieved again.
+type CreateTokenResponse struct {
+	TokenResponse
+	Token string `json:"token"`
+}
+
+// TokenAuth wraps an AuthProvider so that personal access tokens are
+// accepted alongside the provider's own tokens.
+type TokenAuth struct {
+	AuthProvider
+	db db.Store
+}
+
+var _ AuthProvider = (*TokenAuth)(nil)
+
+// NewTokenAuth wraps auth to also accept personal access tokens from store.
+func NewTokenAuth(auth AuthProvider, store db.Store) *TokenAuth {
+	return &TokenAuth{
+		AuthProvider: auth,
+		db:           store,
+	}
+}
+
+// AuthMiddleware authenticates personal access tokens itself and passes
+// everything else to the wrapped provider.
+func (a *TokenAuth) AuthMiddleware(next http.Handler) http.Handler {
+	fallback := a.AuthProvider.AuthMiddleware(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := extractBearerToken(r)
+		if !strings.HasPrefix(token, apiTokenPrefix) {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+
+		apiToken, user, err := a.validateAPIToken(token)
+		if err != nil {
+			writeError(w, http.StatusUnauthorized, "invalid token: "+err.Error())
+			return
+		}
+
+		ctx := WithUser(r.Context(), user)
+		ctx = withScopes(ctx, apiToken.Scopes)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// validateAPIToken looks up a personal access token and its owner.
+func (a *TokenAuth) validateAPIToken(token string) (*db.APIToken, *User, error) {
+	apiToken, err := a.db.GetAPITokenByHash(db.HashToken(token))
+	if err != nil {
+		return nil, nil, fmt.Errorf("unknown token")
+	}
+	if !apiToken.Active() {
+		return nil, nil, fmt.Errorf("token revoked or expired")
+	}
+
+	dbUser, err := a.db.GetUserByID(apiToken.UserID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("token owner not found")
+	}
+
+	// Handlers identify users by WorkOS ID, as with interactive logins
+	return apiToken, &User{ID: dbUser.WorkosID, Email: dbUser.Email}, nil
+}
+
+const scopesContextKey contextKey = "scopes"
+
+// withScopes restricts the request to the given scopes.
+func withScopes(ctx context.Context, scopes []string) context.Context {
+	return context.WithValue(ctx, scopesContextKey, scopes)
+}
+
+// hasScope reports whether the request may use scope. Interactive logins
+// carry no scopes and may do anything; sessions:write implies sessions:read.
+func hasScope(ctx context.Context, scope string) bool {
+	scopes, ok := ctx.Value(scopesContextKey).([]string)
+	if !ok {
+		return true
+	}
+	for _, s := range scopes {
+		if s == scope || (s == ScopeSessionsWrite && scope == ScopeSessionsRead) {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireScope returns middleware that rejects tokens lacking scope.
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !hasScope(r.Context(), scope) {
+				writeError(w, http.StatusForbidden, "token is missing scope: "+scope)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// CreateToken handles POST /v1/tokens.
+func (h *Handlers) CreateToken(w http.ResponseWriter, r *http.Request) {
+	var req CreateTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		writeError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+	if req.ExpiresInSec < 0 {
+		writeError(w, http.StatusBadRequest, "expires_in_sec must not be negative")
+		return
+	}
+	if len(req.Scopes) == 0 {
+		req.Scopes = defaultTokenScopes
+	}
+	for _, scope := range req.Scopes {
+		if !validScopes[scope] {
+			writeError(w, http.StatusBadRequest, "unknown scope: "+scope)
+			return
+		}
+		// A token can't be used to mint a more powerful one
+		if !hasScope(r.Context(), scope) {
+			writeError(w, http.StatusForbidden, "cannot grant scope not held by this token: "+scope)
+			return
+		}
+	}
+
+	// Get authenticated user from context
+	authUser := UserFromContext(r.Context())
+	if authUser == nil {
+		writeError(w, http.StatusUnauthorized, "user not found in context")
+		return
+	}
+
+	// Get or create user in database
+	dbUser, err := h.db.GetOrCreateUser(authUser.ID, authUser.Email)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to get/create user: "+err.Error())
+		return
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to generate token")
+		return
+	}
+	token := apiTokenPrefix + hex.EncodeToString(secret)
+
+	apiToken := &db.APIToken{
+		UserID: dbUser.ID,
+		Name:   req.Name,
+		Prefix: token[:len(apiTokenPrefix)+8],
+		Scopes: req.Scopes,
+	}
+	if req.ExpiresInSec > 0 {
+		expiresAt := time.Now().Add(time.Duration(req.ExpiresInSec) * time.Second)
+		apiToken.ExpiresAt = &expiresAt
+	}
+
+	saved, err := h.db.CreateAPIToken(apiToken, db.HashToken(token))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to save token: "+err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, &CreateTokenResponse{
+		TokenResponse: toTokenResponse(saved),
+		Token:         token,
+	})
+}
+
+// ListTokens handles GET /v1/tokens.
+func (h *Handlers) ListTokens(w http.ResponseWriter, r *http.Request) {
+	// Get authenticated user from context
+	authUser := UserFromContext(r.Context())
+	if authUser == nil {
+		writeError(w, http.StatusUnauthorized, "user not found in context")
+		return
+	}
+
+	// Get user from database
+	dbUser, err := h.db.GetUserByWorkosID(authUser.ID)
+	if err != nil {
+		// User doesn't exist yet, return empty list
+		writeJSON(w, http.StatusOK, []TokenResponse{})
+		return
+	}
+
+	tokens, err := h.db.ListUserAPITokens(dbUser.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to list tokens: "+err.Error())
+		return
+	}
+
+	resp := make([]TokenResponse, 0, len(tokens))
+	for i := range tokens {
+		if tokens[i].Active() {
+			resp = append(resp, toTokenResponse(&tokens[i]))
+		}
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// RevokeToken handles DELETE /v1/tokens/{token_id}.
+func (h *Handlers) RevokeToken(w http.ResponseWriter, r *http.Request) {
+	tokenID := chi.URLParam(r, "token_id")
+
+	// Get authenticated user from context
+	authUser := UserFromContext(r.Context())
+	if authUser == nil {
+		writeError(w, http.StatusUnauthorized, "user not found in context")
+		return
+	}
+
+	// Get user from database
+	dbUser, err := h.db.GetUserByWorkosID(authUser.ID)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "user not found")
+		return
+	}
+
+	if err := h.db.RevokeAPIToken(dbUser.ID, tokenID); err != nil {
+		writeError(w, http.StatusNotFound, "token not found")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "revoked"})
+}
+
+// toTokenResponse converts a stored token to its API representation.
+func toTokenResponse(t *db.APIToken) TokenResponse {
+	return TokenResponse{
+		ID:        t.ID,
+		Name:      t.Name,
+		Prefix:    t.Prefix,
+		Scopes:    t.Scopes,
+		CreatedAt: t.CreatedAt,
+		ExpiresAt: t.ExpiresAt,
+	}
+}
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/izalutski/catty/internal/db"
+)
+
+// tokenTest is an API server with stub auth and a memory store.
+type tokenTest struct {
+	server *Server
+	store  *db.MemoryStore
+}
+
+func newTokenTest(t *testing.T) *tokenTest {
+	t.Helper()
+	store := db.NewMemoryStore()
+	return &tokenTest{
+		server: NewServerWithConfig("", &Config{Store: store, Auth: NewStubAuth("dev@example.com")}),
+		store:  store,
+	}
+}
+
+// do sends a request authenticated with token and returns the response.
+func (tt *tokenTest) do(method, path, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	tt.server.router.ServeHTTP(rec, req)
+	return rec
+}
+
+// createToken creates a token with scopes as the interactive user.
+func (tt *tokenTest) createToken(t *testing.T, scopes ...string) *CreateTokenResponse {
+	t.Helper()
+	body, _ := json.Marshal(&CreateTokenRequest{Name: "test", Scopes: scopes})
+	rec := tt.do("POST", "/v1/tokens", "dev-token", string(body))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("creating a token got %d: %s", rec.Code, rec.Body)
+	}
+	var resp CreateTokenResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return &resp
+}
+
+func TestTokenScopes(t *testing.T) {
+	tt := newTokenTest(t)
+	reader := tt.createToken(t, ScopeSessionsRead)
+	minter := tt.createToken(t, ScopeTokensWrite, ScopeSessionsRead)
+
+	tests := []struct {
+		name   string
+		token  string
+		scopes string
+		want   int
+	}{
+		{"missing scope", reader.Token, `["sessions:read"]`, http.StatusForbidden},
+		{"escalation", minter.Token, `["sessions:write"]`, http.StatusForbidden},
+		{"escalation to billing", minter.Token, `["billing"]`, http.StatusForbidden},
+		{"held scopes", minter.Token, `["tokens:write","sessions:read"]`, http.StatusCreated},
+		{"interactive login", "dev-token", `["billing"]`, http.StatusCreated},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := tt.do("POST", "/v1/tokens", tc.token, `{"name":"new","scopes":`+tc.scopes+`}`)
+			if rec.Code != tc.want {
+				t.Errorf("got %d, want %d: %s", rec.Code, tc.want, rec.Body)
+			}
+		})
+	}
+
+	// sessions:read is enough to read sessions
+	if rec := tt.do("GET", "/v1/sessions", reader.Token, ""); rec.Code != http.StatusOK {
+		t.Errorf("listing sessions got %d, want 200: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestRevokedAndExpiredTokens(t *testing.T) {
+	tt := newTokenTest(t)
+
+	revoked := tt.createToken(t, ScopeTokensWrite)
+	if rec := tt.do("GET", "/v1/tokens", revoked.Token, ""); rec.Code != http.StatusOK {
+		t.Fatalf("listing tokens got %d before revoking: %s", rec.Code, rec.Body)
+	}
+	if rec := tt.do("DELETE", "/v1/tokens/"+revoked.ID, "dev-token", ""); rec.Code != http.StatusOK {
+		t.Fatalf("revoking got %d: %s", rec.Code, rec.Body)
+	}
+
+	user, err := tt.store.GetUserByWorkosID("dev-user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiresAt := time.Now().Add(-time.Minute)
+	expired := apiTokenPrefix + "expired"
+	if _, err := tt.store.CreateAPIToken(&db.APIToken{
+		UserID:    user.ID,
+		Name:      "expired",
+		Prefix:    expired[:len(apiTokenPrefix)+7],
+		Scopes:    []string{ScopeTokensWrite},
+		ExpiresAt: &expiresAt,
+	}, db.HashToken(expired)); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, token := range map[string]string{
+		"revoked": revoked.Token,
+		"expired": expired,
+		"unknown": apiTokenPrefix + "unknown",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if rec := tt.do("GET", "/v1/tokens", token, ""); rec.Code != http.StatusUnauthorized {
+				t.Errorf("got %d, want 401: %s", rec.Code, rec.Body)
+			}
+		})
+	}
+
+	// Neither is listed any more
+	rec := tt.do("GET", "/v1/tokens", "dev-token", "")
+	var tokens []TokenResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &tokens); err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 0 {
+		t.Errorf("listed %d tokens, want none", len(tokens))
+	}
+}
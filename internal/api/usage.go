@@ -0,0 +1,73 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/izalutski/catty/internal/db"
+)
+
+// UsageResponse reports a user's token usage and its cost for the current
+// billing period. Costs are in microdollars.
+type UsageResponse struct {
+	Plan         string    `json:"plan"`
+	PeriodStart  time.Time `json:"period_start"`
+	PriceVersion string    `json:"price_version"`
+	db.UsageSummary
+	TotalTokens int64 `json:"total_tokens"`
+	// QuotaTokens are the input and output tokens counted against
+	// LimitTokens; cache tokens only count through their cost.
+	QuotaTokens int64 `json:"quota_tokens"`
+	// LimitTokens and LimitCostMicroUSD are the period's quota, omitted
+	// for unlimited plans.
+	LimitTokens       int64 `json:"limit_tokens,omitempty"`
+	LimitCostMicroUSD int64 `json:"limit_cost_microusd,omitempty"`
+}
+
+// GetUsage handles GET /v1/usage.
+// Free plans are metered per calendar month, pro plans per subscription period.
+func (h *Handlers) GetUsage(w http.ResponseWriter, r *http.Request) {
+	// Get authenticated user from context
+	authUser := UserFromContext(r.Context())
+	if authUser == nil {
+		writeError(w, http.StatusUnauthorized, "user not found in context")
+		return
+	}
+
+	dbUser, err := h.db.GetOrCreateUser(authUser.ID, authUser.Email)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to get user: "+err.Error())
+		return
+	}
+
+	sub, err := h.db.GetOrCreateSubscription(dbUser.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to get subscription: "+err.Error())
+		return
+	}
+
+	resp := UsageResponse{Plan: sub.Plan, PriceVersion: db.Prices.Version}
+	var usage *db.UsageSummary
+	if sub.Plan == "pro" && sub.CurrentPeriodStart != nil {
+		resp.PeriodStart = *sub.CurrentPeriodStart
+		usage, err = h.db.GetPeriodUsage(dbUser.ID, resp.PeriodStart)
+	} else {
+		now := time.Now().UTC()
+		resp.PeriodStart = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		usage, err = h.db.GetMonthlyUsage(dbUser.ID)
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to get usage: "+err.Error())
+		return
+	}
+
+	resp.UsageSummary = *usage
+	resp.TotalTokens = usage.Total()
+	resp.QuotaTokens = usage.QuotaTokens()
+	if sub.Plan != "pro" {
+		resp.LimitTokens = db.FreeTierMonthlyTokens
+		resp.LimitCostMicroUSD = db.FreeTierMonthlyCostMicroUSD
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
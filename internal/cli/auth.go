@@ -1,8 +1,10 @@
 package cli
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"os"
 	"path/filepath"
 	"time"
@@ -10,10 +12,38 @@ import (
 
 // Credentials stores the user's authentication credentials.
 type Credentials struct {
-	AccessToken string    `json:"access_token"`
-	UserID      string    `json:"user_id"`
-	Email       string    `json:"email"`
-	ExpiresAt   time.Time `json:"expires_at,omitempty"`
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+	UserID       string    `json:"user_id"`
+	Email        string    `json:"email"`
+	ExpiresAt    time.Time `json:"expires_at,omitempty"` // access token expiry
+}
+
+// TokenResponse is the API response for logging in or refreshing a token.
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	User         *struct {
+		ID    string `json:"id"`
+		Email string `json:"email"`
+	} `json:"user,omitempty"`
+}
+
+// Apply updates credentials from a token response.
+func (c *Credentials) Apply(resp *TokenResponse) {
+	c.AccessToken = resp.AccessToken
+	if resp.RefreshToken != "" {
+		c.RefreshToken = resp.RefreshToken
+	}
+	c.ExpiresAt = time.Time{}
+	if resp.ExpiresIn > 0 {
+		c.ExpiresAt = time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second)
+	}
+	if resp.User != nil {
+		c.UserID = resp.User.ID
+		c.Email = resp.User.Email
+	}
 }
 
 // credentialsDir returns the directory for storing credentials.
@@ -25,16 +55,24 @@ func credentialsDir() (string, error) {
 	return filepath.Join(home, ".catty"), nil
 }
 
-// credentialsPath returns the path to the credentials file.
+// credentialsPath returns the path to the credentials file of the active profile.
 func credentialsPath() (string, error) {
+	return credentialsPathFor(ActiveProfile())
+}
+
+// credentialsPathFor returns the path to a profile's credentials file.
+func credentialsPathFor(profile string) (string, error) {
 	dir, err := credentialsDir()
 	if err != nil {
 		return "", err
 	}
-	return filepath.Join(dir, "credentials.json"), nil
+	if profile == DefaultProfile {
+		return filepath.Join(dir, "credentials.json"), nil
+	}
+	return filepath.Join(dir, "credentials-"+profile+".json"), nil
 }
 
-// SaveCredentials saves credentials to disk.
+// SaveCredentials saves credentials for the active profile to disk.
 func SaveCredentials(creds *Credentials) error {
 	dir, err := credentialsDir()
 	if err != nil {
@@ -64,9 +102,14 @@ func SaveCredentials(creds *Credentials) error {
 	return nil
 }
 
-// LoadCredentials loads credentials from disk.
+// LoadCredentials loads the active profile's credentials from disk.
 func LoadCredentials() (*Credentials, error) {
-	path, err := credentialsPath()
+	return loadCredentialsFor(ActiveProfile())
+}
+
+// loadCredentialsFor loads a profile's credentials from disk.
+func loadCredentialsFor(profile string) (*Credentials, error) {
+	path, err := credentialsPathFor(profile)
 	if err != nil {
 		return nil, err
 	}
@@ -87,7 +130,7 @@ func LoadCredentials() (*Credentials, error) {
 	return &creds, nil
 }
 
-// DeleteCredentials removes stored credentials.
+// DeleteCredentials removes the active profile's stored credentials.
 func DeleteCredentials() error {
 	path, err := credentialsPath()
 	if err != nil {
@@ -101,24 +144,91 @@ func DeleteCredentials() error {
 	return nil
 }
 
+// TokenEnvVar holds a personal access token that takes precedence over
+// stored credentials, for CI and other non-interactive use.
+const TokenEnvVar = "CATTY_TOKEN"
+
 // IsLoggedIn checks if the user has valid credentials.
 func IsLoggedIn() bool {
 	creds, err := LoadCredentials()
 	if err != nil || creds == nil {
 		return false
 	}
-	// Check if token is expired
-	if !creds.ExpiresAt.IsZero() && time.Now().After(creds.ExpiresAt) {
+	// An expired access token is fine as long as it can be refreshed
+	if !creds.ExpiresAt.IsZero() && time.Now().After(creds.ExpiresAt) && creds.RefreshToken == "" {
 		return false
 	}
 	return creds.AccessToken != ""
 }
 
-// GetAccessToken returns the stored access token or empty string.
+// HasAccessToken checks if requests can be authenticated, either with
+// CATTY_TOKEN or with stored credentials.
+func HasAccessToken() bool {
+	return os.Getenv(TokenEnvVar) != "" || IsLoggedIn()
+}
+
+// GetAccessToken returns the token from CATTY_TOKEN, else the stored
+// access token, else an empty string.
 func GetAccessToken() string {
+	if token := os.Getenv(TokenEnvVar); token != "" {
+		return token
+	}
 	creds, err := LoadCredentials()
 	if err != nil || creds == nil {
 		return ""
 	}
 	return creds.AccessToken
 }
+
+// RefreshCredentials exchanges the refresh token for new tokens and saves them.
+func RefreshCredentials(apiAddr string, creds *Credentials) error {
+	if creds.RefreshToken == "" {
+		return fmt.Errorf("no refresh token; run 'catty login'")
+	}
+
+	body, _ := json.Marshal(map[string]string{"refresh_token": creds.RefreshToken})
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(apiAddr+"/v1/auth/refresh", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("refresh token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return readError(resp)
+	}
+
+	var tokenResp TokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return fmt.Errorf("parse refresh response: %w", err)
+	}
+	if tokenResp.AccessToken == "" {
+		return fmt.Errorf("refresh response has no access token")
+	}
+
+	creds.Apply(&tokenResp)
+	return SaveCredentials(creds)
+}
+
+// RevokeSession asks the API to end the login session behind creds, so its
+// tokens stop working even if copied elsewhere.
+func RevokeSession(apiAddr string, creds *Credentials) error {
+	req, err := http.NewRequest("POST", apiAddr+"/v1/auth/logout", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+creds.AccessToken)
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return readError(resp)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package cli
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ParseBudget parses a session budget: a token count with an optional k or
+// m suffix ("500k", "1.5m") or a dollar amount ("$5", "2.50usd"). Exactly
+// one of the results is non-zero; costs are in microdollars.
+func ParseBudget(s string) (tokens, costMicroUSD int64, err error) {
+	v := strings.ToLower(strings.TrimSpace(s))
+
+	dollars := false
+	if rest, ok := strings.CutPrefix(v, "$"); ok {
+		v, dollars = rest, true
+	} else if rest, ok := strings.CutSuffix(v, "usd"); ok {
+		v, dollars = strings.TrimSpace(rest), true
+	}
+
+	multiplier := 1.0
+	if !dollars {
+		if rest, ok := strings.CutSuffix(v, "k"); ok {
+			v, multiplier = rest, 1_000
+		} else if rest, ok := strings.CutSuffix(v, "m"); ok {
+			v, multiplier = rest, 1_000_000
+		}
+	}
+
+	n, err := strconv.ParseFloat(v, 64)
+	if dollars {
+		costMicroUSD = int64(math.Round(n * 1_000_000))
+	} else {
+		tokens = int64(math.Round(n * multiplier))
+	}
+	if err != nil || math.IsNaN(n) || math.IsInf(n, 0) || tokens+costMicroUSD <= 0 {
+		return 0, 0, fmt.Errorf("invalid budget %q: expected tokens like 500k or 2m, or dollars like $5", s)
+	}
+	return tokens, costMicroUSD, nil
+}
@@ -1,11 +1,15 @@
 package cli
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"os"
+	"strings"
 	"time"
 )
 
@@ -17,6 +21,9 @@ type APIClient struct {
 	baseURL   string
 	client    *http.Client
 	authToken string
+	// creds are the stored credentials behind authToken, used to refresh
+	// it. Nil when the token comes from CATTY_TOKEN.
+	creds *Credentials
 }
 
 // NewAPIClient creates a new API client.
@@ -24,17 +31,23 @@ func NewAPIClient(baseURL string) *APIClient {
 	if baseURL == "" {
 		baseURL = DefaultAPIAddr
 	}
-	return &APIClient{
-		baseURL:   baseURL,
-		authToken: GetAccessToken(), // Load from stored credentials
+	c := &APIClient{
+		baseURL: baseURL,
 		client: &http.Client{
 			Timeout: 120 * time.Second, // Long timeout for machine creation
 		},
 	}
+	if token := os.Getenv(TokenEnvVar); token != "" {
+		c.authToken = token
+	} else if creds, err := LoadCredentials(); err == nil && creds != nil {
+		c.authToken = creds.AccessToken
+		c.creds = creds
+	}
+	return c
 }
 
-// doRequest performs an HTTP request with auth headers.
-func (c *APIClient) doRequest(method, url string, body io.Reader) (*http.Response, error) {
+// newRequest builds an HTTP request with auth headers.
+func (c *APIClient) newRequest(method, url string, body io.Reader) (*http.Request, error) {
 	req, err := http.NewRequest(method, url, body)
 	if err != nil {
 		return nil, err
@@ -45,6 +58,46 @@ func (c *APIClient) doRequest(method, url string, body io.Reader) (*http.Respons
 	if c.authToken != "" {
 		req.Header.Set("Authorization", "Bearer "+c.authToken)
 	}
+	return req, nil
+}
+
+// doRequest performs an HTTP request with auth headers. If the access
+// token has expired, it is refreshed and the request retried once.
+func (c *APIClient) doRequest(method, url string, body io.Reader) (*http.Response, error) {
+	// Buffer the body so the request can be replayed after a refresh
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = io.ReadAll(body); err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := c.send(method, url, payload)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || c.creds == nil || c.creds.RefreshToken == "" {
+		return resp, err
+	}
+
+	if err := RefreshCredentials(c.baseURL, c.creds); err != nil {
+		// Return the original 401 so callers report it as usual
+		return resp, nil
+	}
+	resp.Body.Close()
+	c.authToken = c.creds.AccessToken
+
+	return c.send(method, url, payload)
+}
+
+// send builds and sends a single request.
+func (c *APIClient) send(method, url string, payload []byte) (*http.Response, error) {
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+	req, err := c.newRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
 	return c.client.Do(req)
 }
 
@@ -56,6 +109,11 @@ type CreateSessionRequest struct {
 	CPUs     int      `json:"cpus"`
 	MemoryMB int      `json:"memory_mb"`
 	TTLSec   int      `json:"ttl_sec"`
+	// Env holds extra environment variables for the agent.
+	Env map[string]string `json:"env,omitempty"`
+	// BudgetTokens and BudgetMicroUSD cap the session's API usage.
+	BudgetTokens   int64 `json:"budget_tokens,omitempty"`
+	BudgetMicroUSD int64 `json:"budget_cost_microusd,omitempty"`
 }
 
 // CreateSessionResponse is the response for creating a session.
@@ -65,9 +123,28 @@ type CreateSessionResponse struct {
 	MachineID    string            `json:"machine_id"`
 	ConnectURL   string            `json:"connect_url"`
 	ConnectToken string            `json:"connect_token"`
+	Status       string            `json:"status"`
 	Headers      map[string]string `json:"headers"`
 }
 
+// SessionEvent is a provisioning progress event streamed by the API.
+type SessionEvent struct {
+	Type      string    `json:"type"`
+	Message   string    `json:"message"`
+	MachineID string    `json:"machine_id,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// Provisioning event types.
+const (
+	EventImageResolved  = "image_resolved"
+	EventMachineCreated = "machine_created"
+	EventMachineStarted = "machine_started"
+	EventWorkspaceReady = "workspace_ready"
+	EventFailed         = "failed"
+)
+
 // SessionInfo is the response for getting session info.
 type SessionInfo struct {
 	SessionID    string    `json:"session_id"`
@@ -94,7 +171,7 @@ func (c *APIClient) CreateSession(req *CreateSessionRequest) (*CreateSessionResp
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
 		return nil, readError(resp)
 	}
 
@@ -106,6 +183,51 @@ func (c *APIClient) CreateSession(req *CreateSessionRequest) (*CreateSessionResp
 	return &result, nil
 }
 
+// StreamSessionEvents follows the provisioning event stream for a session,
+// calling fn for each event. Returns after a terminal event or when the
+// server closes the stream.
+func (c *APIClient) StreamSessionEvents(sessionID string, fn func(*SessionEvent)) error {
+	req, err := c.newRequest("GET", c.baseURL+"/v1/sessions/"+sessionID+"/events", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	// No overall timeout: the stream stays open for as long as provisioning takes
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return readError(resp)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+
+		var ev SessionEvent
+		if err := json.Unmarshal([]byte(strings.TrimSpace(line[5:])), &ev); err != nil {
+			continue
+		}
+		fn(&ev)
+
+		if ev.Type == EventWorkspaceReady || ev.Type == EventFailed {
+			return nil
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("event stream ended before session was ready")
+}
+
 // ListSessions lists all sessions.
 func (c *APIClient) ListSessions() ([]*SessionInfo, error) {
 	resp, err := c.doRequest("GET", c.baseURL+"/v1/sessions", nil)
@@ -178,6 +300,10 @@ type APIError struct {
 	ErrorCode  string
 	Message    string
 	UpgradeURL string
+	// LimitTokens and LimitCostMicroUSD are the quota the API applied,
+	// set on quota errors.
+	LimitTokens       int64
+	LimitCostMicroUSD int64
 }
 
 func (e *APIError) Error() string {
@@ -215,6 +341,193 @@ func (c *APIClient) CreateCheckoutSession() (string, error) {
 	return result.CheckoutURL, nil
 }
 
+// CreateTokenRequest is the request body for creating a personal access token.
+type CreateTokenRequest struct {
+	Name         string   `json:"name"`
+	Scopes       []string `json:"scopes,omitempty"`
+	ExpiresInSec int      `json:"expires_in_sec,omitempty"`
+}
+
+// TokenInfo describes a personal access token.
+type TokenInfo struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Prefix    string     `json:"prefix"`
+	Scopes    []string   `json:"scopes"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// Token is only set when the token is created.
+	Token string `json:"token,omitempty"`
+}
+
+// CreateToken creates a personal access token.
+func (c *APIClient) CreateToken(req *CreateTokenRequest) (*TokenInfo, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.doRequest("POST", c.baseURL+"/v1/tokens", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return nil, readError(resp)
+	}
+
+	var result TokenInfo
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// ListTokens lists the user's personal access tokens.
+func (c *APIClient) ListTokens() ([]*TokenInfo, error) {
+	resp, err := c.doRequest("GET", c.baseURL+"/v1/tokens", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, readError(resp)
+	}
+
+	var result []*TokenInfo
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// RevokeToken revokes a personal access token.
+func (c *APIClient) RevokeToken(tokenID string) error {
+	resp, err := c.doRequest("DELETE", c.baseURL+"/v1/tokens/"+tokenID, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return readError(resp)
+	}
+
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// SecretInfo describes a secret. Values are never returned.
+type SecretInfo struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// SetSecret creates or replaces a secret.
+func (c *APIClient) SetSecret(name, value string) error {
+	body, err := json.Marshal(map[string]string{"value": value})
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.doRequest("PUT", c.baseURL+"/v1/secrets/"+url.PathEscape(name), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return readError(resp)
+	}
+
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// ListSecrets lists the user's secrets.
+func (c *APIClient) ListSecrets() ([]*SecretInfo, error) {
+	resp, err := c.doRequest("GET", c.baseURL+"/v1/secrets", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, readError(resp)
+	}
+
+	var result []*SecretInfo
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// DeleteSecret deletes a secret.
+func (c *APIClient) DeleteSecret(name string) error {
+	resp, err := c.doRequest("DELETE", c.baseURL+"/v1/secrets/"+url.PathEscape(name), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return readError(resp)
+	}
+
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// ModelUsageInfo is the usage and cost of one model. Costs are in microdollars.
+type ModelUsageInfo struct {
+	Model                    string `json:"model"`
+	InputTokens              int64  `json:"input_tokens"`
+	OutputTokens             int64  `json:"output_tokens"`
+	CacheCreationInputTokens int64  `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int64  `json:"cache_read_input_tokens"`
+	CostMicroUSD             int64  `json:"cost_microusd"`
+}
+
+// UsageInfo is the user's token usage for the current billing period.
+type UsageInfo struct {
+	Plan         string    `json:"plan"`
+	PeriodStart  time.Time `json:"period_start"`
+	PriceVersion string    `json:"price_version"`
+	ModelUsageInfo
+	Models            []ModelUsageInfo `json:"models"`
+	TotalTokens       int64            `json:"total_tokens"`
+	QuotaTokens       int64            `json:"quota_tokens"`
+	LimitTokens       int64            `json:"limit_tokens,omitempty"`
+	LimitCostMicroUSD int64            `json:"limit_cost_microusd,omitempty"`
+}
+
+// GetUsage gets the user's token usage for the current billing period.
+func (c *APIClient) GetUsage() (*UsageInfo, error) {
+	resp, err := c.doRequest("GET", c.baseURL+"/v1/usage", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, readError(resp)
+	}
+
+	var result UsageInfo
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
 func readError(resp *http.Response) error {
 	body, _ := io.ReadAll(resp.Body)
 
@@ -223,13 +536,18 @@ func readError(resp *http.Response) error {
 		Error      string `json:"error"`
 		Message    string `json:"message"`
 		UpgradeURL string `json:"upgrade_url"`
+		// Only on quota errors
+		LimitTokens       int64 `json:"limit_tokens"`
+		LimitCostMicroUSD int64 `json:"limit_cost_microusd"`
 	}
 	if err := json.Unmarshal(body, &errResp); err == nil && errResp.Error != "" {
 		return &APIError{
-			StatusCode: resp.StatusCode,
-			ErrorCode:  errResp.Error,
-			Message:    errResp.Message,
-			UpgradeURL: errResp.UpgradeURL,
+			StatusCode:        resp.StatusCode,
+			ErrorCode:         errResp.Error,
+			Message:           errResp.Message,
+			UpgradeURL:        errResp.UpgradeURL,
+			LimitTokens:       errResp.LimitTokens,
+			LimitCostMicroUSD: errResp.LimitCostMicroUSD,
 		}
 	}
 
@@ -0,0 +1,257 @@
+package cli
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// configFileName is the name of both the global and the project config file.
+const configFileName = "config.toml"
+
+// Config holds session defaults. It is read from ~/.catty/config.toml and
+// from the nearest .catty/config.toml above the working directory, which
+// takes precedence. Zero values mean "not set".
+type Config struct {
+	Agent    string            `toml:"agent,omitempty"`
+	Region   string            `toml:"region,omitempty"`
+	CPUs     int               `toml:"cpus,omitzero"`
+	MemoryMB int               `toml:"memory_mb,omitzero"`
+	TTLSec   int               `toml:"ttl_sec,omitzero"`
+	Env      map[string]string `toml:"env,omitempty"`
+	// Ignore lists extra patterns excluded from workspace uploads.
+	Ignore []string `toml:"ignore,omitempty"`
+}
+
+// ConfigKeys are the keys accepted by GetConfigValue and SetConfigValue,
+// in addition to env.<NAME>.
+var ConfigKeys = []string{"agent", "region", "cpus", "memory_mb", "ttl_sec", "ignore"}
+
+// merge overlays the values set in other onto c. Env maps are merged and
+// ignore patterns appended.
+func (c *Config) merge(other *Config) {
+	if other.Agent != "" {
+		c.Agent = other.Agent
+	}
+	if other.Region != "" {
+		c.Region = other.Region
+	}
+	if other.CPUs != 0 {
+		c.CPUs = other.CPUs
+	}
+	if other.MemoryMB != 0 {
+		c.MemoryMB = other.MemoryMB
+	}
+	if other.TTLSec != 0 {
+		c.TTLSec = other.TTLSec
+	}
+	for k, v := range other.Env {
+		if c.Env == nil {
+			c.Env = make(map[string]string)
+		}
+		c.Env[k] = v
+	}
+	c.Ignore = append(c.Ignore, other.Ignore...)
+}
+
+// GlobalConfigPath returns the path to ~/.catty/config.toml.
+func GlobalConfigPath() (string, error) {
+	dir, err := credentialsDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, configFileName), nil
+}
+
+// FindProjectConfig returns the nearest .catty/config.toml in dir or its
+// parents, or "" if there is none. The search stops at the home directory,
+// whose .catty holds the global config.
+func FindProjectConfig(dir string) string {
+	home, _ := os.UserHomeDir()
+	for {
+		if dir == home {
+			return ""
+		}
+		path := filepath.Join(dir, ".catty", configFileName)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// LoadConfigFile reads a config file. A missing file yields an empty config.
+func LoadConfigFile(path string) (*Config, error) {
+	cfg := &Config{}
+	if _, err := toml.DecodeFile(path, cfg); err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// SaveConfigFile writes a config file, creating its directory if needed.
+func SaveConfigFile(path string, cfg *Config) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("create config directory: %w", err)
+	}
+
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(cfg); err != nil {
+		return fmt.Errorf("encode config: %w", err)
+	}
+
+	if err := os.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		return fmt.Errorf("write config: %w", err)
+	}
+	return nil
+}
+
+// LoadConfig returns the effective session defaults for the working
+// directory: the global config, then the active profile's defaults, then
+// the project config.
+func LoadConfig() (*Config, error) {
+	cfg := &Config{}
+
+	globalPath, err := GlobalConfigPath()
+	if err != nil {
+		return nil, err
+	}
+	global, err := LoadConfigFile(globalPath)
+	if err != nil {
+		return nil, err
+	}
+	cfg.merge(global)
+
+	profile := CurrentProfile()
+	cfg.merge(&Config{
+		Agent:    profile.Agent,
+		Region:   profile.Region,
+		CPUs:     profile.CPUs,
+		MemoryMB: profile.MemoryMB,
+		TTLSec:   profile.TTLSec,
+	})
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, fmt.Errorf("get current directory: %w", err)
+	}
+	if projectPath := FindProjectConfig(cwd); projectPath != "" {
+		project, err := LoadConfigFile(projectPath)
+		if err != nil {
+			return nil, err
+		}
+		cfg.merge(project)
+	}
+
+	return cfg, nil
+}
+
+// GetConfigValue returns the value of key formatted for display, and
+// whether it is set.
+func GetConfigValue(cfg *Config, key string) (string, bool, error) {
+	if name, ok := strings.CutPrefix(key, "env."); ok {
+		v, set := cfg.Env[name]
+		return v, set, nil
+	}
+
+	switch key {
+	case "agent":
+		return cfg.Agent, cfg.Agent != "", nil
+	case "region":
+		return cfg.Region, cfg.Region != "", nil
+	case "cpus":
+		return strconv.Itoa(cfg.CPUs), cfg.CPUs != 0, nil
+	case "memory_mb":
+		return strconv.Itoa(cfg.MemoryMB), cfg.MemoryMB != 0, nil
+	case "ttl_sec":
+		return strconv.Itoa(cfg.TTLSec), cfg.TTLSec != 0, nil
+	case "ignore":
+		return strings.Join(cfg.Ignore, ","), len(cfg.Ignore) > 0, nil
+	case "env":
+		names := make([]string, 0, len(cfg.Env))
+		for name := range cfg.Env {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		lines := make([]string, 0, len(names))
+		for _, name := range names {
+			lines = append(lines, name+"="+cfg.Env[name])
+		}
+		return strings.Join(lines, "\n"), len(lines) > 0, nil
+	}
+	return "", false, unknownConfigKey(key)
+}
+
+// SetConfigValue sets key from its string form. An empty value unsets it.
+// Ignore patterns are comma-separated.
+func SetConfigValue(cfg *Config, key, value string) error {
+	if name, ok := strings.CutPrefix(key, "env."); ok {
+		if name == "" {
+			return unknownConfigKey(key)
+		}
+		if value == "" {
+			delete(cfg.Env, name)
+			return nil
+		}
+		if cfg.Env == nil {
+			cfg.Env = make(map[string]string)
+		}
+		cfg.Env[name] = value
+		return nil
+	}
+
+	parseInt := func() (int, error) {
+		if value == "" {
+			return 0, nil
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("%s must be a non-negative integer", key)
+		}
+		return n, nil
+	}
+
+	var err error
+	switch key {
+	case "agent":
+		if value != "" && value != "claude" && value != "codex" {
+			return fmt.Errorf("unknown agent: %s (must be 'claude' or 'codex')", value)
+		}
+		cfg.Agent = value
+	case "region":
+		cfg.Region = value
+	case "cpus":
+		cfg.CPUs, err = parseInt()
+	case "memory_mb":
+		cfg.MemoryMB, err = parseInt()
+	case "ttl_sec":
+		cfg.TTLSec, err = parseInt()
+	case "ignore":
+		cfg.Ignore = nil
+		for _, pattern := range strings.Split(value, ",") {
+			if pattern = strings.TrimSpace(pattern); pattern != "" {
+				cfg.Ignore = append(cfg.Ignore, pattern)
+			}
+		}
+	default:
+		return unknownConfigKey(key)
+	}
+	return err
+}
+
+func unknownConfigKey(key string) error {
+	return fmt.Errorf("unknown config key %q (valid: %s, env.<NAME>)", key, strings.Join(ConfigKeys, ", "))
+}
@@ -0,0 +1,239 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// DefaultProfile is the profile used when none is selected. Its credentials
+// live in credentials.json, where they were kept before profiles existed.
+const DefaultProfile = "default"
+
+// ProfileEnvVar selects a profile, like the --profile flag.
+const ProfileEnvVar = "CATTY_PROFILE"
+
+var profileNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+// Profile is a named API context with its own credentials and default
+// session options. Zero values mean "use the built-in default".
+type Profile struct {
+	APIAddr  string `json:"api,omitempty"`
+	Agent    string `json:"agent,omitempty"`
+	Region   string `json:"region,omitempty"`
+	CPUs     int    `json:"cpus,omitempty"`
+	MemoryMB int    `json:"memory_mb,omitempty"`
+	TTLSec   int    `json:"ttl_sec,omitempty"`
+}
+
+// Profiles is the contents of ~/.catty/profiles.json.
+type Profiles struct {
+	Current  string              `json:"current,omitempty"`
+	Profiles map[string]*Profile `json:"profiles"`
+}
+
+// selectedProfile is set from the --profile flag.
+var selectedProfile string
+
+// SetProfile selects the profile for this process. An empty name falls
+// back to CATTY_PROFILE, then the current profile in profiles.json.
+func SetProfile(name string) error {
+	if name != "" {
+		if err := ValidateProfileName(name); err != nil {
+			return err
+		}
+	}
+	selectedProfile = name
+	return nil
+}
+
+// ActiveProfile returns the name of the profile in use.
+func ActiveProfile() string {
+	if selectedProfile != "" {
+		return selectedProfile
+	}
+	if env := os.Getenv(ProfileEnvVar); env != "" && ValidateProfileName(env) == nil {
+		return env
+	}
+	if profiles, err := LoadProfiles(); err == nil && profiles.Current != "" {
+		return profiles.Current
+	}
+	return DefaultProfile
+}
+
+// CurrentProfile returns the settings of the active profile. A profile
+// that hasn't been saved yet has no settings.
+func CurrentProfile() *Profile {
+	profiles, err := LoadProfiles()
+	if err != nil {
+		return &Profile{}
+	}
+	if p, ok := profiles.Profiles[ActiveProfile()]; ok {
+		return p
+	}
+	return &Profile{}
+}
+
+// ValidateProfileName checks that a profile name is safe to use in a file name.
+func ValidateProfileName(name string) error {
+	if !profileNameRe.MatchString(name) {
+		return fmt.Errorf("invalid profile name %q: use letters, digits, '-' and '_'", name)
+	}
+	return nil
+}
+
+// profilesPath returns the path to the profiles file.
+func profilesPath() (string, error) {
+	dir, err := credentialsDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "profiles.json"), nil
+}
+
+// LoadProfiles loads profiles from disk. A missing file yields no profiles.
+func LoadProfiles() (*Profiles, error) {
+	path, err := profilesPath()
+	if err != nil {
+		return nil, err
+	}
+
+	profiles := &Profiles{Profiles: make(map[string]*Profile)}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return profiles, nil
+		}
+		return nil, fmt.Errorf("read profiles: %w", err)
+	}
+
+	if err := json.Unmarshal(data, profiles); err != nil {
+		return nil, fmt.Errorf("parse profiles: %w", err)
+	}
+	if profiles.Profiles == nil {
+		profiles.Profiles = make(map[string]*Profile)
+	}
+
+	return profiles, nil
+}
+
+// SaveProfiles saves profiles to disk.
+func SaveProfiles(profiles *Profiles) error {
+	dir, err := credentialsDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("create config directory: %w", err)
+	}
+
+	path, err := profilesPath()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(profiles, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal profiles: %w", err)
+	}
+
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("write profiles: %w", err)
+	}
+
+	return nil
+}
+
+// UpdateProfile applies fn to the named profile, creating it if needed,
+// and saves the result.
+func UpdateProfile(name string, fn func(*Profile)) error {
+	if err := ValidateProfileName(name); err != nil {
+		return err
+	}
+
+	profiles, err := LoadProfiles()
+	if err != nil {
+		return err
+	}
+
+	p, ok := profiles.Profiles[name]
+	if !ok {
+		p = &Profile{}
+		profiles.Profiles[name] = p
+	}
+	fn(p)
+
+	return SaveProfiles(profiles)
+}
+
+// ProfileNames returns the names of saved profiles and of profiles that
+// only have credentials, sorted.
+func ProfileNames() ([]string, error) {
+	profiles, err := LoadProfiles()
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	for name := range profiles.Profiles {
+		seen[name] = true
+	}
+	if creds, _ := loadCredentialsFor(DefaultProfile); creds != nil {
+		seen[DefaultProfile] = true
+	}
+	if dir, err := credentialsDir(); err == nil {
+		matches, _ := filepath.Glob(filepath.Join(dir, "credentials-*.json"))
+		for _, m := range matches {
+			name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(m), "credentials-"), ".json")
+			if ValidateProfileName(name) == nil {
+				seen[name] = true
+			}
+		}
+	}
+
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// DeleteProfile removes a profile's settings and credentials.
+func DeleteProfile(name string) error {
+	profiles, err := LoadProfiles()
+	if err != nil {
+		return err
+	}
+
+	delete(profiles.Profiles, name)
+	if profiles.Current == name {
+		profiles.Current = ""
+	}
+	if err := SaveProfiles(profiles); err != nil {
+		return err
+	}
+
+	path, err := credentialsPathFor(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove credentials: %w", err)
+	}
+	return nil
+}
+
+// ProfileCredentials returns a profile's stored credentials, or nil.
+func ProfileCredentials(profile string) *Credentials {
+	creds, err := loadCredentialsFor(profile)
+	if err != nil || creds == nil || creds.AccessToken == "" {
+		return nil
+	}
+	return creds
+}
@@ -25,6 +25,14 @@ type RunOptions struct {
 	TTLSec          int
 	APIAddr         string
 	UploadWorkspace bool
+	// Env holds extra environment variables for the agent.
+	Env map[string]string
+	// Ignore lists extra patterns excluded from the workspace upload.
+	Ignore []string
+	// BudgetTokens and BudgetMicroUSD cap the session's API usage; zero
+	// means no cap.
+	BudgetTokens   int64
+	BudgetMicroUSD int64
 }
 
 // Run starts a new session and connects to it.
@@ -34,12 +42,15 @@ func Run(opts *RunOptions) error {
 	// Create session
 	fmt.Println("Creating session...")
 	resp, err := client.CreateSession(&CreateSessionRequest{
-		Agent:    opts.Agent,
-		Cmd:      opts.Cmd,
-		Region:   opts.Region,
-		CPUs:     opts.CPUs,
-		MemoryMB: opts.MemoryMB,
-		TTLSec:   opts.TTLSec,
+		Agent:          opts.Agent,
+		Cmd:            opts.Cmd,
+		Region:         opts.Region,
+		CPUs:           opts.CPUs,
+		MemoryMB:       opts.MemoryMB,
+		TTLSec:         opts.TTLSec,
+		Env:            opts.Env,
+		BudgetTokens:   opts.BudgetTokens,
+		BudgetMicroUSD: opts.BudgetMicroUSD,
 	})
 	if err != nil {
 		// Check for quota exceeded error
@@ -50,6 +61,14 @@ func Run(opts *RunOptions) error {
 	}
 
 	fmt.Printf("Session created: %s\n", resp.Label)
+
+	// Follow provisioning progress until the machine is ready
+	if resp.Status == "provisioning" {
+		if err := waitForSession(client, resp); err != nil {
+			return err
+		}
+	}
+
 	fmt.Printf("  Reconnect with: catty connect %s\n", resp.Label)
 
 	// Upload workspace if requested
@@ -57,7 +76,7 @@ func Run(opts *RunOptions) error {
 		fmt.Println("Uploading workspace...")
 		machineID := resp.Headers["fly-force-instance-id"]
 		uploadURL := buildUploadURL(resp.ConnectURL)
-		if err := UploadWorkspace(uploadURL, resp.ConnectToken, machineID); err != nil {
+		if err := UploadWorkspace(uploadURL, resp.ConnectToken, machineID, opts.Ignore); err != nil {
 			return fmt.Errorf("failed to upload workspace: %w", err)
 		}
 		fmt.Println("Workspace uploaded.")
@@ -69,6 +88,41 @@ func Run(opts *RunOptions) error {
 	return connect(resp)
 }
 
+// waitForSession renders provisioning progress and fills in the machine
+// details once the session is ready.
+func waitForSession(client *APIClient, resp *CreateSessionResponse) error {
+	var failure *SessionEvent
+	err := client.StreamSessionEvents(resp.SessionID, func(ev *SessionEvent) {
+		switch ev.Type {
+		case EventFailed:
+			failure = ev
+			fmt.Printf("  ✗ %s\n", ev.Message)
+		default:
+			fmt.Printf("  ✓ %s\n", ev.Message)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to follow session progress: %w", err)
+	}
+	if failure != nil {
+		return fmt.Errorf("session failed to start: %s", failure.Error)
+	}
+
+	// The connect URL depends on the machine, so it is only known once ready
+	info, err := client.GetSession(resp.SessionID, false)
+	if err != nil {
+		return fmt.Errorf("failed to get session: %w", err)
+	}
+	resp.MachineID = info.MachineID
+	resp.ConnectURL = info.ConnectURL
+
+	if resp.Headers == nil {
+		resp.Headers = map[string]string{}
+	}
+	resp.Headers["fly-force-instance-id"] = resp.MachineID
+	return nil
+}
+
 // buildUploadURL converts the WebSocket connect URL to an HTTP upload URL.
 func buildUploadURL(connectURL string) string {
 	// Convert wss://app.fly.dev/connect to https://app.fly.dev/upload
@@ -166,6 +220,8 @@ func connect(session *CreateSessionResponse) error {
 					return
 				case *protocol.ErrorMessage:
 					fmt.Fprintf(os.Stderr, "\r\nError: %s\r\n", m.Message)
+				case *protocol.NoticeMessage:
+					fmt.Fprintf(os.Stderr, "\r\nNotice: %s\r\n", m.Message)
 				case *protocol.PingMessage:
 					sendPong(conn)
 				}
@@ -203,7 +259,12 @@ func sendPong(conn *websocket.Conn) {
 func handleQuotaExceeded(apiErr *APIError, client *APIClient) error {
 	fmt.Fprintln(os.Stderr, "")
 	fmt.Fprintln(os.Stderr, "━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
-	fmt.Fprintln(os.Stderr, "  Free tier quota exceeded (1M tokens/month)")
+	if apiErr.LimitTokens > 0 {
+		fmt.Fprintf(os.Stderr, "  Free tier quota exceeded (%d tokens or %s per month)\n",
+			apiErr.LimitTokens, formatUSD(apiErr.LimitCostMicroUSD))
+	} else {
+		fmt.Fprintln(os.Stderr, "  Free tier quota exceeded")
+	}
 	fmt.Fprintln(os.Stderr, "  Upgrade to Pro for unlimited usage.")
 	fmt.Fprintln(os.Stderr, "━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
 	fmt.Fprintln(os.Stderr, "")
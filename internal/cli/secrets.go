@@ -0,0 +1,73 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+)
+
+// SecretSetOptions are the options for the secrets set command.
+type SecretSetOptions struct {
+	Name    string
+	Value   string
+	APIAddr string
+}
+
+// SecretSet stores a secret that is injected into every new session.
+func SecretSet(opts *SecretSetOptions) error {
+	client := NewAPIClient(opts.APIAddr)
+
+	if err := client.SetSecret(opts.Name, opts.Value); err != nil {
+		return fmt.Errorf("failed to set secret: %w", err)
+	}
+
+	fmt.Printf("Secret %s saved; it will be set in new sessions\n", opts.Name)
+	return nil
+}
+
+// SecretListOptions are the options for the secrets list command.
+type SecretListOptions struct {
+	APIAddr string
+}
+
+// SecretList shows the names of the user's secrets.
+func SecretList(opts *SecretListOptions) error {
+	client := NewAPIClient(opts.APIAddr)
+
+	secrets, err := client.ListSecrets()
+	if err != nil {
+		return fmt.Errorf("failed to list secrets: %w", err)
+	}
+
+	if len(secrets) == 0 {
+		fmt.Println("No secrets found")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tUPDATED")
+	for _, s := range secrets {
+		fmt.Fprintf(w, "%s\t%s\n", s.Name, formatAge(s.UpdatedAt))
+	}
+	w.Flush()
+
+	return nil
+}
+
+// SecretDeleteOptions are the options for the secrets delete command.
+type SecretDeleteOptions struct {
+	Name    string
+	APIAddr string
+}
+
+// SecretDelete deletes a secret.
+func SecretDelete(opts *SecretDeleteOptions) error {
+	client := NewAPIClient(opts.APIAddr)
+
+	if err := client.DeleteSecret(opts.Name); err != nil {
+		return fmt.Errorf("failed to delete secret: %w", err)
+	}
+
+	fmt.Printf("Secret %s deleted\n", opts.Name)
+	return nil
+}
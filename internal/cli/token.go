@@ -0,0 +1,130 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// TokenCreateOptions are the options for the token create command.
+type TokenCreateOptions struct {
+	Name    string
+	Scopes  []string
+	Expires string
+	APIAddr string
+}
+
+// TokenCreate creates a personal access token and prints it once.
+func TokenCreate(opts *TokenCreateOptions) error {
+	var expiresInSec int
+	if opts.Expires != "" {
+		d, err := ParseExpiry(opts.Expires)
+		if err != nil {
+			return err
+		}
+		expiresInSec = int(d.Seconds())
+	}
+
+	client := NewAPIClient(opts.APIAddr)
+
+	token, err := client.CreateToken(&CreateTokenRequest{
+		Name:         opts.Name,
+		Scopes:       opts.Scopes,
+		ExpiresInSec: expiresInSec,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create token: %w", err)
+	}
+
+	fmt.Printf("Created token %s (%s)\n", token.Name, token.ID)
+	fmt.Printf("Scopes:  %s\n", strings.Join(token.Scopes, ", "))
+	if token.ExpiresAt != nil {
+		fmt.Printf("Expires: %s\n", token.ExpiresAt.Local().Format("2006-01-02 15:04"))
+	} else {
+		fmt.Println("Expires: never")
+	}
+	fmt.Println()
+	fmt.Println(token.Token)
+	fmt.Println()
+	fmt.Printf("Store it now; it won't be shown again. Use it by setting %s.\n", TokenEnvVar)
+
+	return nil
+}
+
+// TokenListOptions are the options for the token list command.
+type TokenListOptions struct {
+	APIAddr string
+}
+
+// TokenList shows the user's personal access tokens.
+func TokenList(opts *TokenListOptions) error {
+	client := NewAPIClient(opts.APIAddr)
+
+	tokens, err := client.ListTokens()
+	if err != nil {
+		return fmt.Errorf("failed to list tokens: %w", err)
+	}
+
+	if len(tokens) == 0 {
+		fmt.Println("No tokens found")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tTOKEN\tSCOPES\tCREATED\tEXPIRES")
+	for _, t := range tokens {
+		expires := "never"
+		if t.ExpiresAt != nil {
+			expires = t.ExpiresAt.Local().Format("2006-01-02")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s…\t%s\t%s\t%s\n",
+			t.ID, t.Name, t.Prefix, strings.Join(t.Scopes, ","), formatAge(t.CreatedAt), expires)
+	}
+	w.Flush()
+
+	return nil
+}
+
+// TokenRevokeOptions are the options for the token revoke command.
+type TokenRevokeOptions struct {
+	TokenID string
+	APIAddr string
+}
+
+// TokenRevoke revokes a personal access token.
+func TokenRevoke(opts *TokenRevokeOptions) error {
+	client := NewAPIClient(opts.APIAddr)
+
+	if err := client.RevokeToken(opts.TokenID); err != nil {
+		return fmt.Errorf("failed to revoke token: %w", err)
+	}
+
+	fmt.Printf("Token %s revoked\n", opts.TokenID)
+	return nil
+}
+
+// ParseExpiry parses a duration like "30d", "12h" or "90m". A "d" suffix
+// means days, which time.ParseDuration doesn't support.
+func ParseExpiry(s string) (time.Duration, error) {
+	var d time.Duration
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid expiry %q", s)
+		}
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		d, err = time.ParseDuration(s)
+		if err != nil {
+			return 0, fmt.Errorf("invalid expiry %q", s)
+		}
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("expiry must be positive: %q", s)
+	}
+	return d, nil
+}
@@ -0,0 +1,55 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+)
+
+// UsageOptions are the options for the usage command.
+type UsageOptions struct {
+	APIAddr string
+}
+
+// Usage shows token usage and cost for the current billing period, per model.
+func Usage(opts *UsageOptions) error {
+	client := NewAPIClient(opts.APIAddr)
+
+	usage, err := client.GetUsage()
+	if err != nil {
+		return fmt.Errorf("failed to get usage: %w", err)
+	}
+
+	fmt.Printf("Plan: %s, period since %s\n\n", usage.Plan, usage.PeriodStart.Local().Format("2006-01-02"))
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "MODEL\tINPUT\tOUTPUT\tCACHE WRITE\tCACHE READ\tCOST")
+	for _, m := range usage.Models {
+		model := m.Model
+		if model == "" {
+			model = "(unknown)"
+		}
+		printModelUsage(w, model, m)
+	}
+	printModelUsage(w, "total", usage.ModelUsageInfo)
+	w.Flush()
+
+	if usage.LimitTokens > 0 {
+		fmt.Printf("\n%d of %d input and output tokens and %s of %s used this month\n",
+			usage.QuotaTokens, usage.LimitTokens,
+			formatUSD(usage.CostMicroUSD), formatUSD(usage.LimitCostMicroUSD))
+	}
+
+	return nil
+}
+
+// printModelUsage prints one row of the usage table.
+func printModelUsage(w *tabwriter.Writer, name string, m ModelUsageInfo) {
+	fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%s\n", name, m.InputTokens, m.OutputTokens,
+		m.CacheCreationInputTokens, m.CacheReadInputTokens, formatUSD(m.CostMicroUSD))
+}
+
+// formatUSD formats microdollars as dollars and cents.
+func formatUSD(micro int64) string {
+	return fmt.Sprintf("$%.2f", float64(micro)/1_000_000)
+}
@@ -213,13 +213,15 @@ func (w *WorkspaceUploader) Upload(uploadURL, token, machineID string) error {
 	return nil
 }
 
-// UploadWorkspace creates and uploads a workspace zip from the current directory.
-func UploadWorkspace(uploadURL, token, machineID string) error {
+// UploadWorkspace creates and uploads a workspace zip from the current
+// directory, skipping the default ignores, .gitignore and extra patterns.
+func UploadWorkspace(uploadURL, token, machineID string, ignore []string) error {
 	cwd, err := os.Getwd()
 	if err != nil {
 		return fmt.Errorf("failed to get current directory: %w", err)
 	}
 
 	uploader := NewWorkspaceUploader(cwd)
+	uploader.ignoreRules = append(uploader.ignoreRules, ignore...)
 	return uploader.Upload(uploadURL, token, machineID)
 }
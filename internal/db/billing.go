@@ -2,8 +2,12 @@ package db
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
 )
 
 // Subscription represents a user's subscription.
@@ -19,21 +23,147 @@ type Subscription struct {
 	UpdatedAt            time.Time  `json:"updated_at"`
 }
 
+// API providers whose usage is metered.
+const (
+	ProviderAnthropic = "anthropic"
+	ProviderOpenAI    = "openai"
+)
+
+// TokenUsage counts the tokens of one or more API requests, split the way
+// Anthropic reports them. InputTokens excludes tokens written to or read
+// from the prompt cache.
+type TokenUsage struct {
+	InputTokens              int64 `json:"input_tokens"`
+	OutputTokens             int64 `json:"output_tokens"`
+	CacheCreationInputTokens int64 `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int64 `json:"cache_read_input_tokens"`
+}
+
+// Total returns the number of tokens of all kinds.
+func (u TokenUsage) Total() int64 {
+	return u.InputTokens + u.OutputTokens + u.CacheCreationInputTokens + u.CacheReadInputTokens
+}
+
+// QuotaTokens returns the tokens counted against token limits: input and
+// output. Cache writes and reads only count through their cost, which the
+// dollar limits cap; agents re-read their cached context on every turn, so
+// counting it token for token would use up a token limit many times over.
+func (u TokenUsage) QuotaTokens() int64 {
+	return u.InputTokens + u.OutputTokens
+}
+
+// IsZero reports whether no tokens were used.
+func (u TokenUsage) IsZero() bool {
+	return u == TokenUsage{}
+}
+
+// Add returns the sum of u and other.
+func (u TokenUsage) Add(other TokenUsage) TokenUsage {
+	return TokenUsage{
+		InputTokens:              u.InputTokens + other.InputTokens,
+		OutputTokens:             u.OutputTokens + other.OutputTokens,
+		CacheCreationInputTokens: u.CacheCreationInputTokens + other.CacheCreationInputTokens,
+		CacheReadInputTokens:     u.CacheReadInputTokens + other.CacheReadInputTokens,
+	}
+}
+
 // Usage represents a usage record.
 type Usage struct {
-	ID           string    `json:"id"`
-	UserID       string    `json:"user_id"`
-	SessionID    *string   `json:"session_id,omitempty"`
-	InputTokens  int64     `json:"input_tokens"`
-	OutputTokens int64     `json:"output_tokens"`
+	ID        string  `json:"id"`
+	RequestID string  `json:"request_id,omitempty"`
+	UserID    string  `json:"user_id"`
+	SessionID *string `json:"session_id,omitempty"`
+	Provider  string  `json:"provider"`
+	Model     string  `json:"model"`
+	TokenUsage
+	CostMicroUSD int64     `json:"cost_microusd"`
+	PriceVersion string    `json:"price_version"`
 	CreatedAt    time.Time `json:"created_at"`
 }
 
+// UsageRecord is the usage of one API request, waiting to be stored.
+// RequestID is Anthropic's request ID; a record whose RequestID is already
+// stored is skipped, so records can be safely written more than once.
+// ReservationID, if set, is released when the record is stored.
+type UsageRecord struct {
+	RequestID     string `json:"request_id"`
+	UserID        string `json:"user_id"`
+	SessionID     string `json:"session_id,omitempty"`
+	ReservationID string `json:"reservation_id,omitempty"`
+	Provider      string `json:"provider"`
+	Model         string `json:"model"`
+	TokenUsage
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ErrUsageRejected is returned by RecordUsageBatch when the database
+// refuses a record for good, like one that breaks a constraint. Storing
+// the batch again fails the same way.
+var ErrUsageRejected = errors.New("usage record rejected")
+
+// rejectedUsage marks the errors the database returns for records it will
+// never accept with ErrUsageRejected: data exceptions and integrity
+// constraint violations.
+func rejectedUsage(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && (strings.HasPrefix(pgErr.Code, "22") || strings.HasPrefix(pgErr.Code, "23")) {
+		return fmt.Errorf("%w: %w", ErrUsageRejected, err)
+	}
+	return err
+}
+
+// provider returns the record's provider. Records queued before providers
+// were recorded are all Anthropic's.
+func (r UsageRecord) provider() string {
+	if r.Provider == "" {
+		return ProviderAnthropic
+	}
+	return r.Provider
+}
+
+// ModelUsage is the usage and cost of one model over a period.
+type ModelUsage struct {
+	Provider string `json:"provider"`
+	Model    string `json:"model"`
+	TokenUsage
+	CostMicroUSD int64 `json:"cost_microusd"`
+}
+
+// UsageSummary is a user's usage over a period, in total and per model.
+type UsageSummary struct {
+	TokenUsage
+	CostMicroUSD int64        `json:"cost_microusd"`
+	Models       []ModelUsage `json:"models"`
+}
+
+// add adds one model's usage to the summary.
+func (s *UsageSummary) add(m ModelUsage) {
+	s.TokenUsage = s.TokenUsage.Add(m.TokenUsage)
+	s.CostMicroUSD += m.CostMicroUSD
+	s.Models = append(s.Models, m)
+}
+
 // Free tier limits
 const (
-	FreeTierMonthlyTokens = 1_000_000 // 1M tokens per month for free tier
+	FreeTierMonthlyTokens       = 1_000_000 // 1M tokens per month for free tier
+	FreeTierMonthlyCostMicroUSD = 5_000_000 // $5 per month for free tier
 )
 
+// withinFreeTier checks monthly usage against both free tier limits.
+// Returns (allowed, remainingTokens)
+func withinFreeTier(usage *UsageSummary) (bool, int64) {
+	if overFreeTier(usage.QuotaTokens(), usage.CostMicroUSD) {
+		return false, 0
+	}
+	return true, FreeTierMonthlyTokens - usage.QuotaTokens()
+}
+
+// overFreeTier reports whether usage has reached either free tier limit.
+// tokens are quota tokens, as counted by TokenUsage.QuotaTokens.
+func overFreeTier(tokens, costMicroUSD int64) bool {
+	return tokens >= FreeTierMonthlyTokens || costMicroUSD >= FreeTierMonthlyCostMicroUSD
+}
+
 // GetOrCreateSubscription gets or creates a subscription for a user.
 func (c *Client) GetOrCreateSubscription(userID string) (*Subscription, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -87,66 +217,163 @@ func (c *Client) UpdateSubscription(userID, plan, stripeCustomerID, stripeSubscr
 	return nil
 }
 
-// RecordUsage records token usage for a session.
-func (c *Client) RecordUsage(userID, sessionID string, inputTokens, outputTokens int64) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+// RecordUsage records token usage for a session, priced for the model
+// with the current price table.
+func (c *Client) RecordUsage(userID, sessionID, model string, usage TokenUsage) error {
+	return c.RecordUsageBatch([]UsageRecord{{
+		UserID:     userID,
+		SessionID:  sessionID,
+		Provider:   ProviderAnthropic,
+		Model:      model,
+		TokenUsage: usage,
+		CreatedAt:  time.Now(),
+	}})
+}
+
+// RecordUsageBatch stores usage records, each priced for its model with
+// the current price table, and releases their reservations. Records whose
+// request ID is already stored are skipped, and records of sessions that
+// were deleted are stored without their session. If the database refuses
+// a record, the batch fails with ErrUsageRejected.
+func (c *Client) RecordUsageBatch(records []UsageRecord) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	var sessID *string
-	if sessionID != "" {
-		sessID = &sessionID
+	n := len(records)
+	var (
+		requestIDs   = make([]*string, n)
+		userIDs      = make([]string, n)
+		sessionIDs   = make([]*string, n)
+		providers    = make([]string, n)
+		models       = make([]string, n)
+		input        = make([]int64, n)
+		output       = make([]int64, n)
+		cacheWrite   = make([]int64, n)
+		cacheRead    = make([]int64, n)
+		costs        = make([]int64, n)
+		createdAt    = make([]time.Time, n)
+		reservations []string
+	)
+	for i, r := range records {
+		if r.RequestID != "" {
+			requestIDs[i] = &r.RequestID
+		}
+		userIDs[i] = r.UserID
+		if r.SessionID != "" {
+			sessionIDs[i] = &r.SessionID
+		}
+		providers[i] = r.provider()
+		models[i] = r.Model
+		input[i] = r.InputTokens
+		output[i] = r.OutputTokens
+		cacheWrite[i] = r.CacheCreationInputTokens
+		cacheRead[i] = r.CacheReadInputTokens
+		costs[i] = Prices.Lookup(r.Model).Cost(r.TokenUsage)
+		createdAt[i] = r.CreatedAt
+		if r.ReservationID != "" {
+			reservations = append(reservations, r.ReservationID)
+		}
 	}
 
-	_, err := c.pool.Exec(ctx,
-		`INSERT INTO usage (user_id, session_id, input_tokens, output_tokens)
-		 VALUES ($1, $2, $3, $4)`,
-		userID, sessID, inputTokens, outputTokens,
+	tx, err := c.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin recording usage: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// Usage of a session deleted before it was stored is kept without the
+	// session, instead of failing the batch on the foreign key
+	_, err = tx.Exec(ctx,
+		`INSERT INTO usage (request_id, user_id, session_id, provider, model, input_tokens, output_tokens,
+		                    cache_creation_input_tokens, cache_read_input_tokens,
+		                    cost_microusd, price_version, created_at)
+		 SELECT r.request_id, r.user_id, s.id, r.provider, r.model, r.input_tokens, r.output_tokens,
+		        r.cache_creation_input_tokens, r.cache_read_input_tokens,
+		        r.cost_microusd, $12, r.created_at
+		 FROM unnest($1::text[], $2::uuid[], $3::uuid[], $4::text[], $5::text[], $6::bigint[], $7::bigint[],
+		             $8::bigint[], $9::bigint[], $10::bigint[], $11::timestamptz[])
+		   AS r(request_id, user_id, session_id, provider, model, input_tokens, output_tokens,
+		        cache_creation_input_tokens, cache_read_input_tokens, cost_microusd, created_at)
+		 LEFT JOIN sessions s ON s.id = r.session_id
+		 ON CONFLICT (request_id) DO NOTHING`,
+		requestIDs, userIDs, sessionIDs, providers, models, input, output,
+		cacheWrite, cacheRead, costs, createdAt, Prices.Version,
 	)
 	if err != nil {
-		return fmt.Errorf("failed to record usage: %w", err)
+		return fmt.Errorf("failed to record usage: %w", rejectedUsage(err))
 	}
 
+	if len(reservations) > 0 {
+		if _, err := tx.Exec(ctx,
+			`DELETE FROM usage_reservations WHERE id = ANY($1::uuid[])`, reservations,
+		); err != nil {
+			return fmt.Errorf("failed to release reservations: %w", err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit usage: %w", err)
+	}
 	return nil
 }
 
 // GetMonthlyUsage gets total token usage for a user in the current month.
-func (c *Client) GetMonthlyUsage(userID string) (inputTokens, outputTokens int64, err error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	err = c.pool.QueryRow(ctx,
-		`SELECT COALESCE(SUM(input_tokens), 0), COALESCE(SUM(output_tokens), 0)
-		 FROM usage
-		 WHERE user_id = $1
-		   AND created_at >= date_trunc('month', NOW())`,
-		userID,
-	).Scan(&inputTokens, &outputTokens)
+func (c *Client) GetMonthlyUsage(userID string) (*UsageSummary, error) {
+	usage, err := c.sumUsage(`user_id = $1 AND created_at >= date_trunc('month', NOW())`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get monthly usage: %w", err)
+	}
+	return usage, nil
+}
 
+// GetPeriodUsage gets total token usage for a user within a subscription period.
+func (c *Client) GetPeriodUsage(userID string, periodStart time.Time) (*UsageSummary, error) {
+	usage, err := c.sumUsage(`user_id = $1 AND created_at >= $2`, userID, periodStart)
 	if err != nil {
-		return 0, 0, fmt.Errorf("failed to get monthly usage: %w", err)
+		return nil, fmt.Errorf("failed to get period usage: %w", err)
 	}
+	return usage, nil
+}
 
-	return inputTokens, outputTokens, nil
+// GetSessionUsage gets total token usage for a session.
+func (c *Client) GetSessionUsage(sessionID string) (*UsageSummary, error) {
+	usage, err := c.sumUsage(`session_id = $1`, sessionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get session usage: %w", err)
+	}
+	return usage, nil
 }
 
-// GetPeriodUsage gets total token usage for a user within a subscription period.
-func (c *Client) GetPeriodUsage(userID string, periodStart time.Time) (inputTokens, outputTokens int64, err error) {
+// sumUsage sums the usage records matching where, per provider and model.
+func (c *Client) sumUsage(where string, args ...any) (*UsageSummary, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	err = c.pool.QueryRow(ctx,
-		`SELECT COALESCE(SUM(input_tokens), 0), COALESCE(SUM(output_tokens), 0)
+	rows, err := c.pool.Query(ctx,
+		`SELECT provider, model, SUM(input_tokens), SUM(output_tokens),
+		        SUM(cache_creation_input_tokens), SUM(cache_read_input_tokens), SUM(cost_microusd)
 		 FROM usage
-		 WHERE user_id = $1
-		   AND created_at >= $2`,
-		userID, periodStart,
-	).Scan(&inputTokens, &outputTokens)
-
+		 WHERE `+where+`
+		 GROUP BY provider, model
+		 ORDER BY provider, model`,
+		args...,
+	)
 	if err != nil {
-		return 0, 0, fmt.Errorf("failed to get period usage: %w", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	summary := &UsageSummary{Models: []ModelUsage{}}
+	for rows.Next() {
+		var m ModelUsage
+		if err := rows.Scan(&m.Provider, &m.Model, &m.InputTokens, &m.OutputTokens,
+			&m.CacheCreationInputTokens, &m.CacheReadInputTokens, &m.CostMicroUSD); err != nil {
+			return nil, err
+		}
+		summary.add(m)
 	}
 
-	return inputTokens, outputTokens, nil
+	return summary, rows.Err()
 }
 
 // CheckQuota checks if a user is within their quota.
@@ -163,19 +390,13 @@ func (c *Client) CheckQuota(userID string) (bool, int64, error) {
 	}
 
 	// Free tier: check monthly usage
-	input, output, err := c.GetMonthlyUsage(userID)
+	usage, err := c.GetMonthlyUsage(userID)
 	if err != nil {
 		return false, 0, err
 	}
 
-	totalUsed := input + output
-	remaining := FreeTierMonthlyTokens - totalUsed
-
-	if remaining <= 0 {
-		return false, 0, nil
-	}
-
-	return true, remaining, nil
+	allowed, remaining := withinFreeTier(usage)
+	return allowed, remaining, nil
 }
 
 // SetStripeCustomerID sets the Stripe customer ID for a user's subscription.
@@ -251,11 +472,11 @@ func (c *Client) GetSessionByConnectToken(token string) (*Session, error) {
 
 	var session Session
 	err := c.pool.QueryRow(ctx,
-		`SELECT id, user_id, machine_id, label, connect_token, connect_url, region, status, created_at, ended_at
+		`SELECT id, user_id, machine_id, label, connect_token, connect_url, region, status, created_at, ended_at, proxy_token_hash, budget_tokens, budget_microusd
 		 FROM sessions WHERE connect_token = $1`,
 		token,
 	).Scan(&session.ID, &session.UserID, &session.MachineID, &session.Label, &session.ConnectToken,
-		&session.ConnectURL, &session.Region, &session.Status, &session.CreatedAt, &session.EndedAt)
+		&session.ConnectURL, &session.Region, &session.Status, &session.CreatedAt, &session.EndedAt, &session.ProxyTokenHash, &session.BudgetTokens, &session.BudgetMicroUSD)
 
 	if err != nil {
 		return nil, fmt.Errorf("session not found: %w", err)
@@ -0,0 +1,664 @@
+package db
+
+import (
+	"crypto/rand"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore is an in-process Store for local development and tests.
+// It is safe for concurrent use. Data is lost when the process exits.
+type MemoryStore struct {
+	mu            sync.Mutex
+	users         map[string]*User // by ID
+	sessions      map[string]*Session
+	subscriptions map[string]*Subscription // by user ID
+	usage         []Usage
+	reservations  map[string]*Reservation // by ID
+	tokens        map[string]*APIToken    // by token hash
+	secrets       map[string]*Secret      // by user ID and name
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+// NewMemoryStore creates an empty in-memory store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:         make(map[string]*User),
+		sessions:      make(map[string]*Session),
+		subscriptions: make(map[string]*Subscription),
+		reservations:  make(map[string]*Reservation),
+		tokens:        make(map[string]*APIToken),
+		secrets:       make(map[string]*Secret),
+	}
+}
+
+// GetOrCreateUser gets a user by WorkOS ID, or creates one if not found.
+func (m *MemoryStore) GetOrCreateUser(workosID, email string) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, u := range m.users {
+		if u.WorkosID == workosID {
+			user := *u
+			return &user, nil
+		}
+	}
+
+	u := &User{
+		ID:        newUUID(),
+		WorkosID:  workosID,
+		Email:     email,
+		CreatedAt: time.Now(),
+	}
+	m.users[u.ID] = u
+	user := *u
+	return &user, nil
+}
+
+// Close is a no-op; it exists to satisfy Store.
+func (m *MemoryStore) Close() {}
+
+// GetUserByWorkosID gets a user by their WorkOS ID.
+func (m *MemoryStore) GetUserByWorkosID(workosID string) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, u := range m.users {
+		if u.WorkosID == workosID {
+			user := *u
+			return &user, nil
+		}
+	}
+	return nil, fmt.Errorf("user not found: %s", workosID)
+}
+
+// GetUserByID gets a user by ID.
+func (m *MemoryStore) GetUserByID(id string) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[id]
+	if !ok {
+		return nil, fmt.Errorf("user not found: %s", id)
+	}
+	user := *u
+	return &user, nil
+}
+
+// CreateSession creates a new session.
+func (m *MemoryStore) CreateSession(session *Session) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, existing := range m.sessions {
+		if existing.Label == session.Label {
+			return nil, ErrLabelTaken
+		}
+	}
+
+	s := *session
+	s.ID = newUUID()
+	s.CreatedAt = time.Now()
+	s.EndedAt = nil
+	m.sessions[s.ID] = &s
+
+	*session = s
+	return session, nil
+}
+
+// GetSessionByID gets a session by its ID.
+func (m *MemoryStore) GetSessionByID(id string) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.sessions[id]
+	if !ok {
+		return nil, fmt.Errorf("session not found: %s", id)
+	}
+	session := *s
+	return &session, nil
+}
+
+// GetSessionByLabel gets a session by its label for a specific user.
+func (m *MemoryStore) GetSessionByLabel(userID, label string) (*Session, error) {
+	return m.findSession(func(s *Session) bool {
+		return s.UserID == userID && s.Label == label
+	})
+}
+
+// GetSessionByLabelAnyUser gets a session by its label (without user restriction).
+func (m *MemoryStore) GetSessionByLabelAnyUser(label string) (*Session, error) {
+	return m.findSession(func(s *Session) bool {
+		return s.Label == label
+	})
+}
+
+// GetSessionByConnectToken gets a session by its connect token.
+func (m *MemoryStore) GetSessionByConnectToken(token string) (*Session, error) {
+	return m.findSession(func(s *Session) bool {
+		return s.ConnectToken == token
+	})
+}
+
+// ListUserSessions lists all sessions for a user, newest first.
+func (m *MemoryStore) ListUserSessions(userID string) ([]Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var sessions []Session
+	for _, s := range m.sessions {
+		if s.UserID == userID {
+			sessions = append(sessions, *s)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].CreatedAt.After(sessions[j].CreatedAt)
+	})
+	return sessions, nil
+}
+
+// UpdateSessionStatus updates a session's status.
+func (m *MemoryStore) UpdateSessionStatus(id, status string) error {
+	return m.updateSession(id, func(s *Session) {
+		setSessionStatus(s, status)
+	})
+}
+
+// TransitionSessionStatus changes a session's status only if it is still
+// from, and reports whether it did.
+func (m *MemoryStore) TransitionSessionStatus(id, from, to string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.sessions[id]
+	if !ok || s.Status != from {
+		return false, nil
+	}
+	setSessionStatus(s, to)
+	return true, nil
+}
+
+// setSessionStatus sets a session's status, ending it if it stopped.
+func setSessionStatus(s *Session, status string) {
+	s.Status = status
+	if status == "stopped" || status == "failed" {
+		now := time.Now()
+		s.EndedAt = &now
+	}
+}
+
+// UpdateSessionMachine records the machine backing a session.
+func (m *MemoryStore) UpdateSessionMachine(id, machineID, region, connectURL string) error {
+	return m.updateSession(id, func(s *Session) {
+		s.MachineID = machineID
+		s.Region = region
+		s.ConnectURL = connectURL
+	})
+}
+
+// DeleteSession deletes a session by ID.
+func (m *MemoryStore) DeleteSession(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.sessions, id)
+	return nil
+}
+
+// RecordUsage records token usage for a session, priced for the model
+// with the current price table.
+func (m *MemoryStore) RecordUsage(userID, sessionID, model string, usage TokenUsage) error {
+	return m.RecordUsageBatch([]UsageRecord{{
+		UserID:     userID,
+		SessionID:  sessionID,
+		Provider:   ProviderAnthropic,
+		Model:      model,
+		TokenUsage: usage,
+		CreatedAt:  time.Now(),
+	}})
+}
+
+// RecordUsageBatch stores usage records, each priced for its model with
+// the current price table, and releases their reservations. Records whose
+// request ID is already stored are skipped, and records of sessions that
+// were deleted are stored without their session.
+func (m *MemoryStore) RecordUsageBatch(records []UsageRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored := make(map[string]bool)
+	for _, u := range m.usage {
+		if u.RequestID != "" {
+			stored[u.RequestID] = true
+		}
+	}
+
+	for _, r := range records {
+		delete(m.reservations, r.ReservationID)
+		if r.RequestID != "" {
+			if stored[r.RequestID] {
+				continue
+			}
+			stored[r.RequestID] = true
+		}
+
+		var sessID *string
+		if _, ok := m.sessions[r.SessionID]; ok {
+			sessionID := r.SessionID
+			sessID = &sessionID
+		}
+		m.usage = append(m.usage, Usage{
+			ID:           newUUID(),
+			RequestID:    r.RequestID,
+			UserID:       r.UserID,
+			SessionID:    sessID,
+			Provider:     r.provider(),
+			Model:        r.Model,
+			TokenUsage:   r.TokenUsage,
+			CostMicroUSD: Prices.Lookup(r.Model).Cost(r.TokenUsage),
+			PriceVersion: Prices.Version,
+			CreatedAt:    r.CreatedAt,
+		})
+	}
+	return nil
+}
+
+// GetMonthlyUsage gets total token usage for a user in the current month.
+func (m *MemoryStore) GetMonthlyUsage(userID string) (*UsageSummary, error) {
+	now := time.Now()
+	return m.GetPeriodUsage(userID, time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location()))
+}
+
+// GetPeriodUsage gets total token usage for a user since periodStart.
+func (m *MemoryStore) GetPeriodUsage(userID string, periodStart time.Time) (*UsageSummary, error) {
+	return m.sumUsage(func(u Usage) bool {
+		return u.UserID == userID && !u.CreatedAt.Before(periodStart)
+	}), nil
+}
+
+// GetSessionUsage gets total token usage for a session.
+func (m *MemoryStore) GetSessionUsage(sessionID string) (*UsageSummary, error) {
+	return m.sumUsage(func(u Usage) bool {
+		return u.SessionID != nil && *u.SessionID == sessionID
+	}), nil
+}
+
+// sumUsage sums the usage records that match, per provider and model.
+func (m *MemoryStore) sumUsage(match func(Usage) bool) *UsageSummary {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	type modelKey struct{ provider, model string }
+	byModel := make(map[modelKey]*ModelUsage)
+	for _, u := range m.usage {
+		if !match(u) {
+			continue
+		}
+		key := modelKey{u.Provider, u.Model}
+		mu, ok := byModel[key]
+		if !ok {
+			mu = &ModelUsage{Provider: u.Provider, Model: u.Model}
+			byModel[key] = mu
+		}
+		mu.TokenUsage = mu.TokenUsage.Add(u.TokenUsage)
+		mu.CostMicroUSD += u.CostMicroUSD
+	}
+
+	models := make([]ModelUsage, 0, len(byModel))
+	for _, mu := range byModel {
+		models = append(models, *mu)
+	}
+	sort.Slice(models, func(i, j int) bool {
+		if models[i].Provider != models[j].Provider {
+			return models[i].Provider < models[j].Provider
+		}
+		return models[i].Model < models[j].Model
+	})
+
+	summary := &UsageSummary{Models: []ModelUsage{}}
+	for _, mu := range models {
+		summary.add(mu)
+	}
+	return summary
+}
+
+// CheckQuota checks if a user is within their quota.
+// Returns (allowed, remainingTokens, error)
+func (m *MemoryStore) CheckQuota(userID string) (bool, int64, error) {
+	sub, err := m.GetOrCreateSubscription(userID)
+	if err != nil {
+		return false, 0, err
+	}
+
+	// Pro users have unlimited quota
+	if sub.Plan == "pro" {
+		return true, -1, nil // -1 means unlimited
+	}
+
+	// Free tier: check monthly usage
+	usage, err := m.GetMonthlyUsage(userID)
+	if err != nil {
+		return false, 0, err
+	}
+
+	allowed, remaining := withinFreeTier(usage)
+	return allowed, remaining, nil
+}
+
+// ReserveUsage reserves an estimate of a request's usage for a session,
+// unless recorded usage plus outstanding reservations plus the estimate
+// would reach the user's free tier quota or the session's budget.
+func (m *MemoryStore) ReserveUsage(session *Session, tokens, costMicroUSD int64, ttl time.Duration) (*Reservation, error) {
+	sub, err := m.GetOrCreateSubscription(session.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for id, r := range m.reservations {
+		if r.ExpiresAt.Before(now) {
+			delete(m.reservations, id)
+		}
+	}
+
+	if sub.Plan != "pro" {
+		monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+		used, cost := m.heldUsage(
+			func(u Usage) bool { return u.UserID == session.UserID && !u.CreatedAt.Before(monthStart) },
+			func(r *Reservation) bool { return r.UserID == session.UserID },
+		)
+		if overFreeTier(used+tokens, cost+costMicroUSD) {
+			return nil, ErrQuotaExceeded
+		}
+	}
+
+	if session.HasBudget() {
+		used, cost := m.heldUsage(
+			func(u Usage) bool { return u.SessionID != nil && *u.SessionID == session.ID },
+			func(r *Reservation) bool { return r.SessionID == session.ID },
+		)
+		if session.BudgetExhausted(used+tokens, cost+costMicroUSD) {
+			return nil, ErrBudgetExhausted
+		}
+	}
+
+	r := &Reservation{
+		ID:           newUUID(),
+		UserID:       session.UserID,
+		SessionID:    session.ID,
+		Tokens:       tokens,
+		CostMicroUSD: costMicroUSD,
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(ttl),
+	}
+	m.reservations[r.ID] = r
+	reservation := *r
+	return &reservation, nil
+}
+
+// heldUsage sums the quota tokens and cost of matching usage records and
+// reservations. The caller must hold m.mu.
+func (m *MemoryStore) heldUsage(usage func(Usage) bool, reservation func(*Reservation) bool) (tokens, costMicroUSD int64) {
+	for _, u := range m.usage {
+		if usage(u) {
+			tokens += u.QuotaTokens()
+			costMicroUSD += u.CostMicroUSD
+		}
+	}
+	for _, r := range m.reservations {
+		if reservation(r) {
+			tokens += r.Tokens
+			costMicroUSD += r.CostMicroUSD
+		}
+	}
+	return tokens, costMicroUSD
+}
+
+// ReleaseReservation drops a reservation without recording usage.
+func (m *MemoryStore) ReleaseReservation(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.reservations, id)
+	return nil
+}
+
+// GetOrCreateSubscription gets or creates a subscription for a user.
+func (m *MemoryStore) GetOrCreateSubscription(userID string) (*Subscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sub, ok := m.subscriptions[userID]
+	if !ok {
+		now := time.Now()
+		sub = &Subscription{
+			ID:        newUUID(),
+			UserID:    userID,
+			Plan:      "free",
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+		m.subscriptions[userID] = sub
+	}
+
+	result := *sub
+	return &result, nil
+}
+
+// UpdateSubscription updates a subscription's Stripe details.
+func (m *MemoryStore) UpdateSubscription(userID, plan, stripeCustomerID, stripeSubscriptionID string, periodStart, periodEnd time.Time) error {
+	return m.updateSubscription(userID, func(sub *Subscription) {
+		sub.Plan = plan
+		sub.StripeCustomerID = &stripeCustomerID
+		sub.StripeSubscriptionID = &stripeSubscriptionID
+		sub.CurrentPeriodStart = &periodStart
+		sub.CurrentPeriodEnd = &periodEnd
+	})
+}
+
+// UpdateSubscriptionPlan updates only the plan field.
+func (m *MemoryStore) UpdateSubscriptionPlan(userID, plan string) error {
+	return m.updateSubscription(userID, func(sub *Subscription) {
+		sub.Plan = plan
+	})
+}
+
+// UpdateSubscriptionPeriod updates the billing period dates.
+func (m *MemoryStore) UpdateSubscriptionPeriod(userID string, periodStart, periodEnd time.Time) error {
+	return m.updateSubscription(userID, func(sub *Subscription) {
+		sub.CurrentPeriodStart = &periodStart
+		sub.CurrentPeriodEnd = &periodEnd
+	})
+}
+
+// SetStripeCustomerID sets the Stripe customer ID for a user's subscription.
+func (m *MemoryStore) SetStripeCustomerID(userID, customerID string) error {
+	return m.updateSubscription(userID, func(sub *Subscription) {
+		sub.StripeCustomerID = &customerID
+	})
+}
+
+// GetUserByStripeCustomerID finds a user ID by their Stripe customer ID.
+func (m *MemoryStore) GetUserByStripeCustomerID(customerID string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, sub := range m.subscriptions {
+		if sub.StripeCustomerID != nil && *sub.StripeCustomerID == customerID {
+			return sub.UserID, nil
+		}
+	}
+	return "", fmt.Errorf("user not found for stripe customer: %s", customerID)
+}
+
+// CreateAPIToken stores a new token under its hash.
+func (m *MemoryStore) CreateAPIToken(token *APIToken, tokenHash string) (*APIToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.tokens[tokenHash]; ok {
+		return nil, fmt.Errorf("failed to create api token: duplicate hash")
+	}
+
+	t := *token
+	t.ID = newUUID()
+	t.CreatedAt = time.Now()
+	t.RevokedAt = nil
+	m.tokens[tokenHash] = &t
+
+	result := t
+	return &result, nil
+}
+
+// GetAPITokenByHash gets a token by the hash of its secret.
+// Revoked and expired tokens are returned too; callers check Active.
+func (m *MemoryStore) GetAPITokenByHash(tokenHash string) (*APIToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.tokens[tokenHash]
+	if !ok {
+		return nil, fmt.Errorf("api token not found")
+	}
+	result := *t
+	return &result, nil
+}
+
+// ListUserAPITokens lists a user's tokens that have not been revoked, newest first.
+func (m *MemoryStore) ListUserAPITokens(userID string) ([]APIToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var tokens []APIToken
+	for _, t := range m.tokens {
+		if t.UserID == userID && t.RevokedAt == nil {
+			tokens = append(tokens, *t)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.After(tokens[j].CreatedAt)
+	})
+	return tokens, nil
+}
+
+// RevokeAPIToken revokes one of a user's tokens.
+func (m *MemoryStore) RevokeAPIToken(userID, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, t := range m.tokens {
+		if t.ID == id && t.UserID == userID && t.RevokedAt == nil {
+			now := time.Now()
+			t.RevokedAt = &now
+			return nil
+		}
+	}
+	return fmt.Errorf("api token not found: %s", id)
+}
+
+// SetSecret creates or replaces one of a user's secrets.
+func (m *MemoryStore) SetSecret(userID, name string, ciphertext []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	key := userID + "/" + name
+	if s, ok := m.secrets[key]; ok {
+		s.Ciphertext = ciphertext
+		s.UpdatedAt = now
+		return nil
+	}
+	m.secrets[key] = &Secret{
+		UserID:     userID,
+		Name:       name,
+		Ciphertext: ciphertext,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	return nil
+}
+
+// ListUserSecrets lists a user's secrets by name.
+func (m *MemoryStore) ListUserSecrets(userID string) ([]Secret, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var secrets []Secret
+	for _, s := range m.secrets {
+		if s.UserID == userID {
+			secrets = append(secrets, *s)
+		}
+	}
+	sort.Slice(secrets, func(i, j int) bool {
+		return secrets[i].Name < secrets[j].Name
+	})
+	return secrets, nil
+}
+
+// DeleteSecret deletes one of a user's secrets.
+func (m *MemoryStore) DeleteSecret(userID, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := userID + "/" + name
+	if _, ok := m.secrets[key]; !ok {
+		return fmt.Errorf("secret not found: %s", name)
+	}
+	delete(m.secrets, key)
+	return nil
+}
+
+// findSession returns a copy of the first session matching fn.
+func (m *MemoryStore) findSession(fn func(*Session) bool) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, s := range m.sessions {
+		if fn(s) {
+			session := *s
+			return &session, nil
+		}
+	}
+	return nil, fmt.Errorf("session not found")
+}
+
+// updateSession applies fn to a stored session.
+func (m *MemoryStore) updateSession(id string, fn func(*Session)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.sessions[id]
+	if !ok {
+		return fmt.Errorf("session not found: %s", id)
+	}
+	fn(s)
+	return nil
+}
+
+// updateSubscription applies fn to a stored subscription. Like the SQL
+// updates, it does nothing if the user has no subscription yet.
+func (m *MemoryStore) updateSubscription(userID string, fn func(*Subscription)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if sub, ok := m.subscriptions[userID]; ok {
+		fn(sub)
+		sub.UpdatedAt = time.Now()
+	}
+	return nil
+}
+
+// newUUID generates a random version 4 UUID, matching the IDs Postgres generates.
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
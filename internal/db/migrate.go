@@ -0,0 +1,343 @@
+package db
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Migrations live in migrations/ as <version>_<name>.up.sql and
+// <version>_<name>.down.sql. Versions must be unique and increasing.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID is the advisory lock key that serializes migrations
+// across concurrent deploys.
+const migrationLockID = 7_215_001
+
+// Migration is a single versioned schema change.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus reports whether a migration has been applied.
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+}
+
+// Migrations returns the embedded migrations ordered by version.
+func Migrations() ([]Migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, fmt.Errorf("read migrations: %w", err)
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		name := entry.Name()
+
+		var direction string
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(name, ".down.sql"):
+			direction = "down"
+		default:
+			return nil, fmt.Errorf("migration %s: must end in .up.sql or .down.sql", name)
+		}
+
+		base := strings.TrimSuffix(name, "."+direction+".sql")
+		versionStr, label, ok := strings.Cut(base, "_")
+		if !ok {
+			return nil, fmt.Errorf("migration %s: expected <version>_<name>", name)
+		}
+		version, err := strconv.Atoi(versionStr)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s: invalid version %q", name, versionStr)
+		}
+
+		body, err := migrationFiles.ReadFile("migrations/" + name)
+		if err != nil {
+			return nil, fmt.Errorf("read migration %s: %w", name, err)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: label}
+			byVersion[version] = m
+		} else if m.Name != label {
+			return nil, fmt.Errorf("migration version %d used by both %s and %s", version, m.Name, label)
+		}
+		if direction == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s: missing up file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// SchemaVersion returns the version of the latest embedded migration,
+// which is the schema this build expects.
+func SchemaVersion() (int, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return 0, err
+	}
+	if len(migrations) == 0 {
+		return 0, nil
+	}
+	return migrations[len(migrations)-1].Version, nil
+}
+
+// MigrateUp applies all pending migrations, each in its own transaction.
+// Returns the migrations that were applied.
+func (c *Client) MigrateUp() ([]Migration, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.ensureMigrationsTable(); err != nil {
+		return nil, err
+	}
+
+	var applied []Migration
+	for _, m := range migrations {
+		ok, err := c.applyMigration(m, true)
+		if err != nil {
+			return applied, err
+		}
+		if ok {
+			applied = append(applied, m)
+		}
+	}
+	return applied, nil
+}
+
+// MigrateDown reverts the most recently applied migration.
+// Returns nil if no migrations have been applied.
+func (c *Client) MigrateDown() (*Migration, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.ensureMigrationsTable(); err != nil {
+		return nil, err
+	}
+
+	current, err := c.currentSchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	if current == 0 {
+		return nil, nil
+	}
+
+	for _, m := range migrations {
+		if m.Version != current {
+			continue
+		}
+		if m.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s is irreversible", m.Version, m.Name)
+		}
+		if _, err := c.applyMigration(m, false); err != nil {
+			return nil, err
+		}
+		return &m, nil
+	}
+	return nil, fmt.Errorf("applied migration %d is not known to this build", current)
+}
+
+// MigrationStatus lists every embedded migration and when it was applied.
+func (c *Client) MigrationStatus() ([]MigrationStatus, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.ensureMigrationsTable(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := c.pool.Query(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list applied migrations: %w", err)
+	}
+	defer rows.Close()
+
+	appliedAt := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, fmt.Errorf("failed to scan migration: %w", err)
+		}
+		appliedAt[version] = at
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list applied migrations: %w", err)
+	}
+
+	status := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		s := MigrationStatus{Version: m.Version, Name: m.Name}
+		if at, ok := appliedAt[m.Version]; ok {
+			s.AppliedAt = &at
+		}
+		status = append(status, s)
+	}
+	return status, nil
+}
+
+// CheckSchema returns an error unless the database is migrated to exactly
+// the schema version this build expects.
+func (c *Client) CheckSchema() error {
+	want, err := SchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var exists bool
+	if err := c.pool.QueryRow(ctx,
+		`SELECT to_regclass('schema_migrations') IS NOT NULL`,
+	).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to check schema version: %w", err)
+	}
+	if !exists {
+		return fmt.Errorf("database schema is not initialized (want version %d); run 'catty-api migrate up'", want)
+	}
+
+	got, err := c.currentSchemaVersion()
+	if err != nil {
+		return err
+	}
+	if got < want {
+		return fmt.Errorf("database schema is at version %d, want %d; run 'catty-api migrate up'", got, want)
+	}
+	if got > want {
+		return fmt.Errorf("database schema is at version %d, newer than this build (%d)", got, want)
+	}
+	return nil
+}
+
+// ensureMigrationsTable creates the schema_migrations table if needed.
+func (c *Client) ensureMigrationsTable() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := c.pool.Exec(ctx,
+		`CREATE TABLE IF NOT EXISTS schema_migrations (
+			version    INTEGER PRIMARY KEY,
+			name       TEXT NOT NULL,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)`,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+	return nil
+}
+
+// currentSchemaVersion returns the highest applied migration, or 0.
+func (c *Client) currentSchemaVersion() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var version int
+	err := c.pool.QueryRow(ctx,
+		`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`,
+	).Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get schema version: %w", err)
+	}
+	return version, nil
+}
+
+// applyMigration runs a migration up or down in a transaction holding the
+// migration lock. It returns false if there was nothing to do because
+// another process got there first.
+func (c *Client) applyMigration(m Migration, up bool) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	tx, err := c.pool.Begin(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin migration: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, migrationLockID); err != nil {
+		return false, fmt.Errorf("failed to acquire migration lock: %w", err)
+	}
+
+	var applied bool
+	if err := tx.QueryRow(ctx,
+		`SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)`,
+		m.Version,
+	).Scan(&applied); err != nil {
+		return false, fmt.Errorf("failed to check migration %d: %w", m.Version, err)
+	}
+	if applied == up {
+		return false, nil
+	}
+
+	if up {
+		err = runMigration(ctx, tx, m.Up)
+		if err == nil {
+			_, err = tx.Exec(ctx,
+				`INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`,
+				m.Version, m.Name,
+			)
+		}
+	} else {
+		err = runMigration(ctx, tx, m.Down)
+		if err == nil {
+			_, err = tx.Exec(ctx, `DELETE FROM schema_migrations WHERE version = $1`, m.Version)
+		}
+	}
+	if err != nil {
+		return false, fmt.Errorf("migration %d_%s failed: %w", m.Version, m.Name, err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return false, fmt.Errorf("failed to commit migration %d_%s: %w", m.Version, m.Name, err)
+	}
+	return true, nil
+}
+
+// runMigration executes a migration script. Without arguments pgx uses the
+// simple protocol, so a script may contain several statements.
+func runMigration(ctx context.Context, tx pgx.Tx, sql string) error {
+	_, err := tx.Exec(ctx, sql)
+	return err
+}
@@ -0,0 +1,4 @@
+DROP TABLE usage;
+DROP TABLE subscriptions;
+DROP TABLE sessions;
+DROP TABLE users;
@@ -0,0 +1,50 @@
+-- The schema catty ran with before migrations were introduced. Databases
+-- created back then already have it, so every statement is a no-op there
+-- and "catty-api migrate up" just records them as at version 1.
+
+CREATE TABLE IF NOT EXISTS users (
+    id         UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    workos_id  TEXT NOT NULL UNIQUE,
+    email      TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS sessions (
+    id            UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id       UUID NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    machine_id    TEXT NOT NULL DEFAULT '',
+    label         TEXT NOT NULL,
+    connect_token TEXT NOT NULL UNIQUE,
+    connect_url   TEXT NOT NULL DEFAULT '',
+    region        TEXT NOT NULL DEFAULT '',
+    status        TEXT NOT NULL,
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    ended_at      TIMESTAMPTZ,
+    UNIQUE (user_id, label)
+);
+
+CREATE INDEX IF NOT EXISTS sessions_label_idx ON sessions (label);
+CREATE INDEX IF NOT EXISTS sessions_user_created_idx ON sessions (user_id, created_at DESC);
+
+CREATE TABLE IF NOT EXISTS subscriptions (
+    id                     UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id                UUID NOT NULL UNIQUE REFERENCES users (id) ON DELETE CASCADE,
+    plan                   TEXT NOT NULL DEFAULT 'free',
+    stripe_customer_id     TEXT UNIQUE,
+    stripe_subscription_id TEXT,
+    current_period_start   TIMESTAMPTZ,
+    current_period_end     TIMESTAMPTZ,
+    created_at             TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at             TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS usage (
+    id            UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id       UUID NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    session_id    UUID REFERENCES sessions (id) ON DELETE SET NULL,
+    input_tokens  BIGINT NOT NULL DEFAULT 0,
+    output_tokens BIGINT NOT NULL DEFAULT 0,
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS usage_user_created_idx ON usage (user_id, created_at);
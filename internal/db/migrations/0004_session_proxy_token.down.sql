@@ -0,0 +1 @@
+ALTER TABLE sessions DROP COLUMN proxy_token_hash;
@@ -0,0 +1,3 @@
+-- Sessions created before this migration have no proxy credential and are
+-- rejected by the proxy.
+ALTER TABLE sessions ADD COLUMN proxy_token_hash TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,3 @@
+ALTER TABLE sessions DROP CONSTRAINT sessions_label_key;
+CREATE INDEX sessions_label_idx ON sessions (label);
+ALTER TABLE sessions ADD CONSTRAINT sessions_user_id_label_key UNIQUE (user_id, label);
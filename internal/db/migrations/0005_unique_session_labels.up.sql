@@ -0,0 +1,13 @@
+-- Labels identify sessions to the metering proxy, so they must be unique
+-- across all users. Older duplicates get a suffix from their ID first.
+UPDATE sessions s
+SET label = s.label || '-' || left(s.id::text, 8)
+WHERE EXISTS (
+    SELECT 1 FROM sessions o
+    WHERE o.label = s.label
+      AND (o.created_at, o.id) > (s.created_at, s.id)
+);
+
+ALTER TABLE sessions DROP CONSTRAINT sessions_user_id_label_key;
+DROP INDEX sessions_label_idx;
+ALTER TABLE sessions ADD CONSTRAINT sessions_label_key UNIQUE (label);
@@ -0,0 +1,3 @@
+ALTER TABLE usage
+    DROP COLUMN cache_creation_input_tokens,
+    DROP COLUMN cache_read_input_tokens;
@@ -0,0 +1,3 @@
+ALTER TABLE usage
+    ADD COLUMN cache_creation_input_tokens BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN cache_read_input_tokens     BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,4 @@
+ALTER TABLE usage
+    DROP COLUMN model,
+    DROP COLUMN cost_microusd,
+    DROP COLUMN price_version;
@@ -0,0 +1,7 @@
+-- Each usage record carries the model it was for and its cost in
+-- microdollars, priced with the table version named in price_version.
+-- Older records have no model and cost nothing.
+ALTER TABLE usage
+    ADD COLUMN model         TEXT NOT NULL DEFAULT '',
+    ADD COLUMN cost_microusd BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN price_version TEXT NOT NULL DEFAULT '';
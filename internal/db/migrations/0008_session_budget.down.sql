@@ -0,0 +1,3 @@
+ALTER TABLE sessions
+    DROP COLUMN budget_tokens,
+    DROP COLUMN budget_microusd;
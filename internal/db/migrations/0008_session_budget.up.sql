@@ -0,0 +1,5 @@
+-- Optional per-session spending caps enforced by the metering proxy.
+-- Zero means no cap.
+ALTER TABLE sessions
+    ADD COLUMN budget_tokens   BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN budget_microusd BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,14 @@
+-- Usage held for in-flight API requests until their actual usage is known.
+-- Reservations count against quotas and budgets until settled or expired.
+CREATE TABLE usage_reservations (
+    id            UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id       UUID NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    session_id    UUID REFERENCES sessions (id) ON DELETE SET NULL,
+    tokens        BIGINT NOT NULL,
+    cost_microusd BIGINT NOT NULL,
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at    TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX usage_reservations_user_idx ON usage_reservations (user_id);
+CREATE INDEX usage_reservations_session_idx ON usage_reservations (session_id);
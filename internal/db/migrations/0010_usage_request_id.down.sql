@@ -0,0 +1 @@
+ALTER TABLE usage DROP COLUMN request_id;
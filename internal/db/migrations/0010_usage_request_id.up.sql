@@ -0,0 +1,5 @@
+-- Anthropic's request ID for each usage record, so the proxy can replay
+-- queued records without counting them twice. Older rows have none.
+ALTER TABLE usage ADD COLUMN request_id TEXT;
+
+CREATE UNIQUE INDEX usage_request_id_idx ON usage (request_id);
@@ -0,0 +1,3 @@
+-- The API provider each usage record was metered from. Everything before
+-- this was Anthropic.
+ALTER TABLE usage ADD COLUMN provider TEXT NOT NULL DEFAULT 'anthropic';
@@ -2,10 +2,12 @@ package db
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"time"
 
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -64,6 +66,26 @@ type Session struct {
 	Status       string     `json:"status"`
 	CreatedAt    time.Time  `json:"created_at"`
 	EndedAt      *time.Time `json:"ended_at"`
+	// ProxyTokenHash is the hash of the credential the session's agent
+	// presents to the metering proxy.
+	ProxyTokenHash string `json:"-"`
+	// BudgetTokens and BudgetMicroUSD cap the session's usage; zero means
+	// no cap.
+	BudgetTokens   int64 `json:"budget_tokens,omitempty"`
+	BudgetMicroUSD int64 `json:"budget_cost_microusd,omitempty"`
+}
+
+// HasBudget reports whether the session's usage is capped.
+func (s *Session) HasBudget() bool {
+	return s.BudgetTokens > 0 || s.BudgetMicroUSD > 0
+}
+
+// BudgetExhausted reports whether usage of tokens and costMicroUSD has
+// reached either of the session's caps. tokens are quota tokens, as
+// counted by TokenUsage.QuotaTokens.
+func (s *Session) BudgetExhausted(tokens, costMicroUSD int64) bool {
+	return (s.BudgetTokens > 0 && tokens >= s.BudgetTokens) ||
+		(s.BudgetMicroUSD > 0 && costMicroUSD >= s.BudgetMicroUSD)
 }
 
 // GetOrCreateUser gets a user by WorkOS ID, or creates one if not found.
@@ -114,20 +136,30 @@ func (c *Client) GetUserByWorkosID(workosID string) (*User, error) {
 	return &user, nil
 }
 
+// ErrLabelTaken is returned by CreateSession when another session already
+// has the label. Labels are unique across all users.
+var ErrLabelTaken = errors.New("session label already taken")
+
 // CreateSession creates a new session.
 func (c *Client) CreateSession(session *Session) (*Session, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	err := c.pool.QueryRow(ctx,
-		`INSERT INTO sessions (user_id, machine_id, label, connect_token, connect_url, region, status)
-		 VALUES ($1, $2, $3, $4, $5, $6, $7)
-		 RETURNING id, user_id, machine_id, label, connect_token, connect_url, region, status, created_at, ended_at`,
-		session.UserID, session.MachineID, session.Label, session.ConnectToken, session.ConnectURL, session.Region, session.Status,
+		`INSERT INTO sessions (user_id, machine_id, label, connect_token, connect_url, region, status, proxy_token_hash,
+		                       budget_tokens, budget_microusd)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		 RETURNING id, user_id, machine_id, label, connect_token, connect_url, region, status, created_at, ended_at, proxy_token_hash, budget_tokens, budget_microusd`,
+		session.UserID, session.MachineID, session.Label, session.ConnectToken, session.ConnectURL, session.Region, session.Status, session.ProxyTokenHash,
+		session.BudgetTokens, session.BudgetMicroUSD,
 	).Scan(&session.ID, &session.UserID, &session.MachineID, &session.Label, &session.ConnectToken,
-		&session.ConnectURL, &session.Region, &session.Status, &session.CreatedAt, &session.EndedAt)
+		&session.ConnectURL, &session.Region, &session.Status, &session.CreatedAt, &session.EndedAt, &session.ProxyTokenHash, &session.BudgetTokens, &session.BudgetMicroUSD)
 
 	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" && pgErr.ConstraintName == "sessions_label_key" {
+			return nil, ErrLabelTaken
+		}
 		return nil, fmt.Errorf("failed to create session: %w", err)
 	}
 
@@ -141,11 +173,11 @@ func (c *Client) GetSessionByLabel(userID, label string) (*Session, error) {
 
 	var session Session
 	err := c.pool.QueryRow(ctx,
-		`SELECT id, user_id, machine_id, label, connect_token, connect_url, region, status, created_at, ended_at
+		`SELECT id, user_id, machine_id, label, connect_token, connect_url, region, status, created_at, ended_at, proxy_token_hash, budget_tokens, budget_microusd
 		 FROM sessions WHERE user_id = $1 AND label = $2`,
 		userID, label,
 	).Scan(&session.ID, &session.UserID, &session.MachineID, &session.Label, &session.ConnectToken,
-		&session.ConnectURL, &session.Region, &session.Status, &session.CreatedAt, &session.EndedAt)
+		&session.ConnectURL, &session.Region, &session.Status, &session.CreatedAt, &session.EndedAt, &session.ProxyTokenHash, &session.BudgetTokens, &session.BudgetMicroUSD)
 
 	if err != nil {
 		return nil, fmt.Errorf("session not found: %w", err)
@@ -155,18 +187,18 @@ func (c *Client) GetSessionByLabel(userID, label string) (*Session, error) {
 }
 
 // GetSessionByLabelAnyUser gets a session by its label (without user restriction).
-// Used by the proxy to look up sessions for metering.
+// Labels are globally unique. Used by the proxy to look up sessions for metering.
 func (c *Client) GetSessionByLabelAnyUser(label string) (*Session, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	var session Session
 	err := c.pool.QueryRow(ctx,
-		`SELECT id, user_id, machine_id, label, connect_token, connect_url, region, status, created_at, ended_at
+		`SELECT id, user_id, machine_id, label, connect_token, connect_url, region, status, created_at, ended_at, proxy_token_hash, budget_tokens, budget_microusd
 		 FROM sessions WHERE label = $1`,
 		label,
 	).Scan(&session.ID, &session.UserID, &session.MachineID, &session.Label, &session.ConnectToken,
-		&session.ConnectURL, &session.Region, &session.Status, &session.CreatedAt, &session.EndedAt)
+		&session.ConnectURL, &session.Region, &session.Status, &session.CreatedAt, &session.EndedAt, &session.ProxyTokenHash, &session.BudgetTokens, &session.BudgetMicroUSD)
 
 	if err != nil {
 		return nil, fmt.Errorf("session not found: %w", err)
@@ -182,11 +214,11 @@ func (c *Client) GetSessionByID(id string) (*Session, error) {
 
 	var session Session
 	err := c.pool.QueryRow(ctx,
-		`SELECT id, user_id, machine_id, label, connect_token, connect_url, region, status, created_at, ended_at
+		`SELECT id, user_id, machine_id, label, connect_token, connect_url, region, status, created_at, ended_at, proxy_token_hash, budget_tokens, budget_microusd
 		 FROM sessions WHERE id = $1`,
 		id,
 	).Scan(&session.ID, &session.UserID, &session.MachineID, &session.Label, &session.ConnectToken,
-		&session.ConnectURL, &session.Region, &session.Status, &session.CreatedAt, &session.EndedAt)
+		&session.ConnectURL, &session.Region, &session.Status, &session.CreatedAt, &session.EndedAt, &session.ProxyTokenHash, &session.BudgetTokens, &session.BudgetMicroUSD)
 
 	if err != nil {
 		return nil, fmt.Errorf("session not found: %w", err)
@@ -201,7 +233,7 @@ func (c *Client) ListUserSessions(userID string) ([]Session, error) {
 	defer cancel()
 
 	rows, err := c.pool.Query(ctx,
-		`SELECT id, user_id, machine_id, label, connect_token, connect_url, region, status, created_at, ended_at
+		`SELECT id, user_id, machine_id, label, connect_token, connect_url, region, status, created_at, ended_at, proxy_token_hash, budget_tokens, budget_microusd
 		 FROM sessions WHERE user_id = $1 ORDER BY created_at DESC`,
 		userID,
 	)
@@ -214,7 +246,7 @@ func (c *Client) ListUserSessions(userID string) ([]Session, error) {
 	for rows.Next() {
 		var s Session
 		if err := rows.Scan(&s.ID, &s.UserID, &s.MachineID, &s.Label, &s.ConnectToken,
-			&s.ConnectURL, &s.Region, &s.Status, &s.CreatedAt, &s.EndedAt); err != nil {
+			&s.ConnectURL, &s.Region, &s.Status, &s.CreatedAt, &s.EndedAt, &s.ProxyTokenHash, &s.BudgetTokens, &s.BudgetMicroUSD); err != nil {
 			return nil, fmt.Errorf("failed to scan session: %w", err)
 		}
 		sessions = append(sessions, s)
@@ -229,7 +261,7 @@ func (c *Client) UpdateSessionStatus(id, status string) error {
 	defer cancel()
 
 	var err error
-	if status == "stopped" {
+	if status == "stopped" || status == "failed" {
 		_, err = c.pool.Exec(ctx,
 			`UPDATE sessions SET status = $1, ended_at = NOW() WHERE id = $2`,
 			status, id,
@@ -248,6 +280,41 @@ func (c *Client) UpdateSessionStatus(id, status string) error {
 	return nil
 }
 
+// TransitionSessionStatus changes a session's status only if it is still
+// from, and reports whether it did.
+func (c *Client) TransitionSessionStatus(id, from, to string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tag, err := c.pool.Exec(ctx,
+		`UPDATE sessions
+		 SET status = $1, ended_at = CASE WHEN $1 IN ('stopped', 'failed') THEN NOW() ELSE ended_at END
+		 WHERE id = $2 AND status = $3`,
+		to, id, from,
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to update session: %w", err)
+	}
+
+	return tag.RowsAffected() == 1, nil
+}
+
+// UpdateSessionMachine records the machine backing a session once it has been created.
+func (c *Client) UpdateSessionMachine(id, machineID, region, connectURL string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := c.pool.Exec(ctx,
+		`UPDATE sessions SET machine_id = $1, region = $2, connect_url = $3 WHERE id = $4`,
+		machineID, region, connectURL, id,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update session machine: %w", err)
+	}
+
+	return nil
+}
+
 // DeleteSession deletes a session by ID.
 func (c *Client) DeleteSession(id string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
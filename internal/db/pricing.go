@@ -0,0 +1,111 @@
+package db
+
+import "time"
+
+// ModelPrice is what one model costs, in microdollars per million tokens
+// ($3/MTok is 3_000_000).
+type ModelPrice struct {
+	Input      int64 `json:"input"`
+	Output     int64 `json:"output"`
+	CacheWrite int64 `json:"cache_write"`
+	CacheRead  int64 `json:"cache_read"`
+}
+
+// Cost returns the cost of usage in microdollars, rounded up so that small
+// requests are never free.
+func (p ModelPrice) Cost(usage TokenUsage) int64 {
+	total := usage.InputTokens*p.Input +
+		usage.OutputTokens*p.Output +
+		usage.CacheCreationInputTokens*p.CacheWrite +
+		usage.CacheReadInputTokens*p.CacheRead
+	return (total + 999_999) / 1_000_000
+}
+
+// PriceTable maps model IDs to prices. Each usage record stores the version
+// of the table its cost was computed with, so a price change never rewrites
+// what was already billed.
+type PriceTable struct {
+	Version string
+	// Models is keyed by model ID. Snapshots of a model, whose IDs add a
+	// date like claude-sonnet-4-5-20250929 or gpt-4o-2024-08-06, match its
+	// entry; other models sharing a prefix with an entry don't, since newer
+	// models like o3-pro often cost more than the one they are named after.
+	Models map[string]ModelPrice
+	// Fallback prices models missing from the table.
+	Fallback ModelPrice
+}
+
+// Prices is the price table used for new usage records. Cache writes are
+// priced at Anthropic's 5-minute TTL rate; OpenAI caches prompts for free
+// and only charges for cache reads.
+var Prices = PriceTable{
+	Version: "2026-10-18",
+	Models: map[string]ModelPrice{
+		"claude-opus-4-6":   {Input: 5_000_000, Output: 25_000_000, CacheWrite: 6_250_000, CacheRead: 500_000},
+		"claude-opus-4-5":   {Input: 5_000_000, Output: 25_000_000, CacheWrite: 6_250_000, CacheRead: 500_000},
+		"claude-opus-4-1":   {Input: 15_000_000, Output: 75_000_000, CacheWrite: 18_750_000, CacheRead: 1_500_000},
+		"claude-opus-4":     {Input: 15_000_000, Output: 75_000_000, CacheWrite: 18_750_000, CacheRead: 1_500_000},
+		"claude-3-opus":     {Input: 15_000_000, Output: 75_000_000, CacheWrite: 18_750_000, CacheRead: 1_500_000},
+		"claude-sonnet-4-5": {Input: 3_000_000, Output: 15_000_000, CacheWrite: 3_750_000, CacheRead: 300_000},
+		"claude-sonnet-4":   {Input: 3_000_000, Output: 15_000_000, CacheWrite: 3_750_000, CacheRead: 300_000},
+		"claude-3-7-sonnet": {Input: 3_000_000, Output: 15_000_000, CacheWrite: 3_750_000, CacheRead: 300_000},
+		"claude-3-5-sonnet": {Input: 3_000_000, Output: 15_000_000, CacheWrite: 3_750_000, CacheRead: 300_000},
+		"claude-haiku-4-5":  {Input: 1_000_000, Output: 5_000_000, CacheWrite: 1_250_000, CacheRead: 100_000},
+		"claude-3-5-haiku":  {Input: 800_000, Output: 4_000_000, CacheWrite: 1_000_000, CacheRead: 80_000},
+		"claude-3-haiku":    {Input: 250_000, Output: 1_250_000, CacheWrite: 300_000, CacheRead: 30_000},
+
+		"gpt-5":                  {Input: 1_250_000, Output: 10_000_000, CacheRead: 125_000},
+		"gpt-5-mini":             {Input: 250_000, Output: 2_000_000, CacheRead: 25_000},
+		"gpt-5-nano":             {Input: 50_000, Output: 400_000, CacheRead: 5_000},
+		"gpt-5-pro":              {Input: 15_000_000, Output: 120_000_000, CacheRead: 15_000_000},
+		"gpt-5-codex":            {Input: 1_250_000, Output: 10_000_000, CacheRead: 125_000},
+		"gpt-5.1":                {Input: 1_250_000, Output: 10_000_000, CacheRead: 125_000},
+		"gpt-5.1-codex":          {Input: 1_250_000, Output: 10_000_000, CacheRead: 125_000},
+		"gpt-5.1-codex-mini":     {Input: 250_000, Output: 2_000_000, CacheRead: 25_000},
+		"gpt-4.1":                {Input: 2_000_000, Output: 8_000_000, CacheRead: 500_000},
+		"gpt-4.1-mini":           {Input: 400_000, Output: 1_600_000, CacheRead: 100_000},
+		"gpt-4.1-nano":           {Input: 100_000, Output: 400_000, CacheRead: 25_000},
+		"gpt-4o":                 {Input: 2_500_000, Output: 10_000_000, CacheRead: 1_250_000},
+		"gpt-4o-mini":            {Input: 150_000, Output: 600_000, CacheRead: 75_000},
+		"o3":                     {Input: 2_000_000, Output: 8_000_000, CacheRead: 500_000},
+		"o3-pro":                 {Input: 20_000_000, Output: 80_000_000},
+		"o3-deep-research":       {Input: 10_000_000, Output: 40_000_000, CacheRead: 2_500_000},
+		"o3-mini":                {Input: 1_100_000, Output: 4_400_000, CacheRead: 550_000},
+		"o4-mini":                {Input: 1_100_000, Output: 4_400_000, CacheRead: 275_000},
+		"codex-mini":             {Input: 1_500_000, Output: 6_000_000, CacheRead: 375_000},
+		"text-embedding-3-small": {Input: 20_000},
+		"text-embedding-3-large": {Input: 130_000},
+	},
+	// Unknown models are billed like Claude Opus 4, which costs more than
+	// nearly every other model
+	Fallback: ModelPrice{Input: 15_000_000, Output: 75_000_000, CacheWrite: 18_750_000, CacheRead: 1_500_000},
+}
+
+// Lookup returns the price of a model, or the fallback price for models
+// missing from the table.
+func (t PriceTable) Lookup(model string) ModelPrice {
+	if p, ok := t.Models[model]; ok {
+		return p
+	}
+	if base, ok := trimSnapshotDate(model); ok {
+		if p, ok := t.Models[base]; ok {
+			return p
+		}
+	}
+	return t.Fallback
+}
+
+// trimSnapshotDate removes the date a snapshot's model ID ends with,
+// -YYYYMMDD or -YYYY-MM-DD, reporting whether there was one.
+func trimSnapshotDate(model string) (string, bool) {
+	for _, layout := range []string{"20060102", "2006-01-02"} {
+		i := len(model) - len(layout) - 1
+		if i <= 0 || model[i] != '-' {
+			continue
+		}
+		if _, err := time.Parse(layout, model[i+1:]); err == nil {
+			return model[:i], true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,46 @@
+package db
+
+import "testing"
+
+func TestPriceLookup(t *testing.T) {
+	tests := []struct {
+		model string
+		want  string // entry the model is priced as; "" for the fallback
+	}{
+		{"claude-sonnet-4-5", "claude-sonnet-4-5"},
+		{"claude-sonnet-4-5-20250929", "claude-sonnet-4-5"},
+		{"claude-opus-4-20250514", "claude-opus-4"},
+		{"claude-opus-4-1-20250805", "claude-opus-4-1"},
+		{"claude-opus-4-6", "claude-opus-4-6"},
+		{"gpt-4o-2024-08-06", "gpt-4o"},
+		{"gpt-4o-mini-2024-07-18", "gpt-4o-mini"},
+		{"o3-2025-04-16", "o3"},
+		{"o3-pro", "o3-pro"},
+		{"o3-pro-2025-06-10", "o3-pro"},
+
+		// Newer models sharing a prefix with an entry aren't priced as it
+		{"gpt-5.2", ""},
+		{"claude-opus-4-7", ""},
+		{"claude-sonnet-4-5-latest", ""},
+		{"gpt-4o-audio-preview", ""},
+		// Neither are IDs that only look dated
+		{"o3-20251399", ""},
+		{"o3-2025-0416", ""},
+		{"-20250101", ""},
+		{"unknown-model", ""},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		want := Prices.Fallback
+		if tt.want != "" {
+			var ok bool
+			if want, ok = Prices.Models[tt.want]; !ok {
+				t.Fatalf("no price for %s", tt.want)
+			}
+		}
+		if got := Prices.Lookup(tt.model); got != want {
+			t.Errorf("Lookup(%q) = %+v, want the price of %q", tt.model, got, tt.want)
+		}
+	}
+}
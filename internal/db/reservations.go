@@ -0,0 +1,134 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ErrQuotaExceeded is returned by ReserveUsage when the user's plan has no
+// quota left for the month.
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// ErrBudgetExhausted is returned by ReserveUsage when the session has used
+// up its budget.
+var ErrBudgetExhausted = errors.New("session budget exhausted")
+
+// Reservation holds quota for an in-flight API request until its actual
+// usage is known. Reservations count against quotas and budgets like
+// recorded usage, so parallel requests can't all pass the same check.
+// Expired reservations, left by requests that never settled, are ignored
+// and reclaimed.
+type Reservation struct {
+	ID           string    `json:"id"`
+	UserID       string    `json:"user_id"`
+	SessionID    string    `json:"session_id"`
+	Tokens       int64     `json:"tokens"`
+	CostMicroUSD int64     `json:"cost_microusd"`
+	CreatedAt    time.Time `json:"created_at"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// ReserveUsage reserves an estimate of a request's usage for a session,
+// unless recorded usage plus outstanding reservations plus the estimate
+// would reach the user's free tier quota or the session's budget.
+// Reservations for one user are serialized, so each sees all earlier ones.
+func (c *Client) ReserveUsage(session *Session, tokens, costMicroUSD int64, ttl time.Duration) (*Reservation, error) {
+	sub, err := c.GetOrCreateSubscription(session.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := c.pool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin reservation: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// Held until commit
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtextextended($1, 0))`, session.UserID); err != nil {
+		return nil, fmt.Errorf("failed to lock user usage: %w", err)
+	}
+
+	// Reclaim quota held by requests that never settled
+	if _, err := tx.Exec(ctx,
+		`DELETE FROM usage_reservations WHERE user_id = $1 AND expires_at < NOW()`,
+		session.UserID,
+	); err != nil {
+		return nil, fmt.Errorf("failed to reclaim reservations: %w", err)
+	}
+
+	if sub.Plan != "pro" {
+		used, cost, err := sumHeldUsage(ctx, tx,
+			`user_id = $1 AND created_at >= date_trunc('month', NOW())`, `user_id = $1`, session.UserID)
+		if err != nil {
+			return nil, err
+		}
+		if overFreeTier(used+tokens, cost+costMicroUSD) {
+			return nil, ErrQuotaExceeded
+		}
+	}
+
+	if session.HasBudget() {
+		used, cost, err := sumHeldUsage(ctx, tx, `session_id = $1`, `session_id = $1`, session.ID)
+		if err != nil {
+			return nil, err
+		}
+		if session.BudgetExhausted(used+tokens, cost+costMicroUSD) {
+			return nil, ErrBudgetExhausted
+		}
+	}
+
+	r := Reservation{UserID: session.UserID, SessionID: session.ID, Tokens: tokens, CostMicroUSD: costMicroUSD}
+	err = tx.QueryRow(ctx,
+		`INSERT INTO usage_reservations (user_id, session_id, tokens, cost_microusd, expires_at)
+		 VALUES ($1, $2, $3, $4, NOW() + $5 * INTERVAL '1 second')
+		 RETURNING id, created_at, expires_at`,
+		r.UserID, r.SessionID, r.Tokens, r.CostMicroUSD, ttl.Seconds(),
+	).Scan(&r.ID, &r.CreatedAt, &r.ExpiresAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reserve usage: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit reservation: %w", err)
+	}
+
+	return &r, nil
+}
+
+// sumHeldUsage sums the quota tokens and cost of recorded usage matching
+// usageWhere and of live reservations matching reservationWhere.
+func sumHeldUsage(ctx context.Context, tx pgx.Tx, usageWhere, reservationWhere string, arg any) (tokens, costMicroUSD int64, err error) {
+	err = tx.QueryRow(ctx,
+		`SELECT
+		   (SELECT COALESCE(SUM(input_tokens + output_tokens), 0)
+		    FROM usage WHERE `+usageWhere+`)
+		 + (SELECT COALESCE(SUM(tokens), 0) FROM usage_reservations WHERE `+reservationWhere+` AND expires_at >= NOW()),
+		   (SELECT COALESCE(SUM(cost_microusd), 0) FROM usage WHERE `+usageWhere+`)
+		 + (SELECT COALESCE(SUM(cost_microusd), 0) FROM usage_reservations WHERE `+reservationWhere+` AND expires_at >= NOW())`,
+		arg,
+	).Scan(&tokens, &costMicroUSD)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to sum usage: %w", err)
+	}
+	return tokens, costMicroUSD, nil
+}
+
+// ReleaseReservation drops a reservation without recording usage, for
+// requests that failed or didn't use any tokens.
+func (c *Client) ReleaseReservation(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := c.pool.Exec(ctx, `DELETE FROM usage_reservations WHERE id = $1`, id); err != nil {
+		return fmt.Errorf("failed to release reservation: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Secret is a user's named secret. The value is encrypted by the API
+// before it is stored; the store only ever sees ciphertext.
+type Secret struct {
+	UserID     string    `json:"user_id"`
+	Name       string    `json:"name"`
+	Ciphertext []byte    `json:"-"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// SetSecret creates or replaces one of a user's secrets.
+func (c *Client) SetSecret(userID, name string, ciphertext []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := c.pool.Exec(ctx,
+		`INSERT INTO secrets (user_id, name, ciphertext)
+		 VALUES ($1, $2, $3)
+		 ON CONFLICT (user_id, name) DO UPDATE
+		 SET ciphertext = EXCLUDED.ciphertext, updated_at = NOW()`,
+		userID, name, ciphertext,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to set secret: %w", err)
+	}
+
+	return nil
+}
+
+// ListUserSecrets lists a user's secrets by name.
+func (c *Client) ListUserSecrets(userID string) ([]Secret, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := c.pool.Query(ctx,
+		`SELECT user_id, name, ciphertext, created_at, updated_at
+		 FROM secrets WHERE user_id = $1 ORDER BY name`,
+		userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list secrets: %w", err)
+	}
+	defer rows.Close()
+
+	var secrets []Secret
+	for rows.Next() {
+		var s Secret
+		if err := rows.Scan(&s.UserID, &s.Name, &s.Ciphertext, &s.CreatedAt, &s.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan secret: %w", err)
+		}
+		secrets = append(secrets, s)
+	}
+
+	return secrets, nil
+}
+
+// DeleteSecret deletes one of a user's secrets.
+func (c *Client) DeleteSecret(userID, name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tag, err := c.pool.Exec(ctx,
+		`DELETE FROM secrets WHERE user_id = $1 AND name = $2`,
+		userID, name,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to delete secret: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("secret not found: %s", name)
+	}
+
+	return nil
+}
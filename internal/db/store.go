@@ -0,0 +1,99 @@
+package db
+
+import (
+	"os"
+	"time"
+)
+
+// UserStore stores users.
+type UserStore interface {
+	GetOrCreateUser(workosID, email string) (*User, error)
+	GetUserByWorkosID(workosID string) (*User, error)
+	GetUserByID(id string) (*User, error)
+}
+
+// SessionStore stores sessions.
+type SessionStore interface {
+	CreateSession(session *Session) (*Session, error)
+	GetSessionByID(id string) (*Session, error)
+	GetSessionByLabel(userID, label string) (*Session, error)
+	GetSessionByLabelAnyUser(label string) (*Session, error)
+	GetSessionByConnectToken(token string) (*Session, error)
+	ListUserSessions(userID string) ([]Session, error)
+	UpdateSessionStatus(id, status string) error
+	TransitionSessionStatus(id, from, to string) (bool, error)
+	UpdateSessionMachine(id, machineID, region, connectURL string) error
+	DeleteSession(id string) error
+}
+
+// SubscriptionStore stores subscriptions and their Stripe details.
+type SubscriptionStore interface {
+	GetOrCreateSubscription(userID string) (*Subscription, error)
+	UpdateSubscription(userID, plan, stripeCustomerID, stripeSubscriptionID string, periodStart, periodEnd time.Time) error
+	UpdateSubscriptionPlan(userID, plan string) error
+	UpdateSubscriptionPeriod(userID string, periodStart, periodEnd time.Time) error
+	SetStripeCustomerID(userID, customerID string) error
+	GetUserByStripeCustomerID(customerID string) (string, error)
+}
+
+// UsageStore records token usage and enforces quotas.
+type UsageStore interface {
+	RecordUsage(userID, sessionID, model string, usage TokenUsage) error
+	RecordUsageBatch(records []UsageRecord) error
+	GetMonthlyUsage(userID string) (*UsageSummary, error)
+	GetPeriodUsage(userID string, periodStart time.Time) (*UsageSummary, error)
+	GetSessionUsage(sessionID string) (*UsageSummary, error)
+	CheckQuota(userID string) (bool, int64, error)
+	ReserveUsage(session *Session, tokens, costMicroUSD int64, ttl time.Duration) (*Reservation, error)
+	ReleaseReservation(id string) error
+}
+
+// TokenStore stores hashed personal access tokens.
+type TokenStore interface {
+	CreateAPIToken(token *APIToken, tokenHash string) (*APIToken, error)
+	GetAPITokenByHash(tokenHash string) (*APIToken, error)
+	ListUserAPITokens(userID string) ([]APIToken, error)
+	RevokeAPIToken(userID, id string) error
+}
+
+// SecretStore stores users' encrypted secrets.
+type SecretStore interface {
+	SetSecret(userID, name string, ciphertext []byte) error
+	ListUserSecrets(userID string) ([]Secret, error)
+	DeleteSecret(userID, name string) error
+}
+
+// Store is the storage used by the API and the proxy.
+// *Client implements it on top of PostgreSQL; MemoryStore keeps everything
+// in process.
+type Store interface {
+	UserStore
+	SessionStore
+	SubscriptionStore
+	UsageStore
+	TokenStore
+	SecretStore
+	Close()
+}
+
+var _ Store = (*Client)(nil)
+
+// Open opens the store selected by DATABASE_URL. "memory://" selects an
+// in-memory store, which is only suitable when the API and proxy share a
+// process; anything else is treated as a PostgreSQL connection string.
+// PostgreSQL stores must already be migrated to this build's schema.
+func Open() (Store, error) {
+	if os.Getenv("DATABASE_URL") == "memory://" {
+		return NewMemoryStore(), nil
+	}
+
+	client, err := NewClient()
+	if err != nil {
+		return nil, err
+	}
+	if err := client.CheckSchema(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
@@ -0,0 +1,558 @@
+package db
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The store tests run against MemoryStore, and against PostgreSQL when
+// DATABASE_URL points at a database they may migrate and write to. Every
+// test creates its own users, so they don't depend on what is already
+// stored.
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+func TestPostgresStore(t *testing.T) {
+	url := os.Getenv("DATABASE_URL")
+	if url == "" || url == "memory://" {
+		t.Skip("DATABASE_URL not set")
+	}
+	client, err := NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.MigrateUp(); err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, client)
+}
+
+// testStore runs the store tests against s.
+func testStore(t *testing.T, s Store) {
+	t.Run("Users", func(t *testing.T) { testUsers(t, s) })
+	t.Run("Sessions", func(t *testing.T) { testSessions(t, s) })
+	t.Run("SessionStatus", func(t *testing.T) { testSessionStatus(t, s) })
+	t.Run("Usage", func(t *testing.T) { testUsage(t, s) })
+	t.Run("UsageBatchDedup", func(t *testing.T) { testUsageBatchDedup(t, s) })
+	t.Run("UsageOfDeletedSession", func(t *testing.T) { testUsageOfDeletedSession(t, s) })
+	t.Run("Reservations", func(t *testing.T) { testReservations(t, s) })
+	t.Run("ConcurrentReservations", func(t *testing.T) { testConcurrentReservations(t, s) })
+	t.Run("Quota", func(t *testing.T) { testQuota(t, s) })
+	t.Run("APITokens", func(t *testing.T) { testAPITokens(t, s) })
+	t.Run("Secrets", func(t *testing.T) { testSecrets(t, s) })
+}
+
+// newTestUser creates a user with a unique WorkOS ID.
+func newTestUser(t *testing.T, s Store) *User {
+	t.Helper()
+	user, err := s.GetOrCreateUser("user_"+newUUID(), "test@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// newTestSession creates a running session for a user.
+func newTestSession(t *testing.T, s Store, user *User, budgetTokens int64) *Session {
+	t.Helper()
+	session, err := s.CreateSession(&Session{
+		UserID:       user.ID,
+		Label:        "test-" + newUUID(),
+		ConnectToken: newUUID(),
+		Region:       "iad",
+		Status:       "running",
+		BudgetTokens: budgetTokens,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return session
+}
+
+func testUsers(t *testing.T, s Store) {
+	user := newTestUser(t, s)
+
+	again, err := s.GetOrCreateUser(user.WorkosID, user.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ID != user.ID {
+		t.Errorf("GetOrCreateUser created a second user for %s", user.WorkosID)
+	}
+
+	if got, err := s.GetUserByWorkosID(user.WorkosID); err != nil || got.ID != user.ID {
+		t.Errorf("GetUserByWorkosID = %v, %v; want user %s", got, err, user.ID)
+	}
+	if got, err := s.GetUserByID(user.ID); err != nil || got.WorkosID != user.WorkosID {
+		t.Errorf("GetUserByID = %v, %v; want user %s", got, err, user.WorkosID)
+	}
+	if _, err := s.GetUserByWorkosID("user_" + newUUID()); err == nil {
+		t.Error("GetUserByWorkosID found an unknown user")
+	}
+}
+
+func testSessions(t *testing.T, s Store) {
+	user := newTestUser(t, s)
+	first := newTestSession(t, s, user, 0)
+	time.Sleep(time.Millisecond) // Order by creation time
+	second := newTestSession(t, s, user, 0)
+
+	if first.ID == "" || first.CreatedAt.IsZero() {
+		t.Fatalf("CreateSession did not fill in ID and creation time: %+v", first)
+	}
+
+	lookups := map[string]func() (*Session, error){
+		"GetSessionByID":           func() (*Session, error) { return s.GetSessionByID(first.ID) },
+		"GetSessionByLabel":        func() (*Session, error) { return s.GetSessionByLabel(user.ID, first.Label) },
+		"GetSessionByLabelAnyUser": func() (*Session, error) { return s.GetSessionByLabelAnyUser(first.Label) },
+		"GetSessionByConnectToken": func() (*Session, error) { return s.GetSessionByConnectToken(first.ConnectToken) },
+	}
+	for name, lookup := range lookups {
+		if got, err := lookup(); err != nil || got.ID != first.ID {
+			t.Errorf("%s = %v, %v; want session %s", name, got, err, first.ID)
+		}
+	}
+
+	// Labels are unique across users
+	other := newTestUser(t, s)
+	_, err := s.CreateSession(&Session{UserID: other.ID, Label: first.Label, ConnectToken: newUUID(), Status: "running"})
+	if !errors.Is(err, ErrLabelTaken) {
+		t.Errorf("CreateSession with a taken label: got %v, want ErrLabelTaken", err)
+	}
+	if _, err := s.GetSessionByLabel(other.ID, first.Label); err == nil {
+		t.Error("GetSessionByLabel found another user's session")
+	}
+
+	sessions, err := s.ListUserSessions(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 || sessions[0].ID != second.ID || sessions[1].ID != first.ID {
+		t.Errorf("ListUserSessions did not list both sessions newest first: %+v", sessions)
+	}
+
+	if err := s.UpdateSessionMachine(first.ID, "machine-1", "ord", "wss://example.com/connect"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.GetSessionByID(first.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.MachineID != "machine-1" || got.Region != "ord" || got.ConnectURL != "wss://example.com/connect" {
+		t.Errorf("UpdateSessionMachine did not update the machine: %+v", got)
+	}
+
+	if err := s.DeleteSession(first.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetSessionByID(first.ID); err == nil {
+		t.Error("GetSessionByID found a deleted session")
+	}
+}
+
+func testSessionStatus(t *testing.T, s Store) {
+	user := newTestUser(t, s)
+	session := newTestSession(t, s, user, 0)
+
+	if err := s.UpdateSessionStatus(session.ID, "provisioning"); err != nil {
+		t.Fatal(err)
+	}
+	moved, err := s.TransitionSessionStatus(session.ID, "running", "failed")
+	if err != nil || moved {
+		t.Errorf("TransitionSessionStatus from the wrong status = %v, %v; want false", moved, err)
+	}
+	moved, err = s.TransitionSessionStatus(session.ID, "provisioning", "running")
+	if err != nil || !moved {
+		t.Errorf("TransitionSessionStatus = %v, %v; want true", moved, err)
+	}
+	got, err := s.GetSessionByID(session.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != "running" || got.EndedAt != nil {
+		t.Errorf("got status %q ended at %v, want running and not ended", got.Status, got.EndedAt)
+	}
+
+	if err := s.UpdateSessionStatus(session.ID, "stopped"); err != nil {
+		t.Fatal(err)
+	}
+	got, err = s.GetSessionByID(session.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != "stopped" || got.EndedAt == nil {
+		t.Errorf("got status %q ended at %v, want stopped and ended", got.Status, got.EndedAt)
+	}
+
+	if moved, err := s.TransitionSessionStatus(newUUID(), "provisioning", "running"); err != nil || moved {
+		t.Errorf("TransitionSessionStatus of a missing session = %v, %v; want false", moved, err)
+	}
+}
+
+func testUsage(t *testing.T, s Store) {
+	user := newTestUser(t, s)
+	session := newTestSession(t, s, user, 0)
+	other := newTestSession(t, s, user, 0)
+
+	sonnet := TokenUsage{InputTokens: 100, OutputTokens: 50, CacheCreationInputTokens: 20, CacheReadInputTokens: 1000}
+	gpt := TokenUsage{InputTokens: 10, OutputTokens: 5}
+	now := time.Now()
+	err := s.RecordUsageBatch([]UsageRecord{
+		{RequestID: "req_" + newUUID(), UserID: user.ID, SessionID: session.ID, Model: "claude-sonnet-4-5", TokenUsage: sonnet, CreatedAt: now},
+		{RequestID: "req_" + newUUID(), UserID: user.ID, SessionID: session.ID, Model: "claude-sonnet-4-5", TokenUsage: sonnet, CreatedAt: now},
+		{RequestID: "req_" + newUUID(), UserID: user.ID, SessionID: other.ID, Provider: ProviderOpenAI, Model: "gpt-5", TokenUsage: gpt, CreatedAt: now},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	summary, err := s.GetSessionUsage(session.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantUsage := sonnet.Add(sonnet)
+	wantCost := 2 * Prices.Lookup("claude-sonnet-4-5").Cost(sonnet)
+	if summary.TokenUsage != wantUsage || summary.CostMicroUSD != wantCost {
+		t.Errorf("session usage = %+v costing %d, want %+v costing %d", summary.TokenUsage, summary.CostMicroUSD, wantUsage, wantCost)
+	}
+	if len(summary.Models) != 1 || summary.Models[0].Provider != ProviderAnthropic || summary.Models[0].Model != "claude-sonnet-4-5" {
+		t.Errorf("session usage models = %+v, want only anthropic claude-sonnet-4-5", summary.Models)
+	}
+
+	monthly, err := s.GetMonthlyUsage(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if monthly.TokenUsage != wantUsage.Add(gpt) || len(monthly.Models) != 2 {
+		t.Errorf("monthly usage = %+v over %d models, want %+v over 2", monthly.TokenUsage, len(monthly.Models), wantUsage.Add(gpt))
+	}
+
+	later, err := s.GetPeriodUsage(user.ID, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !later.TokenUsage.IsZero() || len(later.Models) != 0 {
+		t.Errorf("usage after the records = %+v, want none", later)
+	}
+}
+
+func testUsageBatchDedup(t *testing.T, s Store) {
+	user := newTestUser(t, s)
+	session := newTestSession(t, s, user, 0)
+	usage := TokenUsage{InputTokens: 10, OutputTokens: 10}
+	record := UsageRecord{
+		RequestID:  "req_" + newUUID(),
+		UserID:     user.ID,
+		SessionID:  session.ID,
+		Model:      "claude-gpt-4-5",
+		TokenUsage: usage,
+		CreatedAt:  time.Now(),
+	}
+
+	// Repeats within a batch and across batches, as a replayed log has
+	if err := s.RecordUsageBatch([]UsageRecord{record, record}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RecordUsageBatch([]UsageRecord{record}); err != nil {
+		t.Fatal(err)
+	}
+
+	summary, err := s.GetSessionUsage(session.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.TokenUsage != usage {
+		t.Errorf("usage = %+v, want one record of %+v", summary.TokenUsage, usage)
+	}
+}
+
+func testUsageOfDeletedSession(t *testing.T, s Store) {
+	user := newTestUser(t, s)
+	session := newTestSession(t, s, user, 0)
+	if err := s.DeleteSession(session.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// A session deleted while its usage is queued doesn't lose the usage,
+	// or the rest of the batch
+	usage := TokenUsage{InputTokens: 10, OutputTokens: 10}
+	err := s.RecordUsageBatch([]UsageRecord{
+		{RequestID: "req_" + newUUID(), UserID: user.ID, SessionID: session.ID, Model: "claude-sonnet-4-5", TokenUsage: usage, CreatedAt: time.Now()},
+		{RequestID: "req_" + newUUID(), UserID: user.ID, Model: "claude-sonnet-4-5", TokenUsage: usage, CreatedAt: time.Now()},
+	})
+	if err != nil {
+		t.Fatalf("RecordUsageBatch for a deleted session: %v", err)
+	}
+
+	monthly, err := s.GetMonthlyUsage(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := usage.Add(usage); monthly.TokenUsage != want {
+		t.Errorf("monthly usage = %+v, want %+v", monthly.TokenUsage, want)
+	}
+}
+
+func testReservations(t *testing.T, s Store) {
+	user := newTestUser(t, s)
+	session := newTestSession(t, s, user, 1000)
+
+	// Reservations count against the budget until released, and one that
+	// would take usage past it is refused
+	first, err := s.ReserveUsage(session, 600, 0, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ReserveUsage(session, 600, 0, time.Minute); !errors.Is(err, ErrBudgetExhausted) {
+		t.Fatalf("reserving past the budget: got %v, want ErrBudgetExhausted", err)
+	}
+	second, err := s.ReserveUsage(session, 300, 0, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ReserveUsage(session, 100, 0, time.Minute); !errors.Is(err, ErrBudgetExhausted) {
+		t.Fatalf("reserving up to the budget: got %v, want ErrBudgetExhausted", err)
+	}
+
+	if err := s.ReleaseReservation(second.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ReserveUsage(session, 1, 0, time.Minute); err != nil {
+		t.Fatalf("reserving after a release: %v", err)
+	}
+
+	// Settling replaces a reservation with what was actually used
+	err = s.RecordUsageBatch([]UsageRecord{{
+		RequestID:     "req_" + newUUID(),
+		UserID:        user.ID,
+		SessionID:     session.ID,
+		ReservationID: first.ID,
+		Model:         "claude-gpt-4-5",
+		TokenUsage:    TokenUsage{InputTokens: 100},
+		CreatedAt:     time.Now(),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ReserveUsage(session, 800, 0, time.Minute); err != nil {
+		t.Fatalf("reserving after settling: %v", err)
+	}
+
+	// Expired reservations don't count
+	expiring := newTestSession(t, s, user, 1000)
+	if _, err := s.ReserveUsage(expiring, 900, 0, -time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ReserveUsage(expiring, 900, 0, time.Minute); err != nil {
+		t.Errorf("expired reservation still counts: %v", err)
+	}
+}
+
+func testConcurrentReservations(t *testing.T, s Store) {
+	const workers = 20
+
+	// Each runs many requests at once, like sub-agents do. Every request
+	// fits on its own, but only some fit together
+	tests := []struct {
+		name         string
+		budgetTokens int64
+		limit        int64
+		tokens       int64
+		want         error
+	}{
+		{"budget", 1000, 1000, 150, ErrBudgetExhausted},
+		{"free tier", 0, FreeTierMonthlyTokens, FreeTierMonthlyTokens / 8, ErrQuotaExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := newTestUser(t, s)
+			session := newTestSession(t, s, user, tt.budgetTokens)
+
+			var (
+				wg       sync.WaitGroup
+				mu       sync.Mutex
+				reserved int64
+			)
+			for range workers {
+				wg.Go(func() {
+					_, err := s.ReserveUsage(session, tt.tokens, 0, time.Minute)
+					switch {
+					case err == nil:
+						mu.Lock()
+						reserved += tt.tokens
+						mu.Unlock()
+					case !errors.Is(err, tt.want):
+						t.Errorf("ReserveUsage: %v", err)
+					}
+				})
+			}
+			wg.Wait()
+
+			if reserved == 0 || reserved > tt.limit {
+				t.Errorf("reserved %d tokens in parallel, want some but at most %d", reserved, tt.limit)
+			}
+		})
+	}
+}
+
+func testQuota(t *testing.T, s Store) {
+	user := newTestUser(t, s)
+	session := newTestSession(t, s, user, 0)
+
+	allowed, remaining, err := s.CheckQuota(user.ID)
+	if err != nil || !allowed || remaining != FreeTierMonthlyTokens {
+		t.Errorf("CheckQuota of a new user = %v, %d, %v; want the whole free tier", allowed, remaining, err)
+	}
+
+	// Cache tokens only count through their cost: twice the token limit
+	// in cache reads costs $0.20
+	err = s.RecordUsageBatch([]UsageRecord{{
+		RequestID:  "req_" + newUUID(),
+		UserID:     user.ID,
+		SessionID:  session.ID,
+		Model:      "claude-haiku-4-5",
+		TokenUsage: TokenUsage{InputTokens: 1000, CacheReadInputTokens: 2 * FreeTierMonthlyTokens},
+		CreatedAt:  time.Now(),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowed, remaining, err = s.CheckQuota(user.ID)
+	if err != nil || !allowed || remaining != FreeTierMonthlyTokens-1000 {
+		t.Errorf("CheckQuota after cache reads = %v, %d, %v; want %d tokens left", allowed, remaining, err, FreeTierMonthlyTokens-1000)
+	}
+	reservation, err := s.ReserveUsage(session, 1, 0, time.Minute)
+	if err != nil {
+		t.Fatalf("reserving after cache reads: %v", err)
+	}
+	if err := s.ReleaseReservation(reservation.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.RecordUsageBatch([]UsageRecord{{
+		RequestID:  "req_" + newUUID(),
+		UserID:     user.ID,
+		SessionID:  session.ID,
+		Model:      "claude-gpt-4-5",
+		TokenUsage: TokenUsage{InputTokens: FreeTierMonthlyTokens},
+		CreatedAt:  time.Now(),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allowed, _, err := s.CheckQuota(user.ID); err != nil || allowed {
+		t.Errorf("CheckQuota over the free tier = %v, %v; want not allowed", allowed, err)
+	}
+	if _, err := s.ReserveUsage(session, 1, 0, time.Minute); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("reserving over the free tier: got %v, want ErrQuotaExceeded", err)
+	}
+
+	// Pro users are unlimited
+	if err := s.UpdateSubscriptionPlan(user.ID, "pro"); err != nil {
+		t.Fatal(err)
+	}
+	if allowed, remaining, err := s.CheckQuota(user.ID); err != nil || !allowed || remaining != -1 {
+		t.Errorf("CheckQuota of a pro user = %v, %d, %v; want unlimited", allowed, remaining, err)
+	}
+	if _, err := s.ReserveUsage(session, 1, 0, time.Minute); err != nil {
+		t.Errorf("reserving as a pro user: %v", err)
+	}
+}
+
+func testAPITokens(t *testing.T, s Store) {
+	user := newTestUser(t, s)
+	hash := HashToken("catty_pat_" + newUUID())
+	token, err := s.CreateAPIToken(&APIToken{UserID: user.ID, Name: "ci", Prefix: "catty_pat_abc", Scopes: []string{"sessions:read"}}, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.ID == "" || !token.Active() {
+		t.Fatalf("CreateAPIToken = %+v, want an active token with an ID", token)
+	}
+
+	got, err := s.GetAPITokenByHash(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != token.ID || len(got.Scopes) != 1 || got.Scopes[0] != "sessions:read" {
+		t.Errorf("GetAPITokenByHash = %+v, want %+v", got, token)
+	}
+
+	tokens, err := s.ListUserAPITokens(user.ID)
+	if err != nil || len(tokens) != 1 {
+		t.Errorf("ListUserAPITokens = %v, %v; want the token", tokens, err)
+	}
+
+	// Only the owner can revoke a token, and only once
+	other := newTestUser(t, s)
+	if err := s.RevokeAPIToken(other.ID, token.ID); err == nil {
+		t.Error("another user revoked the token")
+	}
+	if err := s.RevokeAPIToken(user.ID, token.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RevokeAPIToken(user.ID, token.ID); err == nil {
+		t.Error("revoked the token twice")
+	}
+
+	got, err = s.GetAPITokenByHash(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Active() {
+		t.Error("revoked token is still active")
+	}
+	if tokens, err := s.ListUserAPITokens(user.ID); err != nil || len(tokens) != 0 {
+		t.Errorf("ListUserAPITokens after revoking = %v, %v; want none", tokens, err)
+	}
+}
+
+func testSecrets(t *testing.T, s Store) {
+	user := newTestUser(t, s)
+	if err := s.SetSecret(user.ID, "GITHUB_TOKEN", []byte("sealed-1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetSecret(user.ID, "API_KEY", []byte("sealed-2")); err != nil {
+		t.Fatal(err)
+	}
+	// Setting a secret again replaces it
+	if err := s.SetSecret(user.ID, "GITHUB_TOKEN", []byte("sealed-3")); err != nil {
+		t.Fatal(err)
+	}
+
+	secrets, err := s.ListUserSecrets(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secrets) != 2 || secrets[0].Name != "API_KEY" || secrets[1].Name != "GITHUB_TOKEN" {
+		t.Fatalf("ListUserSecrets = %+v, want API_KEY and GITHUB_TOKEN", secrets)
+	}
+	if string(secrets[0].Ciphertext) != "sealed-2" || string(secrets[1].Ciphertext) != "sealed-3" {
+		t.Errorf("stored ciphertexts %q and %q, want sealed-2 and sealed-3", secrets[0].Ciphertext, secrets[1].Ciphertext)
+	}
+
+	// Secrets are per user
+	other := newTestUser(t, s)
+	if secrets, err := s.ListUserSecrets(other.ID); err != nil || len(secrets) != 0 {
+		t.Errorf("another user's secrets = %v, %v; want none", secrets, err)
+	}
+	if err := s.DeleteSecret(other.ID, "API_KEY"); err == nil {
+		t.Error("another user deleted the secret")
+	}
+
+	if err := s.DeleteSecret(user.ID, "API_KEY"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteSecret(user.ID, "API_KEY"); err == nil {
+		t.Error("deleted the secret twice")
+	}
+	if secrets, err := s.ListUserSecrets(user.ID); err != nil || len(secrets) != 1 {
+		t.Errorf("ListUserSecrets after deleting = %v, %v; want only GITHUB_TOKEN", secrets, err)
+	}
+}
@@ -0,0 +1,145 @@
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// APIToken is a personal access token. Only a hash of the token is stored;
+// Prefix keeps the first few characters so users can tell tokens apart.
+type APIToken struct {
+	ID        string     `json:"id"`
+	UserID    string     `json:"user_id"`
+	Name      string     `json:"name"`
+	Prefix    string     `json:"prefix"`
+	Scopes    []string   `json:"scopes"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Active returns true if the token is neither revoked nor expired.
+func (t *APIToken) Active() bool {
+	if t.RevokedAt != nil {
+		return false
+	}
+	return t.ExpiresAt == nil || time.Now().Before(*t.ExpiresAt)
+}
+
+// HashToken returns the hex SHA-256 of a token. Personal access tokens and
+// session proxy credentials are stored by this hash, and the API caches
+// access tokens by it. Tokens are long and random, so a slow password hash
+// isn't needed.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// GetUserByID gets a user by ID.
+func (c *Client) GetUserByID(id string) (*User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var user User
+	err := c.pool.QueryRow(ctx,
+		`SELECT id, workos_id, email, created_at FROM users WHERE id = $1`,
+		id,
+	).Scan(&user.ID, &user.WorkosID, &user.Email, &user.CreatedAt)
+
+	if err != nil {
+		return nil, fmt.Errorf("user not found: %w", err)
+	}
+
+	return &user, nil
+}
+
+// CreateAPIToken stores a new token under its hash.
+func (c *Client) CreateAPIToken(token *APIToken, tokenHash string) (*APIToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := c.pool.QueryRow(ctx,
+		`INSERT INTO api_tokens (user_id, name, token_hash, prefix, scopes, expires_at)
+		 VALUES ($1, $2, $3, $4, $5, $6)
+		 RETURNING id, user_id, name, prefix, scopes, created_at, expires_at, revoked_at`,
+		token.UserID, token.Name, tokenHash, token.Prefix, token.Scopes, token.ExpiresAt,
+	).Scan(&token.ID, &token.UserID, &token.Name, &token.Prefix, &token.Scopes,
+		&token.CreatedAt, &token.ExpiresAt, &token.RevokedAt)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to create api token: %w", err)
+	}
+
+	return token, nil
+}
+
+// GetAPITokenByHash gets a token by the hash of its secret.
+// Revoked and expired tokens are returned too; callers check Active.
+func (c *Client) GetAPITokenByHash(tokenHash string) (*APIToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var t APIToken
+	err := c.pool.QueryRow(ctx,
+		`SELECT id, user_id, name, prefix, scopes, created_at, expires_at, revoked_at
+		 FROM api_tokens WHERE token_hash = $1`,
+		tokenHash,
+	).Scan(&t.ID, &t.UserID, &t.Name, &t.Prefix, &t.Scopes, &t.CreatedAt, &t.ExpiresAt, &t.RevokedAt)
+
+	if err != nil {
+		return nil, fmt.Errorf("api token not found: %w", err)
+	}
+
+	return &t, nil
+}
+
+// ListUserAPITokens lists a user's tokens that have not been revoked, newest first.
+func (c *Client) ListUserAPITokens(userID string) ([]APIToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := c.pool.Query(ctx,
+		`SELECT id, user_id, name, prefix, scopes, created_at, expires_at, revoked_at
+		 FROM api_tokens WHERE user_id = $1 AND revoked_at IS NULL ORDER BY created_at DESC`,
+		userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list api tokens: %w", err)
+	}
+	defer rows.Close()
+
+	var tokens []APIToken
+	for rows.Next() {
+		var t APIToken
+		if err := rows.Scan(&t.ID, &t.UserID, &t.Name, &t.Prefix, &t.Scopes,
+			&t.CreatedAt, &t.ExpiresAt, &t.RevokedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan api token: %w", err)
+		}
+		tokens = append(tokens, t)
+	}
+
+	return tokens, nil
+}
+
+// RevokeAPIToken revokes one of a user's tokens.
+func (c *Client) RevokeAPIToken(userID, id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tag, err := c.pool.Exec(ctx,
+		`UPDATE api_tokens SET revoked_at = NOW()
+		 WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL`,
+		id, userID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to revoke api token: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("api token not found: %s", id)
+	}
+
+	return nil
+}
@@ -0,0 +1,71 @@
+package executor
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/izalutski/catty/internal/protocol"
+)
+
+// budgetPollInterval is how often the executor asks the metering proxy
+// whether the session's budget has run out.
+const budgetPollInterval = 30 * time.Second
+
+// watchBudget polls the session's budget status until it is exhausted,
+// then tells connected clients. The proxy already refuses further API
+// requests; the notice explains why the agent stopped getting answers.
+func (s *Server) watchBudget(url, apiKey string) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	for {
+		status, err := fetchBudget(client, url, apiKey)
+		if err != nil {
+			slog.Warn("failed to check session budget", "error", err)
+		} else if status.Exhausted {
+			slog.Info("session budget exhausted",
+				"used_tokens", status.UsedTokens, "used_cost_microusd", status.UsedCostMicroUSD)
+			s.notify(budgetNotice(status))
+			return
+		}
+		time.Sleep(budgetPollInterval)
+	}
+}
+
+// fetchBudget gets the session's budget status from the metering proxy.
+func fetchBudget(client *http.Client, url, apiKey string) (*protocol.BudgetStatus, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-api-key", apiKey)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("budget status returned %s", resp.Status)
+	}
+
+	var status protocol.BudgetStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// budgetNotice describes an exhausted budget to the user.
+func budgetNotice(status *protocol.BudgetStatus) string {
+	used := fmt.Sprintf("%d tokens", status.UsedTokens)
+	if status.BudgetCostMicroUSD > 0 && status.UsedCostMicroUSD >= status.BudgetCostMicroUSD {
+		used = fmt.Sprintf("$%.2f of $%.2f", float64(status.UsedCostMicroUSD)/1_000_000, float64(status.BudgetCostMicroUSD)/1_000_000)
+	} else if status.BudgetTokens > 0 {
+		used = fmt.Sprintf("%d of %d tokens", status.UsedTokens, status.BudgetTokens)
+	}
+	return fmt.Sprintf("Session budget exhausted (%s used). The agent's API requests will be refused; "+
+		"start a new session with a larger --budget to continue.", used)
+}
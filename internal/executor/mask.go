@@ -0,0 +1,98 @@
+package executor
+
+import (
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/izalutski/catty/internal/protocol"
+)
+
+// maskMinLength is the shortest value that is masked. Masking values like
+// "1" or "dev" would mangle every log line without hiding anything.
+const maskMinLength = 4
+
+// maskPlaceholder replaces masked values in logs.
+const maskPlaceholder = "****"
+
+// logMask holds the secret values masked by writers from NewLogWriter.
+var logMask = &masker{values: make(map[string]bool)}
+
+type masker struct {
+	mu       sync.RWMutex
+	values   map[string]bool
+	replacer *strings.Replacer
+}
+
+// maskEnv registers the values of the variables listed in MaskEnvVar,
+// looked up with lookup.
+func maskEnv(lookup func(string) string) {
+	names := lookup(protocol.MaskEnvVar)
+	if names == "" {
+		return
+	}
+	var values []string
+	for _, name := range strings.Split(names, ",") {
+		if v := lookup(name); len(v) >= maskMinLength {
+			values = append(values, v)
+		}
+	}
+	logMask.add(values)
+}
+
+// add registers values and rebuilds the replacer.
+func (m *masker) add(values []string) {
+	if len(values) == 0 {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, v := range values {
+		m.values[v] = true
+	}
+
+	// Longest first, so a value containing another is masked whole
+	all := make([]string, 0, len(m.values))
+	for v := range m.values {
+		all = append(all, v)
+	}
+	sort.Slice(all, func(i, j int) bool { return len(all[i]) > len(all[j]) })
+
+	pairs := make([]string, 0, 2*len(all))
+	for _, v := range all {
+		pairs = append(pairs, v, maskPlaceholder)
+	}
+	m.replacer = strings.NewReplacer(pairs...)
+}
+
+// mask returns s with all registered values replaced.
+func (m *masker) mask(s string) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.replacer == nil {
+		return s
+	}
+	return m.replacer.Replace(s)
+}
+
+// NewLogWriter returns a writer that masks the session's secret values
+// before writing to w. Log handlers write whole records at once, so
+// values are never split across writes.
+func NewLogWriter(w io.Writer) io.Writer {
+	return &maskWriter{w: w}
+}
+
+type maskWriter struct {
+	w io.Writer
+}
+
+func (mw *maskWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(mw.w, logMask.mask(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,57 @@
+package executor
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/izalutski/catty/internal/protocol"
+)
+
+func TestLogWriterMasksEnv(t *testing.T) {
+	saved := logMask
+	logMask = &masker{values: make(map[string]bool)}
+	t.Cleanup(func() { logMask = saved })
+
+	env := map[string]string{
+		protocol.MaskEnvVar: "API_KEY,API_KEY_SUFFIX,SHORT,UNSET",
+		"API_KEY":           "sk-secret",
+		"API_KEY_SUFFIX":    "sk-secret-extended",
+		"SHORT":             "dev",
+		"PUBLIC":            "visible-value",
+	}
+	maskEnv(func(name string) string { return env[name] })
+
+	var buf bytes.Buffer
+	w := NewLogWriter(&buf)
+	line := "key=sk-secret long=sk-secret-extended short=dev public=visible-value\n"
+	n, err := fmt.Fprint(w, line)
+	if err != nil || n != len(line) {
+		t.Fatalf("Write = %d, %v; want %d, nil", n, err, len(line))
+	}
+
+	// The longer value is masked whole, and short values are left alone
+	want := "key=**** long=**** short=dev public=visible-value\n"
+	if got := buf.String(); got != want {
+		t.Errorf("logged %q, want %q", got, want)
+	}
+}
+
+func TestLogWriterWithoutMaskEnv(t *testing.T) {
+	saved := logMask
+	logMask = &masker{values: make(map[string]bool)}
+	t.Cleanup(func() { logMask = saved })
+
+	maskEnv(func(name string) string {
+		if name == "API_KEY" {
+			return "sk-secret"
+		}
+		return ""
+	})
+
+	var buf bytes.Buffer
+	fmt.Fprint(NewLogWriter(&buf), "key=sk-secret")
+	if got := buf.String(); got != "key=sk-secret" {
+		t.Errorf("logged %q with no variables to mask", got)
+	}
+}
@@ -50,6 +50,14 @@ func (p *PTY) SetWorkDir(dir string) {
 	p.cmd.Dir = dir
 }
 
+// SetEnv adds environment variables for the process, overriding any
+// inherited values. Must be called before Start.
+func (p *PTY) SetEnv(env map[string]string) {
+	for k, v := range env {
+		p.cmd.Env = append(p.cmd.Env, k+"="+v)
+	}
+}
+
 // Start starts the process in a new PTY.
 func (p *PTY) Start() error {
 	p.mu.Lock()
@@ -26,6 +26,8 @@ type Relay struct {
 	conn *websocket.Conn
 	pty  *PTY
 	mu   sync.Mutex
+	// notice, if set, is sent to the client right after it is ready
+	notice string
 }
 
 // NewRelay creates a new relay.
@@ -42,6 +44,11 @@ func (r *Relay) Run(ctx context.Context) error {
 	if err := r.sendControl(protocol.NewReadyMessage()); err != nil {
 		return err
 	}
+	if r.notice != "" {
+		if err := r.sendControl(protocol.NewNoticeMessage(r.notice)); err != nil {
+			return err
+		}
+	}
 
 	// Start goroutines
 	errCh := make(chan error, 3)
@@ -0,0 +1,52 @@
+package executor
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// ListenAndServe runs an executor server on addr until ctx is cancelled,
+// then shuts it down gracefully.
+func ListenAndServe(ctx context.Context, addr string) error {
+	server := NewServer()
+
+	httpServer := &http.Server{
+		Addr:         addr,
+		Handler:      server.Handler(),
+		ReadTimeout:  5 * time.Minute, // Allow large uploads (up to 100MB)
+		WriteTimeout: 0,               // No timeout for WebSocket
+		IdleTimeout:  120 * time.Second,
+	}
+
+	// Channel for server errors
+	serverErr := make(chan error, 1)
+
+	// Start server
+	go func() {
+		slog.Info("starting executor server", "addr", addr)
+		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			serverErr <- err
+		}
+	}()
+
+	// Wait for shutdown or error
+	select {
+	case err := <-serverErr:
+		return err
+	case <-ctx.Done():
+		slog.Info("shutting down server")
+	}
+
+	// Graceful shutdown
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+
+	slog.Info("server stopped")
+	return nil
+}
@@ -3,6 +3,8 @@ package executor
 import (
 	"archive/zip"
 	"context"
+	"crypto/subtle"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log/slog"
@@ -13,10 +15,12 @@ import (
 	"sync"
 
 	"github.com/coder/websocket"
+	"github.com/izalutski/catty/internal/protocol"
 )
 
 const (
-	// WorkspaceDir is where uploaded workspaces are extracted.
+	// WorkspaceDir is the default directory uploaded workspaces are extracted to.
+	// Overridden by CATTY_WORKSPACE_DIR.
 	WorkspaceDir = "/workspace"
 	// MaxUploadSize is the maximum size of workspace upload (100MB).
 	MaxUploadSize = 100 << 20
@@ -24,18 +28,31 @@ const (
 
 // Server is the executor HTTP/WebSocket server.
 type Server struct {
-	connectToken    string
-	cmd             []string
-	mu              sync.Mutex
-	pty             *PTY
-	workspaceReady  bool
-	workspaceDir    string
+	connectToken   string
+	configureToken string
+	configured     bool
+	cmd            []string
+	env            map[string]string
+	mu             sync.Mutex
+	pty            *PTY
+	workspaceReady bool
+	workspaceDir   string
+	workspaceRoot  string
+	// relays are the connected clients; notice is the last notice sent to
+	// them, repeated to clients that connect later
+	relays map[*Relay]struct{}
+	notice string
 }
 
 // NewServer creates a new executor server.
+//
+// Sessions are normally configured through CONNECT_TOKEN and CATTY_CMD. A
+// machine started ahead of time for the warm pool instead gets
+// CATTY_CONFIGURE_TOKEN and waits for the API to call /configure.
 func NewServer() *Server {
 	// Get connect token from environment
 	token := os.Getenv("CONNECT_TOKEN")
+	configureToken := os.Getenv("CATTY_CONFIGURE_TOKEN")
 
 	// Get command from environment or use default
 	cmdStr := os.Getenv("CATTY_CMD")
@@ -46,18 +63,38 @@ func NewServer() *Server {
 		cmd = []string{"/bin/sh"}
 	}
 
-	slog.Info("executor starting", "command", cmd)
+	workspaceRoot := os.Getenv("CATTY_WORKSPACE_DIR")
+	if workspaceRoot == "" {
+		workspaceRoot = WorkspaceDir
+	}
+
+	// Pool machines stay unconfigured until claimed
+	configured := configureToken == "" || token != ""
+
+	// Keep user-supplied values out of the logs from here on
+	maskEnv(os.Getenv)
+
+	slog.Info("executor starting", "command", cmd, "configured", configured)
 
-	return &Server{
-		connectToken: token,
-		cmd:          cmd,
+	s := &Server{
+		connectToken:   token,
+		configureToken: configureToken,
+		configured:     configured,
+		cmd:            cmd,
+		workspaceRoot:  workspaceRoot,
+		relays:         make(map[*Relay]struct{}),
 	}
+	if budgetURL := os.Getenv(protocol.BudgetURLEnvVar); budgetURL != "" {
+		go s.watchBudget(budgetURL, os.Getenv("ANTHROPIC_API_KEY"))
+	}
+	return s
 }
 
 // Handler returns the HTTP handler for the server.
 func (s *Server) Handler() http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/configure", s.handleConfigure)
 	mux.HandleFunc("/upload", s.handleUpload)
 	mux.HandleFunc("/connect", s.handleConnect)
 	return mux
@@ -69,6 +106,53 @@ func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("ok"))
 }
 
+// handleConfigure assigns a pre-started executor to a session.
+// Only allowed once, and only with the configure token the machine was started with.
+func (s *Server) handleConfigure(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if s.configureToken == "" || !checkBearer(r, s.configureToken) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req protocol.ConfigureRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.ConnectToken == "" {
+		http.Error(w, "connect_token is required", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.configured {
+		http.Error(w, "already configured", http.StatusConflict)
+		return
+	}
+
+	s.connectToken = req.ConnectToken
+	if len(req.Cmd) > 0 {
+		s.cmd = req.Cmd
+	}
+	s.env = req.Env
+	s.configured = true
+	maskEnv(func(name string) string { return req.Env[name] })
+	if budgetURL := req.Env[protocol.BudgetURLEnvVar]; budgetURL != "" {
+		go s.watchBudget(budgetURL, req.Env["ANTHROPIC_API_KEY"])
+	}
+
+	slog.Info("executor configured", "command", s.cmd)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
 // handleUpload handles workspace zip uploads.
 func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -95,7 +179,7 @@ func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, MaxUploadSize)
 
 	// Create workspace directory
-	if err := os.MkdirAll(WorkspaceDir, 0755); err != nil {
+	if err := os.MkdirAll(s.workspaceRoot, 0755); err != nil {
 		slog.Error("failed to create workspace dir", "error", err)
 		http.Error(w, "failed to create workspace", http.StatusInternalServerError)
 		return
@@ -123,7 +207,7 @@ func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
 	slog.Info("received workspace upload", "size", written)
 
 	// Extract zip
-	if err := extractZip(tmpPath, WorkspaceDir); err != nil {
+	if err := extractZip(tmpPath, s.workspaceRoot); err != nil {
 		slog.Error("failed to extract workspace", "error", err)
 		http.Error(w, "failed to extract workspace: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -132,10 +216,10 @@ func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
 	// Mark workspace as ready
 	s.mu.Lock()
 	s.workspaceReady = true
-	s.workspaceDir = WorkspaceDir
+	s.workspaceDir = s.workspaceRoot
 	s.mu.Unlock()
 
-	slog.Info("workspace extracted", "dir", WorkspaceDir)
+	slog.Info("workspace extracted", "dir", s.workspaceRoot)
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("ok"))
 }
@@ -216,20 +300,69 @@ func (s *Server) handleConnect(w http.ResponseWriter, r *http.Request) {
 
 	slog.Info("client connected, starting relay")
 
-	// Run relay
+	// Run relay, telling the client about anything it missed
 	relay := NewRelay(conn, pty)
+	relay.notice = s.addRelay(relay)
+	defer s.removeRelay(relay)
 	if err := relay.Run(context.Background()); err != nil {
 		slog.Error("relay error", "error", err)
 	}
 }
 
+// addRelay registers a connected client and returns the current notice.
+func (s *Server) addRelay(r *Relay) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.relays[r] = struct{}{}
+	return s.notice
+}
+
+// removeRelay unregisters a disconnected client.
+func (s *Server) removeRelay(r *Relay) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.relays, r)
+}
+
+// notify shows a notice on every connected client and remembers it for
+// clients that connect later.
+func (s *Server) notify(message string) {
+	s.mu.Lock()
+	s.notice = message
+	relays := make([]*Relay, 0, len(s.relays))
+	for r := range s.relays {
+		relays = append(relays, r)
+	}
+	s.mu.Unlock()
+
+	for _, r := range relays {
+		if err := r.sendControl(protocol.NewNoticeMessage(message)); err != nil {
+			slog.Warn("failed to send notice", "error", err)
+		}
+	}
+}
+
 // validateToken checks if the request has a valid token.
 func (s *Server) validateToken(r *http.Request) bool {
-	if s.connectToken == "" {
+	s.mu.Lock()
+	configured, connectToken := s.configured, s.connectToken
+	s.mu.Unlock()
+
+	if !configured {
+		// Pool machine not yet assigned to a session
+		return false
+	}
+
+	if connectToken == "" {
 		// No token configured, allow all (for local testing)
 		return true
 	}
 
+	return checkBearer(r, connectToken)
+}
+
+// checkBearer checks that the request carries the given bearer token.
+func checkBearer(r *http.Request, token string) bool {
 	auth := r.Header.Get("Authorization")
 	if auth == "" {
 		return false
@@ -241,7 +374,7 @@ func (s *Server) validateToken(r *http.Request) bool {
 		return false
 	}
 
-	return parts[1] == s.connectToken
+	return subtle.ConstantTimeCompare([]byte(parts[1]), []byte(token)) == 1
 }
 
 // getOrCreatePTY returns the existing PTY or creates a new one.
@@ -263,6 +396,7 @@ func (s *Server) getOrCreatePTY() (*PTY, error) {
 
 	pty := NewPTY(s.cmd[0], s.cmd[1:]...)
 	pty.SetWorkDir(workDir)
+	pty.SetEnv(s.env)
 	if err := pty.Start(); err != nil {
 		slog.Error("PTY start failed", "error", err)
 		return nil, err
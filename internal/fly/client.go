@@ -3,6 +3,7 @@ package fly
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -80,6 +81,12 @@ func (c *Client) AppName() string {
 
 // do performs an HTTP request with authentication.
 func (c *Client) do(method, path string, body any) (*http.Response, error) {
+	return c.doContext(context.Background(), method, path, body)
+}
+
+// doContext performs an HTTP request with authentication that is canceled
+// with ctx.
+func (c *Client) doContext(ctx context.Context, method, path string, body any) (*http.Response, error) {
 	url := c.baseURL + path
 
 	var bodyReader io.Reader
@@ -91,7 +98,7 @@ func (c *Client) do(method, path string, body any) (*http.Response, error) {
 		bodyReader = bytes.NewReader(data)
 	}
 
-	req, err := http.NewRequest(method, url, bodyReader)
+	req, err := http.NewRequestWithContext(ctx, method, url, bodyReader)
 	if err != nil {
 		return nil, fmt.Errorf("create request: %w", err)
 	}
@@ -1,6 +1,7 @@
 package fly
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -103,12 +104,13 @@ func (c *Client) GetMachine(machineID string) (*Machine, error) {
 	return &machine, nil
 }
 
-// WaitMachine waits for a machine to reach a specific state.
-func (c *Client) WaitMachine(machineID, state string, timeout time.Duration) error {
+// WaitMachine waits for a machine to reach a specific state, or until ctx
+// is done.
+func (c *Client) WaitMachine(ctx context.Context, machineID, state string, timeout time.Duration) error {
 	path := fmt.Sprintf("/v1/apps/%s/machines/%s/wait?state=%s&timeout=%d",
 		c.appName, machineID, state, int(timeout.Seconds()))
 
-	resp, err := c.do(http.MethodGet, path, nil)
+	resp, err := c.doContext(ctx, http.MethodGet, path, nil)
 	if err != nil {
 		return err
 	}
@@ -217,3 +219,21 @@ func (c *Client) GetCurrentImage() (string, error) {
 
 	return "", fmt.Errorf("no machines found with image config")
 }
+
+// SetMetadata sets a metadata key on a machine.
+func (c *Client) SetMetadata(machineID, key, value string) error {
+	path := fmt.Sprintf("/v1/apps/%s/machines/%s/metadata/%s", c.appName, machineID, url.PathEscape(key))
+
+	resp, err := c.do(http.MethodPost, path, map[string]string{"value": value})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return readError(resp)
+	}
+
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
@@ -0,0 +1,134 @@
+package fly
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/izalutski/catty/internal/provider"
+)
+
+// Provider runs executor machines as Fly Machines.
+type Provider struct {
+	client   *Client
+	execHost string
+}
+
+var _ provider.Provider = (*Provider)(nil)
+
+// NewProvider creates a Fly machine provider.
+// Executors are reached through CATTY_EXEC_HOST if set, otherwise through
+// the app's fly.dev hostname.
+func NewProvider(client *Client) *Provider {
+	execHost := os.Getenv("CATTY_EXEC_HOST")
+	if execHost == "" {
+		execHost = client.AppName() + ".fly.dev"
+	}
+	return &Provider{
+		client:   client,
+		execHost: execHost,
+	}
+}
+
+// CreateMachine creates a Fly machine running the executor on port 8080.
+func (p *Provider) CreateMachine(req *provider.CreateRequest) (*provider.Machine, error) {
+	machine, err := p.client.CreateMachine(&CreateMachineRequest{
+		Region: req.Region,
+		Config: &MachineConfig{
+			Image: req.Image,
+			Env:   req.Env,
+			Services: []MachineService{
+				{
+					Protocol:     "tcp",
+					InternalPort: 8080,
+					Ports: []ServicePort{
+						{Port: 443, Handlers: []string{"tls", "http"}},
+						{Port: 80, Handlers: []string{"http"}},
+					},
+				},
+			},
+			Guest: &GuestConfig{
+				CPUs:     req.CPUs,
+				MemoryMB: req.MemoryMB,
+				CPUKind:  "shared",
+			},
+			Metadata: req.Metadata,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return toProviderMachine(machine), nil
+}
+
+// WaitMachine waits for a machine to reach a state.
+func (p *Provider) WaitMachine(ctx context.Context, machineID, state string, timeout time.Duration) error {
+	return p.client.WaitMachine(ctx, machineID, state, timeout)
+}
+
+// GetMachine retrieves a machine by ID.
+func (p *Provider) GetMachine(machineID string) (*provider.Machine, error) {
+	machine, err := p.client.GetMachine(machineID)
+	if err != nil {
+		return nil, err
+	}
+	return toProviderMachine(machine), nil
+}
+
+// StopMachine stops a machine.
+func (p *Provider) StopMachine(machineID string) error {
+	return p.client.StopMachine(machineID)
+}
+
+// DeleteMachine deletes a machine.
+func (p *Provider) DeleteMachine(machineID string, force bool) error {
+	return p.client.DeleteMachine(machineID, force)
+}
+
+// ListMachines lists machines filtered by metadata.
+func (p *Provider) ListMachines(metadata map[string]string) ([]*provider.Machine, error) {
+	machines, err := p.client.ListMachines(metadata)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*provider.Machine, 0, len(machines))
+	for _, m := range machines {
+		result = append(result, toProviderMachine(m))
+	}
+	return result, nil
+}
+
+// SetMetadata sets a metadata key on a machine.
+func (p *Provider) SetMetadata(machineID, key, value string) error {
+	return p.client.SetMetadata(machineID, key, value)
+}
+
+// CurrentImage returns the image of the latest deploy of the executor app.
+func (p *Provider) CurrentImage() (string, error) {
+	return p.client.GetCurrentImage()
+}
+
+// Endpoint returns the shared executor hostname, pinned to the machine
+// with Fly's fly-force-instance-id routing header.
+func (p *Provider) Endpoint(machineID string) *provider.Endpoint {
+	return &provider.Endpoint{
+		BaseURL: "https://" + p.execHost,
+		Headers: map[string]string{
+			"fly-force-instance-id": machineID,
+		},
+	}
+}
+
+// toProviderMachine converts a Fly machine to the provider representation.
+func toProviderMachine(m *Machine) *provider.Machine {
+	pm := &provider.Machine{
+		ID:     m.ID,
+		State:  m.State,
+		Region: m.Region,
+	}
+	if m.Config != nil {
+		pm.Image = m.Config.Image
+		pm.Metadata = m.Config.Metadata
+	}
+	return pm
+}
@@ -0,0 +1,451 @@
+// Package local provides a machine provider that runs executors as local
+// catty-exec-runtime processes, for self-hosting and testing without Fly.
+package local
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/izalutski/catty/internal/provider"
+)
+
+// DefaultBinary is the executor binary looked up in PATH.
+const DefaultBinary = "catty-exec-runtime"
+
+// process is a locally running executor.
+type process struct {
+	id       string
+	region   string
+	port     int
+	dir      string
+	cmd      *exec.Cmd
+	state    string
+	metadata map[string]string
+	exited   chan struct{}
+}
+
+// Provider spawns executor processes on this host, each on its own port
+// with its own workspace directory.
+type Provider struct {
+	binary  string
+	args    []string
+	host    string
+	baseDir string
+
+	mu        sync.Mutex
+	processes map[string]*process
+}
+
+var _ provider.Provider = (*Provider)(nil)
+
+// Config configures a local provider.
+type Config struct {
+	// Binary is the executor binary, looked up in PATH if not absolute.
+	Binary string
+	// Args are passed to the binary, e.g. a subcommand that runs the executor.
+	Args []string
+	// Host is the interface executors listen on.
+	Host string
+	// Dir holds per-machine working directories.
+	Dir string
+}
+
+// NewProvider creates a local provider.
+// It reads configuration from environment variables:
+//   - CATTY_EXEC_BINARY: path to catty-exec-runtime (defaults to PATH lookup)
+//   - CATTY_LOCAL_HOST: interface executors listen on (defaults to 127.0.0.1)
+//   - CATTY_LOCAL_DIR: directory for per-machine workspaces (defaults to a temp dir)
+func NewProvider() (*Provider, error) {
+	return NewProviderWithConfig(Config{
+		Binary: os.Getenv("CATTY_EXEC_BINARY"),
+		Host:   os.Getenv("CATTY_LOCAL_HOST"),
+		Dir:    os.Getenv("CATTY_LOCAL_DIR"),
+	})
+}
+
+// NewProviderWithConfig creates a local provider with explicit configuration.
+// Empty fields take the same defaults as NewProvider.
+func NewProviderWithConfig(cfg Config) (*Provider, error) {
+	if cfg.Binary == "" {
+		cfg.Binary = DefaultBinary
+	}
+	path, err := exec.LookPath(cfg.Binary)
+	if err != nil {
+		return nil, fmt.Errorf("find executor binary %q: %w", cfg.Binary, err)
+	}
+
+	if cfg.Host == "" {
+		cfg.Host = "127.0.0.1"
+	}
+
+	if cfg.Dir == "" {
+		cfg.Dir = filepath.Join(os.TempDir(), "catty-local")
+	}
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("create local machine dir: %w", err)
+	}
+
+	return &Provider{
+		binary:    path,
+		args:      cfg.Args,
+		host:      cfg.Host,
+		baseDir:   cfg.Dir,
+		processes: make(map[string]*process),
+	}, nil
+}
+
+// CreateMachine starts a new executor process.
+// Image, CPUs and MemoryMB are ignored; every process runs the local binary.
+func (p *Provider) CreateMachine(req *provider.CreateRequest) (*provider.Machine, error) {
+	id, err := newMachineID()
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := freePort(p.host)
+	if err != nil {
+		return nil, fmt.Errorf("allocate port: %w", err)
+	}
+
+	dir := filepath.Join(p.baseDir, id)
+	if err := os.MkdirAll(filepath.Join(dir, "workspace"), 0755); err != nil {
+		return nil, fmt.Errorf("create machine dir: %w", err)
+	}
+
+	cmd := exec.Command(p.binary, p.args...)
+	cmd.Dir = dir
+	cmd.Env = append(hostEnv(),
+		fmt.Sprintf("CATTY_EXEC_ADDR=%s:%d", p.host, port),
+		"CATTY_WORKSPACE_DIR="+filepath.Join(dir, "workspace"),
+	)
+	for k, v := range req.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// Own process group so stopping a machine also stops the agent it spawned
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if err := cmd.Start(); err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("start executor: %w", err)
+	}
+
+	metadata := make(map[string]string, len(req.Metadata))
+	for k, v := range req.Metadata {
+		metadata[k] = v
+	}
+
+	proc := &process{
+		id:       id,
+		region:   "local",
+		port:     port,
+		dir:      dir,
+		cmd:      cmd,
+		state:    provider.StateCreated,
+		metadata: metadata,
+		exited:   make(chan struct{}),
+	}
+
+	p.mu.Lock()
+	p.processes[id] = proc
+	p.mu.Unlock()
+
+	go p.monitor(proc)
+
+	slog.Info("started local executor", "machine_id", id, "port", port)
+	return p.snapshot(proc), nil
+}
+
+// monitor tracks the process lifecycle: started once it answers health
+// checks, stopped once it exits.
+func (p *Provider) monitor(proc *process) {
+	go func() {
+		proc.cmd.Wait()
+		p.mu.Lock()
+		if proc.state != provider.StateDestroyed {
+			proc.state = provider.StateStopped
+		}
+		p.mu.Unlock()
+		close(proc.exited)
+	}()
+
+	client := &http.Client{Timeout: time.Second}
+	url := fmt.Sprintf("http://%s:%d/healthz", p.host, proc.port)
+	for {
+		select {
+		case <-proc.exited:
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		resp, err := client.Get(url)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+
+		p.mu.Lock()
+		if proc.state == provider.StateCreated {
+			proc.state = provider.StateStarted
+		}
+		p.mu.Unlock()
+		return
+	}
+}
+
+// WaitMachine polls until the process reaches the given state.
+func (p *Provider) WaitMachine(ctx context.Context, machineID, state string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		m, err := p.GetMachine(machineID)
+		if err != nil {
+			return err
+		}
+		if m.State == state {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for state %s (current: %s)", state, m.State)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// GetMachine returns a machine by ID.
+func (p *Provider) GetMachine(machineID string) (*provider.Machine, error) {
+	proc, err := p.get(machineID)
+	if err != nil {
+		return nil, err
+	}
+	return p.snapshot(proc), nil
+}
+
+// StopMachine sends SIGTERM to the process group and waits for it to exit.
+func (p *Provider) StopMachine(machineID string) error {
+	proc, err := p.get(machineID)
+	if err != nil {
+		return err
+	}
+	return p.signal(proc, syscall.SIGTERM, 10*time.Second)
+}
+
+// DeleteMachine stops the process and removes its workspace.
+func (p *Provider) DeleteMachine(machineID string, force bool) error {
+	proc, err := p.get(machineID)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	running := proc.state != provider.StateStopped
+	p.mu.Unlock()
+
+	if running {
+		if !force {
+			return fmt.Errorf("machine %s is still running", machineID)
+		}
+		if err := p.signal(proc, syscall.SIGKILL, 5*time.Second); err != nil {
+			return err
+		}
+	}
+
+	p.mu.Lock()
+	proc.state = provider.StateDestroyed
+	delete(p.processes, machineID)
+	p.mu.Unlock()
+
+	return os.RemoveAll(proc.dir)
+}
+
+// ListMachines lists processes whose metadata contains all given pairs.
+func (p *Provider) ListMachines(metadata map[string]string) ([]*provider.Machine, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var result []*provider.Machine
+	for _, proc := range p.processes {
+		if matchMetadata(proc.metadata, metadata) {
+			result = append(result, p.snapshotLocked(proc))
+		}
+	}
+	return result, nil
+}
+
+// SetMetadata sets a metadata key on a machine.
+func (p *Provider) SetMetadata(machineID, key, value string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	proc, ok := p.processes[machineID]
+	if !ok {
+		return fmt.Errorf("machine %s not found", machineID)
+	}
+	proc.metadata[key] = value
+	return nil
+}
+
+// CurrentImage returns the executor binary path, which plays the role of an image.
+func (p *Provider) CurrentImage() (string, error) {
+	return "local:" + p.binary, nil
+}
+
+// Endpoint returns the local address of the executor process.
+func (p *Provider) Endpoint(machineID string) *provider.Endpoint {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	port := 0
+	if proc, ok := p.processes[machineID]; ok {
+		port = proc.port
+	}
+	return &provider.Endpoint{
+		BaseURL: fmt.Sprintf("http://%s:%d", p.host, port),
+		Headers: map[string]string{},
+	}
+}
+
+// Shutdown kills all executor processes. Used when the host process exits.
+func (p *Provider) Shutdown() {
+	p.mu.Lock()
+	ids := make([]string, 0, len(p.processes))
+	for id := range p.processes {
+		ids = append(ids, id)
+	}
+	p.mu.Unlock()
+
+	for _, id := range ids {
+		p.DeleteMachine(id, true)
+	}
+}
+
+// get looks up a process by ID.
+func (p *Provider) get(machineID string) (*process, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	proc, ok := p.processes[machineID]
+	if !ok {
+		return nil, fmt.Errorf("machine %s not found", machineID)
+	}
+	return proc, nil
+}
+
+// signal signals the process group and waits for the process to exit.
+func (p *Provider) signal(proc *process, sig syscall.Signal, timeout time.Duration) error {
+	select {
+	case <-proc.exited:
+		return nil
+	default:
+	}
+
+	if err := syscall.Kill(-proc.cmd.Process.Pid, sig); err != nil && err != syscall.ESRCH {
+		return fmt.Errorf("signal executor: %w", err)
+	}
+
+	select {
+	case <-proc.exited:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("executor %s did not exit after %s", proc.id, sig)
+	}
+}
+
+// snapshot returns a copy of the process state.
+func (p *Provider) snapshot(proc *process) *provider.Machine {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.snapshotLocked(proc)
+}
+
+// snapshotLocked is snapshot with p.mu already held.
+func (p *Provider) snapshotLocked(proc *process) *provider.Machine {
+	metadata := make(map[string]string, len(proc.metadata))
+	for k, v := range proc.metadata {
+		metadata[k] = v
+	}
+	return &provider.Machine{
+		ID:       proc.id,
+		State:    proc.state,
+		Region:   proc.region,
+		Image:    "local:" + p.binary,
+		Metadata: metadata,
+	}
+}
+
+// matchMetadata returns true if have contains every pair in want.
+func matchMetadata(have, want map[string]string) bool {
+	for k, v := range want {
+		if have[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// freePort asks the kernel for an unused TCP port.
+func freePort(host string) (int, error) {
+	l, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// newMachineID generates a random machine ID.
+func newMachineID() (string, error) {
+	b := make([]byte, 7)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// hostEnvNames are the variables of this process's environment executors
+// inherit, besides the LC_* locale settings.
+var hostEnvNames = map[string]bool{
+	"PATH":          true,
+	"HOME":          true,
+	"USER":          true,
+	"LOGNAME":       true,
+	"SHELL":         true,
+	"TERM":          true,
+	"COLORTERM":     true,
+	"LANG":          true,
+	"TZ":            true,
+	"TMPDIR":        true,
+	"SSL_CERT_FILE": true,
+	"SSL_CERT_DIR":  true,
+	"CATTY_DEBUG":   true,
+}
+
+// hostEnv returns the parts of this process's environment an executor
+// needs to run. Agents only get the credentials the API passes in the
+// request, so the host's API keys and other secrets aren't handed to them.
+func hostEnv() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		if hostEnvNames[name] || strings.HasPrefix(name, "LC_") {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
@@ -0,0 +1,119 @@
+package local
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/izalutski/catty/internal/provider"
+)
+
+// TestHelperExecutor stands in for catty-exec-runtime when the provider
+// runs this test binary. It serves its environment at /env.
+func TestHelperExecutor(t *testing.T) {
+	if os.Getenv("CATTY_TEST_EXECUTOR") != "1" {
+		t.Skip("only runs as an executor started by the provider tests")
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/env", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(os.Environ())
+	})
+	http.ListenAndServe(os.Getenv("CATTY_EXEC_ADDR"), mux)
+	os.Exit(0)
+}
+
+func TestProviderPassesOnlyAllowedHostEnv(t *testing.T) {
+	t.Setenv("LANG", "en_US.UTF-8")
+	t.Setenv("CATTY_TEST_HOST_SECRET", "leaked")
+
+	p, err := NewProviderWithConfig(Config{
+		Binary: os.Args[0],
+		Args:   []string{"-test.run=^TestHelperExecutor$"},
+		Dir:    t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Shutdown)
+
+	m, err := p.CreateMachine(&provider.CreateRequest{
+		Env:      map[string]string{"CATTY_TEST_EXECUTOR": "1", "SESSION_VAR": "set"},
+		Metadata: map[string]string{"label": "test"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.WaitMachine(context.Background(), m.ID, provider.StateStarted, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Get(p.Endpoint(m.ID).BaseURL + "/env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var env []string
+	err = json.NewDecoder(resp.Body).Decode(&env)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"LANG=en_US.UTF-8", "SESSION_VAR=set"} {
+		if !slices.Contains(env, want) {
+			t.Errorf("executor env is missing %s", want)
+		}
+	}
+	for _, kv := range env {
+		if strings.HasPrefix(kv, "CATTY_TEST_HOST_SECRET=") {
+			t.Errorf("executor env has %s from the host", kv)
+		}
+	}
+
+	if err := p.StopMachine(m.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := p.GetMachine(m.ID); err != nil || got.State != provider.StateStopped {
+		t.Errorf("GetMachine after stopping = %+v, %v; want stopped", got, err)
+	}
+	if err := p.DeleteMachine(m.ID, false); err != nil {
+		t.Fatal(err)
+	}
+	if machines, _ := p.ListMachines(nil); len(machines) != 0 {
+		t.Errorf("%d machines left after deleting", len(machines))
+	}
+}
+
+func TestWaitMachineStopsWithContext(t *testing.T) {
+	p, err := NewProviderWithConfig(Config{
+		Binary: os.Args[0],
+		Args:   []string{"-test.run=^TestHelperExecutor$"},
+		Dir:    t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Shutdown)
+
+	// Without CATTY_TEST_EXECUTOR the helper exits at once, so the
+	// machine never starts
+	m, err := p.CreateMachine(&provider.CreateRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := p.WaitMachine(ctx, m.ID, provider.StateStarted, time.Minute); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("WaitMachine = %v, want the context's error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("WaitMachine returned after %v, want at the deadline", elapsed)
+	}
+}
@@ -12,6 +12,7 @@ const (
 	TypeReady  = "ready"
 	TypeExit   = "exit"
 	TypeError  = "error"
+	TypeNotice = "notice"
 )
 
 // BaseMessage is used to determine the message type before full parsing.
@@ -60,6 +61,13 @@ type ErrorMessage struct {
 	Message string `json:"message"` // Error description
 }
 
+// NoticeMessage is sent from server to client with something the user
+// should know about the session, shown outside the agent's own output.
+type NoticeMessage struct {
+	Type    string `json:"type"`    // "notice"
+	Message string `json:"message"` // Text to show
+}
+
 // ParseMessage parses a JSON message and returns the appropriate type.
 func ParseMessage(data []byte) (any, error) {
 	var base BaseMessage
@@ -98,6 +106,12 @@ func ParseMessage(data []byte) (any, error) {
 			return nil, err
 		}
 		return &msg, nil
+	case TypeNotice:
+		var msg NoticeMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return nil, err
+		}
+		return &msg, nil
 	default:
 		return &base, nil
 	}
@@ -137,3 +151,39 @@ func NewExitMessage(code int, signal *string) *ExitMessage {
 func NewErrorMessage(message string) *ErrorMessage {
 	return &ErrorMessage{Type: TypeError, Message: message}
 }
+
+// NewNoticeMessage creates a new notice message.
+func NewNoticeMessage(message string) *NoticeMessage {
+	return &NoticeMessage{Type: TypeNotice, Message: message}
+}
+
+// MaskEnvVar names the environment variable that lists, comma-separated,
+// the variables whose values the executor must mask in its logs.
+const MaskEnvVar = "CATTY_MASK_ENV"
+
+// ConfigureRequest is sent from the API to a pre-started executor over HTTP
+// (POST /configure) to assign it to a session.
+type ConfigureRequest struct {
+	ConnectToken string            `json:"connect_token"`
+	Cmd          []string          `json:"cmd"`
+	Env          map[string]string `json:"env,omitempty"`
+}
+
+// BudgetURLEnvVar names the environment variable holding the metering
+// proxy's budget status URL for a session with a budget. The executor polls
+// it, authenticated with the session's ANTHROPIC_API_KEY.
+const BudgetURLEnvVar = "CATTY_BUDGET_URL"
+
+// BudgetPath is the path, under a session's proxy base URL, that serves
+// its BudgetStatus.
+const BudgetPath = "/catty/budget"
+
+// BudgetStatus is the metering proxy's view of a session's budget. Costs
+// are in microdollars; zero budgets mean no cap.
+type BudgetStatus struct {
+	BudgetTokens       int64 `json:"budget_tokens"`
+	BudgetCostMicroUSD int64 `json:"budget_cost_microusd"`
+	UsedTokens         int64 `json:"used_tokens"`
+	UsedCostMicroUSD   int64 `json:"used_cost_microusd"`
+	Exhausted          bool  `json:"exhausted"`
+}
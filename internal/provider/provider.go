@@ -0,0 +1,65 @@
+// Package provider defines the interface for backends that run executor machines.
+package provider
+
+import (
+	"context"
+	"time"
+)
+
+// Machine states reported by providers.
+const (
+	StateCreated   = "created"
+	StateStarted   = "started"
+	StateStopped   = "stopped"
+	StateDestroyed = "destroyed"
+)
+
+// CreateRequest describes an executor machine to create.
+type CreateRequest struct {
+	Region   string
+	Image    string
+	Env      map[string]string
+	CPUs     int
+	MemoryMB int
+	Metadata map[string]string
+}
+
+// Machine is a provider-agnostic view of an executor machine.
+type Machine struct {
+	ID       string
+	State    string
+	Region   string
+	Image    string
+	Metadata map[string]string
+}
+
+// Endpoint is how clients reach the executor running on a machine.
+type Endpoint struct {
+	// BaseURL is the HTTP base URL of the executor, e.g. https://exec.catty.dev.
+	BaseURL string
+	// Headers must be sent with every request to route it to the machine.
+	Headers map[string]string
+}
+
+// Provider creates and manages executor machines.
+type Provider interface {
+	// CreateMachine creates and boots a new machine.
+	CreateMachine(req *CreateRequest) (*Machine, error)
+	// WaitMachine blocks until the machine reaches the given state, the
+	// timeout passes or ctx is done.
+	WaitMachine(ctx context.Context, machineID, state string, timeout time.Duration) error
+	// GetMachine returns the current state of a machine.
+	GetMachine(machineID string) (*Machine, error)
+	// StopMachine stops a running machine.
+	StopMachine(machineID string) error
+	// DeleteMachine destroys a machine. force destroys it even if running.
+	DeleteMachine(machineID string, force bool) error
+	// ListMachines lists machines whose metadata contains all given pairs.
+	ListMachines(metadata map[string]string) ([]*Machine, error)
+	// SetMetadata sets a metadata key on a machine.
+	SetMetadata(machineID, key, value string) error
+	// CurrentImage returns the executor image new machines should use.
+	CurrentImage() (string, error)
+	// Endpoint returns how to reach the executor on a machine.
+	Endpoint(machineID string) *Endpoint
+}
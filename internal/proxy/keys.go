@@ -0,0 +1,458 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// minEjection and maxEjection bound how long a key sits out after a
+	// 429 or 529 without a retry-after header. The ejection doubles with
+	// each consecutive failure.
+	minEjection = 10 * time.Second
+	maxEjection = 5 * time.Minute
+)
+
+// KeyConfig is one upstream Anthropic API key.
+type KeyConfig struct {
+	Secret string
+	// Weight is the key's share of requests relative to the other keys.
+	Weight int
+}
+
+// ParseKeys parses a comma-separated list of keys, each optionally
+// followed by :weight, e.g. "sk-ant-a:3,sk-ant-b".
+func ParseKeys(s string) ([]KeyConfig, error) {
+	var keys []KeyConfig
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		key := KeyConfig{Secret: part, Weight: 1}
+		if secret, weight, ok := strings.Cut(part, ":"); ok {
+			w, err := strconv.Atoi(weight)
+			if err != nil || w < 1 {
+				return nil, fmt.Errorf("invalid weight %q for key %d", weight, len(keys))
+			}
+			key = KeyConfig{Secret: secret, Weight: w}
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// KeysFromEnv reads upstream keys from ANTHROPIC_API_KEYS (see ParseKeys),
+// falling back to the single key in ANTHROPIC_API_KEY.
+func KeysFromEnv() ([]KeyConfig, error) {
+	return keysFromEnv("ANTHROPIC_API_KEYS", "ANTHROPIC_API_KEY")
+}
+
+// OpenAIKeysFromEnv reads upstream OpenAI keys from OPENAI_API_KEYS (see
+// ParseKeys), falling back to the single key in OPENAI_API_KEY.
+func OpenAIKeysFromEnv() ([]KeyConfig, error) {
+	return keysFromEnv("OPENAI_API_KEYS", "OPENAI_API_KEY")
+}
+
+func keysFromEnv(listVar, keyVar string) ([]KeyConfig, error) {
+	if s := os.Getenv(listVar); s != "" {
+		return ParseKeys(s)
+	}
+	if key := os.Getenv(keyVar); key != "" {
+		return []KeyConfig{{Secret: key, Weight: 1}}, nil
+	}
+	return nil, nil
+}
+
+// upstreamKey is a key and what the pool knows about its health.
+type upstreamKey struct {
+	name   string
+	secret string
+	weight int
+
+	// current is the key's smooth weighted round-robin counter
+	current int
+
+	ejectedUntil time.Time
+	failures     int // consecutive 429/529 responses
+
+	// Rate limits from the last response; -1 when unknown
+	requestsRemaining int64
+	requestsReset     time.Time
+	tokensRemaining   int64
+	tokensReset       time.Time
+
+	requests   int64
+	ejections  int64
+	lastStatus int
+}
+
+// availableAt returns when the key can next take a request.
+func (k *upstreamKey) availableAt() time.Time {
+	at := k.ejectedUntil
+	if k.requestsRemaining == 0 && k.requestsReset.After(at) {
+		at = k.requestsReset
+	}
+	if k.tokensRemaining == 0 && k.tokensReset.After(at) {
+		at = k.tokensReset
+	}
+	return at
+}
+
+// KeyPool spreads requests over upstream keys by weighted round-robin,
+// skipping keys that were rate limited or overloaded until they recover.
+// It is safe for concurrent use.
+type KeyPool struct {
+	mu   sync.Mutex
+	keys []*upstreamKey
+}
+
+// NewKeyPool creates a pool from key configs.
+func NewKeyPool(configs []KeyConfig) (*KeyPool, error) {
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("no upstream API keys")
+	}
+	pool := &KeyPool{}
+	for i, c := range configs {
+		if c.Secret == "" {
+			return nil, fmt.Errorf("key %d is empty", i)
+		}
+		weight := c.Weight
+		if weight < 1 {
+			weight = 1
+		}
+		pool.keys = append(pool.keys, &upstreamKey{
+			name:              keyName(i, c.Secret),
+			secret:            c.Secret,
+			weight:            weight,
+			requestsRemaining: -1,
+			tokensRemaining:   -1,
+		})
+	}
+	return pool, nil
+}
+
+// keyName identifies a key in logs and metrics without revealing it.
+func keyName(i int, secret string) string {
+	suffix := secret
+	if len(suffix) > 4 {
+		suffix = suffix[len(suffix)-4:]
+	}
+	return fmt.Sprintf("%d-%s", i, suffix)
+}
+
+// next picks the key for a request, skipping keys in tried. Available keys
+// are chosen by smooth weighted round-robin; if none is available the key
+// that recovers first is used. Returns nil once every key has been tried.
+func (p *KeyPool) next(tried map[*upstreamKey]bool) *upstreamKey {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	var best, soonest *upstreamKey
+	total := 0
+	for _, k := range p.keys {
+		if tried[k] {
+			continue
+		}
+		if soonest == nil || k.availableAt().Before(soonest.availableAt()) {
+			soonest = k
+		}
+		if k.availableAt().After(now) {
+			continue
+		}
+		k.current += k.weight
+		total += k.weight
+		if best == nil || k.current > best.current {
+			best = k
+		}
+	}
+
+	if best == nil {
+		best = soonest
+	} else {
+		best.current -= total
+	}
+	if best != nil {
+		best.requests++
+	}
+	return best
+}
+
+// observe updates a key's health from an upstream response.
+func (p *KeyPool) observe(k *upstreamKey, resp *http.Response) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	k.lastStatus = resp.StatusCode
+	updateRateLimits(k, resp.Header)
+
+	if !ejectable(resp.StatusCode) {
+		k.failures = 0
+		return
+	}
+
+	k.failures++
+	k.ejections++
+	ejection := minEjection << min(k.failures-1, 5)
+	if after, ok := retryAfter(resp.Header); ok {
+		ejection = after
+	}
+	k.ejectedUntil = now.Add(min(ejection, maxEjection))
+}
+
+// ejectable reports whether a status means the key should sit out for a
+// while: rate limited (429) or Anthropic overloaded (529).
+func ejectable(status int) bool {
+	return status == http.StatusTooManyRequests || status == 529
+}
+
+// updateRateLimits reads Anthropic's or OpenAI's rate limit headers into k.
+func updateRateLimits(k *upstreamKey, h http.Header) {
+	if v, err := strconv.ParseInt(h.Get("anthropic-ratelimit-requests-remaining"), 10, 64); err == nil {
+		k.requestsRemaining = v
+	}
+	if t, err := time.Parse(time.RFC3339, h.Get("anthropic-ratelimit-requests-reset")); err == nil {
+		k.requestsReset = t
+	}
+	if v, err := strconv.ParseInt(h.Get("anthropic-ratelimit-tokens-remaining"), 10, 64); err == nil {
+		k.tokensRemaining = v
+	}
+	if t, err := time.Parse(time.RFC3339, h.Get("anthropic-ratelimit-tokens-reset")); err == nil {
+		k.tokensReset = t
+	}
+
+	// OpenAI gives resets as durations, like "6m0s"
+	if v, err := strconv.ParseInt(h.Get("x-ratelimit-remaining-requests"), 10, 64); err == nil {
+		k.requestsRemaining = v
+	}
+	if d, err := time.ParseDuration(h.Get("x-ratelimit-reset-requests")); err == nil {
+		k.requestsReset = time.Now().Add(d)
+	}
+	if v, err := strconv.ParseInt(h.Get("x-ratelimit-remaining-tokens"), 10, 64); err == nil {
+		k.tokensRemaining = v
+	}
+	if d, err := time.ParseDuration(h.Get("x-ratelimit-reset-tokens")); err == nil {
+		k.tokensReset = time.Now().Add(d)
+	}
+}
+
+// KeyStats is a snapshot of one key's state.
+type KeyStats struct {
+	Name              string    `json:"name"`
+	Weight            int       `json:"weight"`
+	Available         bool      `json:"available"`
+	AvailableAt       time.Time `json:"available_at"`
+	Requests          int64     `json:"requests"`
+	Ejections         int64     `json:"ejections"`
+	LastStatus        int       `json:"last_status"`
+	RequestsRemaining int64     `json:"requests_remaining"`
+	TokensRemaining   int64     `json:"tokens_remaining"`
+}
+
+// Stats returns the state of every key, in configuration order.
+func (p *KeyPool) Stats() []KeyStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	stats := make([]KeyStats, 0, len(p.keys))
+	for _, k := range p.keys {
+		stats = append(stats, KeyStats{
+			Name:              k.name,
+			Weight:            k.weight,
+			Available:         !k.availableAt().After(now),
+			AvailableAt:       k.availableAt(),
+			Requests:          k.requests,
+			Ejections:         k.ejections,
+			LastStatus:        k.lastStatus,
+			RequestsRemaining: k.requestsRemaining,
+			TokensRemaining:   k.tokensRemaining,
+		})
+	}
+	return stats
+}
+
+// keyTransport sends each request with a key from the pool. A request that
+// gets a 429 or 529 is retried on the next untried key; once every key has
+// failed, one that got a 529 or a transient 5xx is retried with backoff.
+// The client has received nothing yet at this point, so retries are
+// invisible to it; responses are never retried once they are returned.
+type keyTransport struct {
+	keys *KeyPool
+	base http.RoundTripper
+	// authorize sets a key on an upstream request
+	authorize func(h http.Header, secret string)
+	logger    *slog.Logger
+
+	// baseDelay, maxDelay and budget time the retries of requests that
+	// failed on every key, as retryBaseDelay, retryMaxDelay and
+	// retryBudget do outside of tests
+	baseDelay time.Duration
+	maxDelay  time.Duration
+	budget    time.Duration
+
+	failovers atomic.Int64 // requests sent again on another key
+	retries   atomic.Int64 // requests sent again after backing off
+	exhausted atomic.Int64 // requests that failed after every retry
+}
+
+func (t *keyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Buffer the body so it can be replayed on another key
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("read request body: %w", err)
+		}
+	}
+
+	tried := make(map[*upstreamKey]bool)
+	key := t.keys.next(tried)
+	var retries int
+	var waited time.Duration
+	for {
+		out := req.Clone(req.Context())
+		out.Body = io.NopCloser(bytes.NewReader(body))
+		out.ContentLength = int64(len(body))
+		t.authorize(out.Header, key.secret)
+
+		resp, err := t.base.RoundTrip(out)
+		if err != nil {
+			return nil, err
+		}
+		t.keys.observe(key, resp)
+		if !ejectable(resp.StatusCode) && !retryable(resp.StatusCode) {
+			if retries > 0 {
+				t.logger.Info("upstream responded after retries",
+					"status", resp.StatusCode, "retries", retries, "waited", waited)
+			}
+			return resp, nil
+		}
+
+		// Rate limited or overloaded keys are swapped for another first
+		tried[key] = true
+		if ejectable(resp.StatusCode) {
+			if nextKey := t.keys.next(tried); nextKey != nil {
+				t.logger.Warn("upstream key unavailable, retrying on another key",
+					"key", key.name, "status", resp.StatusCode, "next_key", nextKey.name)
+				t.failovers.Add(1)
+				drain(resp)
+				key = nextKey
+				continue
+			}
+		}
+		if !retryable(resp.StatusCode) {
+			return resp, nil
+		}
+
+		// Then the request waits and starts over on every key
+		delay, ok := t.retryDelay(retries, resp.Header)
+		if !ok || retries >= maxUpstreamRetries || waited+delay > t.budget {
+			t.logger.Warn("upstream still failing, giving up",
+				"status", resp.StatusCode, "retries", retries, "waited", waited)
+			t.exhausted.Add(1)
+			return resp, nil
+		}
+		retries++
+		waited += delay
+		t.retries.Add(1)
+		t.logger.Warn("upstream request failed, retrying",
+			"key", key.name, "status", resp.StatusCode, "retry", retries, "delay", delay)
+		drain(resp)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, context.Cause(req.Context())
+		case <-timer.C:
+		}
+		clear(tried)
+		key = t.keys.next(tried)
+	}
+}
+
+// drain discards a response that is being retried.
+func drain(resp *http.Response) {
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+// Metrics serves the state of each upstream key and of the usage queue in
+// the Prometheus text format.
+func (p *Proxy) Metrics(w http.ResponseWriter, r *http.Request) {
+	type providerStats struct {
+		provider string
+		stats    []KeyStats
+	}
+	var pools []providerStats
+	for _, u := range []*upstream{p.anthropic, p.openai} {
+		if u != nil {
+			pools = append(pools, providerStats{u.provider, u.keys.Stats()})
+		}
+	}
+
+	var b strings.Builder
+	metric := func(name, kind, help string, value func(KeyStats) int64) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, pool := range pools {
+			for _, s := range pool.stats {
+				fmt.Fprintf(&b, "%s{provider=%q,key=%q} %d\n", name, pool.provider, s.Name, value(s))
+			}
+		}
+	}
+
+	metric("catty_proxy_key_up", "gauge", "Whether the key is taking requests.", func(s KeyStats) int64 {
+		if s.Available {
+			return 1
+		}
+		return 0
+	})
+	metric("catty_proxy_key_weight", "gauge", "Relative share of requests sent with the key.", func(s KeyStats) int64 { return int64(s.Weight) })
+	metric("catty_proxy_key_available_at_seconds", "gauge", "Unix time the key recovers from its last ejection or rate limit.", func(s KeyStats) int64 {
+		if s.AvailableAt.IsZero() {
+			return 0
+		}
+		return s.AvailableAt.Unix()
+	})
+	metric("catty_proxy_key_last_status", "gauge", "HTTP status of the key's last upstream response.", func(s KeyStats) int64 { return int64(s.LastStatus) })
+	metric("catty_proxy_key_ratelimit_requests_remaining", "gauge", "Requests left in the key's rate limit window, -1 if unknown.", func(s KeyStats) int64 { return s.RequestsRemaining })
+	metric("catty_proxy_key_ratelimit_tokens_remaining", "gauge", "Tokens left in the key's rate limit window, -1 if unknown.", func(s KeyStats) int64 { return s.TokensRemaining })
+	metric("catty_proxy_key_requests_total", "counter", "Upstream requests sent with the key.", func(s KeyStats) int64 { return s.Requests })
+	metric("catty_proxy_key_ejections_total", "counter", "Times the key was ejected after a 429 or 529.", func(s KeyStats) int64 { return s.Ejections })
+
+	retries := func(name, help string, value func(*keyTransport) int64) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+		for _, u := range []*upstream{p.anthropic, p.openai} {
+			if u != nil {
+				fmt.Fprintf(&b, "%s{provider=%q} %d\n", name, u.provider, value(u.transport))
+			}
+		}
+	}
+	retries("catty_proxy_upstream_failovers_total", "Requests sent again with another key after a 429 or 529.",
+		func(t *keyTransport) int64 { return t.failovers.Load() })
+	retries("catty_proxy_upstream_retries_total", "Requests sent again after backing off from a 529 or 5xx.",
+		func(t *keyTransport) int64 { return t.retries.Load() })
+	retries("catty_proxy_upstream_retries_exhausted_total", "Requests that still failed when the proxy stopped retrying.",
+		func(t *keyTransport) int64 { return t.exhausted.Load() })
+
+	fmt.Fprintf(&b, "# HELP catty_proxy_usage_queue_pending Usage records waiting to be stored.\n"+
+		"# TYPE catty_proxy_usage_queue_pending gauge\ncatty_proxy_usage_queue_pending %d\n", p.usage.Len())
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	io.WriteString(w, b.String())
+}
@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// pick returns the secrets of the next n keys the pool gives requests.
+func pick(p *KeyPool, n int) []string {
+	var secrets []string
+	for range n {
+		secrets = append(secrets, p.next(nil).secret)
+	}
+	return secrets
+}
+
+// keyResponse is an upstream response with the given status and headers.
+func keyResponse(status int, header ...string) *http.Response {
+	resp := &http.Response{StatusCode: status, Header: http.Header{}}
+	for i := 0; i+1 < len(header); i += 2 {
+		resp.Header.Set(header[i], header[i+1])
+	}
+	return resp
+}
+
+func newTestKeyPool(t *testing.T, keys ...KeyConfig) *KeyPool {
+	t.Helper()
+	pool, err := NewKeyPool(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+func TestKeyPoolRotatesByWeight(t *testing.T) {
+	pool := newTestKeyPool(t, KeyConfig{Secret: "a", Weight: 3}, KeyConfig{Secret: "b", Weight: 1})
+
+	// Smooth weighted round-robin spreads the heavier key's turns out
+	got := fmt.Sprint(pick(pool, 8))
+	if want := "[a a b a a a b a]"; got != want {
+		t.Errorf("keys picked %s, want %s", got, want)
+	}
+
+	stats := pool.Stats()
+	if stats[0].Requests != 6 || stats[1].Requests != 2 {
+		t.Errorf("counted %d and %d requests, want 6 and 2", stats[0].Requests, stats[1].Requests)
+	}
+}
+
+func TestKeyPoolEjectsAndRecovers(t *testing.T) {
+	pool := newTestKeyPool(t, KeyConfig{Secret: "a", Weight: 1}, KeyConfig{Secret: "b", Weight: 1})
+	a := pool.keys[0]
+
+	pool.observe(a, keyResponse(http.StatusTooManyRequests, "retry-after-ms", "100"))
+	if got := fmt.Sprint(pick(pool, 4)); got != "[b b b b]" {
+		t.Errorf("keys picked while a is ejected %s, want only b", got)
+	}
+	if s := pool.Stats()[0]; s.Available || s.Ejections != 1 || s.LastStatus != http.StatusTooManyRequests {
+		t.Errorf("stats of the ejected key = %+v", s)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if got := pick(pool, 2); got[0] == got[1] {
+		t.Errorf("keys picked after a recovered %s, want both", got)
+	}
+
+	// A success resets the backoff of later ejections
+	pool.observe(a, keyResponse(http.StatusOK))
+	if a.failures != 0 {
+		t.Errorf("key has %d failures after a success, want 0", a.failures)
+	}
+}
+
+func TestKeyPoolEjectionBacksOff(t *testing.T) {
+	pool := newTestKeyPool(t, KeyConfig{Secret: "a", Weight: 1})
+	a := pool.keys[0]
+
+	// Without a retry-after, each consecutive failure doubles the
+	// ejection, up to the maximum
+	for i, want := range []time.Duration{minEjection, 2 * minEjection, 4 * minEjection} {
+		start := time.Now()
+		pool.observe(a, keyResponse(529))
+		if got := a.ejectedUntil.Sub(start); got < want || got > want+time.Second {
+			t.Errorf("failure %d ejected the key for %v, want %v", i+1, got, want)
+		}
+	}
+	for range 10 {
+		pool.observe(a, keyResponse(529))
+	}
+	if got := time.Until(a.ejectedUntil); got > maxEjection {
+		t.Errorf("ejected the key for %v, want at most %v", got, maxEjection)
+	}
+}
+
+func TestKeyPoolHonorsRateLimitHeaders(t *testing.T) {
+	pool := newTestKeyPool(t, KeyConfig{Secret: "a", Weight: 1}, KeyConfig{Secret: "b", Weight: 1})
+	a := pool.keys[0]
+
+	reset := time.Now().Add(time.Minute).UTC().Format(time.RFC3339)
+	pool.observe(a, keyResponse(http.StatusOK,
+		"anthropic-ratelimit-requests-remaining", "0",
+		"anthropic-ratelimit-requests-reset", reset))
+	if got := fmt.Sprint(pick(pool, 2)); got != "[b b]" {
+		t.Errorf("keys picked with a out of requests %s, want only b", got)
+	}
+
+	pool.observe(pool.keys[1], keyResponse(http.StatusOK,
+		"x-ratelimit-remaining-tokens", "0",
+		"x-ratelimit-reset-tokens", "30s"))
+	// With every key out, the one that recovers first is used
+	if got := fmt.Sprint(pick(pool, 2)); got != "[b b]" {
+		t.Errorf("keys picked with both out %s, want b, which resets first", got)
+	}
+}
+
+func TestKeyPoolSkipsTriedKeys(t *testing.T) {
+	pool := newTestKeyPool(t, KeyConfig{Secret: "a", Weight: 1}, KeyConfig{Secret: "b", Weight: 1})
+	tried := map[*upstreamKey]bool{}
+	for range 2 {
+		k := pool.next(tried)
+		if k == nil || tried[k] {
+			t.Fatalf("next picked %v, want an untried key", k)
+		}
+		tried[k] = true
+	}
+	if k := pool.next(tried); k != nil {
+		t.Errorf("next picked %s once every key was tried, want none", k.secret)
+	}
+}
+
+func TestTransportFailsOverToNextKey(t *testing.T) {
+	keys := []KeyConfig{{Secret: "sk-ant-a", Weight: 1}, {Secret: "sk-ant-b", Weight: 1}}
+	transport, url, hits := newTestTransport(t, keys, func(w http.ResponseWriter, key string, n int) {
+		if key == "sk-ant-a" {
+			w.Header().Set("retry-after", "60")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	resp := roundTrip(t, transport, url)
+	if got := fmt.Sprint(hits.list()); resp.StatusCode != http.StatusOK || got != "[sk-ant-a sk-ant-b]" {
+		t.Errorf("got %d after trying %s, want 200 after a then b", resp.StatusCode, got)
+	}
+	if n := transport.failovers.Load(); n != 1 {
+		t.Errorf("counted %d failovers, want 1", n)
+	}
+
+	// The rate limited key sits out the next requests
+	roundTrip(t, transport, url)
+	roundTrip(t, transport, url)
+	if got := fmt.Sprint(hits.list()[2:]); got != "[sk-ant-b sk-ant-b]" {
+		t.Errorf("later requests went to %s, want only b", got)
+	}
+}
+
+func TestTransportReturnsRateLimitOnceEveryKeyFailed(t *testing.T) {
+	keys := []KeyConfig{{Secret: "sk-ant-a", Weight: 1}, {Secret: "sk-ant-b", Weight: 1}}
+	transport, url, hits := newTestTransport(t, keys, func(w http.ResponseWriter, key string, n int) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+
+	resp := roundTrip(t, transport, url)
+	if resp.StatusCode != http.StatusTooManyRequests || len(hits.list()) != 2 {
+		t.Errorf("got %d after %d requests, want 429 after trying both keys", resp.StatusCode, len(hits.list()))
+	}
+}
+
+func TestTransportFailsOverThenRetriesOverload(t *testing.T) {
+	// Both keys are overloaded once; the request tries each, then backs
+	// off and starts over
+	keys := []KeyConfig{{Secret: "sk-ant-a", Weight: 1}, {Secret: "sk-ant-b", Weight: 1}}
+	transport, url, hits := newTestTransport(t, keys, func(w http.ResponseWriter, key string, n int) {
+		if n <= 2 {
+			w.Header().Set("retry-after-ms", "10")
+			w.WriteHeader(529)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	resp := roundTrip(t, transport, url)
+	if resp.StatusCode != http.StatusOK || len(hits.list()) != 3 {
+		t.Errorf("got %d after %d requests, want 200 after 3", resp.StatusCode, len(hits.list()))
+	}
+	if f, r := transport.failovers.Load(), transport.retries.Load(); f != 1 || r != 1 {
+		t.Errorf("counted %d failovers and %d retries, want 1 of each", f, r)
+	}
+}
@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+
+	"github.com/izalutski/catty/internal/db"
+)
+
+// openAIUsage is the usage object of OpenAI's APIs. Chat completions and
+// embeddings report prompt and completion tokens; the Responses API reports
+// input and output tokens. Either way, cached tokens are included in the
+// input count.
+type openAIUsage struct {
+	PromptTokens        int64 `json:"prompt_tokens"`
+	CompletionTokens    int64 `json:"completion_tokens"`
+	PromptTokensDetails struct {
+		CachedTokens int64 `json:"cached_tokens"`
+	} `json:"prompt_tokens_details"`
+
+	InputTokens        int64 `json:"input_tokens"`
+	OutputTokens       int64 `json:"output_tokens"`
+	InputTokensDetails struct {
+		CachedTokens int64 `json:"cached_tokens"`
+	} `json:"input_tokens_details"`
+}
+
+// tokenUsage converts the usage to catty's split, in which input tokens
+// exclude cache reads. OpenAI doesn't charge for cache writes.
+func (u *openAIUsage) tokenUsage() db.TokenUsage {
+	input := u.PromptTokens + u.InputTokens
+	cached := u.PromptTokensDetails.CachedTokens + u.InputTokensDetails.CachedTokens
+	return db.TokenUsage{
+		InputTokens:          input - cached,
+		OutputTokens:         u.CompletionTokens + u.OutputTokens,
+		CacheReadInputTokens: cached,
+	}
+}
+
+// parseOpenAIResponse extracts the model and usage from a non-streaming
+// OpenAI response.
+func parseOpenAIResponse(body []byte) (string, db.TokenUsage, error) {
+	var resp struct {
+		Model string       `json:"model"`
+		Usage *openAIUsage `json:"usage"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return "", db.TokenUsage{}, err
+	}
+	if resp.Usage == nil {
+		return resp.Model, db.TokenUsage{}, nil
+	}
+	return resp.Model, resp.Usage.tokenUsage(), nil
+}
+
+// wantOpenAIEvent reports whether an OpenAI event may carry usage. Chat
+// completion chunks are unnamed; of the Responses API's events, only those
+// ending a response carry it.
+func wantOpenAIEvent(event []byte) bool {
+	switch string(event) {
+	case "", "response.completed", "response.incomplete", "response.failed":
+		return true
+	}
+	return false
+}
+
+// parseOpenAIData extracts usage from an OpenAI SSE data payload. Chat
+// completion streams end with a chunk carrying the usage of the whole
+// request, when asked for with stream_options; Responses API streams end
+// with an event carrying the final response. Payloads without a usage
+// object aren't decoded.
+func (r *sseUsageReader) parseOpenAIData(_, data []byte) {
+	if !hasUsageObject(data) {
+		return
+	}
+
+	var event struct {
+		Model    string       `json:"model"`
+		Usage    *openAIUsage `json:"usage"`
+		Response *struct {
+			Model string       `json:"model"`
+			Usage *openAIUsage `json:"usage"`
+		} `json:"response"`
+	}
+	if err := json.Unmarshal(data, &event); err != nil {
+		return
+	}
+
+	if event.Model != "" {
+		r.model = event.Model
+	}
+	if event.Usage != nil {
+		r.usage = event.Usage.tokenUsage()
+	}
+	if resp := event.Response; resp != nil {
+		if resp.Model != "" {
+			r.model = resp.Model
+		}
+		if resp.Usage != nil {
+			r.usage = resp.Usage.tokenUsage()
+		}
+	}
+}
+
+// hasUsageObject reports whether a JSON payload has a "usage" key with an
+// object value. Chat completion chunks asked to include usage carry a null
+// one until the last.
+func hasUsageObject(data []byte) bool {
+	key := []byte(`"usage"`)
+	for {
+		i := bytes.Index(data, key)
+		if i < 0 {
+			return false
+		}
+		data = bytes.TrimLeft(data[i+len(key):], " \t\r\n")
+		if len(data) > 0 && data[0] == ':' {
+			if v := bytes.TrimLeft(data[1:], " \t\r\n"); len(v) > 0 && v[0] == '{' {
+				return true
+			}
+		}
+	}
+}
+
+// withStreamUsage asks for usage in a streaming chat completion request,
+// which OpenAI otherwise leaves out of the stream. Clients that asked for
+// it already get the same stream; others get one more chunk, with no
+// choices, before the end. Other requests are returned as they are.
+func withStreamUsage(body []byte) []byte {
+	var req map[string]json.RawMessage
+	if err := json.Unmarshal(body, &req); err != nil {
+		return body
+	}
+	var stream bool
+	if json.Unmarshal(req["stream"], &stream); !stream {
+		return body
+	}
+
+	options := make(map[string]any)
+	if raw, ok := req["stream_options"]; ok {
+		json.Unmarshal(raw, &options)
+	}
+	if include, _ := options["include_usage"].(bool); include {
+		return body
+	}
+	options["include_usage"] = true
+
+	raw, err := json.Marshal(options)
+	if err != nil {
+		return body
+	}
+	req["stream_options"] = raw
+	out, err := json.Marshal(req)
+	if err != nil {
+		return body
+	}
+	return out
+}
+
+// writeOpenAIError writes an error in the OpenAI API's format, so agents
+// show it like any other API error.
+func writeOpenAIError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"error": map[string]any{
+			"message": message,
+			"type":    code,
+			"param":   nil,
+			"code":    code,
+		},
+	})
+}
@@ -0,0 +1,262 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+
+	"github.com/izalutski/catty/internal/db"
+)
+
+// Policy limits what a session's API requests may ask for. Model patterns
+// match a model ID exactly, or by prefix when they end in *, so
+// "claude-sonnet-4-5*" matches claude-sonnet-4-5-20250929.
+type Policy struct {
+	// Models are the patterns of the models requests may use; empty
+	// allows every model.
+	Models []string `toml:"models"`
+	// MaxTokens caps the output a request may ask for; zero means no cap.
+	MaxTokens int64 `toml:"max_tokens"`
+	// Downgrade maps model patterns to the model used instead. It applies
+	// before Models is checked.
+	Downgrade map[string]string `toml:"downgrade"`
+	// BlockedBetas are beta features requests may not enable with the
+	// anthropic-beta or OpenAI-Beta header.
+	BlockedBetas []string `toml:"blocked_betas"`
+}
+
+// merge overlays the values set in other onto p. Downgrades are merged
+// and blocked betas appended.
+func (p *Policy) merge(other Policy) {
+	if len(other.Models) > 0 {
+		p.Models = other.Models
+	}
+	if other.MaxTokens != 0 {
+		p.MaxTokens = other.MaxTokens
+	}
+	for k, v := range other.Downgrade {
+		if p.Downgrade == nil {
+			p.Downgrade = make(map[string]string)
+		}
+		p.Downgrade[k] = v
+	}
+	p.BlockedBetas = append(p.BlockedBetas, other.BlockedBetas...)
+}
+
+// PolicyConfig holds the policies for each plan and organization. A
+// user's organization is their email domain; its policy is overlaid on
+// their plan's.
+//
+//	[plans.free]
+//	models = ["claude-sonnet-4-5*", "claude-haiku-4-5*"]
+//	max_tokens = 16000
+//	blocked_betas = ["context-1m-2025-08-07"]
+//
+//	[plans.free.downgrade]
+//	"claude-opus-*" = "claude-sonnet-4-5"
+//
+//	[orgs."example.com"]
+//	max_tokens = 64000
+type PolicyConfig struct {
+	Plans map[string]Policy `toml:"plans"`
+	Orgs  map[string]Policy `toml:"orgs"`
+}
+
+// LoadPolicyConfig reads a policy config file.
+func LoadPolicyConfig(path string) (*PolicyConfig, error) {
+	cfg := &PolicyConfig{}
+	md, err := toml.DecodeFile(path, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return nil, fmt.Errorf("read %s: unknown key %s", path, undecoded[0])
+	}
+	for _, policies := range []map[string]Policy{cfg.Plans, cfg.Orgs} {
+		for name, p := range policies {
+			if p.MaxTokens < 0 {
+				return nil, fmt.Errorf("read %s: %s: max_tokens must not be negative", path, name)
+			}
+			for from, to := range p.Downgrade {
+				if to == "" || strings.HasSuffix(to, "*") {
+					return nil, fmt.Errorf("read %s: %s: downgrade of %q must name a model", path, name, from)
+				}
+			}
+		}
+	}
+	return cfg, nil
+}
+
+// PolicyConfigFromEnv reads the policy config file named by
+// CATTY_PROXY_POLICY. Without one, requests are not limited.
+func PolicyConfigFromEnv() (*PolicyConfig, error) {
+	path := os.Getenv("CATTY_PROXY_POLICY")
+	if path == "" {
+		return nil, nil
+	}
+	return LoadPolicyConfig(path)
+}
+
+// policy returns the policy for a user on plan with email.
+func (c *PolicyConfig) policy(plan, email string) Policy {
+	var p Policy
+	p.merge(c.Plans[plan])
+	if _, domain, ok := strings.Cut(email, "@"); ok {
+		p.merge(c.Orgs[strings.ToLower(domain)])
+	}
+	return p
+}
+
+// hasOrgs reports whether any organization has a policy, which is the only
+// reason to look up a user's email.
+func (c *PolicyConfig) hasOrgs() bool {
+	return len(c.Orgs) > 0
+}
+
+// matchModel reports whether model matches pattern.
+func matchModel(pattern, model string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(model, prefix)
+	}
+	return model == pattern
+}
+
+// policyError is a request the policy refuses, with the status and
+// provider error type to report it with.
+type policyError struct {
+	status  int
+	errType string
+	message string
+}
+
+func (e *policyError) Error() string {
+	return e.message
+}
+
+// outputCapField returns the field a provider's endpoint takes its output
+// cap in, or "" for endpoints that don't generate output, like token
+// counting.
+func outputCapField(provider, apiPath string) string {
+	switch provider {
+	case db.ProviderAnthropic:
+		if apiPath == "/v1/messages" {
+			return "max_tokens"
+		}
+	case db.ProviderOpenAI:
+		switch apiPath {
+		case "/v1/chat/completions":
+			return "max_completion_tokens"
+		case "/v1/responses":
+			return "max_output_tokens"
+		case "/v1/completions":
+			return "max_tokens"
+		}
+	}
+	return ""
+}
+
+// enforce checks a request against the policy, switching its model if it
+// is downgraded. Requests that don't cap their output are given the
+// policy's cap in capField, unless it is empty. It returns the body to
+// forward, or a *policyError.
+func (p *Policy) enforce(header http.Header, body []byte, capField string) ([]byte, error) {
+	for _, name := range []string{"anthropic-beta", "OpenAI-Beta"} {
+		for _, value := range header.Values(name) {
+			for beta := range strings.SplitSeq(value, ",") {
+				beta = strings.TrimSpace(beta)
+				for _, blocked := range p.BlockedBetas {
+					if beta == blocked {
+						return nil, &policyError{http.StatusForbidden, "permission_error",
+							fmt.Sprintf("catty policy: beta %q is not allowed on your plan", beta)}
+					}
+				}
+			}
+		}
+	}
+
+	var req map[string]json.RawMessage
+	if err := json.Unmarshal(body, &req); err != nil {
+		// Not a request the policy applies to, like a model listing
+		return body, nil
+	}
+
+	var model string
+	json.Unmarshal(req["model"], &model)
+	if model != "" {
+		if to := p.downgrade(model); to != "" && to != model {
+			raw, err := json.Marshal(to)
+			if err != nil {
+				return nil, err
+			}
+			req["model"] = raw
+			if body, err = json.Marshal(req); err != nil {
+				return nil, err
+			}
+			model = to
+		}
+
+		if !p.allows(model) {
+			return nil, &policyError{http.StatusForbidden, "permission_error",
+				fmt.Sprintf("catty policy: model %q is not allowed on your plan (allowed: %s)",
+					model, strings.Join(p.Models, ", "))}
+		}
+	}
+
+	if p.MaxTokens > 0 {
+		capped := false
+		for _, field := range []string{"max_tokens", "max_completion_tokens", "max_output_tokens"} {
+			var n int64
+			json.Unmarshal(req[field], &n)
+			if n > p.MaxTokens {
+				return nil, &policyError{http.StatusBadRequest, "invalid_request_error",
+					fmt.Sprintf("catty policy: %s is %d, but your plan allows at most %d", field, n, p.MaxTokens)}
+			}
+			if n > 0 {
+				capped = true
+			}
+		}
+		// Without a cap the request could generate as much as the model
+		// allows
+		if !capped && capField != "" {
+			raw, err := json.Marshal(p.MaxTokens)
+			if err != nil {
+				return nil, err
+			}
+			req[capField] = raw
+			if body, err = json.Marshal(req); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return body, nil
+}
+
+// downgrade returns the model to use instead of model, or "" to keep it.
+// The longest matching pattern wins.
+func (p *Policy) downgrade(model string) string {
+	best, to := -1, ""
+	for pattern, replacement := range p.Downgrade {
+		if len(pattern) > best && matchModel(pattern, model) {
+			best, to = len(pattern), replacement
+		}
+	}
+	return to
+}
+
+// allows reports whether the policy lets requests use model.
+func (p *Policy) allows(model string) bool {
+	if len(p.Models) == 0 {
+		return true
+	}
+	for _, pattern := range p.Models {
+		if matchModel(pattern, model) {
+			return true
+		}
+	}
+	return false
+}
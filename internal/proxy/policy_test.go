@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/izalutski/catty/internal/db"
+)
+
+func TestPolicyMaxTokens(t *testing.T) {
+	policy := &Policy{MaxTokens: 1000}
+	tests := []struct {
+		name     string
+		provider string
+		apiPath  string
+		body     string
+		// want is the cap each field should be sent with; a missing field
+		// should be left out
+		want    map[string]int64
+		refused bool
+	}{
+		{
+			name:     "messages without a cap get one",
+			provider: db.ProviderAnthropic,
+			apiPath:  "/v1/messages",
+			body:     `{"model":"claude-sonnet-4-5"}`,
+			want:     map[string]int64{"max_tokens": 1000},
+		},
+		{
+			name:     "chat completions without a cap get one",
+			provider: db.ProviderOpenAI,
+			apiPath:  "/v1/chat/completions",
+			body:     `{"model":"gpt-5"}`,
+			want:     map[string]int64{"max_completion_tokens": 1000},
+		},
+		{
+			name:     "responses without a cap get one",
+			provider: db.ProviderOpenAI,
+			apiPath:  "/v1/responses",
+			body:     `{"model":"gpt-5"}`,
+			want:     map[string]int64{"max_output_tokens": 1000},
+		},
+		{
+			name:     "a lower cap is kept",
+			provider: db.ProviderOpenAI,
+			apiPath:  "/v1/chat/completions",
+			body:     `{"model":"gpt-5","max_tokens":500}`,
+			want:     map[string]int64{"max_tokens": 500},
+		},
+		{
+			name:     "token counting is left alone",
+			provider: db.ProviderAnthropic,
+			apiPath:  "/v1/messages/count_tokens",
+			body:     `{"model":"claude-sonnet-4-5"}`,
+			want:     map[string]int64{},
+		},
+		{
+			name:     "a higher cap is refused",
+			provider: db.ProviderAnthropic,
+			apiPath:  "/v1/messages",
+			body:     `{"model":"claude-sonnet-4-5","max_tokens":2000}`,
+			refused:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := policy.enforce(http.Header{}, []byte(tt.body), outputCapField(tt.provider, tt.apiPath))
+			var violation *policyError
+			if tt.refused {
+				if !errors.As(err, &violation) {
+					t.Fatalf("got %v, want a policy error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got map[string]any
+			if err := json.Unmarshal(body, &got); err != nil {
+				t.Fatal(err)
+			}
+			for _, field := range []string{"max_tokens", "max_completion_tokens", "max_output_tokens"} {
+				want, ok := tt.want[field]
+				n, present := got[field]
+				switch {
+				case ok && n != float64(want):
+					t.Errorf("%s is %v, want %d", field, n, want)
+				case !ok && present:
+					t.Errorf("%s was added: %s", field, body)
+				}
+			}
+		})
+	}
+}
@@ -3,7 +3,9 @@ package proxy
 import (
 	"bytes"
 	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -11,85 +13,166 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/izalutski/catty/internal/db"
+	"github.com/izalutski/catty/internal/protocol"
 )
 
 const (
 	AnthropicAPIBase = "https://api.anthropic.com"
+	OpenAIAPIBase    = "https://api.openai.com"
 )
 
-// Proxy is an Anthropic API proxy that counts tokens.
+// maxRequestBody bounds the request bodies the proxy reads into memory.
+// It matches the Anthropic API's own limit for Messages requests.
+const maxRequestBody = 32 << 20
+
+// Proxy is an Anthropic and OpenAI API proxy that counts tokens.
 type Proxy struct {
-	db           *db.Client
-	anthropicKey string
+	db     db.Store
+	usage  *UsageQueue
+	logger *slog.Logger
+
+	// policies limit what requests may ask for; nil means no limits
+	policies *PolicyConfig
+
+	// headerTimeout is how long a request waits for the upstream response
+	// to start; upstreamIdle and clientIdle how long a response may go
+	// without a byte from upstream or without the client taking one
+	headerTimeout time.Duration
+	upstreamIdle  time.Duration
+	clientIdle    time.Duration
+
+	// anthropic and openai are nil for providers without keys
+	anthropic *upstream
+	openai    *upstream
+}
+
+// upstream is an API provider requests are forwarded to.
+type upstream struct {
+	provider     string
+	keys         *KeyPool
+	transport    *keyTransport
 	reverseProxy *httputil.ReverseProxy
-	logger       *slog.Logger
 }
 
-// NewProxy creates a new Anthropic API proxy.
-func NewProxy(dbClient *db.Client, anthropicKey string, logger *slog.Logger) (*Proxy, error) {
-	target, err := url.Parse(AnthropicAPIBase)
-	if err != nil {
-		return nil, fmt.Errorf("parse anthropic URL: %w", err)
+// NewProxy creates a new API proxy that forwards requests with keys from a
+// pool per provider and records their usage through a queue. Requests for
+// a provider without keys are refused; policies may be nil.
+func NewProxy(store db.Store, usage *UsageQueue, keys, openAIKeys []KeyConfig, policies *PolicyConfig, logger *slog.Logger) (*Proxy, error) {
+	if len(keys) == 0 && len(openAIKeys) == 0 {
+		return nil, fmt.Errorf("no upstream API keys")
 	}
 
 	proxy := &Proxy{
-		db:           dbClient,
-		anthropicKey: anthropicKey,
-		logger:       logger,
+		db:       store,
+		usage:    usage,
+		logger:   logger,
+		policies: policies,
+
+		headerTimeout: upstreamHeaderTimeout,
+		upstreamIdle:  streamIdleTimeout,
+		clientIdle:    streamIdleTimeout,
 	}
 
-	// Create reverse proxy
-	rp := httputil.NewSingleHostReverseProxy(target)
-	rp.Director = proxy.director
-	rp.ModifyResponse = proxy.modifyResponse
-	proxy.reverseProxy = rp
+	var err error
+	if len(keys) > 0 {
+		proxy.anthropic, err = proxy.newUpstream(db.ProviderAnthropic, AnthropicAPIBase, keys,
+			func(h http.Header, secret string) { h.Set("x-api-key", secret) })
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(openAIKeys) > 0 {
+		proxy.openai, err = proxy.newUpstream(db.ProviderOpenAI, OpenAIAPIBase, openAIKeys,
+			func(h http.Header, secret string) { h.Set("Authorization", "Bearer "+secret) })
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	return proxy, nil
 }
 
-// director modifies the outgoing request to Anthropic.
-func (p *Proxy) director(req *http.Request) {
-	target, _ := url.Parse(AnthropicAPIBase)
-	req.URL.Scheme = target.Scheme
-	req.URL.Host = target.Host
-	req.Host = target.Host
+// newUpstream creates a reverse proxy to a provider's API that sets keys
+// from a pool with authorize.
+func (p *Proxy) newUpstream(provider, base string, keys []KeyConfig, authorize func(http.Header, string)) (*upstream, error) {
+	target, err := url.Parse(base)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s URL: %w", provider, err)
+	}
+
+	pool, err := NewKeyPool(keys)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", provider, err)
+	}
 
-	// Replace the API key with ours
-	req.Header.Set("x-api-key", p.anthropicKey)
+	rp := httputil.NewSingleHostReverseProxy(target)
+	rp.Director = func(req *http.Request) {
+		req.URL.Scheme = target.Scheme
+		req.URL.Host = target.Host
+		req.Host = target.Host
+
+		// Drop the session's proxy credential; the transport sets a real
+		// API key, which only the proxy holds
+		req.Header.Del("x-api-key")
+		req.Header.Del("Authorization")
+	}
+	rp.ModifyResponse = p.modifyResponse
+	rp.ErrorHandler = p.errorHandler
+	// Pass every chunk on as it arrives
+	rp.FlushInterval = -1
+	transport := &keyTransport{
+		keys:      pool,
+		base:      http.DefaultTransport,
+		authorize: authorize,
+		logger:    p.logger,
+		baseDelay: retryBaseDelay,
+		maxDelay:  retryMaxDelay,
+		budget:    retryBudget,
+	}
+	rp.Transport = transport
 
-	// Remove our custom auth header
-	req.Header.Del("Authorization")
+	return &upstream{provider: provider, keys: pool, transport: transport, reverseProxy: rp}, nil
 }
 
-// modifyResponse processes the response from Anthropic to count tokens.
+// modifyResponse processes the response from upstream to count tokens.
 func (p *Proxy) modifyResponse(resp *http.Response) error {
-	// Only process successful message responses
+	// The response has started; from here the upstream only has to keep
+	// sending
+	if wd := watchdogFromContext(resp.Request.Context()); wd != nil {
+		wd.kick()
+		resp.Body = &idleReader{ReadCloser: resp.Body, watchdog: wd}
+	}
+
+	// Only process successful responses
 	if resp.StatusCode != http.StatusOK {
 		return nil
 	}
 
-	// Check if this is a messages endpoint
-	if !strings.Contains(resp.Request.URL.Path, "/messages") {
+	// Get the request's usage tracker from context (set in ServeHTTP)
+	tracker := trackerFromContext(resp.Request.Context())
+	if tracker == nil {
 		return nil
 	}
 
-	// Get session info from context (set in ServeHTTP)
-	session := SessionFromContext(resp.Request.Context())
-	if session == nil {
-		return nil
+	// Only Anthropic's messages endpoints use tokens; OpenAI responses
+	// carry usage wherever it applies
+	if tracker.provider == db.ProviderAnthropic {
+		if !strings.Contains(resp.Request.URL.Path, "/messages") {
+			return nil
+		}
+		tracker.requestID = resp.Header.Get("request-id")
+	} else {
+		tracker.requestID = resp.Header.Get("x-request-id")
 	}
 
 	// Check if this is a streaming response
 	contentType := resp.Header.Get("Content-Type")
 	if strings.Contains(contentType, "text/event-stream") {
 		// Wrap the response body to intercept SSE events
-		resp.Body = &sseUsageReader{
-			reader:  resp.Body,
-			proxy:   p,
-			session: session,
-		}
+		resp.Body = newSSEUsageReader(resp.Body, tracker)
 		return nil
 	}
 
@@ -102,24 +185,14 @@ func (p *Proxy) modifyResponse(resp *http.Response) error {
 	resp.Body.Close()
 
 	// Parse usage from response
-	var messageResp struct {
-		Usage struct {
-			InputTokens  int64 `json:"input_tokens"`
-			OutputTokens int64 `json:"output_tokens"`
-		} `json:"usage"`
+	parse := parseAnthropicResponse
+	if tracker.provider == db.ProviderOpenAI {
+		parse = parseOpenAIResponse
 	}
-
-	if err := json.Unmarshal(body, &messageResp); err != nil {
+	if model, usage, err := parse(body); err != nil {
 		p.logger.Debug("failed to parse response for usage", "error", err)
-	} else if messageResp.Usage.InputTokens > 0 || messageResp.Usage.OutputTokens > 0 {
-		if err := p.db.RecordUsage(session.UserID, session.ID, messageResp.Usage.InputTokens, messageResp.Usage.OutputTokens); err != nil {
-			p.logger.Error("failed to record usage", "error", err, "session_id", session.ID)
-		} else {
-			p.logger.Info("recorded usage",
-				"session_id", session.ID,
-				"input_tokens", messageResp.Usage.InputTokens,
-				"output_tokens", messageResp.Usage.OutputTokens)
-		}
+	} else if !usage.IsZero() {
+		tracker.settle(model, usage)
 	}
 
 	// Restore the response body
@@ -129,22 +202,60 @@ func (p *Proxy) modifyResponse(resp *http.Response) error {
 	return nil
 }
 
+// errorHandler reports a failed upstream request before its response
+// started.
+func (p *Proxy) errorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(context.Cause(r.Context()), errUpstreamIdle):
+		p.logger.Warn("upstream timed out", "api_path", r.URL.Path)
+		http.Error(w, `{"error":"upstream timed out"}`, http.StatusGatewayTimeout)
+	case r.Context().Err() != nil:
+		// The client went away; there is no one to answer
+		p.logger.Info("client disconnected", "api_path", r.URL.Path)
+	default:
+		p.logger.Error("upstream request failed", "error", err, "api_path", r.URL.Path)
+		http.Error(w, `{"error":"upstream request failed"}`, http.StatusBadGateway)
+	}
+}
+
+// parseAnthropicResponse extracts the model and usage from a Messages API
+// response.
+func parseAnthropicResponse(body []byte) (string, db.TokenUsage, error) {
+	var messageResp struct {
+		Model string        `json:"model"`
+		Usage db.TokenUsage `json:"usage"`
+	}
+	err := json.Unmarshal(body, &messageResp)
+	return messageResp.Model, messageResp.Usage, err
+}
+
 // sseUsageReader wraps an SSE response body to extract usage information.
 type sseUsageReader struct {
-	reader       io.ReadCloser
-	proxy        *Proxy
-	session      *db.Session
-	buffer       []byte
-	inputTokens  int64
-	outputTokens int64
+	reader  io.ReadCloser
+	tracker *usageTracker
+	parser  sseParser
+	model   string
+	usage   db.TokenUsage
+}
+
+// newSSEUsageReader wraps a streaming response body of the tracker's
+// provider.
+func newSSEUsageReader(body io.ReadCloser, tracker *usageTracker) *sseUsageReader {
+	r := &sseUsageReader{reader: body, tracker: tracker}
+	if tracker.provider == db.ProviderOpenAI {
+		r.parser.want = wantOpenAIEvent
+		r.parser.handle = r.parseOpenAIData
+	} else {
+		r.parser.want = wantAnthropicEvent
+		r.parser.handle = r.parseAnthropicData
+	}
+	return r
 }
 
 func (r *sseUsageReader) Read(p []byte) (n int, err error) {
 	n, err = r.reader.Read(p)
 	if n > 0 {
-		// Append to buffer for parsing
-		r.buffer = append(r.buffer, p[:n]...)
-		r.parseSSEEvents()
+		r.parser.feed(p[:n])
 	}
 	// Record usage on EOF (in case Close() isn't called)
 	if err == io.EOF {
@@ -153,20 +264,12 @@ func (r *sseUsageReader) Read(p []byte) (n int, err error) {
 	return n, err
 }
 
-// recorded tracks if we've already recorded usage for this stream
+// recordUsageOnce records the usage seen so far, then clears it so the
+// stream is only counted once.
 func (r *sseUsageReader) recordUsageOnce() {
-	if r.inputTokens > 0 || r.outputTokens > 0 {
-		if err := r.proxy.db.RecordUsage(r.session.UserID, r.session.ID, r.inputTokens, r.outputTokens); err != nil {
-			r.proxy.logger.Error("failed to record usage", "error", err, "session_id", r.session.ID)
-		} else {
-			r.proxy.logger.Info("recorded usage",
-				"session_id", r.session.ID,
-				"input_tokens", r.inputTokens,
-				"output_tokens", r.outputTokens)
-		}
-		// Clear to prevent duplicate recording
-		r.inputTokens = 0
-		r.outputTokens = 0
+	if !r.usage.IsZero() {
+		r.tracker.settle(r.model, r.usage)
+		r.usage = db.TokenUsage{}
 	}
 }
 
@@ -175,85 +278,78 @@ func (r *sseUsageReader) Close() error {
 	return r.reader.Close()
 }
 
-// parseSSEEvents extracts usage from SSE events in the buffer.
-func (r *sseUsageReader) parseSSEEvents() {
-	// SSE format: "event: type\ndata: {json}\n\n" or just "data: {json}\n\n"
-	for {
-		// Look for double newline (end of SSE event)
-		idx := bytes.Index(r.buffer, []byte("\n\n"))
-		if idx == -1 {
-			// Also try \r\n\r\n
-			idx = bytes.Index(r.buffer, []byte("\r\n\r\n"))
-			if idx == -1 {
-				break
-			}
-			// Adjust for \r\n\r\n
-			event := r.buffer[:idx]
-			r.buffer = r.buffer[idx+4:]
-			r.parseSSEEvent(event)
-			continue
-		}
-
-		event := r.buffer[:idx]
-		r.buffer = r.buffer[idx+2:]
-		r.parseSSEEvent(event)
+// wantAnthropicEvent reports whether an Anthropic event may carry usage.
+// Anthropic names every event after its type; unnamed events are checked
+// when they arrive.
+func wantAnthropicEvent(event []byte) bool {
+	switch string(event) {
+	case "", "message_start", "message_delta":
+		return true
 	}
+	return false
 }
 
-// parseSSEEvent parses a single SSE event block
-func (r *sseUsageReader) parseSSEEvent(event []byte) {
-	// Split by newlines and find data line
-	lines := bytes.Split(event, []byte("\n"))
-	for _, line := range lines {
-		// Handle \r if present
-		line = bytes.TrimSuffix(line, []byte("\r"))
-
-		if bytes.HasPrefix(line, []byte("data: ")) {
-			data := line[6:]
-			// Skip [DONE] marker
-			if bytes.Equal(data, []byte("[DONE]")) {
-				continue
-			}
-			r.parseSSEData(data)
-		}
+// parseAnthropicData extracts usage from an Anthropic SSE data payload.
+// Only message_start and message_delta payloads are decoded.
+func (r *sseUsageReader) parseAnthropicData(event, data []byte) {
+	if len(event) == 0 && !bytes.Contains(data, []byte(`"message_`)) {
+		return
 	}
-}
 
-// parseSSEData extracts usage from an SSE data payload.
-func (r *sseUsageReader) parseSSEData(data []byte) {
-	// First, just get the type
-	var typeOnly struct {
-		Type string `json:"type"`
+	var payload struct {
+		Type    string `json:"type"`
+		Message struct {
+			Model string        `json:"model"`
+			Usage db.TokenUsage `json:"usage"`
+		} `json:"message"`
+		Usage db.TokenUsage `json:"usage"`
 	}
-	if err := json.Unmarshal(data, &typeOnly); err != nil {
+	if err := json.Unmarshal(data, &payload); err != nil {
 		return
 	}
 
-	switch typeOnly.Type {
+	// message_start carries the input side of the usage, message_delta the
+	// final counts. Delta counts are cumulative and may repeat or revise any
+	// field, so non-zero values replace what message_start reported.
+	switch payload.Type {
 	case "message_start":
-		var messageStart struct {
-			Message struct {
-				Usage struct {
-					InputTokens int64 `json:"input_tokens"`
-				} `json:"usage"`
-			} `json:"message"`
-		}
-		if err := json.Unmarshal(data, &messageStart); err == nil {
-			r.inputTokens = messageStart.Message.Usage.InputTokens
-		}
-
+		r.model = payload.Message.Model
+		r.usage = payload.Message.Usage
 	case "message_delta":
-		var messageDelta struct {
-			Usage struct {
-				OutputTokens int64 `json:"output_tokens"`
-			} `json:"usage"`
-		}
-		if err := json.Unmarshal(data, &messageDelta); err == nil && messageDelta.Usage.OutputTokens > 0 {
-			r.outputTokens = messageDelta.Usage.OutputTokens
-		}
+		mergeUsage(&r.usage, payload.Usage)
+	}
+}
+
+// mergeUsage overwrites the fields of dst with the non-zero fields of update.
+func mergeUsage(dst *db.TokenUsage, update db.TokenUsage) {
+	if update.InputTokens > 0 {
+		dst.InputTokens = update.InputTokens
+	}
+	if update.OutputTokens > 0 {
+		dst.OutputTokens = update.OutputTokens
+	}
+	if update.CacheCreationInputTokens > 0 {
+		dst.CacheCreationInputTokens = update.CacheCreationInputTokens
+	}
+	if update.CacheReadInputTokens > 0 {
+		dst.CacheReadInputTokens = update.CacheReadInputTokens
 	}
 }
 
+// validProxyToken reports whether the request carries the session's proxy
+// credential, sent by Anthropic clients as x-api-key or a bearer token.
+// Sessions without a credential are always rejected.
+func validProxyToken(r *http.Request, session *db.Session) bool {
+	token := r.Header.Get("x-api-key")
+	if token == "" {
+		token, _ = strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	if token == "" || session.ProxyTokenHash == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(db.HashToken(token)), []byte(session.ProxyTokenHash)) == 1
+}
+
 type contextKey string
 
 const sessionContextKey contextKey = "session"
@@ -271,6 +367,67 @@ func SessionFromContext(ctx context.Context) *db.Session {
 	return nil
 }
 
+// serveBudget reports how much of its budget a session has used.
+func (p *Proxy) serveBudget(w http.ResponseWriter, session *db.Session) {
+	usage, err := p.db.GetSessionUsage(session.ID)
+	if err != nil {
+		p.logger.Error("failed to get session usage", "error", err)
+		http.Error(w, `{"error":"internal error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(protocol.BudgetStatus{
+		BudgetTokens:       session.BudgetTokens,
+		BudgetCostMicroUSD: session.BudgetMicroUSD,
+		UsedTokens:         usage.QuotaTokens(),
+		UsedCostMicroUSD:   usage.CostMicroUSD,
+		Exhausted:          session.HasBudget() && session.BudgetExhausted(usage.QuotaTokens(), usage.CostMicroUSD),
+	})
+}
+
+// writeAnthropicError writes an error in the Anthropic API's format, so
+// agents show it like any other API error.
+func writeAnthropicError(w http.ResponseWriter, status int, errType, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"type": "error",
+		"error": map[string]string{
+			"type":    errType,
+			"message": message,
+		},
+	})
+}
+
+// writeProviderError writes an error in the format of a provider's API.
+func writeProviderError(w http.ResponseWriter, provider string, status int, errType, message string) {
+	if provider == db.ProviderOpenAI {
+		writeOpenAIError(w, status, errType, message)
+		return
+	}
+	writeAnthropicError(w, status, errType, message)
+}
+
+// enforcePolicy applies the policy for the session's user to a request,
+// returning the body to forward or a *policyError.
+func (p *Proxy) enforcePolicy(session *db.Session, provider, apiPath string, header http.Header, body []byte) ([]byte, error) {
+	sub, err := p.db.GetOrCreateSubscription(session.UserID)
+	if err != nil {
+		return nil, err
+	}
+	var email string
+	if p.policies.hasOrgs() {
+		user, err := p.db.GetUserByID(session.UserID)
+		if err != nil {
+			return nil, err
+		}
+		email = user.Email
+	}
+	policy := p.policies.policy(sub.Plan, email)
+	return policy.enforce(header, body, outputCapField(provider, apiPath))
+}
+
 // ServeHTTP handles incoming proxy requests.
 // Expected path format: /s/{label}/v1/messages
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -303,32 +460,139 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check quota
-	allowed, remaining, err := p.db.CheckQuota(session.UserID)
+	// The agent must present its session's proxy credential
+	if !validProxyToken(r, session) {
+		p.logger.Warn("invalid proxy credential", "label", label)
+		http.Error(w, `{"error":"invalid session credential"}`, http.StatusUnauthorized)
+		return
+	}
+
+	// The session's executor polls its budget here to tell the user when
+	// it runs out, starting while the session is still provisioning
+	if apiPath == protocol.BudgetPath {
+		p.serveBudget(w, session)
+		return
+	}
+
+	// Only running sessions may use the API; stopped and failed sessions
+	// keep their label and credential in the database
+	if session.Status != "running" {
+		p.logger.Warn("session not running", "label", label, "status", session.Status)
+		http.Error(w, `{"error":"session is not running"}`, http.StatusForbidden)
+		return
+	}
+
+	// OpenAI's API is under /openai, e.g. /s/{label}/openai/v1/responses
+	up := p.anthropic
+	if rest, ok := strings.CutPrefix(apiPath, "/openai/"); ok {
+		up = p.openai
+		apiPath = "/" + rest
+	}
+	if up == nil {
+		p.logger.Warn("provider not configured", "label", label, "api_path", apiPath)
+		http.Error(w, `{"error":"no API keys configured for this provider"}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	// Reserve the most the request can use. Reservations count against
+	// the quota and budget until settled, so parallel requests can't all
+	// pass the same check
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBody))
+	r.Body.Close()
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		p.logger.Warn("request body too large", "session_id", session.ID, "limit", tooLarge.Limit)
+		writeProviderError(w, up.provider, http.StatusRequestEntityTooLarge, "request_too_large",
+			fmt.Sprintf("catty: request body exceeds the %d MB limit", maxRequestBody>>20))
+		return
+	}
 	if err != nil {
-		p.logger.Error("failed to check quota", "error", err)
-		http.Error(w, `{"error":"internal error"}`, http.StatusInternalServerError)
+		http.Error(w, `{"error":"failed to read request body"}`, http.StatusBadRequest)
 		return
 	}
+	// Apply the user's plan and organization policy
+	if p.policies != nil {
+		body, err = p.enforcePolicy(session, up.provider, apiPath, r.Header, body)
+		var violation *policyError
+		if errors.As(err, &violation) {
+			p.logger.Warn("request refused by policy", "session_id", session.ID, "reason", violation.message)
+			writeProviderError(w, up.provider, violation.status, violation.errType, violation.message)
+			return
+		}
+		if err != nil {
+			p.logger.Error("failed to apply policy", "error", err)
+			http.Error(w, `{"error":"internal error"}`, http.StatusInternalServerError)
+			return
+		}
+	}
 
-	if !allowed {
+	if up.provider == db.ProviderOpenAI && strings.HasSuffix(apiPath, "/chat/completions") {
+		body = withStreamUsage(body)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+
+	tokens, cost := estimateUsage(body)
+	reservation, err := p.db.ReserveUsage(session, tokens, cost, reservationTTL)
+	switch {
+	case errors.Is(err, db.ErrQuotaExceeded):
 		p.logger.Warn("quota exceeded", "user_id", session.UserID)
+		if up.provider == db.ProviderOpenAI {
+			writeOpenAIError(w, http.StatusTooManyRequests, "insufficient_quota",
+				"catty quota exceeded - upgrade to pro for unlimited usage")
+			return
+		}
 		http.Error(w, `{"error":"quota exceeded - upgrade to pro for unlimited usage"}`, http.StatusPaymentRequired)
 		return
+	case errors.Is(err, db.ErrBudgetExhausted):
+		p.logger.Warn("session budget exhausted", "session_id", session.ID)
+		const msg = "catty session budget exhausted: start a new session with a larger --budget to continue"
+		if up.provider == db.ProviderOpenAI {
+			writeOpenAIError(w, http.StatusTooManyRequests, "insufficient_quota", msg)
+			return
+		}
+		writeAnthropicError(w, http.StatusPaymentRequired, "billing_error", msg)
+		return
+	case err != nil:
+		p.logger.Error("failed to reserve usage", "error", err)
+		http.Error(w, `{"error":"internal error"}`, http.StatusInternalServerError)
+		return
 	}
 
+	// The response body settles the reservation when it reports usage; by
+	// the time the reverse proxy returns the body has been fully copied, so
+	// anything still held was never used
+	tracker := &usageTracker{proxy: p, provider: up.provider, session: session, reservation: reservation}
+	defer tracker.release()
+
 	p.logger.Debug("proxying request",
 		"session_id", session.ID,
 		"user_id", session.UserID,
-		"remaining_tokens", remaining,
+		"reserved_tokens", tokens,
+		"provider", up.provider,
 		"api_path", apiPath)
 
-	// Store session in context for modifyResponse
-	r = r.WithContext(ContextWithSession(r.Context(), session))
+	// Streams may run as long as both ends keep them moving. The upstream
+	// request is abandoned if the upstream goes quiet, and canceled with
+	// the incoming request's context if the client disconnects
+	ctx, wd := newWatchdog(r.Context(), p.headerTimeout, p.upstreamIdle)
+	defer func() {
+		if errors.Is(context.Cause(ctx), errUpstreamIdle) {
+			p.logger.Warn("abandoned idle upstream request", "session_id", session.ID, "api_path", apiPath)
+		}
+		wd.stop()
+	}()
+	sw := newStreamWriter(w, p.clientIdle)
+	defer sw.done()
+
+	// Store session, tracker and watchdog in context for modifyResponse
+	ctx = ContextWithSession(ctx, session)
+	ctx = contextWithTracker(ctx, tracker)
+	r = r.WithContext(contextWithWatchdog(ctx, wd))
 
 	// Rewrite URL path to remove session prefix before forwarding
 	r.URL.Path = apiPath
 
-	// Forward to Anthropic
-	p.reverseProxy.ServeHTTP(w, r)
+	// Forward to the provider
+	up.reverseProxy.ServeHTTP(sw, r)
 }
@@ -0,0 +1,223 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/izalutski/catty/internal/db"
+)
+
+const testProxyToken = "catty-proxy-test"
+
+// testProxy is a proxy in front of a fake Anthropic API, with one running
+// session.
+type testProxy struct {
+	*Proxy
+	store   *db.MemoryStore
+	session *db.Session
+	// url is the session's base URL on the proxy, as agents get it
+	url string
+}
+
+// newTestProxy starts a proxy that forwards to upstream.
+func newTestProxy(t *testing.T, upstream http.Handler) *testProxy {
+	t.Helper()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	store := db.NewMemoryStore()
+	user, err := store.GetOrCreateUser("user_test", "test@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := store.CreateSession(&db.Session{
+		UserID:         user.ID,
+		Label:          "test-cat",
+		ConnectToken:   "connect-test",
+		Status:         "running",
+		ProxyTokenHash: db.HashToken(testProxyToken),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queue, err := NewUsageQueue(store, "", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(queue.Close)
+
+	keys := []KeyConfig{{Secret: "sk-ant-test", Weight: 1}}
+	p, err := NewProxy(store, queue, keys, nil, nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Read the request like a real API does first; until it is read, the
+	// server doesn't notice the proxy going away
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		upstream.ServeHTTP(w, r)
+	}))
+	t.Cleanup(upstreamServer.Close)
+	p.anthropic, err = p.newUpstream(db.ProviderAnthropic, upstreamServer.URL, keys,
+		func(h http.Header, secret string) { h.Set("x-api-key", secret) })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxyServer := httptest.NewServer(p)
+	t.Cleanup(proxyServer.Close)
+
+	return &testProxy{
+		Proxy:   p,
+		store:   store,
+		session: session,
+		url:     proxyServer.URL + "/s/" + session.Label,
+	}
+}
+
+// post sends a Messages API request through the proxy.
+func (tp *testProxy) post(t *testing.T, ctx context.Context, body string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequestWithContext(ctx, "POST", tp.url+"/v1/messages", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("x-api-key", testProxyToken)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// waitUsage waits for the session's usage to be stored.
+func (tp *testProxy) waitUsage(t *testing.T) *db.UsageSummary {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		summary, err := tp.store.GetSessionUsage(tp.session.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !summary.TokenUsage.IsZero() {
+			return summary
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("usage was not recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestRecordedUsage replays recorded Anthropic responses through the proxy
+// and checks the usage it records for them.
+func TestRecordedUsage(t *testing.T) {
+	tests := []struct {
+		fixture string
+		// truncated responses are cut off by the upstream going away
+		truncated bool
+		model     string
+		want      db.TokenUsage
+	}{
+		{
+			// message_delta only reports output; the rest comes from
+			// message_start
+			fixture: "stream_cache_write.sse",
+			model:   "claude-sonnet-4-5-20250929",
+			want:    db.TokenUsage{InputTokens: 12, OutputTokens: 187, CacheCreationInputTokens: 4096},
+		},
+		{
+			// message_delta repeats the input side with the final output
+			fixture: "stream_cache_read.sse",
+			model:   "claude-sonnet-4-5-20250929",
+			want:    db.TokenUsage{InputTokens: 8, OutputTokens: 342, CacheReadInputTokens: 4096},
+		},
+		{
+			// What message_start reported is counted even without a
+			// message_delta
+			fixture:   "stream_truncated.sse",
+			truncated: true,
+			model:     "claude-haiku-4-5-20251001",
+			want:      db.TokenUsage{InputTokens: 30, OutputTokens: 1, CacheReadInputTokens: 1000},
+		},
+		{
+			fixture: "message_cache_write.json",
+			model:   "claude-opus-4-5-20251101",
+			want:    db.TokenUsage{InputTokens: 5, OutputTokens: 64, CacheCreationInputTokens: 2048, CacheReadInputTokens: 512},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			recorded, err := os.ReadFile(filepath.Join("testdata", tt.fixture))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tp := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("request-id", "req_"+tt.fixture)
+				if strings.HasSuffix(tt.fixture, ".sse") {
+					w.Header().Set("Content-Type", "text/event-stream")
+				} else {
+					w.Header().Set("Content-Type", "application/json")
+				}
+				w.Write(recorded)
+				if tt.truncated {
+					w.(http.Flusher).Flush()
+					panic(http.ErrAbortHandler)
+				}
+			}))
+
+			resp := tp.post(t, context.Background(), `{"model":"`+tt.model+`","max_tokens":1024}`)
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if tt.truncated {
+				if err == nil {
+					t.Error("truncated response ended cleanly")
+				}
+			} else if err != nil || string(body) != string(recorded) {
+				t.Errorf("response was not passed through unchanged: %v", err)
+			}
+
+			usage := tp.waitUsage(t)
+			if usage.TokenUsage != tt.want {
+				t.Errorf("recorded %+v, want %+v", usage.TokenUsage, tt.want)
+			}
+			if len(usage.Models) != 1 || usage.Models[0].Model != tt.model {
+				t.Errorf("recorded models %+v, want only %s", usage.Models, tt.model)
+			}
+			if want := db.Prices.Lookup(tt.model).Cost(tt.want); usage.CostMicroUSD != want {
+				t.Errorf("recorded a cost of %d, want %d", usage.CostMicroUSD, want)
+			}
+		})
+	}
+}
+
+func TestOversizedRequestIsRefused(t *testing.T) {
+	tp := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("oversized request was forwarded")
+	}))
+
+	body := `{"model":"claude-sonnet-4-5","max_tokens":1024,"system":"` + strings.Repeat("x", maxRequestBody) + `"}`
+	resp := tp.post(t, context.Background(), body)
+	defer resp.Body.Close()
+
+	var apiErr struct {
+		Error struct {
+			Type string `json:"type"`
+		} `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&apiErr)
+	if resp.StatusCode != http.StatusRequestEntityTooLarge || apiErr.Error.Type != "request_too_large" {
+		t.Errorf("got %d %q, want 413 request_too_large", resp.StatusCode, apiErr.Error.Type)
+	}
+}
@@ -0,0 +1,354 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/izalutski/catty/internal/db"
+)
+
+const (
+	// usageBatchDelay is how long the queue waits after a record arrives
+	// for more to batch with it.
+	usageBatchDelay = 500 * time.Millisecond
+	// usageBatchSize is the most records stored in one database call.
+	usageBatchSize = 500
+
+	// minUsageRetry and maxUsageRetry bound the wait between attempts to
+	// store a batch while the database is failing. The wait doubles with
+	// each failure.
+	minUsageRetry = time.Second
+	maxUsageRetry = time.Minute
+)
+
+// UsageQueue stores usage records in the background, in batches, so a
+// response never waits on the database and a database outage doesn't lose
+// billing data. Records are appended to a write-ahead log before they are
+// queued and stay there until stored; records left in the log by a crash
+// are stored on the next start. Records are deduplicated by request ID,
+// so storing one twice is harmless. Records the database rejects for good
+// are moved to a dead-letter file instead of blocking the rest. It is safe
+// for concurrent use.
+type UsageQueue struct {
+	store  db.UsageStore
+	logger *slog.Logger
+
+	mu      sync.Mutex
+	path    string
+	wal     *os.File // nil without a log
+	pending []db.UsageRecord
+
+	wake    chan struct{}
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// NewUsageQueue creates a queue that stores records in store, replays any
+// records left in the log at walPath and starts storing them. With an
+// empty walPath, queued records are only kept in memory.
+func NewUsageQueue(store db.UsageStore, walPath string, logger *slog.Logger) (*UsageQueue, error) {
+	q := &UsageQueue{
+		store:   store,
+		logger:  logger,
+		path:    walPath,
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	if walPath != "" {
+		records, err := readUsageLog(walPath, logger)
+		if err != nil {
+			return nil, err
+		}
+		if len(records) > 0 {
+			logger.Info("replaying usage log", "path", walPath, "records", len(records))
+		}
+		q.pending = records
+
+		q.wal, err = os.OpenFile(walPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("open usage log: %w", err)
+		}
+		// Start from a clean log, so a torn last line can't swallow the
+		// next record appended to it
+		if err := q.rewriteLog(); err != nil {
+			q.wal.Close()
+			return nil, fmt.Errorf("rewrite usage log: %w", err)
+		}
+	}
+
+	go q.run()
+	if len(q.pending) > 0 {
+		q.signal()
+	}
+	return q, nil
+}
+
+// readUsageLog reads the records in a usage log, if it exists. A line that
+// doesn't parse, such as one torn by a crash mid-write, is skipped.
+func readUsageLog(path string, logger *slog.Logger) ([]db.UsageRecord, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open usage log: %w", err)
+	}
+	defer f.Close()
+
+	var records []db.UsageRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var r db.UsageRecord
+		if err := json.Unmarshal(line, &r); err != nil {
+			logger.Warn("skipping unreadable usage log entry", "path", path, "error", err)
+			continue
+		}
+		records = append(records, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read usage log: %w", err)
+	}
+	return records, nil
+}
+
+// Enqueue queues a record to be stored. With a log, the record is on disk
+// when Enqueue returns; if the log can't be written the record is still
+// queued in memory.
+func (q *UsageQueue) Enqueue(r db.UsageRecord) {
+	q.mu.Lock()
+	if q.wal != nil {
+		if err := appendUsageLog(q.wal, r); err != nil {
+			q.logger.Error("failed to write usage log", "error", err, "request_id", r.RequestID)
+		}
+	}
+	q.pending = append(q.pending, r)
+	q.mu.Unlock()
+
+	q.signal()
+}
+
+// appendUsageLog writes a record to the log and syncs it to disk.
+func appendUsageLog(f *os.File, r db.UsageRecord) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// Len returns the number of records waiting to be stored.
+func (q *UsageQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+func (q *UsageQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run stores queued records until the queue is closed.
+func (q *UsageQueue) run() {
+	defer close(q.stopped)
+
+	retry := minUsageRetry
+	for {
+		select {
+		case <-q.wake:
+		case <-q.stop:
+			q.drain()
+			return
+		}
+
+		// Give records arriving together a chance to share a batch
+		select {
+		case <-time.After(usageBatchDelay):
+		case <-q.stop:
+			q.drain()
+			return
+		}
+
+		for q.Len() > 0 {
+			if err := q.flush(); err != nil {
+				q.logger.Error("failed to store usage, will retry",
+					"error", err, "pending", q.Len(), "retry_in", retry)
+				select {
+				case <-time.After(retry):
+				case <-q.stop:
+					return
+				}
+				retry = min(retry*2, maxUsageRetry)
+				continue
+			}
+			retry = minUsageRetry
+		}
+	}
+}
+
+// drain stores queued records until the queue is empty or storing fails.
+func (q *UsageQueue) drain() {
+	for q.Len() > 0 {
+		if err := q.flush(); err != nil {
+			q.logger.Error("failed to store usage", "error", err)
+			return
+		}
+	}
+}
+
+// flush stores one batch of queued records and drops them from the queue
+// and the log.
+func (q *UsageQueue) flush() error {
+	q.mu.Lock()
+	batch := q.pending[:min(len(q.pending), usageBatchSize)]
+	q.mu.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+
+	done := 0
+	err := q.store.RecordUsageBatch(batch)
+	switch {
+	case err == nil:
+		done = len(batch)
+	case errors.Is(err, db.ErrUsageRejected):
+		// Store the records one by one, so the one the database refuses
+		// doesn't hold up the rest
+		done, err = q.storeEach(batch)
+	}
+	if done == 0 {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pending = q.pending[done:]
+	if err := q.rewriteLog(); err != nil {
+		// The stored records stay in the log and are skipped as duplicates
+		// when it is replayed
+		q.logger.Error("failed to compact usage log", "error", err)
+	}
+	return err
+}
+
+// storeEach stores records one at a time, setting aside the ones the
+// database rejects. It returns how many records it dealt with before
+// storing failed.
+func (q *UsageQueue) storeEach(records []db.UsageRecord) (int, error) {
+	for i, r := range records {
+		err := q.store.RecordUsageBatch([]db.UsageRecord{r})
+		if errors.Is(err, db.ErrUsageRejected) {
+			q.reject(r, err)
+		} else if err != nil {
+			return i, err
+		}
+	}
+	return len(records), nil
+}
+
+// reject sets aside a record the database won't store, in a dead-letter
+// file next to the log, to be looked into by hand.
+func (q *UsageQueue) reject(r db.UsageRecord, reason error) {
+	q.logger.Error("usage record rejected", "error", reason, "request_id", r.RequestID,
+		"user_id", r.UserID, "session_id", r.SessionID, "dead_letter", q.deadLetterPath())
+	if q.path == "" {
+		return
+	}
+	f, err := os.OpenFile(q.deadLetterPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err == nil {
+		err = appendUsageLog(f, r)
+		f.Close()
+	}
+	if err != nil {
+		q.logger.Error("failed to write rejected usage record", "error", err, "request_id", r.RequestID)
+	}
+}
+
+// deadLetterPath returns the file rejected records are kept in, or "" for
+// a queue without a log.
+func (q *UsageQueue) deadLetterPath() string {
+	if q.path == "" {
+		return ""
+	}
+	return q.path + ".rejected"
+}
+
+// rewriteLog replaces the log with the records still pending. The caller
+// must hold q.mu.
+func (q *UsageQueue) rewriteLog() error {
+	if q.wal == nil {
+		return nil
+	}
+	if len(q.pending) == 0 {
+		return q.wal.Truncate(0)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(q.path), filepath.Base(q.path)+".*")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, r := range q.pending {
+		if err = enc.Encode(r); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmp.Name(), q.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	wal, err := os.OpenFile(q.path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	q.wal.Close()
+	q.wal = wal
+	return nil
+}
+
+// Close makes a last attempt to store queued records and closes the log.
+// Records that couldn't be stored stay in the log for the next start.
+func (q *UsageQueue) Close() {
+	close(q.stop)
+	<-q.stopped
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.pending) > 0 {
+		q.logger.Warn("usage records left unstored", "records", len(q.pending), "path", q.path)
+	}
+	if q.wal != nil {
+		q.wal.Close()
+	}
+}
@@ -0,0 +1,254 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/izalutski/catty/internal/db"
+)
+
+// queueStore is a memory store whose usage writes can be made to fail.
+type queueStore struct {
+	*db.MemoryStore
+
+	mu sync.Mutex
+	// down fails every write, like a database outage
+	down bool
+	// reject is the request ID of a record the store refuses for good
+	reject string
+	// writes counts calls to RecordUsageBatch
+	writes int
+}
+
+func (s *queueStore) RecordUsageBatch(records []db.UsageRecord) error {
+	s.mu.Lock()
+	s.writes++
+	down, reject := s.down, s.reject
+	s.mu.Unlock()
+
+	if down {
+		return errors.New("connection refused")
+	}
+	for _, r := range records {
+		if r.RequestID != "" && r.RequestID == reject {
+			return fmt.Errorf("failed to record usage: %w", db.ErrUsageRejected)
+		}
+	}
+	return s.MemoryStore.RecordUsageBatch(records)
+}
+
+func (s *queueStore) setDown(down bool) {
+	s.mu.Lock()
+	s.down = down
+	s.mu.Unlock()
+}
+
+func (s *queueStore) writeCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writes
+}
+
+// newQueueTest returns a store with one session, and a path for a usage
+// log in a temporary directory.
+func newQueueTest(t *testing.T) (*queueStore, *db.Session, string) {
+	t.Helper()
+	store := &queueStore{MemoryStore: db.NewMemoryStore()}
+	user, err := store.GetOrCreateUser("user_test", "test@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := store.CreateSession(&db.Session{UserID: user.ID, Label: "test-cat", Status: "running"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, session, filepath.Join(t.TempDir(), "usage.wal")
+}
+
+func newTestQueue(t *testing.T, store db.UsageStore, walPath string) *UsageQueue {
+	t.Helper()
+	q, err := NewUsageQueue(store, walPath, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+// usageRecord is a record of 10 input and 10 output tokens.
+func usageRecord(session *db.Session, requestID string) db.UsageRecord {
+	return db.UsageRecord{
+		RequestID:  requestID,
+		UserID:     session.UserID,
+		SessionID:  session.ID,
+		Provider:   db.ProviderAnthropic,
+		Model:      "claude-sonnet-4-5",
+		TokenUsage: db.TokenUsage{InputTokens: 10, OutputTokens: 10},
+		CreatedAt:  time.Now(),
+	}
+}
+
+// waitFor polls cond until it holds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// checkStored checks the session's usage is that of n records.
+func checkStored(t *testing.T, store db.UsageStore, session *db.Session, n int64) {
+	t.Helper()
+	summary, err := store.GetSessionUsage(session.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (db.TokenUsage{InputTokens: 10 * n, OutputTokens: 10 * n}); summary.TokenUsage != want {
+		t.Errorf("stored usage %+v, want %+v from %d records", summary.TokenUsage, want, n)
+	}
+}
+
+// logLines returns the non-empty lines of a file, or none if it doesn't
+// exist.
+func logLines(t *testing.T, path string) []string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for line := range strings.Lines(string(b)) {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func TestUsageQueueReplaysLog(t *testing.T) {
+	store, session, wal := newQueueTest(t)
+
+	// Records queued while the database is down are left in the log
+	store.setDown(true)
+	q := newTestQueue(t, store, wal)
+	q.Enqueue(usageRecord(session, "req_1"))
+	q.Enqueue(usageRecord(session, "req_2"))
+	q.Close()
+	if n := len(logLines(t, wal)); n != 2 {
+		t.Fatalf("log has %d records after shutdown, want 2", n)
+	}
+
+	// A crash mid-write leaves a torn line at the end
+	f, err := os.OpenFile(wal, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"request_id":"req_3","user_`)
+	f.Close()
+
+	store.setDown(false)
+	q = newTestQueue(t, store, wal)
+	defer q.Close()
+	waitFor(t, "the log to be replayed", func() bool { return q.Len() == 0 })
+
+	checkStored(t, store, session, 2)
+	if lines := logLines(t, wal); len(lines) != 0 {
+		t.Errorf("log still has %d records after replay", len(lines))
+	}
+
+	// The log keeps working after the torn line was dropped
+	q.Enqueue(usageRecord(session, "req_4"))
+	waitFor(t, "a new record to be stored", func() bool { return q.Len() == 0 })
+	checkStored(t, store, session, 3)
+}
+
+func TestUsageQueueSkipsStoredRecordsOnReplay(t *testing.T) {
+	store, session, wal := newQueueTest(t)
+
+	// A log that couldn't be compacted still has records already stored
+	stored := usageRecord(session, "req_stored")
+	if err := store.RecordUsageBatch([]db.UsageRecord{stored}); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(wal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []db.UsageRecord{stored, usageRecord(session, "req_new"), stored} {
+		if err := appendUsageLog(f, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+
+	q := newTestQueue(t, store, wal)
+	waitFor(t, "the log to be replayed", func() bool { return q.Len() == 0 })
+	q.Close()
+
+	checkStored(t, store, session, 2)
+}
+
+func TestUsageQueueHoldsRecordsDuringOutage(t *testing.T) {
+	store, session, wal := newQueueTest(t)
+	store.setDown(true)
+
+	q := newTestQueue(t, store, wal)
+	defer q.Close()
+	q.Enqueue(usageRecord(session, "req_1"))
+	q.Enqueue(usageRecord(session, "req_2"))
+
+	waitFor(t, "a failed write", func() bool { return store.writeCount() > 0 })
+	if q.Len() != 2 {
+		t.Errorf("queue has %d records during the outage, want 2", q.Len())
+	}
+	if n := len(logLines(t, wal)); n != 2 {
+		t.Errorf("log has %d records during the outage, want 2", n)
+	}
+	checkStored(t, store, session, 0)
+
+	store.setDown(false)
+	waitFor(t, "the queue to drain", func() bool { return q.Len() == 0 })
+	checkStored(t, store, session, 2)
+	if n := len(logLines(t, wal)); n != 0 {
+		t.Errorf("log has %d records after draining, want none", n)
+	}
+}
+
+func TestUsageQueueSetsAsideRejectedRecords(t *testing.T) {
+	store, session, wal := newQueueTest(t)
+	store.reject = "req_bad"
+
+	q := newTestQueue(t, store, wal)
+	q.Enqueue(usageRecord(session, "req_1"))
+	q.Enqueue(usageRecord(session, "req_bad"))
+	q.Enqueue(usageRecord(session, "req_2"))
+	waitFor(t, "the queue to drain", func() bool { return q.Len() == 0 })
+
+	// Records after it keep being stored
+	q.Enqueue(usageRecord(session, "req_3"))
+	waitFor(t, "the queue to drain", func() bool { return q.Len() == 0 })
+	q.Close()
+
+	checkStored(t, store, session, 3)
+	if n := len(logLines(t, wal)); n != 0 {
+		t.Errorf("log has %d records, want none", n)
+	}
+	rejected := logLines(t, q.deadLetterPath())
+	if len(rejected) != 1 || !strings.Contains(rejected[0], `"req_bad"`) {
+		t.Errorf("dead-letter file has %q, want only req_bad", rejected)
+	}
+}
@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/izalutski/catty/internal/db"
+)
+
+// reservationTTL is how long a request's reserved usage is held. Streams
+// settle when they finish; a reservation left by a proxy that crashed
+// mid-stream is reclaimed after this long.
+const reservationTTL = 15 * time.Minute
+
+// bytesPerToken is a deliberately low estimate of request bytes per input
+// token, so reservations err on the side of holding too much.
+const bytesPerToken = 4
+
+// defaultOutputEstimate is the output reserved for requests that don't
+// cap it, which OpenAI allows.
+const defaultOutputEstimate = 4096
+
+// estimateUsage estimates the most a request can use: its body as input
+// tokens plus its output cap as output tokens, priced for its model.
+func estimateUsage(body []byte) (tokens, costMicroUSD int64) {
+	var req struct {
+		Model string `json:"model"`
+		// Anthropic and OpenAI chat completions; OpenAI chat completions
+		// for reasoning models; OpenAI responses
+		MaxTokens           int64 `json:"max_tokens"`
+		MaxCompletionTokens int64 `json:"max_completion_tokens"`
+		MaxOutputTokens     int64 `json:"max_output_tokens"`
+	}
+	// Requests that aren't JSON still reserve their size
+	json.Unmarshal(body, &req)
+
+	output := max(req.MaxTokens, req.MaxCompletionTokens, req.MaxOutputTokens)
+	if output <= 0 {
+		output = defaultOutputEstimate
+	}
+	usage := db.TokenUsage{
+		InputTokens:  int64(len(body)) / bytesPerToken,
+		OutputTokens: output,
+	}
+	return usage.QuotaTokens(), db.Prices.Lookup(req.Model).Cost(usage)
+}
+
+// usageTracker turns one request's reservation into recorded usage. Settle
+// and release may race between the response body and the handler; only
+// the first takes effect.
+type usageTracker struct {
+	proxy       *Proxy
+	provider    string
+	session     *db.Session
+	reservation *db.Reservation
+	// requestID is the provider's ID for the request, from the response
+	requestID string
+
+	mu   sync.Mutex
+	done bool
+}
+
+// finish marks the reservation as handled, reporting whether it already was.
+func (t *usageTracker) finish() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	done := t.done
+	t.done = true
+	return done
+}
+
+// settle queues the request's actual usage to be recorded; the record
+// releases the reservation once stored.
+func (t *usageTracker) settle(model string, usage db.TokenUsage) {
+	if t.finish() {
+		return
+	}
+
+	// Responses without a request ID still need a stable key, so replays
+	// of the record don't count it twice
+	requestID := t.requestID
+	if requestID == "" {
+		requestID = "reservation-" + t.reservation.ID
+	}
+	t.proxy.usage.Enqueue(db.UsageRecord{
+		RequestID:     requestID,
+		UserID:        t.session.UserID,
+		SessionID:     t.session.ID,
+		ReservationID: t.reservation.ID,
+		Provider:      t.provider,
+		Model:         model,
+		TokenUsage:    usage,
+		CreatedAt:     time.Now(),
+	})
+	t.proxy.logger.Info("queued usage",
+		"session_id", t.session.ID,
+		"request_id", requestID,
+		"provider", t.provider,
+		"model", model,
+		"input_tokens", usage.InputTokens,
+		"output_tokens", usage.OutputTokens,
+		"cache_creation_input_tokens", usage.CacheCreationInputTokens,
+		"cache_read_input_tokens", usage.CacheReadInputTokens)
+}
+
+// release drops the reservation of a request that reported no usage,
+// such as one that failed upstream.
+func (t *usageTracker) release() {
+	if t.finish() {
+		return
+	}
+	if err := t.proxy.db.ReleaseReservation(t.reservation.ID); err != nil {
+		t.proxy.logger.Error("failed to release usage reservation", "error", err, "session_id", t.session.ID)
+	}
+}
+
+const trackerContextKey contextKey = "usage_tracker"
+
+// contextWithTracker adds a request's usage tracker to the context.
+func contextWithTracker(ctx context.Context, t *usageTracker) context.Context {
+	return context.WithValue(ctx, trackerContextKey, t)
+}
+
+// trackerFromContext retrieves a request's usage tracker from the context.
+func trackerFromContext(ctx context.Context) *usageTracker {
+	t, _ := ctx.Value(trackerContextKey).(*usageTracker)
+	return t
+}
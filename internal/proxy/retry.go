@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// maxUpstreamRetries is how many times a request that failed on every
+	// key is sent again after waiting.
+	maxUpstreamRetries = 3
+
+	// retryBaseDelay and retryMaxDelay bound the wait before a retry. The
+	// wait doubles with each retry and is jittered so that requests that
+	// failed together don't retry together.
+	retryBaseDelay = 500 * time.Millisecond
+	retryMaxDelay  = 8 * time.Second
+
+	// retryBudget bounds the total time a request spends waiting to be
+	// retried. The client sees nothing until the proxy gives up, so the
+	// budget is kept well below how long agents wait for a response.
+	retryBudget = 20 * time.Second
+)
+
+// retryable reports whether an upstream status is worth sending the same
+// request again for: Anthropic overloaded (529) or a transient server
+// error.
+func retryable(status int) bool {
+	switch status {
+	case 529, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryDelay returns how long to wait before retry number attempt, counted
+// from zero. A retry-after from the upstream is honored; if it asks for
+// longer than the maximum delay, ok is false and the request should not be
+// retried.
+func (t *keyTransport) retryDelay(attempt int, h http.Header) (delay time.Duration, ok bool) {
+	backoff := min(t.baseDelay<<attempt, t.maxDelay)
+	delay = backoff/2 + rand.N(backoff/2+1)
+
+	if after, found := retryAfter(h); found {
+		if after > t.maxDelay {
+			return 0, false
+		}
+		delay = max(delay, after)
+	}
+	return delay, true
+}
+
+// retryAfter reads how long the upstream asked to be left alone, from
+// OpenAI's retry-after-ms or the standard retry-after in seconds.
+func retryAfter(h http.Header) (time.Duration, bool) {
+	if ms, err := strconv.ParseFloat(h.Get("retry-after-ms"), 64); err == nil && ms > 0 {
+		return time.Duration(ms * float64(time.Millisecond)), true
+	}
+	if s, err := strconv.Atoi(h.Get("retry-after")); err == nil && s > 0 {
+		return time.Duration(s) * time.Second, true
+	}
+	return 0, false
+}
@@ -0,0 +1,274 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// upstreamHits records the keys requests reached a fake upstream with.
+type upstreamHits struct {
+	mu   sync.Mutex
+	keys []string
+}
+
+func (h *upstreamHits) add(key string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.keys = append(h.keys, key)
+	return len(h.keys)
+}
+
+func (h *upstreamHits) list() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string(nil), h.keys...)
+}
+
+// newTestTransport returns a transport with the given keys in front of a
+// fake upstream. handler is called with the key of each request and how
+// many requests the upstream has had, counting this one. Retries wait
+// about a millisecond.
+func newTestTransport(t *testing.T, keys []KeyConfig, handler func(w http.ResponseWriter, key string, n int)) (*keyTransport, string, *upstreamHits) {
+	t.Helper()
+	hits := &upstreamHits{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		key := r.Header.Get("x-api-key")
+		handler(w, key, hits.add(key))
+	}))
+	t.Cleanup(upstream.Close)
+
+	pool, err := NewKeyPool(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := &keyTransport{
+		keys:      pool,
+		base:      http.DefaultTransport,
+		authorize: func(h http.Header, secret string) { h.Set("x-api-key", secret) },
+		logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		baseDelay: time.Millisecond,
+		maxDelay:  time.Second,
+		budget:    10 * time.Second,
+	}
+	return transport, upstream.URL, hits
+}
+
+// roundTrip sends a Messages API request through a transport.
+func roundTrip(t *testing.T, transport http.RoundTripper, url string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest("POST", url+"/v1/messages", strings.NewReader(`{"model":"claude-sonnet-4-5"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp
+}
+
+var oneKey = []KeyConfig{{Secret: "sk-ant-only", Weight: 1}}
+
+func TestTransientErrorsAreRetried(t *testing.T) {
+	for _, status := range []int{529, 500, 502, 503, 504} {
+		t.Run(strconv.Itoa(status), func(t *testing.T) {
+			transport, url, hits := newTestTransport(t, oneKey, func(w http.ResponseWriter, key string, n int) {
+				if n <= 2 {
+					w.WriteHeader(status)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+			})
+
+			resp := roundTrip(t, transport, url)
+			if resp.StatusCode != http.StatusOK || len(hits.list()) != 3 {
+				t.Errorf("got %d after %d requests, want 200 after 3", resp.StatusCode, len(hits.list()))
+			}
+			if n := transport.retries.Load(); n != 2 {
+				t.Errorf("counted %d retries, want 2", n)
+			}
+		})
+	}
+}
+
+func TestOtherErrorsAreNotRetried(t *testing.T) {
+	// 429 swaps keys, but with only one key there is nothing to swap to
+	for _, status := range []int{400, 401, 404, 413, 429} {
+		t.Run(strconv.Itoa(status), func(t *testing.T) {
+			transport, url, hits := newTestTransport(t, oneKey, func(w http.ResponseWriter, key string, n int) {
+				w.WriteHeader(status)
+			})
+
+			resp := roundTrip(t, transport, url)
+			if resp.StatusCode != status || len(hits.list()) != 1 {
+				t.Errorf("got %d after %d requests, want %d after 1", resp.StatusCode, len(hits.list()), status)
+			}
+		})
+	}
+}
+
+func TestRetriesStopAfterMaxRetries(t *testing.T) {
+	transport, url, hits := newTestTransport(t, oneKey, func(w http.ResponseWriter, key string, n int) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	resp := roundTrip(t, transport, url)
+	if resp.StatusCode != http.StatusServiceUnavailable || len(hits.list()) != maxUpstreamRetries+1 {
+		t.Errorf("got %d after %d requests, want 503 after %d", resp.StatusCode, len(hits.list()), maxUpstreamRetries+1)
+	}
+	if n := transport.exhausted.Load(); n != 1 {
+		t.Errorf("counted %d exhausted requests, want 1", n)
+	}
+}
+
+func TestRetryAfterIsHonored(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		wait   time.Duration
+	}{
+		{"milliseconds", "retry-after-ms", "200", 200 * time.Millisecond},
+		{"seconds", "retry-after", "1", time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				mu    sync.Mutex
+				first time.Time
+				gap   time.Duration
+			)
+			transport, url, _ := newTestTransport(t, oneKey, func(w http.ResponseWriter, key string, n int) {
+				mu.Lock()
+				defer mu.Unlock()
+				if n == 1 {
+					first = time.Now()
+					w.Header().Set(tt.header, tt.value)
+					w.WriteHeader(529)
+					return
+				}
+				gap = time.Since(first)
+				w.WriteHeader(http.StatusOK)
+			})
+			transport.maxDelay = 2 * time.Second
+
+			resp := roundTrip(t, transport, url)
+			mu.Lock()
+			defer mu.Unlock()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("got %d, want 200", resp.StatusCode)
+			}
+			if gap < tt.wait {
+				t.Errorf("retried after %v, want at least %v", gap, tt.wait)
+			}
+		})
+	}
+}
+
+func TestLongRetryAfterIsNotWaitedFor(t *testing.T) {
+	transport, url, hits := newTestTransport(t, oneKey, func(w http.ResponseWriter, key string, n int) {
+		w.Header().Set("retry-after", "30")
+		w.WriteHeader(529)
+	})
+
+	start := time.Now()
+	resp := roundTrip(t, transport, url)
+	if resp.StatusCode != 529 || len(hits.list()) != 1 {
+		t.Errorf("got %d after %d requests, want 529 after 1", resp.StatusCode, len(hits.list()))
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("gave up after %v, want at once", elapsed)
+	}
+}
+
+func TestRetriesStopWhenBudgetRunsOut(t *testing.T) {
+	// Every retry waits 30ms; a third would take the wait to 90ms
+	transport, url, hits := newTestTransport(t, oneKey, func(w http.ResponseWriter, key string, n int) {
+		w.Header().Set("retry-after-ms", "30")
+		w.WriteHeader(529)
+	})
+	transport.budget = 70 * time.Millisecond
+
+	start := time.Now()
+	resp := roundTrip(t, transport, url)
+	if resp.StatusCode != 529 || len(hits.list()) != 3 {
+		t.Errorf("got %d after %d requests, want 529 after 3", resp.StatusCode, len(hits.list()))
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("gave up after %v, want about 60ms", elapsed)
+	}
+	if n := transport.exhausted.Load(); n != 1 {
+		t.Errorf("counted %d exhausted requests, want 1", n)
+	}
+}
+
+func TestRetryWaitEndsWithRequest(t *testing.T) {
+	transport, url, hits := newTestTransport(t, oneKey, func(w http.ResponseWriter, key string, n int) {
+		w.Header().Set("retry-after-ms", "5000")
+		w.WriteHeader(529)
+	})
+	transport.maxDelay = 10 * time.Second
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", url+"/v1/messages", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := transport.RoundTrip(req); err == nil {
+		t.Error("request ended while waiting to retry, but got a response")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second || len(hits.list()) != 1 {
+		t.Errorf("stopped after %v and %d requests, want at the deadline after 1", elapsed, len(hits.list()))
+	}
+}
+
+func TestRetryDelayBackoff(t *testing.T) {
+	transport := &keyTransport{baseDelay: 100 * time.Millisecond, maxDelay: 300 * time.Millisecond}
+	for attempt, backoff := range []time.Duration{100, 200, 300, 300} {
+		backoff *= time.Millisecond
+		for range 100 {
+			delay, ok := transport.retryDelay(attempt, http.Header{})
+			if !ok || delay < backoff/2 || delay > backoff {
+				t.Fatalf("retry %d waits %v, want between %v and %v", attempt, delay, backoff/2, backoff)
+			}
+		}
+	}
+}
+
+// TestStartedResponsesAreNotRetried checks a response that fails after
+// its headers were passed on is not sent again: the client has already
+// seen part of it.
+func TestStartedResponsesAreNotRetried(t *testing.T) {
+	var hits upstreamHits
+	tp := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.add(r.Header.Get("x-api-key"))
+		startSSE(w)
+		io.WriteString(w, contentDeltaEvent)
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+	tp.anthropic.transport.baseDelay = time.Millisecond
+
+	resp := tp.post(t, context.Background(), `{"model":"claude-sonnet-4-5","max_tokens":1024,"stream":true}`)
+	_, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || err == nil {
+		t.Errorf("got %d, %v; want a 200 stream that is cut off", resp.StatusCode, err)
+	}
+	if n := len(hits.list()); n != 1 {
+		t.Errorf("upstream got %d requests, want 1", n)
+	}
+}
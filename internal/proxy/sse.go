@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"bytes"
+)
+
+// maxSSELine bounds a line, and the data of an event. Usage events are
+// small; events with longer lines or data are dropped.
+const maxSSELine = 1 << 20
+
+// sseParser splits a server-sent event stream into events as it is read,
+// following the event stream format: lines end with CRLF, LF or CR, fields
+// are "name: value", data fields of one event are joined with newlines,
+// and a blank line dispatches the event.
+//
+// Only the lines of events the caller wants are kept. Lines that end
+// within a chunk are parsed in place; only a line split across reads is
+// copied, into a buffer that is reused, as is the buffer events are
+// assembled in.
+type sseParser struct {
+	// want reports whether the event with the given name is needed; the
+	// name is empty for events without an event field. handle is called
+	// with each wanted event that carries data. Neither may keep the
+	// slices they are passed.
+	want   func(event []byte) bool
+	handle func(event, data []byte)
+
+	line     []byte // start of a line split across reads
+	overflow bool   // the current line outgrew maxSSELine
+	skipLF   bool   // the last read ended with CR, which may precede LF
+
+	event   []byte
+	data    []byte
+	hasData bool
+	skip    bool // the current event isn't wanted
+}
+
+// feed parses the next chunk of the stream.
+func (p *sseParser) feed(b []byte) {
+	for len(b) > 0 {
+		if p.skipLF {
+			p.skipLF = false
+			if b[0] == '\n' {
+				b = b[1:]
+				continue
+			}
+		}
+
+		i := bytes.IndexAny(b, "\r\n")
+		if i < 0 {
+			p.carry(b)
+			return
+		}
+
+		line := b[:i]
+		if len(p.line) > 0 || p.overflow {
+			p.carry(line)
+			line = p.line
+		} else if len(line) > maxSSELine {
+			p.overflow = true
+		}
+		if b[i] == '\r' {
+			if i+1 < len(b) {
+				if b[i+1] == '\n' {
+					i++
+				}
+			} else {
+				p.skipLF = true
+			}
+		}
+		b = b[i+1:]
+
+		if p.overflow {
+			p.skip = true
+		} else {
+			p.parseLine(line)
+		}
+		p.line = p.line[:0]
+		p.overflow = false
+	}
+}
+
+// carry keeps the start of a line until the rest of it is read.
+func (p *sseParser) carry(b []byte) {
+	if p.overflow {
+		return
+	}
+	if len(p.line)+len(b) > maxSSELine {
+		p.overflow = true
+		p.line = p.line[:0]
+		return
+	}
+	p.line = append(p.line, b...)
+}
+
+// parseLine handles a complete line of the stream.
+func (p *sseParser) parseLine(line []byte) {
+	if len(line) == 0 {
+		p.dispatch()
+		return
+	}
+
+	// Comments, such as keep-alives, start with a colon
+	if line[0] == ':' {
+		return
+	}
+
+	field, value := line, []byte(nil)
+	if i := bytes.IndexByte(line, ':'); i >= 0 {
+		field, value = line[:i], line[i+1:]
+		if len(value) > 0 && value[0] == ' ' {
+			value = value[1:]
+		}
+	}
+
+	switch string(field) {
+	case "event":
+		p.event = append(p.event[:0], value...)
+		p.skip = !p.want(p.event)
+	case "data":
+		if p.skip {
+			return
+		}
+		if len(p.data)+len(value) >= maxSSELine {
+			p.skip = true
+			return
+		}
+		if p.hasData {
+			p.data = append(p.data, '\n')
+		}
+		p.data = append(p.data, value...)
+		p.hasData = true
+	}
+}
+
+// dispatch passes on the current event and starts the next one.
+func (p *sseParser) dispatch() {
+	if p.hasData && !p.skip && p.want(p.event) {
+		p.handle(p.event, p.data)
+	}
+	p.event = p.event[:0]
+	p.data = p.data[:0]
+	p.hasData = false
+	p.skip = false
+}
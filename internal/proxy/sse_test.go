@@ -0,0 +1,276 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/izalutski/catty/internal/db"
+)
+
+type sseEvent struct {
+	name, data string
+}
+
+// parseSSE feeds a stream to a parser that wants every event except
+// "skipped", in chunks of the given size, and returns the events.
+func parseSSE(stream string, chunk int) []sseEvent {
+	var events []sseEvent
+	p := sseParser{
+		want: func(event []byte) bool { return string(event) != "skipped" },
+		handle: func(event, data []byte) {
+			events = append(events, sseEvent{string(event), string(data)})
+		},
+	}
+	for len(stream) > 0 {
+		n := min(chunk, len(stream))
+		p.feed([]byte(stream[:n]))
+		stream = stream[n:]
+	}
+	return events
+}
+
+func TestSSEParser(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream string
+		want   []sseEvent
+	}{
+		{
+			name:   "LF",
+			stream: "event: a\ndata: 1\n\ndata: 2\n\n",
+			want:   []sseEvent{{"a", "1"}, {"", "2"}},
+		},
+		{
+			name:   "CRLF",
+			stream: "event: a\r\ndata: 1\r\n\r\ndata: 2\r\n\r\n",
+			want:   []sseEvent{{"a", "1"}, {"", "2"}},
+		},
+		{
+			name:   "CR",
+			stream: "event: a\rdata: 1\r\rdata: 2\r\r",
+			want:   []sseEvent{{"a", "1"}, {"", "2"}},
+		},
+		{
+			name:   "mixed line endings",
+			stream: "event: a\r\ndata: 1\r\n\ndata: 2\r\r\n\n",
+			want:   []sseEvent{{"a", "1"}, {"", "2"}},
+		},
+		{
+			name:   "multi-line data",
+			stream: "data: {\"a\":\ndata: 1}\n\n",
+			want:   []sseEvent{{"", "{\"a\":\n1}"}},
+		},
+		{
+			name:   "field values lose one leading space",
+			stream: "data:1\n\ndata:  2\n\n",
+			want:   []sseEvent{{"", "1"}, {"", " 2"}},
+		},
+		{
+			name:   "empty data line",
+			stream: "data\ndata: x\n\n",
+			want:   []sseEvent{{"", "\nx"}},
+		},
+		{
+			name:   "comments and unknown fields are ignored",
+			stream: ": ping\nid: 7\nretry: 100\ndata: 1\n\n",
+			want:   []sseEvent{{"", "1"}},
+		},
+		{
+			name:   "events without data are not dispatched",
+			stream: "event: a\n\n: ping\n\ndata: 1\n\n",
+			want:   []sseEvent{{"", "1"}},
+		},
+		{
+			name:   "unwanted events are skipped",
+			stream: "event: skipped\ndata: 1\n\nevent: a\ndata: 2\n\n",
+			want:   []sseEvent{{"a", "2"}},
+		},
+		{
+			name:   "unwanted event named after its data",
+			stream: "data: 1\nevent: skipped\n\ndata: 2\n\n",
+			want:   []sseEvent{{"", "2"}},
+		},
+		{
+			name:   "unfinished event at the end is dropped",
+			stream: "data: 1\n\ndata: 2\n",
+			want:   []sseEvent{{"", "1"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Every split of the stream across reads parses the same
+			for chunk := 1; chunk <= len(tt.stream); chunk++ {
+				got := parseSSE(tt.stream, chunk)
+				if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+					t.Fatalf("in chunks of %d: got %q, want %q", chunk, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSSEParserDropsOverlongLines(t *testing.T) {
+	long := strings.Repeat("x", maxSSELine+1)
+	stream := "event: a\ndata: " + long + "\n\nevent: b\ndata: 2\n\n"
+	want := []sseEvent{{"b", "2"}}
+
+	for _, chunk := range []int{1 << 10, 64 << 10, len(stream)} {
+		got := parseSSE(stream, chunk)
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("in chunks of %d: got %d events, want only b", chunk, len(got))
+		}
+	}
+
+	// A line that fits is kept whole
+	fits := strings.Repeat("x", maxSSELine-len("data: "))
+	got := parseSSE("data: "+fits+"\n\n", 64<<10)
+	if len(got) != 1 || got[0].data != fits {
+		t.Errorf("line of maxSSELine bytes was not kept")
+	}
+}
+
+func TestSSEUsageReaderReadsUsage(t *testing.T) {
+	stream := benchmarkStream(10)
+	for _, chunk := range []int{1, 7, 4096, len(stream)} {
+		r := newSSEUsageReader(nil, &usageTracker{provider: db.ProviderAnthropic})
+		for b := stream; len(b) > 0; {
+			n := min(chunk, len(b))
+			r.parser.feed(b[:n])
+			b = b[n:]
+		}
+		want := db.TokenUsage{InputTokens: 25, OutputTokens: 10, CacheReadInputTokens: 100}
+		if r.model != "claude-sonnet-4-5" || r.usage != want {
+			t.Errorf("in chunks of %d: got %s %+v, want %+v", chunk, r.model, r.usage, want)
+		}
+	}
+}
+
+// benchmarkStream is an Anthropic stream with the given number of text
+// deltas.
+func benchmarkStream(deltas int) []byte {
+	var b bytes.Buffer
+	b.WriteString("event: message_start\n" +
+		`data: {"type":"message_start","message":{"id":"msg_1","type":"message","role":"assistant","model":"claude-sonnet-4-5","content":[],"usage":{"input_tokens":25,"cache_read_input_tokens":100,"output_tokens":1}}}` + "\n\n")
+	b.WriteString("event: content_block_start\n" +
+		`data: {"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}` + "\n\n")
+	for i := range deltas {
+		if i%100 == 0 {
+			b.WriteString("event: ping\ndata: {\"type\": \"ping\"}\n\n")
+		}
+		b.WriteString("event: content_block_delta\n" +
+			`data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"some streamed text, "}}` + "\n\n")
+	}
+	b.WriteString("event: content_block_stop\n" + `data: {"type":"content_block_stop","index":0}` + "\n\n")
+	fmt.Fprintf(&b, "event: message_delta\n"+
+		`data: {"type":"message_delta","delta":{"stop_reason":"end_turn","stop_sequence":null},"usage":{"output_tokens":%d}}`+"\n\n", deltas)
+	b.WriteString("event: message_stop\n" + `data: {"type":"message_stop"}` + "\n\n")
+	return b.Bytes()
+}
+
+// bufferedUsageParser is the parser sseUsageReader used before sseParser,
+// kept to benchmark against: it buffers the stream, searches the whole
+// buffer for the end of each event and decodes every data line.
+type bufferedUsageParser struct {
+	buffer []byte
+	model  string
+	usage  db.TokenUsage
+}
+
+func (r *bufferedUsageParser) feed(p []byte) {
+	r.buffer = append(r.buffer, p...)
+	for {
+		idx := bytes.Index(r.buffer, []byte("\n\n"))
+		if idx == -1 {
+			idx = bytes.Index(r.buffer, []byte("\r\n\r\n"))
+			if idx == -1 {
+				break
+			}
+			event := r.buffer[:idx]
+			r.buffer = r.buffer[idx+4:]
+			r.parseEvent(event)
+			continue
+		}
+		event := r.buffer[:idx]
+		r.buffer = r.buffer[idx+2:]
+		r.parseEvent(event)
+	}
+}
+
+func (r *bufferedUsageParser) parseEvent(event []byte) {
+	for _, line := range bytes.Split(event, []byte("\n")) {
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if data, ok := bytes.CutPrefix(line, []byte("data: ")); ok && !bytes.Equal(data, []byte("[DONE]")) {
+			r.parseData(data)
+		}
+	}
+}
+
+func (r *bufferedUsageParser) parseData(data []byte) {
+	var typeOnly struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(data, &typeOnly); err != nil {
+		return
+	}
+	switch typeOnly.Type {
+	case "message_start":
+		var messageStart struct {
+			Message struct {
+				Model string        `json:"model"`
+				Usage db.TokenUsage `json:"usage"`
+			} `json:"message"`
+		}
+		if err := json.Unmarshal(data, &messageStart); err == nil {
+			r.model = messageStart.Message.Model
+			r.usage = messageStart.Message.Usage
+		}
+	case "message_delta":
+		var messageDelta struct {
+			Usage db.TokenUsage `json:"usage"`
+		}
+		if err := json.Unmarshal(data, &messageDelta); err == nil {
+			mergeUsage(&r.usage, messageDelta.Usage)
+		}
+	}
+}
+
+// BenchmarkSSEParser compares sseParser with the buffered parser on
+// streams of growing length, read in the reverse proxy's 32KB chunks and
+// in small chunks like those of a slowly generated stream.
+func BenchmarkSSEParser(b *testing.B) {
+	for _, deltas := range []int{100, 10_000} {
+		stream := benchmarkStream(deltas)
+		for _, chunk := range []int{32 << 10, 256} {
+			feed := func(b *testing.B, newParser func() func([]byte)) {
+				b.SetBytes(int64(len(stream)))
+				b.ReportAllocs()
+				for b.Loop() {
+					parse := newParser()
+					for s := stream; len(s) > 0; {
+						n := min(chunk, len(s))
+						parse(s[:n])
+						s = s[n:]
+					}
+				}
+			}
+
+			name := fmt.Sprintf("deltas=%d/chunk=%d", deltas, chunk)
+			b.Run(name+"/incremental", func(b *testing.B) {
+				feed(b, func() func([]byte) {
+					r := newSSEUsageReader(nil, &usageTracker{provider: db.ProviderAnthropic})
+					return r.parser.feed
+				})
+			})
+			b.Run(name+"/buffered", func(b *testing.B) {
+				feed(b, func() func([]byte) {
+					r := &bufferedUsageParser{}
+					return r.feed
+				})
+			})
+		}
+	}
+}
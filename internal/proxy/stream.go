@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// upstreamHeaderTimeout is how long a request waits for the upstream
+	// response to start. Non-streaming requests only respond once the whole
+	// message is generated, which Anthropic allows to take 10 minutes.
+	upstreamHeaderTimeout = 10 * time.Minute
+
+	// streamIdleTimeout is how long a response may go without a byte from
+	// upstream, or without the client taking one, before it is abandoned.
+	// Streams may last any length of time as long as they keep moving;
+	// Anthropic sends pings while a model is thinking.
+	streamIdleTimeout = 5 * time.Minute
+)
+
+// errUpstreamIdle is the cause of a request abandoned by its watchdog.
+var errUpstreamIdle = errors.New("upstream went idle")
+
+// watchdog cancels a request whose upstream goes quiet for too long. Every
+// read from the upstream body pushes the deadline back.
+type watchdog struct {
+	idle   time.Duration
+	timer  *time.Timer
+	cancel context.CancelCauseFunc
+
+	mu      sync.Mutex
+	stopped bool
+}
+
+// newWatchdog returns a context for the upstream request that is canceled
+// with errUpstreamIdle unless the watchdog is kicked within wait. The
+// caller must stop the watchdog once the request is done.
+func newWatchdog(ctx context.Context, wait, idle time.Duration) (context.Context, *watchdog) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	w := &watchdog{idle: idle, cancel: cancel}
+	w.timer = time.AfterFunc(wait, func() { cancel(errUpstreamIdle) })
+	return ctx, w
+}
+
+// kick pushes the deadline back by the idle timeout.
+func (w *watchdog) kick() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.stopped {
+		w.timer.Reset(w.idle)
+	}
+}
+
+// stop disarms the watchdog and releases its context.
+func (w *watchdog) stop() {
+	w.mu.Lock()
+	w.stopped = true
+	w.timer.Stop()
+	w.mu.Unlock()
+	w.cancel(nil)
+}
+
+// idleReader kicks a watchdog with every read from an upstream body.
+type idleReader struct {
+	io.ReadCloser
+	watchdog *watchdog
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.watchdog.kick()
+	}
+	return n, err
+}
+
+// streamWriter gives each write to the client its own deadline, so a
+// response may stream for as long as the client keeps reading, and
+// flushes every write so SSE events reach the client as they arrive.
+type streamWriter struct {
+	http.ResponseWriter
+	rc   *http.ResponseController
+	idle time.Duration
+}
+
+func newStreamWriter(w http.ResponseWriter, idle time.Duration) *streamWriter {
+	return &streamWriter{ResponseWriter: w, rc: http.NewResponseController(w), idle: idle}
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	// Servers without write deadline support just don't get one
+	w.rc.SetWriteDeadline(time.Now().Add(w.idle))
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *streamWriter) Flush() {
+	w.rc.Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *streamWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// done clears the write deadline, which would otherwise outlive the
+// request on a kept-alive connection.
+func (w *streamWriter) done() {
+	w.rc.SetWriteDeadline(time.Time{})
+}
+
+const watchdogContextKey contextKey = "watchdog"
+
+// contextWithWatchdog adds a request's watchdog to the context.
+func contextWithWatchdog(ctx context.Context, w *watchdog) context.Context {
+	return context.WithValue(ctx, watchdogContextKey, w)
+}
+
+// watchdogFromContext retrieves a request's watchdog from the context.
+func watchdogFromContext(ctx context.Context) *watchdog {
+	w, _ := ctx.Value(watchdogContextKey).(*watchdog)
+	return w
+}
@@ -0,0 +1,196 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	messageStartEvent = "event: message_start\n" +
+		`data: {"type":"message_start","message":{"model":"claude-sonnet-4-5","usage":{"input_tokens":25,"output_tokens":1}}}` + "\n\n"
+	contentDeltaEvent = "event: content_block_delta\n" +
+		`data: {"type":"content_block_delta","index":0,"delta":{"type":"thinking_delta","thinking":"hmm"}}` + "\n\n"
+	messageDeltaEvent = "event: message_delta\n" +
+		`data: {"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":%d}}` + "\n\n"
+	messageStopEvent = "event: message_stop\n" + `data: {"type":"message_stop"}` + "\n\n"
+)
+
+// startSSE starts a streaming response with message_start.
+func startSSE(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, messageStartEvent)
+	w.(http.Flusher).Flush()
+}
+
+// shortTimeouts scales the proxy's timeouts down so that a stream of a
+// second or two stands in for one of many minutes.
+func shortTimeouts(p *Proxy, header, upstreamIdle, clientIdle time.Duration) {
+	p.headerTimeout = header
+	p.upstreamIdle = upstreamIdle
+	p.clientIdle = clientIdle
+}
+
+func TestLongStreamIsNotCutOff(t *testing.T) {
+	// 60 events 25ms apart last 15 idle timeouts
+	const deltas = 60
+	tp := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		startSSE(w)
+		for range deltas {
+			time.Sleep(25 * time.Millisecond)
+			io.WriteString(w, contentDeltaEvent)
+			w.(http.Flusher).Flush()
+		}
+		fmt.Fprintf(w, messageDeltaEvent, deltas)
+		io.WriteString(w, messageStopEvent)
+	}))
+	shortTimeouts(tp.Proxy, 100*time.Millisecond, 100*time.Millisecond, 100*time.Millisecond)
+
+	resp := tp.post(t, context.Background(), `{"model":"claude-sonnet-4-5","max_tokens":1024,"stream":true}`)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("stream was cut off: %v", err)
+	}
+	if got := strings.Count(string(body), "content_block_delta\n"); got != deltas {
+		t.Errorf("got %d deltas, want %d", got, deltas)
+	}
+	if !strings.HasSuffix(string(body), messageStopEvent) {
+		t.Errorf("stream did not end with message_stop")
+	}
+
+	usage := tp.waitUsage(t)
+	if usage.InputTokens != 25 || usage.OutputTokens != deltas {
+		t.Errorf("recorded %d input and %d output tokens, want 25 and %d", usage.InputTokens, usage.OutputTokens, deltas)
+	}
+}
+
+func TestEventsAreFlushedAsTheyArrive(t *testing.T) {
+	next := make(chan struct{})
+	tp := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		startSSE(w)
+		<-next
+		io.WriteString(w, messageStopEvent)
+	}))
+
+	resp := tp.post(t, context.Background(), `{"model":"claude-sonnet-4-5","max_tokens":1024,"stream":true}`)
+	defer resp.Body.Close()
+
+	// The first event arrives while the upstream is still holding the rest
+	buf := make([]byte, len(messageStartEvent))
+	if _, err := io.ReadFull(resp.Body, buf); err != nil {
+		t.Fatalf("read first event: %v", err)
+	}
+	if string(buf) != messageStartEvent {
+		t.Errorf("got %q, want message_start", buf)
+	}
+	close(next)
+}
+
+func TestIdleStreamIsCutOff(t *testing.T) {
+	canceled := make(chan struct{})
+	tp := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		startSSE(w)
+		<-r.Context().Done()
+		close(canceled)
+	}))
+	shortTimeouts(tp.Proxy, time.Second, 100*time.Millisecond, time.Second)
+
+	resp := tp.post(t, context.Background(), `{"model":"claude-sonnet-4-5","max_tokens":1024,"stream":true}`)
+	defer resp.Body.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(resp.Body)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("idle stream ended cleanly, want it aborted")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle stream was not cut off")
+	}
+
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream request was not canceled")
+	}
+
+	// What the stream reported before it stalled is still counted
+	if usage := tp.waitUsage(t); usage.InputTokens != 25 {
+		t.Errorf("recorded %d input tokens, want 25", usage.InputTokens)
+	}
+}
+
+func TestSlowUpstreamHeadersTimeOut(t *testing.T) {
+	tp := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	shortTimeouts(tp.Proxy, 100*time.Millisecond, time.Second, time.Second)
+
+	resp := tp.post(t, context.Background(), `{"model":"claude-sonnet-4-5","max_tokens":1024}`)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusGatewayTimeout)
+	}
+}
+
+func TestClientThatStopsReadingIsCutOff(t *testing.T) {
+	canceled := make(chan struct{})
+	tp := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(canceled)
+		startSSE(w)
+		// Produce far more than socket buffers hold
+		chunk := ": " + strings.Repeat("x", 64<<10) + "\n\n"
+		for r.Context().Err() == nil {
+			if _, err := io.WriteString(w, chunk); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+		}
+	}))
+	// Only the client side is short, so the write deadline is what trips
+	shortTimeouts(tp.Proxy, 10*time.Second, 10*time.Second, 200*time.Millisecond)
+
+	resp := tp.post(t, context.Background(), `{"model":"claude-sonnet-4-5","max_tokens":1024,"stream":true}`)
+	defer resp.Body.Close()
+
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream request was not canceled after the client stopped reading")
+	}
+}
+
+func TestClientDisconnectCancelsUpstream(t *testing.T) {
+	canceled := make(chan struct{})
+	tp := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		startSSE(w)
+		<-r.Context().Done()
+		close(canceled)
+	}))
+	shortTimeouts(tp.Proxy, 10*time.Second, 10*time.Second, 10*time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	resp := tp.post(t, ctx, `{"model":"claude-sonnet-4-5","max_tokens":1024,"stream":true}`)
+	defer resp.Body.Close()
+	buf := make([]byte, len(messageStartEvent))
+	if _, err := io.ReadFull(resp.Body, buf); err != nil {
+		t.Fatalf("read first event: %v", err)
+	}
+	cancel()
+
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream request was not canceled after the client disconnected")
+	}
+}